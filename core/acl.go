@@ -0,0 +1,326 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sdwan packet filter is applied to the packets from other nodes before writing tun.
+// It's stateful: the replies of the flows started by this node are always allowed,
+// so the rules only describe who can start the connections to this node and its resources.
+// The non-first IPv4 fragments have no ports, they are allowed only if the first fragment is.
+
+const (
+	aclTCPTimeout   = 5 * time.Minute
+	aclOtherTimeout = time.Minute
+	aclSweepTime    = time.Minute
+	aclFragTimeout  = 30 * time.Second // like the reassembly timeout of linux
+	IPProtoICMP     = 1
+	IPProtoTCP      = 6
+	IPProtoUDP      = 17
+	IPProtoICMPv6   = 58
+)
+
+type aclRule struct {
+	srcIDs  map[uint64]bool // nil for any node
+	dstNet  uint32
+	dstMask uint32      // 0 for any
+	proto   byte        // 0 for any
+	ports   [][2]uint16 // empty for any
+	allow   bool
+}
+
+type flowKey struct {
+	src, dst     uint32
+	sport, dport uint16
+	proto        byte
+}
+
+// fragKey identifies the fragments of one ipv4 packet
+type fragKey struct {
+	src, dst uint32
+	id       uint16
+	proto    byte
+}
+
+type sdwanACL struct {
+	enabled   atomic.Bool
+	mtx       sync.RWMutex
+	rules     []*aclRule
+	flowMtx   sync.Mutex
+	flows     map[flowKey]int64 // the flows started by this node, key is the reply direction. value is expire time
+	frags     map[fragKey]int64 // the packets whose first fragment is allowed. value is expire time
+	lastSweep int64
+}
+
+func newSDWANACL() *sdwanACL {
+	return &sdwanACL{flows: make(map[flowKey]int64), frags: make(map[fragKey]int64)}
+}
+
+// "22,8000-8080" to port ranges
+func parsePortRanges(s string) ([][2]uint16, error) {
+	res := [][2]uint16{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		arr := strings.SplitN(item, "-", 2)
+		min, err := strconv.ParseUint(arr[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("wrong port %s", item)
+		}
+		max := min
+		if len(arr) == 2 {
+			if max, err = strconv.ParseUint(arr[1], 10, 16); err != nil || max < min {
+				return nil, fmt.Errorf("wrong port range %s", item)
+			}
+		}
+		res = append(res, [2]uint16{uint16(min), uint16(max)})
+	}
+	return res, nil
+}
+
+func compileRule(r *SDWANRule, nodes []*SDWANNode) (*aclRule, error) {
+	rule := &aclRule{}
+	switch strings.ToLower(r.Action) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("wrong action %s", r.Action)
+	}
+	if r.Src != "" && r.Src != "*" {
+		rule.srcIDs = make(map[uint64]bool)
+		if strings.HasPrefix(r.Src, "tag:") {
+			tag := strings.TrimPrefix(r.Src, "tag:")
+			for _, node := range nodes {
+				for _, t := range strings.Split(node.Tags, ",") {
+					if strings.TrimSpace(t) == tag {
+						rule.srcIDs[NodeNameToID(node.Name)] = true
+					}
+				}
+			}
+		} else {
+			rule.srcIDs[NodeNameToID(r.Src)] = true
+		}
+	}
+	if r.Dst != "" && r.Dst != "*" {
+		dst := r.Dst
+		if !strings.Contains(dst, "/") {
+			dst += "/32"
+		}
+		_, ipnet, err := net.ParseCIDR(dst)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("wrong dst %s", r.Dst)
+		}
+		rule.dstNet = binary.BigEndian.Uint32(ipnet.IP.To4())
+		rule.dstMask = binary.BigEndian.Uint32(ipnet.Mask)
+	}
+	switch strings.ToLower(r.Proto) {
+	case "", "*":
+	case "tcp":
+		rule.proto = IPProtoTCP
+	case "udp":
+		rule.proto = IPProtoUDP
+	case "icmp":
+		rule.proto = IPProtoICMP
+	default:
+		return nil, fmt.Errorf("wrong proto %s", r.Proto)
+	}
+	ports, err := parsePortRanges(r.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > 0 && rule.proto != IPProtoTCP && rule.proto != IPProtoUDP {
+		return nil, fmt.Errorf("ports need tcp or udp proto")
+	}
+	rule.ports = ports
+	return rule, nil
+}
+
+// update the rules from the sdwan info. A wrong rule is treated as deny all, it's safer than ignoring it
+func (acl *sdwanACL) update(sdwan *SDWANInfo) {
+	rules := []*aclRule{}
+	for _, r := range sdwan.Rules {
+		rule, err := compileRule(r, sdwan.Nodes)
+		if err != nil {
+			gLog.Printf(LvERROR, "sdwan acl rule %+v error:%s, deny all", *r, err)
+			rules = []*aclRule{{allow: false}}
+			break
+		}
+		rules = append(rules, rule)
+	}
+	acl.mtx.Lock()
+	acl.rules = rules
+	acl.mtx.Unlock()
+	// the tracked flows are kept, they are started by this node and not limited by the rules
+	acl.enabled.Store(len(rules) > 0)
+	gLog.Printf(LvINFO, "sdwan acl %d rules", len(rules))
+}
+
+// parseFlow parses the ipv4 flow, the ports of non-first fragment are unknown
+func parseFlow(b []byte, key *flowKey) (fragment bool, ok bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return false, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	key.src = binary.BigEndian.Uint32(b[12:16])
+	key.dst = binary.BigEndian.Uint32(b[16:20])
+	key.proto = b[9]
+	key.sport, key.dport = 0, 0
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+		return true, true
+	}
+	switch key.proto {
+	case IPProtoTCP, IPProtoUDP:
+		if len(b) < ihl+4 {
+			return false, false
+		}
+		key.sport = binary.BigEndian.Uint16(b[ihl:])
+		key.dport = binary.BigEndian.Uint16(b[ihl+2:])
+	case IPProtoICMP:
+		if len(b) >= ihl+8 { // echo identifier
+			key.sport = binary.BigEndian.Uint16(b[ihl+4:])
+			key.dport = key.sport
+		}
+	}
+	return false, true
+}
+
+// track the outbound packet, so its replies are allowed
+func (acl *sdwanACL) track(p []byte) {
+	if !acl.enabled.Load() {
+		return
+	}
+	var key flowKey
+	if frag, ok := parseFlow(p, &key); !ok || frag {
+		return
+	}
+	reply := flowKey{src: key.dst, dst: key.src, sport: key.dport, dport: key.sport, proto: key.proto}
+	timeout := aclOtherTimeout
+	if key.proto == IPProtoTCP {
+		timeout = aclTCPTimeout
+	}
+	now := time.Now().UnixNano()
+	acl.flowMtx.Lock()
+	acl.flows[reply] = now + int64(timeout)
+	acl.sweepLocked(now)
+	acl.flowMtx.Unlock()
+}
+
+func (acl *sdwanACL) sweepLocked(now int64) {
+	if now-acl.lastSweep <= int64(aclSweepTime) {
+		return
+	}
+	acl.lastSweep = now
+	for k, expire := range acl.flows {
+		if expire < now {
+			delete(acl.flows, k)
+		}
+	}
+	for k, expire := range acl.frags {
+		if expire < now {
+			delete(acl.frags, k)
+		}
+	}
+}
+
+func newFragKey(p []byte) fragKey {
+	return fragKey{src: binary.BigEndian.Uint32(p[12:16]), dst: binary.BigEndian.Uint32(p[16:20]), id: binary.BigEndian.Uint16(p[4:6]), proto: p[9]}
+}
+
+// trackFragment allows the other fragments of the packet, whose first fragment is allowed
+func (acl *sdwanACL) trackFragment(p []byte) {
+	now := time.Now().UnixNano()
+	acl.flowMtx.Lock()
+	acl.frags[newFragKey(p)] = now + int64(aclFragTimeout)
+	acl.sweepLocked(now)
+	acl.flowMtx.Unlock()
+}
+
+func (acl *sdwanACL) fragmentTracked(p []byte) bool {
+	acl.flowMtx.Lock()
+	expire, ok := acl.frags[newFragKey(p)]
+	acl.flowMtx.Unlock()
+	return ok && expire > time.Now().UnixNano()
+}
+
+// allow checks the inbound packet from node srcID
+func (acl *sdwanACL) allow(srcID uint64, p []byte) bool {
+	if !acl.enabled.Load() {
+		return true
+	}
+	var key flowKey
+	frag, ok := parseFlow(p, &key)
+	if !ok {
+		return false
+	}
+	if frag { // checked with the ports of the first fragment, the ones arriving before it are dropped
+		return acl.fragmentTracked(p)
+	}
+	allowed := acl.tracked(&key) || (key.proto == IPProtoICMP && acl.icmpErrorTracked(p)) || acl.ruleAllow(srcID, &key)
+	if allowed && p[6]&0x20 != 0 { // MF
+		acl.trackFragment(p)
+	}
+	return allowed
+}
+
+func (acl *sdwanACL) ruleAllow(srcID uint64, key *flowKey) bool {
+	acl.mtx.RLock()
+	defer acl.mtx.RUnlock()
+	for _, r := range acl.rules {
+		if r.match(srcID, key) {
+			return r.allow
+		}
+	}
+	return false
+}
+
+func (acl *sdwanACL) tracked(key *flowKey) bool {
+	acl.flowMtx.Lock()
+	expire, ok := acl.flows[*key]
+	acl.flowMtx.Unlock()
+	return ok && expire > time.Now().UnixNano()
+}
+
+// the icmp destination unreachable or time exceeded of the flows started by this node, like the fragmentation needed
+func (acl *sdwanACL) icmpErrorTracked(p []byte) bool {
+	ihl := int(p[0]&0x0f) * 4
+	if len(p) < ihl+8+20 || (p[ihl] != 3 && p[ihl] != 11) {
+		return false
+	}
+	var orig flowKey
+	if _, ok := parseFlow(p[ihl+8:], &orig); !ok {
+		return false
+	}
+	reply := flowKey{src: orig.dst, dst: orig.src, sport: orig.dport, dport: orig.sport, proto: orig.proto}
+	return acl.tracked(&reply)
+}
+
+func (r *aclRule) match(srcID uint64, key *flowKey) bool {
+	if r.srcIDs != nil && !r.srcIDs[srcID] {
+		return false
+	}
+	if key.dst&r.dstMask != r.dstNet {
+		return false
+	}
+	if r.proto != 0 && r.proto != key.proto {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if key.dport >= pr[0] && key.dport <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSDWANACL(t *testing.T) {
+	acl := newSDWANACL()
+	contractor, admin := NodeNameToID("laptop1"), NodeNameToID("admin1")
+	if !acl.allow(contractor, testIPv4Packet(0x0a020305, 0x0a020301, IPProtoTCP, 40000, 22)) {
+		t.Error("no rules should allow all")
+	}
+	acl.update(&SDWANInfo{
+		Nodes: []*SDWANNode{{Name: "laptop1", Tags: "contractor"}, {Name: "admin1", Tags: "ops, admin"}},
+		Rules: []*SDWANRule{
+			{Src: "tag:admin", Action: "allow"},
+			{Src: "tag:contractor", Dst: "10.2.3.0/24", Proto: "tcp", Ports: "80,8000-8080", Action: "allow"},
+			{Src: "*", Proto: "icmp", Action: "allow"},
+		},
+	})
+	cases := []struct {
+		src    uint64
+		packet []byte
+		allow  bool
+	}{
+		{admin, testIPv4Packet(0x0a020306, 0xc0a8010a, IPProtoUDP, 40000, 53), true},
+		{contractor, testIPv4Packet(0x0a020305, 0x0a020301, IPProtoTCP, 40000, 8080), true},
+		{contractor, testIPv4Packet(0x0a020305, 0x0a020301, IPProtoTCP, 40000, 22), false},
+		{contractor, testIPv4Packet(0x0a020305, 0x0a020301, IPProtoUDP, 40000, 80), false},
+		{contractor, testIPv4Packet(0x0a020305, 0xc0a8010a, IPProtoTCP, 40000, 80), false},
+		{contractor, testIPv4Packet(0x0a020305, 0x0a020301, IPProtoICMP, 0, 0), true},
+		{contractor, []byte{0x60, 0, 0, 0}, false},
+	}
+	for i, c := range cases {
+		if acl.allow(c.src, c.packet) != c.allow {
+			t.Errorf("case %d should be %v", i, c.allow)
+		}
+	}
+	// the reply of the flow started by this node
+	reply := testIPv4Packet(0x0a020305, 0x0a020301, IPProtoTCP, 22, 40001)
+	if acl.allow(contractor, reply) {
+		t.Error("untracked reply should be denied")
+	}
+	acl.track(testIPv4Packet(0x0a020301, 0x0a020305, IPProtoTCP, 40001, 22))
+	if !acl.allow(contractor, reply) {
+		t.Error("tracked reply should be allowed")
+	}
+	// fragmentation needed of the tracked flow
+	icmpErr := append(testIPv4Packet(0x0a020309, 0x0a020301, IPProtoICMP, 0x0304, 0)[:28], testIPv4Packet(0x0a020301, 0x0a020305, IPProtoTCP, 40001, 22)...)
+	if !acl.icmpErrorTracked(icmpErr) {
+		t.Error("icmp error of tracked flow should be allowed")
+	}
+	acl.update(&SDWANInfo{Rules: []*SDWANRule{{Src: "*", Ports: "22", Action: "allow"}}})
+	if acl.allow(admin, testIPv4Packet(0x0a020306, 0x0a020301, IPProtoTCP, 40000, 22)) {
+		t.Error("wrong rule should deny all")
+	}
+	if !acl.allow(contractor, reply) {
+		t.Error("tracked flow should be kept by the update")
+	}
+}
+
+func TestSDWANACLFragment(t *testing.T) {
+	acl := newSDWANACL()
+	contractor := NodeNameToID("laptop1")
+	acl.update(&SDWANInfo{
+		Nodes: []*SDWANNode{{Name: "laptop1"}},
+		Rules: []*SDWANRule{{Src: "laptop1", Proto: "udp", Ports: "53", Action: "allow"}},
+	})
+	fragment := func(sport, dport, id uint16, offset uint16, more bool) []byte {
+		p := testIPv4Packet(0x0a020305, 0x0a020301, IPProtoUDP, sport, dport)
+		binary.BigEndian.PutUint16(p[4:6], id)
+		if more {
+			offset |= 0x2000
+		}
+		binary.BigEndian.PutUint16(p[6:8], offset)
+		return p
+	}
+	if acl.allow(contractor, fragment(0, 0, 1, 185, false)) {
+		t.Error("fragment without the first should be denied")
+	}
+	if acl.allow(contractor, fragment(40000, 22, 2, 0, true)) || acl.allow(contractor, fragment(0, 0, 2, 185, false)) {
+		t.Error("fragments of denied packet should be denied")
+	}
+	if !acl.allow(contractor, fragment(40000, 53, 3, 0, true)) || !acl.allow(contractor, fragment(0, 0, 3, 185, false)) {
+		t.Error("fragments of allowed packet should be allowed")
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ports, err := parsePortRanges("22, 8000-8080")
+	if err != nil || len(ports) != 2 || ports[1] != [2]uint16{8000, 8080} {
+		t.Errorf("parse wrong:%v %v", ports, err)
+	}
+	for _, s := range []string{"80-22", "abc", "70000"} {
+		if _, err = parsePortRanges(s); err == nil {
+			t.Errorf("%s should fail", s)
+		}
+	}
+}
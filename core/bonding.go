@@ -0,0 +1,518 @@
+package openp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// bonding stripes one overlay connection across the direct tunnel and the relay tunnel of the app at the same
+// time. It doesn't build more direct underlays, like TCP6 and UDP punch together or one per WAN interface, the
+// app has one direct tunnel to the peer.
+// every segment carries a sequence number, the receiver reorders and acks them,
+// the sender keeps unacked segments and resends them on other paths when a path fails.
+// The connection ends with an empty segment after the last one, so the receiver closes after all the data.
+// The sender waits until the segments are acked before closing the bond.
+
+const (
+	BondWindowSize    = 4096 // max unacked segments
+	BondAckInterval   = 32   // ack every N in-order segments
+	BondProbeInterval = time.Second
+	BondProbeWindow   = 10 // calc loss every N probes
+	BondPathTimeout   = TunnelHeartbeatTime
+	BondCloseTimeout  = TunnelHeartbeatTime // wait for the unacked segments when closing
+)
+
+type overlayBondHeader struct {
+	ID  uint64
+	Seq uint64
+}
+
+var overlayBondHeaderSize = binary.Size(overlayBondHeader{})
+
+type overlayBondProbe struct {
+	ID   uint64
+	Path uint8
+	Echo uint8
+	Ts   int64
+}
+
+var overlayBondProbeSize = binary.Size(overlayBondProbe{})
+
+// key: overlayID; value: *overlayConn
+var overlayBonds sync.Map
+
+type bondPath struct {
+	tunnel     *P2PTunnel
+	rtid       uint64 // 0 direct
+	rtt        time.Duration
+	loss       float64
+	probeSent  int
+	probeAcked int
+	lastEcho   time.Time
+	sentBytes  int
+	down       bool
+}
+
+func (p *bondPath) alive() bool {
+	return !p.down && p.tunnel != nil && p.tunnel.isRuning() && time.Since(p.lastEcho) < BondPathTimeout
+}
+
+// smaller is better. bytes share is inversely proportional to rtt and loss
+func (p *bondPath) cost() float64 {
+	rtt := p.rtt
+	if rtt <= 0 {
+		rtt = time.Millisecond
+	}
+	return float64(p.sentBytes+1) * float64(rtt) * (1 + p.loss*10)
+}
+
+func (p *bondPath) write(subType uint16, body []byte) error {
+	if p.rtid == 0 {
+		return p.tunnel.conn.WriteBytes(MsgP2P, subType, body)
+	}
+	relayHead := new(bytes.Buffer)
+	binary.Write(relayHead, binary.LittleEndian, p.rtid)
+	all := append(relayHead.Bytes(), encodeHeader(MsgP2P, subType, uint32(len(body)))...)
+	all = append(all, body...)
+	return p.tunnel.conn.WriteBytes(MsgP2P, MsgRelayData, all)
+}
+
+type bondSegment struct {
+	data []byte
+	path int
+}
+
+// bondWrite is a frame picked under the lock and written after unlocking
+type bondWrite struct {
+	path    int
+	subType uint16
+	data    []byte
+}
+
+type overlayBond struct {
+	id      uint64
+	paths   []*bondPath
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	running bool
+	// sender
+	sendSeq  uint64
+	ackedSeq uint64
+	unacked  map[uint64]*bondSegment
+	// receiver
+	recvSeq    uint64 // next expected seq
+	pending    map[uint64][]byte
+	ready      [][]byte // in order, waiting for delivering
+	delivering bool     // one receiver delivers the ready segments at a time, keeps the order
+	sinceAck   int
+	deliver    func([]byte) (int, error)
+	fin        func() // the empty segment is delivered, the peer has closed
+	finRecv    bool
+}
+
+func newOverlayBond(id uint64, paths []*bondPath, deliver func([]byte) (int, error)) *overlayBond {
+	b := &overlayBond{
+		id:      id,
+		paths:   paths,
+		running: true,
+		unacked: make(map[uint64]*bondSegment),
+		pending: make(map[uint64][]byte),
+		deliver: deliver,
+	}
+	b.cond = sync.NewCond(&b.mtx)
+	for _, p := range paths {
+		p.lastEcho = time.Now()
+	}
+	return b
+}
+
+// bondPaths return the running tunnels of the app, the order is sent to the peer and probe echo use the index
+func (app *p2pApp) bondPaths() []*bondPath {
+	if app.config.Bonding == 0 || compareVersion(app.config.peerVersion, SupportBondingVersion) < 0 {
+		return nil
+	}
+	paths := []*bondPath{}
+	if direct := app.DirectTunnel(); direct != nil && direct.isRuning() {
+		paths = append(paths, &bondPath{tunnel: direct})
+	}
+	if relay := app.RelayTunnel(); relay != nil && relay.isRuning() {
+		paths = append(paths, &bondPath{tunnel: relay, rtid: app.rtid})
+	}
+	if len(paths) < 2 {
+		return nil
+	}
+	return paths
+}
+
+// client side
+func (app *p2pApp) initBond(oConn *overlayConn, req *OverlayConnectReq) {
+	paths := app.bondPaths()
+	if paths == nil {
+		return
+	}
+	for _, p := range paths {
+		if p.rtid == 0 {
+			req.BondPaths = append(req.BondPaths, BondPath{TunnelID: p.tunnel.id})
+		} else {
+			req.BondPaths = append(req.BondPaths, BondPath{TunnelID: p.rtid, RelayTunnelID: p.tunnel.id})
+		}
+	}
+	oConn.bond = newOverlayBond(oConn.id, paths, oConn.Write)
+	oConn.bond.fin = func() { oConn.Close() }
+	overlayBonds.Store(oConn.id, oConn)
+	go oConn.bond.probeLoop()
+	gLog.Printf(LvDEBUG, "%d overlay bonding on %d paths", oConn.id, len(paths))
+}
+
+// bondPeerApp finds the memapp of the peer which sent the overlay connect request on the tunnel,
+// its tunnels and rtid are pushed by the server
+func bondPeerApp(t *P2PTunnel, rtid uint64) *p2pApp {
+	var peerApp *p2pApp
+	GNetwork.apps.Range(func(_, i interface{}) bool {
+		app := i.(*p2pApp)
+		if (rtid == 0 && app.DirectTunnel() == t) || (rtid != 0 && app.RelayTunnel() == t && app.rtid == rtid) {
+			peerApp = app
+			return false
+		}
+		return true
+	})
+	return peerApp
+}
+
+// peerBondPaths only accepts the paths on the tunnels of the peer's memapp, the peer can't bond other nodes' tunnels
+func peerBondPaths(app *p2pApp, req *OverlayConnectReq) ([]*bondPath, error) {
+	direct, relay := app.DirectTunnel(), app.RelayTunnel()
+	paths := []*bondPath{}
+	for _, bp := range req.BondPaths {
+		switch {
+		case bp.RelayTunnelID == 0 && direct != nil && direct.id == bp.TunnelID:
+			paths = append(paths, &bondPath{tunnel: direct})
+		case bp.RelayTunnelID != 0 && relay != nil && relay.id == bp.TunnelID && app.rtid == bp.RelayTunnelID:
+			paths = append(paths, &bondPath{tunnel: relay, rtid: bp.RelayTunnelID})
+		default:
+			return nil, fmt.Errorf("%w: tunnel %d rtid %d", ErrBondPath, bp.TunnelID, bp.RelayTunnelID)
+		}
+	}
+	return paths, nil
+}
+
+// server side
+func initPeerBond(t *P2PTunnel, oConn *overlayConn, req *OverlayConnectReq) {
+	if len(req.BondPaths) == 0 {
+		return
+	}
+	app := bondPeerApp(t, req.RelayTunnelID)
+	if app == nil {
+		gLog.Printf(LvERROR, "%d overlay bonding error:%s", oConn.id, ErrBondPeerApp)
+		return
+	}
+	paths, err := peerBondPaths(app, req)
+	if err != nil {
+		gLog.Printf(LvERROR, "%d overlay bonding error:%s", oConn.id, err)
+		return
+	}
+	oConn.bond = newOverlayBond(oConn.id, paths, oConn.Write)
+	oConn.bond.fin = func() { oConn.Close() }
+	overlayBonds.Store(oConn.id, oConn)
+	go oConn.bond.probeLoop()
+	gLog.Printf(LvDEBUG, "%d overlay bonding accepted on %d paths", oConn.id, len(paths))
+}
+
+func (b *overlayBond) pickPath(except int) int {
+	best := -1
+	for i, p := range b.paths {
+		if i == except || !p.alive() {
+			continue
+		}
+		if best < 0 || p.cost() < b.paths[best].cost() {
+			best = i
+		}
+	}
+	return best
+}
+
+func (b *overlayBond) write(payload []byte) error {
+	buf := make([]byte, overlayBondHeaderSize+len(payload))
+	b.mtx.Lock()
+	for b.running && len(b.unacked) >= BondWindowSize {
+		b.cond.Wait()
+	}
+	if !b.running {
+		b.mtx.Unlock()
+		return ErrOverlayConnDisconnect
+	}
+	seq := b.sendSeq
+	b.sendSeq++
+	binary.LittleEndian.PutUint64(buf[:8], b.id)
+	binary.LittleEndian.PutUint64(buf[8:16], seq)
+	copy(buf[overlayBondHeaderSize:], payload)
+	idx := b.pickPath(-1)
+	b.unacked[seq] = &bondSegment{data: buf, path: idx}
+	if idx < 0 { // all paths down, keep it until one is back
+		b.mtx.Unlock()
+		return nil
+	}
+	b.paths[idx].sentBytes += len(buf)
+	b.mtx.Unlock()
+	b.flush([]bondWrite{{path: idx, subType: MsgOverlayBondData, data: buf}})
+	return nil
+}
+
+// flush writes the frames picked under the lock, a failed path resends its segments on other paths
+func (b *overlayBond) flush(writes []bondWrite) {
+	for _, w := range writes {
+		if err := b.paths[w.path].write(w.subType, w.data); err != nil {
+			gLog.Printf(LvDEBUG, "%d bond path %d write error:%s", b.id, w.path, err)
+			b.failPath(w.path)
+		}
+	}
+}
+
+// resend the unacked segments of the failed path on other paths
+func (b *overlayBond) failPath(idx int) {
+	b.mtx.Lock()
+	if idx >= 0 && idx < len(b.paths) {
+		if b.paths[idx].down { // failed by another writer, its segments are resent
+			b.mtx.Unlock()
+			return
+		}
+		b.paths[idx].down = true
+	}
+	writes := b.resendLocked(idx)
+	b.mtx.Unlock()
+	b.flush(writes)
+}
+
+func (b *overlayBond) resendLocked(idx int) (writes []bondWrite) {
+	for seq := b.ackedSeq; seq < b.sendSeq; seq++ {
+		seg, ok := b.unacked[seq]
+		if !ok || seg.path != idx {
+			continue
+		}
+		newIdx := b.pickPath(idx)
+		if newIdx < 0 {
+			return
+		}
+		seg.path = newIdx
+		b.paths[newIdx].sentBytes += len(seg.data)
+		writes = append(writes, bondWrite{path: newIdx, subType: MsgOverlayBondData, data: seg.data})
+	}
+	return
+}
+
+func (b *overlayBond) receive(seq uint64, payload []byte) {
+	b.mtx.Lock()
+	if seq < b.recvSeq {
+		b.mtx.Unlock()
+		return // duplicated by resending
+	}
+	dup := make([]byte, len(payload)) // the payload buffer is reused by the reader
+	copy(dup, payload)
+	if seq > b.recvSeq {
+		if _, ok := b.pending[seq]; !ok && len(b.pending) < BondWindowSize*2 {
+			b.pending[seq] = dup
+		}
+		b.mtx.Unlock()
+		return
+	}
+	for data, ok := dup, true; ok; data, ok = b.pending[b.recvSeq] {
+		delete(b.pending, b.recvSeq)
+		b.ready = append(b.ready, data)
+		b.recvSeq++
+		b.sinceAck++
+		if len(data) == 0 {
+			b.finRecv = true
+		}
+	}
+	var writes []bondWrite
+	if b.sinceAck >= BondAckInterval || b.finRecv { // the sender waits for the ack of the end
+		writes = b.ackLocked()
+	}
+	if b.delivering { // the other receiver delivers ours after its own
+		b.mtx.Unlock()
+		b.flush(writes)
+		return
+	}
+	b.delivering = true
+	for len(b.ready) > 0 {
+		ready := b.ready
+		b.ready = nil
+		b.mtx.Unlock()
+		for _, data := range ready {
+			if len(data) == 0 {
+				if b.fin != nil {
+					b.fin()
+				}
+				continue
+			}
+			b.deliver(data)
+		}
+		b.mtx.Lock()
+	}
+	b.delivering = false
+	b.mtx.Unlock()
+	b.flush(writes)
+}
+
+func (b *overlayBond) ackLocked() []bondWrite {
+	b.sinceAck = 0
+	idx := b.pickPath(-1)
+	if idx < 0 {
+		return nil
+	}
+	buf := make([]byte, overlayBondHeaderSize)
+	binary.LittleEndian.PutUint64(buf[:8], b.id)
+	binary.LittleEndian.PutUint64(buf[8:16], b.recvSeq)
+	return []bondWrite{{path: idx, subType: MsgOverlayBondAck, data: buf}}
+}
+
+func (b *overlayBond) ack(seq uint64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ; b.ackedSeq < seq && b.ackedSeq < b.sendSeq; b.ackedSeq++ {
+		delete(b.unacked, b.ackedSeq)
+	}
+	b.cond.Broadcast()
+}
+
+func (b *overlayBond) probe(idx int, echo uint8, ts int64) {
+	if idx < 0 || idx >= len(b.paths) || b.paths[idx].tunnel == nil {
+		return
+	}
+	req := overlayBondProbe{ID: b.id, Path: uint8(idx), Echo: echo, Ts: ts}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, req)
+	b.paths[idx].write(MsgOverlayBondProbe, buf.Bytes())
+}
+
+func (b *overlayBond) handleProbe(req *overlayBondProbe) {
+	if req.Echo == 0 {
+		b.probe(int(req.Path), 1, req.Ts)
+		return
+	}
+	if int(req.Path) >= len(b.paths) {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	p := b.paths[req.Path]
+	rtt := time.Duration(time.Now().UnixNano() - req.Ts)
+	if p.rtt == 0 {
+		p.rtt = rtt
+	} else {
+		p.rtt = (p.rtt*7 + rtt) / 8
+	}
+	p.probeAcked++
+	p.lastEcho = time.Now()
+	if p.down && p.tunnel.isRuning() {
+		gLog.Printf(LvDEBUG, "%d bond path %d recovered", b.id, req.Path)
+		p.down = false
+	}
+}
+
+func (b *overlayBond) probeLoop() {
+	tc := time.NewTicker(BondProbeInterval)
+	defer tc.Stop()
+	for range tc.C {
+		b.mtx.Lock()
+		if !b.running {
+			b.mtx.Unlock()
+			return
+		}
+		var writes []bondWrite
+		for i, p := range b.paths {
+			p.sentBytes /= 2 // decay history
+			if p.probeSent >= BondProbeWindow {
+				p.loss = 1 - float64(p.probeAcked)/float64(p.probeSent)
+				p.probeSent = 0
+				p.probeAcked = 0
+			}
+			if p.tunnel != nil && !p.down && !p.alive() {
+				gLog.Printf(LvDEBUG, "%d bond path %d timeout", b.id, i)
+				p.down = true
+				writes = append(writes, b.resendLocked(i)...)
+			}
+			p.probeSent++
+		}
+		writes = append(writes, b.resendLocked(-1)...) // segments sent when all paths were down
+		writes = append(writes, b.ackLocked()...)
+		b.cond.Broadcast()
+		b.mtx.Unlock()
+		b.flush(writes)
+		for i := range b.paths {
+			b.probe(i, 0, time.Now().UnixNano())
+		}
+	}
+}
+
+// finish sends the end after the last segment and waits until all are acked, returns false if timeout.
+// It doesn't send the end when the peer has closed
+func (b *overlayBond) finish(timeout time.Duration) bool {
+	b.mtx.Lock()
+	finRecv := b.finRecv
+	b.mtx.Unlock()
+	if finRecv {
+		return true
+	}
+	if b.write(nil) != nil {
+		return false
+	}
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond * 20) {
+		b.mtx.Lock()
+		n := len(b.unacked)
+		b.mtx.Unlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+}
+
+func (b *overlayBond) close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.running = false
+	b.cond.Broadcast()
+}
+
+func handleBondMessage(subType uint16, body []byte, decryptData []byte) {
+	if len(body) < 8 {
+		return
+	}
+	overlayID := binary.LittleEndian.Uint64(body[:8])
+	i, ok := overlayBonds.Load(overlayID)
+	if !ok {
+		gLog.Printf(LvDEBUG, "bond overlay connection %d not found", overlayID)
+		return
+	}
+	oConn := i.(*overlayConn)
+	switch subType {
+	case MsgOverlayBondData:
+		if len(body) < overlayBondHeaderSize {
+			return
+		}
+		seq := binary.LittleEndian.Uint64(body[8:16])
+		payload := body[overlayBondHeaderSize:]
+		if oConn.appKey != 0 && len(payload) > 0 { // the end isn't encrypted
+			payload, _ = decryptBytes(oConn.appKeyBytes, decryptData, payload, len(payload))
+		}
+		oConn.bond.receive(seq, payload)
+	case MsgOverlayBondAck:
+		if len(body) < overlayBondHeaderSize {
+			return
+		}
+		oConn.bond.ack(binary.LittleEndian.Uint64(body[8:16]))
+	case MsgOverlayBondProbe:
+		if len(body) < overlayBondProbeSize {
+			return
+		}
+		req := overlayBondProbe{}
+		binary.Read(bytes.NewReader(body), binary.LittleEndian, &req)
+		oConn.bond.handleProbe(&req)
+	}
+}
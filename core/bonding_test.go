@@ -0,0 +1,154 @@
+package openp2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBondReorder(t *testing.T) {
+	out := new(bytes.Buffer)
+	b := newOverlayBond(1, nil, out.Write)
+	b.receive(1, []byte("b"))
+	b.receive(3, []byte("d"))
+	if out.Len() != 0 {
+		t.Errorf("out of order segment delivered:%s", out.String())
+	}
+	b.receive(0, []byte("a"))
+	b.receive(1, []byte("b")) // duplicated
+	b.receive(2, []byte("c"))
+	if out.String() != "abcd" {
+		t.Errorf("reorder error:%s", out.String())
+	}
+	if b.recvSeq != 4 || len(b.pending) != 0 {
+		t.Errorf("recvSeq=%d pending=%d", b.recvSeq, len(b.pending))
+	}
+}
+
+func TestBondAck(t *testing.T) {
+	b := newOverlayBond(1, nil, nil)
+	for i := 0; i < 10; i++ {
+		b.write([]byte("data")) // all paths down, keep unacked
+	}
+	if len(b.unacked) != 10 {
+		t.Errorf("unacked=%d", len(b.unacked))
+	}
+	b.ack(6)
+	if len(b.unacked) != 4 || b.ackedSeq != 6 {
+		t.Errorf("unacked=%d ackedSeq=%d", len(b.unacked), b.ackedSeq)
+	}
+	b.ack(100)
+	if len(b.unacked) != 0 || b.ackedSeq != 10 {
+		t.Errorf("unacked=%d ackedSeq=%d", len(b.unacked), b.ackedSeq)
+	}
+}
+
+func TestBondPickPath(t *testing.T) {
+	fast := &bondPath{tunnel: &P2PTunnel{running: true}, rtt: time.Millisecond * 10}
+	slow := &bondPath{tunnel: &P2PTunnel{running: true}, rtt: time.Millisecond * 40}
+	b := newOverlayBond(1, []*bondPath{fast, slow}, nil)
+	counts := make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		idx := b.pickPath(-1)
+		counts[idx]++
+		b.paths[idx].sentBytes += 1000
+	}
+	if counts[0] < counts[1]*3 || counts[0] > counts[1]*5 {
+		t.Errorf("weight by rtt error: fast=%d slow=%d", counts[0], counts[1])
+	}
+	slow.down = true
+	if b.pickPath(0) != -1 {
+		t.Error("down path should not be picked")
+	}
+	fast.lastEcho = time.Now().Add(-BondPathTimeout * 2)
+	if b.pickPath(-1) != -1 {
+		t.Error("timeout path should not be picked")
+	}
+}
+
+func TestBondDeliverUnlocked(t *testing.T) {
+	var b *overlayBond
+	out := new(bytes.Buffer)
+	b = newOverlayBond(1, nil, func(p []byte) (int, error) {
+		b.ack(0) // the sender side isn't blocked by a slow delivering
+		return out.Write(p)
+	})
+	buf := []byte("a")
+	b.receive(1, []byte("b"))
+	b.receive(0, buf)
+	buf[0] = 'x' // reused by the reader
+	b.receive(2, []byte("c"))
+	if out.String() != "abc" {
+		t.Errorf("deliver error:%s", out.String())
+	}
+}
+
+func TestBondPaths(t *testing.T) {
+	paths := []*bondPath{}
+	for i := 0; i < 3; i++ {
+		paths = append(paths, &bondPath{tunnel: &P2PTunnel{running: true}, rtt: time.Millisecond * 10})
+	}
+	b := newOverlayBond(1, paths, nil)
+	counts := make([]int, len(paths))
+	for i := 0; i < 900; i++ {
+		idx := b.pickPath(-1)
+		counts[idx]++
+		b.paths[idx].sentBytes += 1000
+	}
+	for i, c := range counts {
+		if c < 250 || c > 350 {
+			t.Errorf("path %d picked %d", i, c)
+		}
+	}
+}
+
+func TestBondPeerPaths(t *testing.T) {
+	app := &p2pApp{directTunnel: &P2PTunnel{id: 1}, relayTunnel: &P2PTunnel{id: 2}, rtid: 20}
+	req := OverlayConnectReq{BondPaths: []BondPath{{TunnelID: 1}, {TunnelID: 2, RelayTunnelID: 20}}}
+	paths, err := peerBondPaths(app, &req)
+	if err != nil || len(paths) != 2 || paths[0].tunnel.id != 1 || paths[1].tunnel.id != 2 || paths[1].rtid != 20 {
+		t.Fatalf("paths %v error %v", paths, err)
+	}
+	for _, bp := range []BondPath{{TunnelID: 3}, {TunnelID: 2, RelayTunnelID: 21}, {TunnelID: 1, RelayTunnelID: 20}, {TunnelID: 2}} {
+		req := OverlayConnectReq{BondPaths: []BondPath{{TunnelID: 1}, bp}}
+		if _, err := peerBondPaths(app, &req); !errors.Is(err, ErrBondPath) {
+			t.Errorf("%+v accepted", bp)
+		}
+	}
+}
+
+func TestBondFinish(t *testing.T) {
+	// the segments sent when all paths are down are kept, the end follows them
+	sender := newOverlayBond(1, nil, nil)
+	sender.write([]byte("a"))
+	sender.write([]byte("b"))
+	if sender.finish(time.Millisecond*50) || len(sender.unacked) != 3 {
+		t.Fatalf("finish should wait for the unacked segments, unacked=%d", len(sender.unacked))
+	}
+	out := new(bytes.Buffer)
+	fin := 0
+	receiver := newOverlayBond(1, nil, func(p []byte) (int, error) {
+		if fin > 0 {
+			t.Error("data delivered after the end")
+		}
+		return out.Write(p)
+	})
+	receiver.fin = func() { fin++ }
+	for _, seq := range []uint64{2, 1, 0} { // the end arrives first on the faster path
+		receiver.receive(seq, sender.unacked[seq].data[overlayBondHeaderSize:])
+	}
+	if out.String() != "ab" || fin != 1 || !receiver.finRecv {
+		t.Errorf("out=%s fin=%d", out.String(), fin)
+	}
+	done := make(chan bool)
+	go func() { done <- sender.finish(time.Second) }()
+	time.Sleep(time.Millisecond * 50)
+	sender.ack(4) // the data, the end and the end of the second finish
+	if !<-done {
+		t.Error("finish should end when all segments are acked")
+	}
+	if !receiver.finish(0) {
+		t.Error("the closed peer doesn't send the end")
+	}
+}
@@ -0,0 +1,138 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// The data path builds frames in pooled buffers. The payload is read at FrameHeadroom offset,
+// then the headers are written backwards into the headroom, so a packet is forwarded without
+// copying or allocating:
+//
+//	[openP2PHeader MsgRelayData][rtid][openP2PHeader][overlay id or from node id][payload]
+
+const (
+	FrameHeadroom  = 8 + RelayHeaderSize + 8 + 8
+	PoolBufferSize = FrameHeadroom + ReadBuffLen + PaddingSize
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, PoolBufferSize)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if b == nil || cap(*b) < PoolBufferSize {
+		return
+	}
+	*b = (*b)[:PoolBufferSize]
+	bufferPool.Put(b)
+}
+
+func putHeader(b []byte, mainType, subType uint16, dataLen uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], dataLen)
+	binary.LittleEndian.PutUint16(b[4:6], mainType)
+	binary.LittleEndian.PutUint16(b[6:8], subType)
+}
+
+func parseP2PHeader(b []byte, head *openP2PHeader) {
+	head.DataLen = binary.LittleEndian.Uint32(b[0:4])
+	head.MainType = binary.LittleEndian.Uint16(b[4:6])
+	head.SubType = binary.LittleEndian.Uint16(b[6:8])
+}
+
+// prependID writes id before buf[start:], return the new start
+func prependID(buf []byte, start int, id uint64) int {
+	start -= 8
+	binary.LittleEndian.PutUint64(buf[start:], id)
+	return start
+}
+
+// prependHeaders writes the openP2PHeader before buf[start:end], wraps it with the relay header when rtid!=0
+func prependHeaders(buf []byte, start, end int, subType uint16, rtid uint64) []byte {
+	start -= openP2PHeaderSize
+	putHeader(buf[start:], MsgP2P, subType, uint32(end-start-openP2PHeaderSize))
+	if rtid != 0 {
+		start = prependID(buf, start, rtid)
+		start -= openP2PHeaderSize
+		putHeader(buf[start:], MsgP2P, MsgRelayData, uint32(end-start-openP2PHeaderSize))
+	}
+	return buf[start:end]
+}
+
+// DefaultReadFrame reads a whole frame including header into buf, buf grows when the frame is larger.
+// The frame is valid until the next read.
+func DefaultReadFrame(ul underlay, buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	b := *buf
+	if _, err := io.ReadFull(ul, b[:openP2PHeaderSize]); err != nil {
+		return nil, err
+	}
+	parseP2PHeader(b, head)
+	if head.MainType > 16 {
+		return nil, ErrMsgFormat
+	}
+	frameLen := openP2PHeaderSize + int(head.DataLen)
+	if frameLen > len(b) {
+		b = make([]byte, frameLen)
+		copy(b, (*buf)[:openP2PHeaderSize])
+		*buf = b
+	}
+	_, err := io.ReadFull(ul, b[openP2PHeaderSize:frameLen])
+	return b[:frameLen], err
+}
+
+// frameBuffer is the data in a pooled buffer handed over to another goroutine, the receiver releases buf
+type frameBuffer struct {
+	buf  *[]byte
+	data []byte
+}
+
+// newNodeData copies the packet into a pooled buffer with headroom, call Release when it's consumed
+func newNodeData(nodeID uint64, data []byte) *NodeData {
+	if len(data) > ReadBuffLen+PaddingSize {
+		return &NodeData{NodeID: nodeID, Data: append([]byte(nil), data...)}
+	}
+	buf := getBuffer()
+	n := copy((*buf)[FrameHeadroom:], data)
+	return &NodeData{NodeID: nodeID, Data: (*buf)[FrameHeadroom : FrameHeadroom+n], buf: buf}
+}
+
+// Release returns the buffer to the pool, Data must not be used after that.
+// It's optional, the buffer is collected by GC if not released.
+func (nd *NodeData) Release() {
+	putBuffer(nd.buf)
+	nd.buf = nil
+	nd.Data = nil
+}
+
+// headroom returns Data with n bytes reserved in front, nil if Data is not pooled
+func (nd *NodeData) headroom(n int) []byte {
+	if nd.buf == nil || n > FrameHeadroom {
+		return nil
+	}
+	return (*nd.buf)[FrameHeadroom-n : FrameHeadroom+len(nd.Data)]
+}
+
+// nodeFrame builds the node data frame in a pooled buffer, relayed by rtid if it isn't 0
+func nodeFrame(data []byte, rtid uint64) (*[]byte, []byte) {
+	var buf *[]byte
+	if len(data) > ReadBuffLen+PaddingSize {
+		b := make([]byte, FrameHeadroom+len(data))
+		buf = &b
+	} else {
+		buf = getBuffer()
+	}
+	end := FrameHeadroom + copy((*buf)[FrameHeadroom:], data)
+	if rtid == 0 {
+		return buf, prependHeaders(*buf, FrameHeadroom, end, MsgNodeData, 0)
+	}
+	start := prependID(*buf, FrameHeadroom, gConf.nodeID())
+	return buf, prependHeaders(*buf, start, end, MsgRelayNodeData, rtid)
+}
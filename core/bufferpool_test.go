@@ -0,0 +1,260 @@
+package openp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// benchUnderlay reads the same frame repeatedly and discards the written data
+type benchUnderlay struct {
+	frame   []byte
+	off     int
+	written int
+}
+
+func (u *benchUnderlay) Read(b []byte) (int, error) {
+	n := copy(b, u.frame[u.off:])
+	u.off = (u.off + n) % len(u.frame)
+	return n, nil
+}
+
+func (u *benchUnderlay) Write(b []byte) (int, error) {
+	u.written += len(b)
+	return len(b), nil
+}
+
+func (u *benchUnderlay) ReadBuffer() (*openP2PHeader, []byte, error) {
+	return DefaultReadBuffer(u)
+}
+
+func (u *benchUnderlay) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(u, buf, head)
+}
+
+func (u *benchUnderlay) WriteBytes(mainType uint16, subType uint16, data []byte) error {
+	return DefaultWriteBytes(u, mainType, subType, data)
+}
+
+func (u *benchUnderlay) WriteBuffer(data []byte) error {
+	return DefaultWriteBuffer(u, data)
+}
+
+func (u *benchUnderlay) WriteMessage(mainType uint16, subType uint16, packet interface{}) error {
+	return DefaultWriteMessage(u, mainType, subType, packet)
+}
+
+func (u *benchUnderlay) Close() error                       { return nil }
+func (u *benchUnderlay) WLock()                             {}
+func (u *benchUnderlay) WUnlock()                           {}
+func (u *benchUnderlay) SetReadDeadline(t time.Time) error  { return nil }
+func (u *benchUnderlay) SetWriteDeadline(t time.Time) error { return nil }
+func (u *benchUnderlay) Protocol() string                   { return "bench" }
+
+func testFrame(subType uint16, body []byte) []byte {
+	return append(encodeHeader(MsgP2P, subType, uint32(len(body))), body...)
+}
+
+// the relay frame to rtid carries MsgOverlayData of overlay id
+func testRelayOverlayFrame(rtid, oid uint64, payload []byte) []byte {
+	inner := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint64(inner, oid)
+	inner = testFrame(MsgOverlayData, append(inner, payload...))
+	relayHead := make([]byte, RelayHeaderSize)
+	binary.LittleEndian.PutUint64(relayHead, rtid)
+	return testFrame(MsgRelayData, append(relayHead, inner...))
+}
+
+func TestPrependHeaders(t *testing.T) {
+	payload := []byte("hello openp2p")
+	buf := make([]byte, PoolBufferSize)
+	end := FrameHeadroom + copy(buf[FrameHeadroom:], payload)
+	start := prependID(buf, FrameHeadroom, 7)
+	frame := prependHeaders(buf, start, end, MsgOverlayData, 9)
+	if !bytes.Equal(frame, testRelayOverlayFrame(9, 7, payload)) {
+		t.Errorf("relay frame wrong:%v", frame)
+	}
+	end = FrameHeadroom + copy(buf[FrameHeadroom:], payload)
+	frame = prependHeaders(buf, FrameHeadroom, end, MsgNodeData, 0)
+	if !bytes.Equal(frame, testFrame(MsgNodeData, payload)) {
+		t.Errorf("direct frame wrong:%v", frame)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	large := bytes.Repeat([]byte{1}, PoolBufferSize*2)
+	ul := &benchUnderlay{frame: append(testFrame(MsgNodeData, []byte("small")), testFrame(MsgNodeData, large)...)}
+	buf := make([]byte, PoolBufferSize)
+	head := openP2PHeader{}
+	frame, err := ul.ReadFrame(&buf, &head)
+	if err != nil || head.SubType != MsgNodeData || string(frame[openP2PHeaderSize:]) != "small" {
+		t.Errorf("read small frame error:%v %v", err, head)
+	}
+	frame, err = ul.ReadFrame(&buf, &head)
+	if err != nil || !bytes.Equal(frame[openP2PHeaderSize:], large) || len(buf) < len(frame) {
+		t.Errorf("read large frame error:%v %d", err, head.DataLen)
+	}
+	ul = &benchUnderlay{frame: encodeHeader(100, 0, 0)}
+	if _, err = ul.ReadFrame(&buf, &head); err != ErrMsgFormat {
+		t.Errorf("wrong main type should be rejected:%v", err)
+	}
+}
+
+func TestCBCCipher(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	c, err := newCBCCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"first packet", "the second packet is longer than one block"} {
+		in := make([]byte, len(plain)+PaddingSize)
+		copy(in, plain)
+		expect, _ := encryptBytes(key, make([]byte, len(in)), append([]byte(nil), in...), len(plain))
+		// encrypt in place, the iv must be reset for every packet
+		enc, _ := c.encrypt(in, in, len(plain))
+		if !bytes.Equal(enc, expect) {
+			t.Errorf("encrypt %q not equal to encryptBytes", plain)
+		}
+		dec, err := c.decrypt(enc, enc, len(enc))
+		if err != nil || string(dec) != plain {
+			t.Errorf("decrypt %q error:%v %q", plain, err, dec)
+		}
+	}
+	if _, err = c.decrypt(make([]byte, 20), make([]byte, 20), 20); err == nil {
+		t.Error("decrypt wrong size should fail")
+	}
+}
+
+func TestNodeData(t *testing.T) {
+	nd := newNodeData(1, []byte("packet"))
+	if string(nd.Data) != "packet" || nd.buf == nil {
+		t.Errorf("newNodeData wrong:%v", nd)
+	}
+	if b := nd.headroom(4); len(b) != 4+len("packet") || string(b[4:]) != "packet" {
+		t.Errorf("headroom wrong:%v", b)
+	}
+	nd.Release()
+	if nd.Data != nil || nd.buf != nil {
+		t.Error("Release should clear the data")
+	}
+	nd = newNodeData(1, make([]byte, PoolBufferSize))
+	if nd.buf != nil || nd.headroom(4) != nil || len(nd.Data) != PoolBufferSize {
+		t.Error("large node data should not be pooled")
+	}
+	nd.Release()
+}
+
+func relayBenchNetwork() (*P2PNetwork, *P2PTunnel) {
+	pn := &P2PNetwork{relayAcct: newRelayAccounting()}
+	from := &P2PTunnel{id: 1, conn: &benchUnderlay{}, config: AppConfig{PeerNode: "nodeA"}}
+	to := &P2PTunnel{id: 2, conn: &benchUnderlay{}, config: AppConfig{PeerNode: "nodeB"}}
+	next := &P2PTunnel{id: 3, conn: &benchUnderlay{}, config: AppConfig{PeerNode: "nodeC"}}
+	pn.allTunnels.Store(to.id, to)
+	route := &relayRoute{id: 4, next: next}
+	route.activeTime.Store(time.Now().UnixNano())
+	pn.relayRoutes.Store(route.id, route)
+	return pn, from
+}
+
+func TestZeroAllocs(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 1400)
+	ul := &benchUnderlay{frame: testRelayOverlayFrame(2, 7, payload)}
+	buf := make([]byte, PoolBufferSize)
+	head := openP2PHeader{}
+	pn, from := relayBenchNetwork()
+	if n := testing.AllocsPerRun(100, func() {
+		frame, _ := ul.ReadFrame(&buf, &head)
+		pn.relay(from, 2, frame)
+	}); n != 0 {
+		t.Errorf("read and relay allocs %v per packet", n)
+	}
+	frame := testRelayOverlayFrame(4, 7, payload)
+	if n := testing.AllocsPerRun(100, func() {
+		pn.forwardRelay(from, 4, frame)
+	}); n != 0 {
+		t.Errorf("forward relay allocs %v per packet", n)
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		newNodeData(1, payload).Release()
+	}); n > 1 { // the NodeData itself
+		t.Errorf("node data allocs %v per packet", n)
+	}
+}
+
+func BenchmarkReadBuffer(b *testing.B) {
+	ul := &benchUnderlay{frame: testFrame(MsgNodeData, make([]byte, 1400))}
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	for i := 0; i < b.N; i++ {
+		ul.ReadBuffer()
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	ul := &benchUnderlay{frame: testFrame(MsgNodeData, make([]byte, 1400))}
+	buf := make([]byte, PoolBufferSize)
+	head := openP2PHeader{}
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	for i := 0; i < b.N; i++ {
+		ul.ReadFrame(&buf, &head)
+	}
+}
+
+// the overlayConn.run path: encrypt in place, prepend the overlay and relay headers, write
+func BenchmarkOverlayFrame(b *testing.B) {
+	c, _ := newCBCCipher([]byte("0123456789abcdef"))
+	ul := &benchUnderlay{}
+	buf := make([]byte, PoolBufferSize)
+	b.ReportAllocs()
+	b.SetBytes(ReadBuffLen)
+	for i := 0; i < b.N; i++ {
+		start := FrameHeadroom
+		payload, _ := c.encrypt(buf[start:], buf[start:], ReadBuffLen)
+		end := start + len(payload)
+		start = prependID(buf, start, 7)
+		ul.WriteBuffer(prependHeaders(buf, start, end, MsgOverlayData, 9))
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	pn, from := relayBenchNetwork()
+	frame := testRelayOverlayFrame(2, 7, make([]byte, 1400))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		pn.relay(from, 2, frame)
+	}
+}
+
+func BenchmarkForwardRelay(b *testing.B) {
+	pn, from := relayBenchNetwork()
+	frame := testRelayOverlayFrame(4, 7, make([]byte, 1400))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		pn.forwardRelay(from, 4, frame)
+	}
+}
+
+func BenchmarkNodeFrame(b *testing.B) {
+	packet := make([]byte, 1400)
+	ul := &benchUnderlay{}
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	for i := 0; i < b.N; i++ {
+		buf, frame := nodeFrame(packet, 9)
+		ul.WriteBuffer(frame)
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkNodeData(b *testing.B) {
+	packet := make([]byte, 1400)
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	for i := 0; i < b.N; i++ {
+		newNodeData(1, packet).Release()
+	}
+}
@@ -0,0 +1,245 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sdwan packets are captured on demand by "openp2p capture", the running node streams the matched packets
+// as pcapng through the control api. The packets are captured where they're routed to the nodes and where
+// they're received from the nodes, every packet is commented with the peer node and the tunnel.
+
+const (
+	captureQueueSize      = 4096
+	captureDefaultSnaplen = 65535
+	captureNoRoute        = 0
+	captureFlood          = math.MaxUint64 // broadcast to all nodes
+	captureDropsTrailer   = "X-Openp2p-Drops"
+)
+
+type captureSession struct {
+	filter  captureFilter
+	snaplen int
+	ch      chan []byte
+	drops   atomic.Uint64
+}
+
+type captureManager struct {
+	mtx      sync.RWMutex
+	sessions map[*captureSession]bool
+	active   atomic.Int32
+}
+
+var gCapture = &captureManager{sessions: make(map[*captureSession]bool)}
+
+func init() {
+	ctlHandle("/capture", handleCapture)
+}
+
+func (m *captureManager) add(s *captureSession) {
+	m.mtx.Lock()
+	m.sessions[s] = true
+	m.active.Store(int32(len(m.sessions)))
+	m.mtx.Unlock()
+}
+
+func (m *captureManager) remove(s *captureSession) {
+	m.mtx.Lock()
+	delete(m.sessions, s)
+	m.active.Store(int32(len(m.sessions)))
+	m.mtx.Unlock()
+}
+
+// captureSDWAN is called on the data path, it costs nothing when no capture is running
+func captureSDWAN(inbound bool, nodeID uint64, p []byte, ether bool) {
+	if gCapture.active.Load() == 0 {
+		return
+	}
+	gCapture.capture(inbound, nodeID, p, ether, time.Now())
+}
+
+func (m *captureManager) capture(inbound bool, nodeID uint64, p []byte, ether bool, now time.Time) {
+	c := capturePacket{data: p, ether: ether, inbound: inbound, nodeID: nodeID}
+	ip := p
+	iface := pcapngIfaceTun
+	if ether {
+		iface = pcapngIfaceTap
+		ip = nil
+		if len(p) >= ethHeaderSize && binary.BigEndian.Uint16(p[12:14]) == ethTypeIPv4 {
+			ip = p[ethHeaderSize:]
+		}
+	}
+	var key flowKey
+	_, ok := parseFlow(ip, &key)
+	comment := ""
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for s := range m.sessions {
+		if s.filter != nil && !s.filter(&c, &key, ok) {
+			continue
+		}
+		if comment == "" {
+			comment = captureComment(inbound, nodeID)
+		}
+		select {
+		case s.ch <- pcapngPacket(iface, now, p, s.snaplen, inbound, comment):
+		default:
+			s.drops.Add(1)
+		}
+	}
+}
+
+// captureComment describes the peer node and the tunnel of the packet
+func captureComment(inbound bool, nodeID uint64) string {
+	switch nodeID {
+	case captureNoRoute:
+		return "no route"
+	case captureFlood:
+		return "to all nodes"
+	}
+	dir := "to"
+	if inbound {
+		dir = "from"
+	}
+	if nodeID == gConf.nodeID() {
+		return dir + " local"
+	}
+	if GNetwork == nil {
+		return fmt.Sprintf("%s %d", dir, nodeID)
+	}
+	i, ok := GNetwork.apps.Load(nodeID)
+	if !ok {
+		return fmt.Sprintf("%s %d", dir, nodeID)
+	}
+	app := i.(*p2pApp)
+	t := app.Tunnel()
+	if t == nil {
+		return fmt.Sprintf("%s %s no tunnel", dir, app.config.PeerNode)
+	}
+	mode := "direct"
+	if !app.isDirect() {
+		mode = "relay " + app.config.RelayNode
+	}
+	return fmt.Sprintf("%s %s tunnel %d %s", dir, app.config.PeerNode, t.id, mode)
+}
+
+// handleCapture streams the packets until the limits of count, duration or size
+func handleCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseCaptureFilter(q.Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count, _ := strconv.Atoi(q.Get("count"))
+	duration, _ := time.ParseDuration(q.Get("duration"))
+	maxSize, _ := strconv.Atoi(q.Get("size"))
+	snaplen, _ := strconv.Atoi(q.Get("snaplen"))
+	if snaplen <= 0 || snaplen > captureDefaultSnaplen {
+		snaplen = captureDefaultSnaplen
+	}
+	s := &captureSession{filter: filter, snaplen: snaplen, ch: make(chan []byte, captureQueueSize)}
+	gCapture.add(s)
+	defer gCapture.remove(s)
+	gLog.Printf(LvINFO, "capture start, filter:%s", q.Get("filter"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", captureDropsTrailer)
+	flusher, _ := w.(http.Flusher)
+	header := pcapngHeader(snaplen)
+	w.Write(header)
+	size, packets := len(header), 0
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	defer func() {
+		w.Header().Set(captureDropsTrailer, strconv.FormatUint(s.drops.Load(), 10))
+		gLog.Printf(LvINFO, "capture end, %d packets, %d dropped", packets, s.drops.Load())
+	}()
+	for {
+		select {
+		case b := <-s.ch:
+			if maxSize > 0 && size+len(b) > maxSize {
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			size += len(b)
+			packets++
+			if count > 0 && packets >= count {
+				return
+			}
+			if len(s.ch) == 0 && flusher != nil {
+				flusher.Flush()
+			}
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// captureCmd writes the packets captured by the running node to pcapng, the relative output is in workDir
+func captureCmd(args []string, workDir string) {
+	fset := flag.NewFlagSet("capture", flag.ExitOnError)
+	output := fset.String("w", "openp2p.pcapng", "write to the pcapng file, - for stdout")
+	filter := fset.String("f", "", `filter like "host 10.2.3.4 and (tcp port 22 or icmp) and not node NAS1"`)
+	count := fset.Int("c", 0, "stop after N packets, 0:unlimited")
+	duration := fset.Duration("t", 0, "stop after the duration, like 30s. 0:unlimited")
+	sizeMB := fset.Int("s", 100, "stop when the file reaches N MB, 0:unlimited")
+	snaplen := fset.Int("snaplen", captureDefaultSnaplen, "capture the first N bytes of every packet")
+	fset.Parse(args)
+	if *output != "-" && !filepath.IsAbs(*output) {
+		*output = filepath.Join(workDir, *output)
+	}
+	gConf.load()
+	query := url.Values{}
+	query.Set("filter", *filter)
+	query.Set("count", strconv.Itoa(*count))
+	query.Set("duration", duration.String())
+	query.Set("size", strconv.Itoa(*sizeMB*1024*1024))
+	query.Set("snaplen", strconv.Itoa(*snaplen))
+	rsp, err := ctlRequest("/capture", query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "capture error:", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, "capture error:", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		rsp.Body.Close() // stop the capture
+	}()
+	fmt.Fprintf(os.Stderr, "capturing to %s, press Ctrl+C to stop\n", *output)
+	n, _ := io.Copy(out, rsp.Body)
+	drops := rsp.Trailer.Get(captureDropsTrailer)
+	if drops == "" {
+		drops = "0"
+	}
+	fmt.Fprintf(os.Stderr, "captured %d bytes, %s packets dropped\n", n, drops)
+}
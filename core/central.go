@@ -0,0 +1,184 @@
+package openp2p
+
+import (
+	"sync"
+	"time"
+)
+
+// The central nodes relay the sdwan pairs of the other nodes. They are tried in order, every node checks
+// its direct tunnels to them and relays through the first healthy one. The active central node is failed
+// after it's unreachable for centralFailTime, and a higher priority one takes over again after it's healthy
+// for centralRecoverTime, so a flapping node doesn't move the relay paths back and forth.
+
+const (
+	centralCheckInterval = time.Second * 5
+	centralFailTime      = TunnelHeartbeatTime * 3
+	centralRecoverTime   = time.Minute
+)
+
+type centralHA struct {
+	mtx      sync.Mutex
+	active   string
+	upTime   map[string]time.Time // healthy since
+	downTime map[string]time.Time // unhealthy since
+}
+
+func newCentralHA() *centralHA {
+	return &centralHA{upTime: make(map[string]time.Time), downTime: make(map[string]time.Time)}
+}
+
+// centralNodes returns the central nodes in priority order, CentralNode is the first for the old server
+func centralNodes(sdwan *SDWANInfo) []string {
+	nodes := []string{}
+	if sdwan.CentralNode != "" {
+		nodes = append(nodes, sdwan.CentralNode)
+	}
+	for _, n := range sdwan.CentralNodes {
+		if n != "" && n != sdwan.CentralNode {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func isCentralNode(sdwan *SDWANInfo, node string) bool {
+	for _, n := range centralNodes(sdwan) {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the central node to relay through, empty if no central node
+func (c *centralHA) current(nodes []string) string {
+	if c == nil {
+		if len(nodes) == 0 {
+			return ""
+		}
+		return nodes[0]
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.currentLocked(nodes)
+}
+
+func (c *centralHA) currentLocked(nodes []string) string {
+	for _, n := range nodes {
+		if n == c.active {
+			return n
+		}
+	}
+	if len(nodes) == 0 {
+		c.active = ""
+	} else {
+		c.active = nodes[0]
+	}
+	return c.active
+}
+
+// update records the health of the central nodes, returns the old and new active node when failed over
+func (c *centralHA) update(nodes []string, healthy func(string) bool, now time.Time) (string, string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	old := c.currentLocked(nodes)
+	activeIdx := 0
+	for i, n := range nodes {
+		if n == old {
+			activeIdx = i
+		}
+		if healthy(n) {
+			delete(c.downTime, n)
+			if _, ok := c.upTime[n]; !ok {
+				c.upTime[n] = now
+			}
+		} else {
+			delete(c.upTime, n)
+			if _, ok := c.downTime[n]; !ok {
+				c.downTime[n] = now
+			}
+		}
+	}
+	for i, n := range nodes {
+		if n == old {
+			down, failed := c.downTime[n]
+			if !failed || now.Sub(down) < centralFailTime {
+				return old, old
+			}
+			continue
+		}
+		up, ok := c.upTime[n]
+		if !ok || (i < activeIdx && now.Sub(up) < centralRecoverTime) {
+			continue
+		}
+		c.active = n
+		return old, n
+	}
+	return old, old // no better one
+}
+
+// centralHealthy checks the direct tunnel to the central node
+func centralHealthy(node string) bool {
+	if node == gConf.Network.Node {
+		return true
+	}
+	i, ok := GNetwork.apps.Load(NodeNameToID(node))
+	if !ok {
+		return false
+	}
+	t := i.(*p2pApp).DirectTunnel()
+	return t != nil && t.isActive()
+}
+
+func (s *p2pSDWAN) centralLoop() {
+	for {
+		time.Sleep(centralCheckInterval)
+		sdwan := gConf.getSDWAN()
+		nodes := centralNodes(&sdwan)
+		if len(nodes) < 2 || isCentralNode(&sdwan, gConf.Network.Node) { // the central nodes connect the others directly
+			s.central.current(nodes)
+			continue
+		}
+		if old, active := s.central.update(nodes, centralHealthy, time.Now()); old != active {
+			gLog.Printf(LvWARN, "sdwan central node switch from %s to %s", old, active)
+			switchRelayNode(old, active)
+		}
+	}
+}
+
+// switchRelayNode moves the memapps relayed by old to node, their relay tunnels are rebuilt
+func switchRelayNode(old, node string) {
+	gConf.mtx.Lock()
+	for _, config := range gConf.Apps {
+		if config.SrcPort == 0 && config.RelayNode == old {
+			config.RelayNode = node
+		}
+	}
+	gConf.save()
+	gConf.mtx.Unlock()
+	GNetwork.apps.Range(func(id, i interface{}) bool {
+		if app := i.(*p2pApp); app.config.isMemApp() {
+			app.hbMtx.Lock()
+			app.relaySwitch = [2]string{old, node}
+			app.hbMtx.Unlock()
+		}
+		return true
+	})
+}
+
+// applyRelaySwitch runs in checkP2PTunnel, which owns the relay fields of the app
+func (app *p2pApp) applyRelaySwitch() {
+	app.hbMtx.Lock()
+	sw := app.relaySwitch
+	app.relaySwitch = [2]string{}
+	if sw[1] == "" || app.config.RelayNode != sw[0] {
+		app.hbMtx.Unlock()
+		return
+	}
+	app.hbTimeRelay = time.Now().Add(-TunnelHeartbeatTime * 3)
+	app.hbMtx.Unlock()
+	gLog.Printf(LvINFO, "switch %s relay node to %s", app.config.LogPeerNode(), sw[1])
+	app.config.RelayNode = sw[1]
+	app.retryRelayNum = 0
+	app.nextRetryRelayTime = time.Now()
+}
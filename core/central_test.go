@@ -0,0 +1,72 @@
+package openp2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCentralNodes(t *testing.T) {
+	sdwan := SDWANInfo{CentralNode: "c1", CentralNodes: []string{"c1", "c2", "c3"}}
+	nodes := centralNodes(&sdwan)
+	if len(nodes) != 3 || nodes[0] != "c1" || nodes[2] != "c3" {
+		t.Errorf("central nodes %v", nodes)
+	}
+	if !isCentralNode(&sdwan, "c2") || isCentralNode(&sdwan, "n1") {
+		t.Error("isCentralNode error")
+	}
+	if len(centralNodes(&SDWANInfo{})) != 0 {
+		t.Error("no central node")
+	}
+}
+
+func TestCentralFailover(t *testing.T) {
+	nodes := []string{"c1", "c2", "c3"}
+	health := map[string]bool{"c1": true, "c2": true, "c3": true}
+	healthy := func(n string) bool { return health[n] }
+	c := newCentralHA()
+	now := time.Now()
+	if c.current(nodes) != "c1" {
+		t.Fatal("the first central node should be active")
+	}
+	c.update(nodes, healthy, now)
+	health["c1"] = false
+	if _, active := c.update(nodes, healthy, now.Add(time.Second)); active != "c1" {
+		t.Error("should not fail over before centralFailTime")
+	}
+	old, active := c.update(nodes, healthy, now.Add(centralFailTime+time.Second*2))
+	if old != "c1" || active != "c2" {
+		t.Errorf("fail over %s -> %s, want c1 -> c2", old, active)
+	}
+	// c1 recovers, but it's not stable yet
+	health["c1"] = true
+	base := now.Add(centralFailTime + time.Second*3)
+	if _, active := c.update(nodes, healthy, base); active != "c2" {
+		t.Error("should not fail back before centralRecoverTime")
+	}
+	if _, active := c.update(nodes, healthy, base.Add(centralRecoverTime)); active != "c1" {
+		t.Errorf("should fail back to c1, got %s", active)
+	}
+	// all down, keep the active one
+	for _, n := range nodes {
+		health[n] = false
+	}
+	base = base.Add(centralRecoverTime + time.Second)
+	c.update(nodes, healthy, base)
+	if _, active := c.update(nodes, healthy, base.Add(centralFailTime*2)); active != "c1" {
+		t.Errorf("no healthy central node, active %s", active)
+	}
+}
+
+func TestApplyRelaySwitch(t *testing.T) {
+	app := &p2pApp{config: AppConfig{PeerNode: "node1", RelayNode: "central1"}, retryRelayNum: retryLimit}
+	app.relaySwitch = [2]string{"central2", "central3"}
+	app.applyRelaySwitch()
+	if app.config.RelayNode != "central1" || app.relaySwitch[1] != "" {
+		t.Errorf("switched the app relayed by another node:%s", app.config.RelayNode)
+	}
+	app.relaySwitch = [2]string{"central1", "central3"}
+	app.applyRelaySwitch()
+	if app.config.RelayNode != "central3" || app.retryRelayNum != 0 || app.hbTimeRelay.After(time.Now().Add(-TunnelHeartbeatTime*2)) {
+		t.Errorf("switch error:%s %d", app.config.RelayNode, app.retryRelayNum)
+	}
+}
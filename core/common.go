@@ -16,6 +16,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -114,6 +115,56 @@ func decryptBytes(key []byte, out, in []byte, dataLen int) ([]byte, error) {
 	return pkcs7UnPadding(out, dataLen)
 }
 
+type ivSetter interface {
+	SetIV([]byte)
+}
+
+// cbcCipher caches the AES block and CBC modes of a key, the iv is reset before every packet
+type cbcCipher struct {
+	mtx   sync.Mutex
+	block cipher.Block
+	enc   cipher.BlockMode
+	dec   cipher.BlockMode
+}
+
+func newCBCCipher(key []byte) (*cbcCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbcCipher{block: block, enc: cipher.NewCBCEncrypter(block, cbcIVBlock), dec: cipher.NewCBCDecrypter(block, cbcIVBlock)}, nil
+}
+
+// same as encryptBytes, out and in could be the same buffer
+func (c *cbcCipher) encrypt(out, in []byte, plainLen int) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if s, ok := c.enc.(ivSetter); ok {
+		s.SetIV(cbcIVBlock)
+	} else {
+		c.enc = cipher.NewCBCEncrypter(c.block, cbcIVBlock)
+	}
+	total := pkcs7Padding(in, plainLen, aes.BlockSize) + plainLen
+	c.enc.CryptBlocks(out[:total], in[:total])
+	return out[:total], nil
+}
+
+// same as decryptBytes, out and in could be the same buffer
+func (c *cbcCipher) decrypt(out, in []byte, dataLen int) ([]byte, error) {
+	if dataLen <= 0 || dataLen%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("wrong encrypted data size:%d", dataLen)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if s, ok := c.dec.(ivSetter); ok {
+		s.SetIV(cbcIVBlock)
+	} else {
+		c.dec = cipher.NewCBCDecrypter(c.block, cbcIVBlock)
+	}
+	c.dec.CryptBlocks(out[:dataLen], in[:dataLen])
+	return pkcs7UnPadding(out, dataLen)
+}
+
 // {240e:3b7:622:3440:59ad:7fa1:170c:ef7f 47924975352157270363627191692449083263 China CN 0xc0000965c8 Guangdong GD 0  Guangzhou 23.1167 113.25 Asia/Shanghai AS4134 Chinanet }
 func netInfo() *NetInfo {
 	tr := &http.Transport{
@@ -3,9 +3,16 @@ package openp2p
 import (
 	"fmt"
 	"log"
+	"os"
 	"testing"
 )
 
+// TestMain sets up the logger for all the tests of the package
+func TestMain(m *testing.M) {
+	gLog = NewLogger(os.TempDir(), ProductName, LvERROR, 1024*1024, LogConsole)
+	os.Exit(m.Run())
+}
+
 func TestAESCBC(t *testing.T) {
 	for packetSize := 1; packetSize <= 8192; packetSize++ {
 		log.Println("test packetSize=", packetSize)
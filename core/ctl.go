@@ -0,0 +1,167 @@
+package openp2p
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The control api serves the local commands like capture on 127.0.0.1, the commands talk to the running
+// node by it. The requests are authorized by a random secret the node writes to a file only its user
+// can read, config.json is readable by all.
+
+const (
+	ctlDefaultPort = 27181
+	ctlAuthHeader  = "X-Openp2p-Auth"
+	ctlUpgrade     = "openp2p-ctl"
+)
+
+var (
+	ctlMux        = http.NewServeMux()
+	ctlOnce       sync.Once
+	ctlSecretPath = "ctl.secret" // in the base dir
+	ctlKey        string         // the secret of the running node
+)
+
+func ctlPort() int {
+	if gConf.Network.CtlPort > 0 {
+		return gConf.Network.CtlPort
+	}
+	return ctlDefaultPort
+}
+
+// initCtlSecret writes a new secret for this run, called before serving
+func initCtlSecret() error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(b)
+	os.Remove(ctlSecretPath) // WriteFile keeps the mode of the existing file
+	if err := os.WriteFile(ctlSecretPath, []byte(key), 0600); err != nil {
+		return err
+	}
+	ctlKey = key
+	return nil
+}
+
+// ctlSecret reads the secret of the running node
+func ctlSecret() (string, error) {
+	b, err := os.ReadFile(ctlSecretPath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrCtlNotRunning, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s, run it as the user of the node", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ctlHandle registers the handler of the authorized requests
+func ctlHandle(path string, h http.HandlerFunc) {
+	ctlMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if ctlKey == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(ctlAuthHeader)), []byte(ctlKey)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+func startCtlServer() {
+	ctlOnce.Do(func() {
+		addr := fmt.Sprintf("127.0.0.1:%d", ctlPort())
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			gLog.Printf(LvWARN, "control api listen %s error:%s", addr, err)
+			return
+		}
+		if err = initCtlSecret(); err != nil {
+			gLog.Printf(LvWARN, "control api secret error:%s", err)
+			l.Close()
+			return
+		}
+		gLog.Printf(LvDEBUG, "control api listen %s", addr)
+		go http.Serve(l, ctlMux)
+	})
+}
+
+func newCtlRequest(path string, query url.Values) (*http.Request, error) {
+	u := url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", ctlPort()), Path: path, RawQuery: query.Encode()}
+	key, err := ctlSecret()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ctlAuthHeader, key)
+	return req, nil
+}
+
+// ctlRequest sends the command to the running node, the caller closes the body
+func ctlRequest(path string, query url.Values) (*http.Response, error) {
+	req, err := newCtlRequest(path, query)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCtlNotRunning, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		buf := make([]byte, 1024)
+		n, _ := rsp.Body.Read(buf)
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", rsp.Status, buf[:n])
+	}
+	return rsp, nil
+}
+
+// ctlDial upgrades the request to a raw connection to the running node
+func ctlDial(path string, query url.Values) (io.ReadWriteCloser, error) {
+	req, err := newCtlRequest(path, query)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", ctlUpgrade)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCtlNotRunning, err)
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		buf := make([]byte, 1024)
+		n, _ := rsp.Body.Read(buf)
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", rsp.Status, buf[:n])
+	}
+	return rsp.Body.(io.ReadWriteCloser), nil
+}
+
+// ctlHijack switches the request of ctlDial to the raw connection
+func ctlHijack(w http.ResponseWriter) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, http.ErrNotSupported
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + ctlUpgrade + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
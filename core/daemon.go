@@ -4,14 +4,19 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/openp2p-cn/service"
 )
 
+// the worker cleans up the routes, dns and firewall rules on SIGTERM, it's killed if it doesn't exit in time
+const workerStopTimeout = 10 * time.Second
+
 type daemon struct {
 	running bool
 	proc    *os.Process
+	exited  chan struct{} // closed when the worker exits
 }
 
 func (d *daemon) Start(s service.Service) error {
@@ -24,7 +29,7 @@ func (d *daemon) Stop(s service.Service) error {
 	d.running = false
 	if d.proc != nil {
 		gLog.Println(LvINFO, "stop worker")
-		d.proc.Kill()
+		d.stopWorker()
 	}
 	if service.Interactive() {
 		gLog.Println(LvINFO, "stop daemon")
@@ -33,6 +38,19 @@ func (d *daemon) Stop(s service.Service) error {
 	return nil
 }
 
+// stopWorker terminates the worker gracefully, windows doesn't support SIGTERM and kills it directly
+func (d *daemon) stopWorker() {
+	if err := d.proc.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-d.exited:
+			return
+		case <-time.After(workerStopTimeout):
+			gLog.Printf(LvWARN, "worker not exit in %s, kill it", workerStopTimeout)
+		}
+	}
+	d.proc.Kill()
+}
+
 func (d *daemon) run() {
 	gLog.Println(LvINFO, "daemon run start")
 	defer gLog.Println(LvINFO, "daemon run end")
@@ -79,8 +97,10 @@ func (d *daemon) run() {
 			gLog.Printf(LvERROR, "start worker error:%s", err)
 			return
 		}
+		d.exited = make(chan struct{})
 		d.proc = p
 		_, _ = p.Wait()
+		close(d.exited)
 		f.Close()
 		time.Sleep(time.Second)
 		err = os.Rename(tmpDump, dumpFile)
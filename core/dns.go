@@ -0,0 +1,463 @@
+package openp2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The sdwan node serves DNS on its virtual ip, it answers <node>.<network> from SDWANInfo.Nodes,
+// forwards the split domains to the resolvers behind the resource nodes, and the others to the
+// upstream nameservers when the system resolver is replaced. The other sdwan nodes get the node
+// names only, the forwarding is for the local clients, so the node isn't an open resolver.
+
+const (
+	dnsPort        = 53
+	dnsTTL         = 60
+	dnsMaxSize     = 1232 // EDNS safe udp payload size
+	dnsMinSize     = 512  // the udp payload size without EDNS
+	dnsForwardTime = 5 * time.Second
+	resolvConfPath = "/etc/resolv.conf"
+	resolvConfMark = "# openp2p sdwan"
+	resolvConfBak  = "/etc/resolv.conf.openp2p" // the original resolv.conf, restored by the next start after a crash
+)
+
+type sdwanDNS struct {
+	mtx      sync.RWMutex
+	domain   string            // network name with the trailing dot
+	records  map[string]net.IP // <node>.<network>. in lower case
+	split    map[string]string // domain. to resolver ip:port
+	upstream []string          // the original nameservers of resolv.conf
+	exitDNS  string            // all the other names are resolved through exit node
+	conn     net.PacketConn
+	listenIP string
+	system   bool // system resolver configured
+}
+
+func newSDWANDNS() *sdwanDNS {
+	return &sdwanDNS{records: make(map[string]net.IP), split: make(map[string]string)}
+}
+
+// dnsLabel converts the name to a valid dns label
+func dnsLabel(name string) string {
+	b := []byte(strings.ToLower(strings.TrimSpace(name)))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			b[i] = '-'
+		}
+	}
+	return string(b)
+}
+
+// "corp.example=10.1.0.53,lan=192.168.1.1:5353" to domain. and resolver ip:port
+func parseSplitDNS(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		arr := strings.Split(item, "=")
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("wrong split dns %s", item)
+		}
+		server := arr[1]
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, fmt.Sprint(dnsPort))
+		} else if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("wrong split dns %s:%s", item, err)
+		}
+		res[strings.ToLower(strings.TrimSuffix(arr[0], "."))+"."] = server
+	}
+	return res, nil
+}
+
+// setExitDNS resolves the names out of sdwan by the resolver through exit node, empty to disable
+func (d *sdwanDNS) setExitDNS(server string) {
+	if server != "" && net.ParseIP(server) != nil {
+		server = net.JoinHostPort(server, fmt.Sprint(dnsPort))
+	}
+	d.mtx.Lock()
+	d.exitDNS = server
+	d.mtx.Unlock()
+}
+
+// update the records from the sdwan info
+func (d *sdwanDNS) update(sdwan *SDWANInfo) {
+	split, err := parseSplitDNS(gConf.Network.SplitDNS)
+	if err != nil {
+		gLog.Printf(LvERROR, "parse split dns error:%s", err)
+	}
+	records := make(map[string]net.IP)
+	domain := dnsLabel(sdwan.Name) + "."
+	for _, node := range sdwan.Nodes {
+		if ip := net.ParseIP(node.IP).To4(); ip != nil {
+			records[dnsLabel(node.Name)+"."+domain] = ip
+		}
+	}
+	d.mtx.Lock()
+	d.domain = domain
+	d.records = records
+	if split != nil {
+		d.split = split
+	}
+	d.mtx.Unlock()
+	gLog.Printf(LvDEBUG, "sdwan dns update %d records in %s", len(records), domain)
+}
+
+func (d *sdwanDNS) reset() {
+	d.mtx.Lock()
+	d.records = make(map[string]net.IP)
+	d.mtx.Unlock()
+}
+
+// lookup the sdwan node name, like node1.mynet
+func (d *sdwanDNS) lookup(host string) net.IP {
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.records[name]
+}
+
+// forwardAddr returns the resolver of the longest matched split domain, or the upstream
+func (d *sdwanDNS) forwardAddr(name string) string {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	server := ""
+	matched := 0
+	for domain, s := range d.split {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > matched {
+			server = s
+			matched = len(domain)
+		}
+	}
+	if server == "" && d.exitDNS != "" {
+		server = d.exitDNS
+	}
+	if server == "" && len(d.upstream) > 0 {
+		server = d.upstream[0]
+	}
+	return server
+}
+
+// answer the query of the sdwan names, return the resolver address when it should be forwarded.
+// Only the local queries are forwarded.
+func (d *sdwanDNS) answer(req []byte, local bool) ([]byte, string, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if h.Response {
+		return nil, "", fmt.Errorf("not a dns query")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, "", err
+	}
+	name := strings.ToLower(q.Name.String())
+	d.mtx.RLock()
+	domain := d.domain
+	ip, found := d.records[name]
+	d.mtx.RUnlock()
+	rh := dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, RecursionDesired: h.RecursionDesired, RecursionAvailable: true}
+	if domain == "." || !(name == domain || strings.HasSuffix(name, "."+domain)) {
+		if server := d.forwardAddr(name); server != "" && local {
+			return nil, server, nil
+		}
+		rh.RCode = dnsmessage.RCodeRefused
+		return buildDNSResponse(rh, q, nil)
+	}
+	rh.Authoritative = true
+	if !found && name != domain {
+		rh.RCode = dnsmessage.RCodeNameError
+		return buildDNSResponse(rh, q, nil)
+	}
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeALL {
+		return buildDNSResponse(rh, q, nil) // NOERROR without answer, no ipv6 in sdwan
+	}
+	return buildDNSResponse(rh, q, ip)
+}
+
+func buildDNSResponse(h dnsmessage.Header, q dnsmessage.Question, ip net.IP) ([]byte, string, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, "", err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, "", err
+	}
+	if ip != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, "", err
+		}
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		if err := b.AResource(rh, a); err != nil {
+			return nil, "", err
+		}
+	}
+	rsp, err := b.Finish()
+	return rsp, "", err
+}
+
+func (d *sdwanDNS) serve(conn net.PacketConn, dial dialFunc) {
+	gLog.Printf(LvINFO, "sdwan dns listen on %s", conn.LocalAddr())
+	defer gLog.Printf(LvINFO, "sdwan dns %s end", conn.LocalAddr())
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		rsp, server, err := d.answer(buf[:n], d.isLocal(addr))
+		if err != nil {
+			gLog.Printf(LvDEBUG, "sdwan dns query from %s error:%s", addr, err)
+			continue
+		}
+		if server == "" {
+			conn.WriteTo(rsp, addr)
+			continue
+		}
+		go func(req []byte) {
+			rsp, err := forwardDNS(dial, server, req)
+			if err != nil {
+				gLog.Printf(LvDEBUG, "sdwan dns forward to %s error:%s", server, err)
+				return
+			}
+			conn.WriteTo(rsp, addr)
+		}(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// isLocal reports whether the query is from this node, which has the virtual ip as source
+func (d *sdwanDNS) isLocal(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return ua.IP.IsLoopback() || ua.IP.String() == d.listenIP
+}
+
+func forwardDNS(dial dialFunc, server string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTime)
+	defer cancel()
+	c, err := dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsForwardTime))
+	if _, err = c.Write(req); err != nil {
+		return nil, err
+	}
+	rsp := make([]byte, 65535)
+	n, err := c.Read(rsp)
+	if err != nil {
+		return nil, err
+	}
+	if n > dnsClientSize(req) {
+		return truncateDNS(rsp[:n])
+	}
+	return rsp[:n], nil
+}
+
+// dnsClientSize is the udp payload size advertised by the EDNS of the query
+func dnsClientSize(req []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(req); err != nil {
+		return dnsMinSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsMinSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsMinSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			if size := int(h.Class); size > dnsMinSize {
+				return size
+			}
+			return dnsMinSize
+		}
+		if p.SkipAdditional() != nil {
+			return dnsMinSize
+		}
+	}
+}
+
+// truncateDNS keeps the header and the questions of the reply with TC set, the client retries over tcp
+func truncateDNS(rsp []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(rsp)
+	if err != nil {
+		return nil, err
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	for _, q := range qs {
+		b.Question(q)
+	}
+	return b.Finish()
+}
+
+// start serving on the virtual ip, the listener is provided by netstack or the system
+func (d *sdwanDNS) start(ip string, listen func(addr string) (net.PacketConn, error), dial dialFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.conn != nil && d.listenIP == ip {
+		return
+	}
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	conn, err := listen(net.JoinHostPort(ip, fmt.Sprint(dnsPort)))
+	if err != nil {
+		gLog.Printf(LvERROR, "sdwan dns listen %s error:%s", ip, err)
+		d.conn = nil
+		return
+	}
+	d.conn = conn
+	d.listenIP = ip
+	go d.serve(conn, dial)
+}
+
+func (d *sdwanDNS) stop() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	if d.system {
+		resetSystemDNS()
+		d.system = false
+	}
+}
+
+// setSystem configures the system resolver to query the sdwan dns. systemd-resolved routes only the sdwan
+// and split domains to the tun link, otherwise the virtual ip is prepended to resolv.conf and the
+// other names are forwarded to the original nameservers.
+func (d *sdwanDNS) setSystem(tunName, ip string) {
+	if runtime.GOOS != "linux" { // only support Linux
+		gLog.Printf(LvWARN, "configure system dns is not supported on %s", runtime.GOOS)
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.system {
+		return
+	}
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		domains := []string{"~" + strings.TrimSuffix(d.domain, ".")}
+		if d.exitDNS != "" { // all domains to prevent dns leak
+			domains = append(domains, "~.")
+		}
+		for domain := range d.split {
+			domains = append(domains, "~"+strings.TrimSuffix(domain, "."))
+		}
+		err = execCommand("resolvectl", true, "dns", tunName, ip)
+		if err == nil {
+			err = execCommand("resolvectl", true, append([]string{"domain", tunName}, domains...)...)
+		}
+		if err == nil {
+			gLog.Printf(LvINFO, "sdwan dns set systemd-resolved %s %s %v", tunName, ip, domains)
+			d.system = true
+			return
+		}
+		gLog.Printf(LvWARN, "resolvectl error:%s, use resolv.conf", err)
+	}
+	upstream, err := setResolvConf(ip)
+	if err != nil {
+		gLog.Printf(LvERROR, "sdwan dns set resolv.conf error:%s", err)
+		return
+	}
+	gLog.Printf(LvINFO, "sdwan dns set resolv.conf %s, upstream %v", ip, upstream)
+	d.upstream = upstream
+	d.system = true
+}
+
+// setResolvConf prepends the nameserver ip with mark, return the original nameservers.
+// The original file is backed up first, the backup of a crashed process is kept.
+func setResolvConf(ip string) ([]string, error) {
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+	upstream := []string{}
+	original := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(line, resolvConfMark) {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && fields[1] != ip {
+			upstream = append(upstream, net.JoinHostPort(fields[1], fmt.Sprint(dnsPort)))
+		}
+		original = append(original, line)
+	}
+	if _, err = os.Stat(resolvConfBak); os.IsNotExist(err) {
+		if err = os.WriteFile(resolvConfBak, []byte(strings.Join(original, "\n")), 0644); err != nil {
+			return nil, err
+		}
+	}
+	lines := append([]string{fmt.Sprintf("nameserver %s %s", ip, resolvConfMark)}, original...)
+	return upstream, os.WriteFile(resolvConfPath, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// resetSystemDNS reverts the resolver of the tun link and restores resolv.conf, it's also called at start
+// to clean up the state left by a crashed process
+func resetSystemDNS() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		execCommand("resolvectl", true, "revert", tunIfaceName)
+	}
+	restoreResolvConf(resolvConfPath, resolvConfBak)
+}
+
+// restoreResolvConf writes the backup back if the file still has the mark, otherwise the file has been
+// rewritten by others, like dhcp client, and the backup is outdated
+func restoreResolvConf(path, bak string) {
+	backup, bakErr := os.ReadFile(bak)
+	os.Remove(bak)
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), resolvConfMark) {
+		return
+	}
+	if bakErr == nil {
+		gLog.Printf(LvINFO, "restore %s from %s", path, bak)
+		os.WriteFile(path, backup, 0644)
+		return
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasSuffix(line, resolvConfMark) {
+			lines = append(lines, line)
+		}
+	}
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
@@ -0,0 +1,146 @@
+package openp2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	req, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestSDWANDNSAnswer(t *testing.T) {
+	gConf.Network.SplitDNS = "corp.example=10.1.0.53,dev.corp.example=10.1.1.53:5353"
+	defer func() { gConf.Network.SplitDNS = "" }()
+	d := newSDWANDNS()
+	d.update(&SDWANInfo{Name: "MyNet", Nodes: []*SDWANNode{{Name: "Node1", IP: "10.2.3.1"}, {Name: "node 2", IP: "10.2.3.2"}}})
+	if ip := d.lookup("node-2.mynet"); !ip.Equal(net.ParseIP("10.2.3.2")) {
+		t.Errorf("lookup wrong:%s", ip)
+	}
+	rsp, server, err := d.answer(dnsQuery(t, "NODE1.mynet.", dnsmessage.TypeA), true)
+	if err != nil || server != "" {
+		t.Fatalf("answer error:%v %s", err, server)
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(rsp); err != nil || m.ID != 7 || len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 2, 3, 1} {
+		t.Errorf("A response wrong:%v %v", m, err)
+	}
+	rsp, _, _ = d.answer(dnsQuery(t, "node3.mynet.", dnsmessage.TypeA), true)
+	if m.Unpack(rsp); m.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("unknown node should be NXDOMAIN:%v", m.RCode)
+	}
+	rsp, _, _ = d.answer(dnsQuery(t, "node1.mynet.", dnsmessage.TypeAAAA), true)
+	if m.Unpack(rsp); m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+		t.Errorf("AAAA should be empty:%v", m)
+	}
+	if _, server, _ = d.answer(dnsQuery(t, "git.dev.corp.example.", dnsmessage.TypeA), true); server != "10.1.1.53:5353" {
+		t.Errorf("split dns should match the longest domain:%s", server)
+	}
+	if _, server, _ = d.answer(dnsQuery(t, "www.corp.example.", dnsmessage.TypeA), true); server != "10.1.0.53:53" {
+		t.Errorf("split dns wrong:%s", server)
+	}
+	rsp, server, _ = d.answer(dnsQuery(t, "example.com.", dnsmessage.TypeA), true)
+	if m.Unpack(rsp); server != "" || m.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("other names should be refused without upstream:%s %v", server, m.RCode)
+	}
+	d.upstream = []string{"8.8.8.8:53"}
+	if _, server, _ = d.answer(dnsQuery(t, "example.com.", dnsmessage.TypeA), true); server != "8.8.8.8:53" {
+		t.Errorf("other names should be forwarded to upstream:%s", server)
+	}
+	rsp, server, _ = d.answer(dnsQuery(t, "example.com.", dnsmessage.TypeA), false)
+	if m.Unpack(rsp); server != "" || m.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("the query from other nodes should be refused:%s %v", server, m.RCode)
+	}
+	if _, server, _ = d.answer(dnsQuery(t, "node1.mynet.", dnsmessage.TypeA), false); server != "" {
+		t.Errorf("the sdwan names should be answered for other nodes:%s", server)
+	}
+}
+
+func TestRestoreResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	path, bak := filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "resolv.conf.bak")
+	os.WriteFile(path, []byte("nameserver 10.2.3.1 "+resolvConfMark+"\nnameserver 8.8.8.8\n"), 0644)
+	os.WriteFile(bak, []byte("search lan\nnameserver 8.8.8.8\n"), 0644)
+	restoreResolvConf(path, bak)
+	if data, _ := os.ReadFile(path); string(data) != "search lan\nnameserver 8.8.8.8\n" {
+		t.Errorf("restore wrong:%q", data)
+	}
+	if _, err := os.Stat(bak); !os.IsNotExist(err) {
+		t.Error("backup should be removed")
+	}
+	// rewritten by others
+	os.WriteFile(path, []byte("nameserver 1.1.1.1\n"), 0644)
+	os.WriteFile(bak, []byte("nameserver 8.8.8.8\n"), 0644)
+	restoreResolvConf(path, bak)
+	if data, _ := os.ReadFile(path); string(data) != "nameserver 1.1.1.1\n" {
+		t.Errorf("outdated backup restored:%q", data)
+	}
+}
+
+func TestParseSplitDNS(t *testing.T) {
+	if _, err := parseSplitDNS("corp.example"); err == nil {
+		t.Error("no resolver should fail")
+	}
+	if _, err := parseSplitDNS("corp.example=resolver"); err == nil {
+		t.Error("wrong resolver should fail")
+	}
+}
+
+func TestForwardDNSTruncate(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, dnsMaxSize)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, _ := p.Start(buf[:n])
+			q, _ := p.Question()
+			h.Response = true
+			b := dnsmessage.NewBuilder(nil, h)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			for i := 0; i < 100; i++ { // about 1.6k
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}})
+			}
+			rsp, _ := b.Finish()
+			upstream.WriteTo(rsp, addr)
+		}
+	}()
+	dial := (&net.Dialer{}).DialContext
+	var m dnsmessage.Message
+	rsp, err := forwardDNS(dial, upstream.LocalAddr().String(), dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	if err != nil || m.Unpack(rsp) != nil || !m.Truncated || len(m.Answers) != 0 || len(m.Questions) != 1 || m.ID != 7 {
+		t.Fatalf("the reply over 512 should be truncated:%v %v", m.Header, err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 8, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	req, _ := b.Finish()
+	rsp, err = forwardDNS(dial, upstream.LocalAddr().String(), req)
+	if err != nil || m.Unpack(rsp) != nil || m.Truncated || len(m.Answers) != 100 {
+		t.Fatalf("the reply within the EDNS size should be complete:%d %v", len(m.Answers), err)
+	}
+}
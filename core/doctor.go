@@ -0,0 +1,320 @@
+package openp2p
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// "openp2p doctor" checks the network of this node like the login does, and prints what works and what
+// doesn't. With -peer it asks the running node for the peer info, and prints the link modes in the order
+// addDirectTunnel tries them.
+
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+
+	mtuProbeMin     = 576
+	mtuProbeMax     = 1500
+	mtuProbeTimeout = time.Second
+)
+
+type doctorResult struct {
+	status string
+	name   string
+	detail string
+}
+
+func (r doctorResult) String() string {
+	return fmt.Sprintf("[%-4s] %-10s %s", r.status, r.name, r.detail)
+}
+
+type firewallCheck struct {
+	detail   string
+	blocking bool
+}
+
+func init() {
+	ctlHandle("/peerinfo", handlePeerInfo)
+}
+
+func doctorCmd(args []string) {
+	fset := flag.NewFlagSet("doctor", flag.ExitOnError)
+	peer := fset.String("peer", "", "print the link modes to the peer node, requires the running openp2p")
+	fset.Parse(args)
+	gConf.load()
+	gLog.setMode(LogFile) // the report only
+	if gConf.Network.ServerHost == "" {
+		gConf.Network.ServerHost = "api.openp2p.cn"
+	}
+	if gConf.Network.ServerPort == 0 {
+		gConf.Network.ServerPort = WsPort
+	}
+	gConf.Network.UDPPort1 = UDPPort1
+	gConf.Network.UDPPort2 = UDPPort2
+	if gConf.Network.TCPPort == 0 {
+		gConf.Network.TCPPort = int(gConf.nodeID()%15000 + 50000)
+	}
+	fmt.Printf("openp2p %s doctor, node %s\n", OpenP2PVersion, gConf.Network.Node)
+	checks := []func() []doctorResult{doctorGateway, doctorNAT, doctorUPNP, doctorIPv6, doctorMTU, doctorFirewall}
+	for _, check := range checks {
+		for _, r := range check() {
+			fmt.Println(r)
+		}
+	}
+	if *peer != "" {
+		doctorPeer(*peer)
+	}
+}
+
+// doctorGateway checks the dns, tls and websocket of the login
+func doctorGateway() []doctorResult {
+	host := gConf.Network.ServerHost
+	addr := fmt.Sprintf("%s:%d", host, gConf.Network.ServerPort)
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return []doctorResult{{doctorFail, "dns", fmt.Sprintf("resolve %s error:%s", host, err)}}
+	}
+	res := []doctorResult{{doctorOK, "dns", fmt.Sprintf("%s is %s", host, strings.Join(ips, ","))}}
+	if gConf.Network.HTTPProxy == "" {
+		start := time.Now()
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: ClientAPITimeout}, "tcp", addr, gatewayTLSConfig())
+		if err != nil {
+			return append(res, doctorResult{doctorFail, "tls", fmt.Sprintf("%s error:%s, try -httpproxy if the network requires a proxy", addr, err)})
+		}
+		cert := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		res = append(res, doctorResult{doctorOK, "tls", fmt.Sprintf("%s in %dms, cert expires %s", addr, time.Since(start).Milliseconds(), cert.NotAfter.Format("2006-01-02"))})
+	}
+	dialer := websocket.Dialer{TLSClientConfig: gatewayTLSConfig(), HandshakeTimeout: ClientAPITimeout, Proxy: httpProxy()}
+	u := url.URL{Scheme: "wss", Host: addr, Path: "/api/v1/login"}
+	ws, rsp, err := dialer.Dial(u.String(), nil)
+	switch {
+	case err == nil:
+		ws.Close()
+		res = append(res, doctorResult{doctorOK, "websocket", u.String()})
+	case rsp != nil: // the gateway answers without the login params
+		res = append(res, doctorResult{doctorOK, "websocket", fmt.Sprintf("%s answers %s", u.String(), rsp.Status)})
+	default:
+		res = append(res, doctorResult{doctorFail, "websocket", fmt.Sprintf("%s error:%s", u.String(), err)})
+	}
+	return res
+}
+
+// doctorNAT detects the nat type and the public ip like the login
+func doctorNAT() []doctorResult {
+	host := gConf.Network.ServerHost
+	publicIP, natType, err := getNATType(host, gConf.Network.UDPPort1, gConf.Network.UDPPort2)
+	if err != nil {
+		return []doctorResult{{doctorFail, "nat", fmt.Sprintf("udp %d,%d blocked:%s, punching is unavailable, the tunnels go through wss or relay", gConf.Network.UDPPort1, gConf.Network.UDPPort2, err)}}
+	}
+	gConf.Network.publicIP, gConf.Network.natType = publicIP, natType
+	res := []doctorResult{}
+	if natType == NATCone {
+		res = append(res, doctorResult{doctorOK, "nat", fmt.Sprintf("cone, public ip %s, punching works with most peers", publicIP)})
+	} else {
+		res = append(res, doctorResult{doctorWarn, "nat", fmt.Sprintf("symmetric, public ip %s, punching needs a cone peer", publicIP)})
+	}
+	_, natPort, localPort := natTCP(host, IfconfigPort1)
+	switch {
+	case natPort == 0:
+		res = append(res, doctorResult{doctorWarn, "tcp nat", fmt.Sprintf("tcp %d blocked, tcp punching is unavailable", IfconfigPort1)})
+	case natPort == localPort:
+		res = append(res, doctorResult{doctorOK, "tcp nat", fmt.Sprintf("port %d preserved", localPort)})
+	default:
+		res = append(res, doctorResult{doctorOK, "tcp nat", fmt.Sprintf("port %d mapped to %d", localPort, natPort)})
+	}
+	hasIPv4, hasUPNP := publicIPTest(publicIP, gConf.Network.TCPPort)
+	gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP = hasIPv4, hasUPNP
+	switch {
+	case hasIPv4 == 1:
+		res = append(res, doctorResult{doctorOK, "public ip", fmt.Sprintf("%s:%d is reachable, peers connect by tcp4", publicIP, gConf.Network.TCPPort)})
+	case hasUPNP == 1:
+		res = append(res, doctorResult{doctorOK, "public ip", fmt.Sprintf("%s:%d is reachable by the upnp port mapping, peers connect by tcp4", publicIP, gConf.Network.TCPPort)})
+	default:
+		res = append(res, doctorResult{doctorWarn, "public ip", fmt.Sprintf("%s:%d is not reachable, behind nat or firewall", publicIP, gConf.Network.TCPPort)})
+	}
+	return res
+}
+
+func doctorUPNP() []doctorResult {
+	nat, err := Discover()
+	if err != nil || nat == nil {
+		return []doctorResult{{doctorWarn, "upnp", fmt.Sprintf("no upnp or nat-pmp gateway: %v", err)}}
+	}
+	ext, err := nat.GetExternalAddress()
+	if err != nil {
+		return []doctorResult{{doctorWarn, "upnp", fmt.Sprintf("gateway found, external address error:%s", err)}}
+	}
+	if ext.String() != gConf.Network.publicIP && gConf.Network.publicIP != "" {
+		return []doctorResult{{doctorWarn, "upnp", fmt.Sprintf("gateway external ip %s isn't the public ip %s, there's another nat", ext, gConf.Network.publicIP)}}
+	}
+	return []doctorResult{{doctorOK, "upnp", fmt.Sprintf("gateway external ip %s", ext)}}
+}
+
+func doctorIPv6() []doctorResult {
+	ip, err := publicIPv6()
+	if err != nil || !IsIPv6(ip) {
+		return []doctorResult{{doctorWarn, "ipv6", fmt.Sprintf("no public ipv6: %v", err)}}
+	}
+	gConf.setIPv6(ip)
+	return []doctorResult{{doctorOK, "ipv6", fmt.Sprintf("%s, peers with ipv6 connect by tcp6", ip)}}
+}
+
+// doctorMTU probes the path mtu to the gateway by ICMP echo with DF
+func doctorMTU() []doctorResult {
+	mtu, err := probePathMTU(gConf.Network.ServerHost)
+	if err != nil {
+		return []doctorResult{{doctorWarn, "mtu", fmt.Sprintf("probe error:%s", err)}}
+	}
+	overhead := 28 + openP2PHeaderSize + 32 // ip, udp, the frame header and about the quic or kcp header
+	if mtu < tunMTU()+overhead {
+		return []doctorResult{{doctorWarn, "mtu", fmt.Sprintf("path mtu %d, the sdwan mtu %d will be lowered to about %d", mtu, tunMTU(), mtu-overhead)}}
+	}
+	return []doctorResult{{doctorOK, "mtu", fmt.Sprintf("path mtu %d", mtu)}}
+}
+
+func doctorFirewall() []doctorResult {
+	res := []doctorResult{}
+	for _, s := range firewallStatus() {
+		status := doctorOK
+		if s.blocking {
+			status = doctorWarn
+		}
+		res = append(res, doctorResult{status, "firewall", s.detail})
+	}
+	return res
+}
+
+// doctorPeer prints the peer info and the link modes
+func doctorPeer(peer string) {
+	rsp, err := ctlRequest("/peerinfo", url.Values{"node": {peer}})
+	if err != nil {
+		fmt.Println(doctorResult{doctorFail, "peer", err.Error()})
+		return
+	}
+	defer rsp.Body.Close()
+	info := QueryPeerInfoRsp{}
+	if err = json.NewDecoder(rsp.Body).Decode(&info); err != nil {
+		fmt.Println(doctorResult{doctorFail, "peer", err.Error()})
+		return
+	}
+	config := AppConfig{PeerNode: peer}
+	config.peerVersion = info.Version
+	config.peerLanIP = info.LanIP
+	config.hasIPv4 = info.HasIPv4
+	config.peerIP = info.IPv4
+	config.peerIPv6 = info.IPv6
+	config.hasUPNPorNATPMP = info.HasUPNPorNATPMP
+	config.peerNatType = info.NatType
+	fmt.Println(doctorResult{doctorOK, "peer", fmt.Sprintf("%s version %s, %s nat, public ip %s, ipv6 %s, hasIPv4 %d, upnp %d",
+		peer, info.Version, natTypeName(info.NatType), info.IPv4, info.IPv6, info.HasIPv4, info.HasUPNPorNATPMP)})
+	modes := linkModes(&config)
+	if len(modes) == 0 {
+		fmt.Println(doctorResult{doctorWarn, "link", "no direct link mode, the tunnel goes through relay"})
+		return
+	}
+	fmt.Println(doctorResult{doctorOK, "link", fmt.Sprintf("try %s, then relay", strings.Join(modes, ", "))})
+}
+
+// handlePeerInfo queries the peer info from the server for doctor
+func handlePeerInfo(w http.ResponseWriter, r *http.Request) {
+	if GNetwork == nil || !GNetwork.online {
+		http.Error(w, "openp2p is not online", http.StatusServiceUnavailable)
+		return
+	}
+	config := AppConfig{PeerNode: r.URL.Query().Get("node"), peerToken: gConf.Network.Token}
+	if err := GNetwork.requestPeerInfo(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(QueryPeerInfoRsp{
+		PeerNode:        config.PeerNode,
+		Online:          1,
+		Version:         config.peerVersion,
+		NatType:         config.peerNatType,
+		IPv4:            config.peerIP,
+		LanIP:           config.peerLanIP,
+		HasIPv4:         config.hasIPv4,
+		IPv6:            config.peerIPv6,
+		HasUPNPorNATPMP: config.hasUPNPorNATPMP,
+	})
+}
+
+// probePathMTU finds the largest ICMP echo with DF answered by host, it requires root
+func probePathMTU(host string) (int, error) {
+	dst, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := net.ListenIP("ip4:icmp", &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if err = setDontFragment(rc); err != nil {
+		return 0, err
+	}
+	seq := 0
+	echo := func(size int) bool {
+		seq++
+		return pingDF(conn, dst, size, seq)
+	}
+	if !echo(mtuProbeMin) {
+		return 0, fmt.Errorf("no ICMP echo reply from %s", host)
+	}
+	lo, hi := mtuProbeMin, mtuProbeMax
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if echo(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// pingDF sends the echo of the ip packet size and waits the reply
+func pingDF(conn *net.IPConn, dst *net.IPAddr, size int, seq int) bool {
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: make([]byte, size-28)}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false
+	}
+	if _, err = conn.WriteTo(b, dst); err != nil { // EMSGSIZE when it exceeds the known path mtu
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout))
+	buf := make([]byte, mtuProbeMax)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		rm, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || rm.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if e, ok := rm.Body.(*icmp.Echo); ok && e.ID == id && e.Seq == seq {
+			return true
+		}
+	}
+}
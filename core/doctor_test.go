@@ -0,0 +1,44 @@
+package openp2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLinkModes(t *testing.T) {
+	old := gConf.Network
+	defer func() { gConf.Network = old }()
+	gConf.Network.HTTPProxy = ""
+	gConf.Network.publicIP = "1.2.3.4"
+	gConf.Network.hasIPv4 = 0
+	gConf.Network.hasUPNPorNATPMP = 0
+	gConf.Network.natType = NATSymmetric
+	gConf.setIPv6("")
+	cases := []struct {
+		config AppConfig
+		modes  []string
+	}{
+		{AppConfig{peerVersion: OpenP2PVersion, peerIP: "5.6.7.8", peerNatType: NATSymmetric}, []string{}},
+		{AppConfig{peerVersion: OpenP2PVersion, peerIP: "1.2.3.4", peerNatType: NATCone}, []string{LinkModeIntranet, LinkModeTCPPunch, LinkModeUDPPunch}},
+		{AppConfig{peerVersion: OpenP2PVersion, peerIP: "5.6.7.8", hasIPv4: 1, peerNatType: NATCone, PunchPriority: PunchPriorityUDPDisable}, []string{LinkModeTCP4, LinkModeTCPPunch}},
+		{AppConfig{peerVersion: OpenP2PVersion, peerIP: "5.6.7.8", hasIPv4: 1, UnderlayProtocol: "wss", peerNatType: NATSymmetric}, []string{LinkModeWSS, LinkModeTCP4}},
+	}
+	for i, c := range cases {
+		if modes := linkModes(&c.config); !reflect.DeepEqual(modes, c.modes) {
+			t.Errorf("case %d modes %v, want %v", i, modes, c.modes)
+		}
+	}
+	gConf.setIPv6("2001:db8::1")
+	c := AppConfig{peerVersion: OpenP2PVersion, peerIP: "5.6.7.8", peerIPv6: "2001:db8::2", peerNatType: NATSymmetric}
+	if modes := linkModes(&c); !reflect.DeepEqual(modes, []string{LinkModeTCP6}) {
+		t.Errorf("ipv6 modes %v", modes)
+	}
+	c = AppConfig{peerNatType: NATCone}
+	if n := linkModeRetry(&c, LinkModeUDPPunch); n != 1 {
+		t.Errorf("udp punch to cone from symmetric retry %d, want 1", n)
+	}
+	gConf.Network.natType = NATCone
+	if n := linkModeRetry(&c, LinkModeUDPPunch); n != Cone2ConeUDPPunchMaxRetry {
+		t.Errorf("cone to cone udp punch retry %d, want %d", n, Cone2ConeUDPPunchMaxRetry)
+	}
+}
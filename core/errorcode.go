@@ -30,4 +30,26 @@ var (
 	ErrBuildTunnelBusy       = errors.New("build tunnel busy")
 	ErrMemAppTunnelNotFound  = errors.New("memapp tunnel not found")
 	ErrRemoteServiceUnable   = errors.New("remote service unable")
+	ErrRelayQuotaExceeded    = errors.New("relay quota exceeded")
+	ErrRelayChainLoop        = errors.New("relay chain loop")
+	ErrRelayChainTooLong     = errors.New("relay chain too long")
+	ErrNoRelayCandidate      = errors.New("no relay candidate")
+	ErrWSSNotListen          = errors.New("wss not listen")
+	ErrStaticAuth            = errors.New("static sdwan auth error")
+	ErrTapUnsupported        = errors.New("tap mode is only supported on linux")
+	ErrMTUProbeUnsupported   = errors.New("path mtu probe is only supported on linux")
+	ErrSpeedTestDatagram     = errors.New("udp speedtest requires a direct quic tunnel")
+	ErrSpeedTestParam        = errors.New("wrong speedtest parameter")
+	ErrCtlNotRunning         = errors.New("openp2p is not running")
+	ErrConnectNodeTimeout    = errors.New("connect node timeout")
+	ErrReverseUDP            = errors.New("reverse app supports tcp only")
+	ErrBondPeerApp           = errors.New("bonding peer memapp not found")
+	ErrBondPath              = errors.New("bonding path not on the peer tunnels")
+	ErrRelayHopDenied        = errors.New("relay hop access denied")
+	ErrRelayHopTTL           = errors.New("relay hop ttl exceeded")
+	ErrWSSCert               = errors.New("wrong wss cert of the peer")
+	ErrProxyNotLoopback      = errors.New("netstack proxy must listen on loopback")
+	ErrNetstackNotSDWAN      = errors.New("netstack dials the sdwan only")
+	ErrStaticToken           = errors.New("static sdwan requires the token")
+	ErrNCNotRunning          = errors.New("openp2p is not running, start the daemon first")
 )
@@ -0,0 +1,264 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The exit node routes the whole internet traffic of the clients, its egress is masqueraded by initSNATRule.
+// The client routes 0.0.0.0/0 to tun with the policy routing, the underlay traffic to the server, proxy and
+// peers keeps using the main table:
+//
+//	6999: to <server/peer ip> lookup main
+//	7000: lookup main suppress_prefixlength 0   # the lan and sdwan routes, not the default route
+//	7001: lookup 7000                           # default dev optun for both ipv4 and ipv6
+//
+// The sdwan is ipv4 only, ipv6 is dropped by tun instead of leaking out of the physical interface. The
+// routes of table 7000 are removed with tun when the process is killed, then the rules fall through
+// to main, and the rules left by a crashed process are flushed at the next start.
+// The dns queries are forwarded to ExitDNS through the exit node.
+
+const (
+	exitRouteTable   = "7000"
+	exitBypassPrio   = "6999"
+	exitSuppressPrio = "7000"
+	exitTablePrio    = "7001"
+	defaultExitDNS   = "1.1.1.1"
+	ipForwardPath    = "/proc/sys/net/ipv4/ip_forward"
+)
+
+var ipForwardOld string // the ip_forward before enableExitForward, restored at exit
+
+type exitHop struct {
+	node       *sdwanNode
+	subnetNet  uint32
+	subnetMask uint32
+}
+
+type exitRoute struct {
+	hop    atomic.Pointer[exitHop] // nil if not using exit node, read by routeTunPacket
+	mtx    sync.Mutex
+	active bool // policy routing installed
+	bypass map[string]bool
+}
+
+func newExitRoute() *exitRoute {
+	return &exitRoute{bypass: make(map[string]bool)}
+}
+
+// findExitNode returns the designated exit node of the name
+func findExitNode(sdwan *SDWANInfo, name string) (*SDWANNode, error) {
+	for _, node := range sdwan.Nodes {
+		if node.Name != name {
+			continue
+		}
+		if node.ExitNode == 0 {
+			return nil, fmt.Errorf("node %s is not an exit node", name)
+		}
+		return node, nil
+	}
+	return nil, fmt.Errorf("exit node %s not found in sdwan", name)
+}
+
+// nextHop returns the exit node for the ipv4 dst out of sdwan, nil if not routed
+func (e *exitRoute) nextHop(dst uint32) *sdwanNode {
+	if e == nil {
+		return nil
+	}
+	hop := e.hop.Load()
+	if hop == nil || dst&hop.subnetMask == hop.subnetNet {
+		return nil
+	}
+	return hop.node
+}
+
+func (e *exitRoute) enabled() bool {
+	return e != nil && e.hop.Load() != nil
+}
+
+// addBypass keeps the underlay traffic to ip out of the tunnel
+func (e *exitRoute) addBypass(ip string) {
+	if e == nil || net.ParseIP(ip) == nil {
+		return
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.bypass[ip] {
+		return
+	}
+	e.bypass[ip] = true
+	if e.active {
+		addBypassRule(ip)
+	}
+}
+
+func ipCmd(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "-6"
+	}
+	return "-4"
+}
+
+func addBypassRule(ip string) {
+	if err := execCommand("ip", true, ipCmd(ip), "rule", "add", "to", ip, "lookup", "main", "priority", exitBypassPrio); err != nil {
+		gLog.Printf(LvWARN, "exit node bypass %s error:%s", ip, err)
+	}
+}
+
+// the server, http proxy and peers of the current tunnels
+func (e *exitRoute) collectBypass() {
+	if ips, err := net.LookupIP(gConf.Network.ServerHost); err == nil {
+		for _, ip := range ips {
+			e.addBypass(ip.String())
+		}
+	}
+	if gConf.Network.HTTPProxy != "" {
+		if u, err := url.Parse(gConf.Network.HTTPProxy); err == nil {
+			if ips, err := net.LookupIP(u.Hostname()); err == nil {
+				for _, ip := range ips {
+					e.addBypass(ip.String())
+				}
+			}
+		}
+	}
+	GNetwork.allTunnels.Range(func(id, i interface{}) bool {
+		t := i.(*P2PTunnel)
+		e.addBypass(t.config.peerIP)
+		e.addBypass(t.config.peerIPv6)
+		return true
+	})
+}
+
+// setup routes the internet traffic to the exit node
+func (e *exitRoute) setup(node *SDWANNode, subnet *net.IPNet, tunName string) error {
+	e.hop.Store(&exitHop{
+		node:       &sdwanNode{name: node.Name, id: NodeNameToID(node.Name)},
+		subnetNet:  binary.BigEndian.Uint32(subnet.IP.To4()),
+		subnetMask: binary.BigEndian.Uint32(subnet.Mask),
+	})
+	e.mtx.Lock()
+	active := e.active
+	e.mtx.Unlock()
+	if active || isNetstackMode() { // netstack routes the proxies by nextHop
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("exit node routing is not supported on %s, use netstack mode", runtime.GOOS)
+	}
+	e.collectBypass()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for ip := range e.bypass { // before the default route, or the underlay will be routed into tun
+		addBypassRule(ip)
+	}
+	e.active = true
+	cmds := [][]string{
+		{"-4", "route", "replace", "default", "dev", tunName, "table", exitRouteTable},
+		{"-6", "route", "replace", "default", "dev", tunName, "table", exitRouteTable},
+		{"-4", "rule", "add", "lookup", "main", "suppress_prefixlength", "0", "priority", exitSuppressPrio},
+		{"-6", "rule", "add", "lookup", "main", "suppress_prefixlength", "0", "priority", exitSuppressPrio},
+		{"-4", "rule", "add", "lookup", exitRouteTable, "priority", exitTablePrio},
+		{"-6", "rule", "add", "lookup", exitRouteTable, "priority", exitTablePrio},
+	}
+	for _, cmd := range cmds {
+		err := execCommand("ip", true, cmd...)
+		if err != nil && cmd[0] == "-6" { // ipv6 may be disabled
+			gLog.Printf(LvWARN, "exit node ip %s error:%s", strings.Join(cmd, " "), err)
+		} else if err != nil {
+			gLog.Printf(LvERROR, "exit node ip %s error:%s", strings.Join(cmd, " "), err)
+			e.clearLocked()
+			return err
+		}
+	}
+	gLog.Printf(LvINFO, "route internet traffic through exit node %s", node.Name)
+	return nil
+}
+
+func (e *exitRoute) clear() {
+	if e == nil {
+		return
+	}
+	e.hop.Store(nil)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.clearLocked()
+}
+
+func (e *exitRoute) clearLocked() {
+	if !e.active {
+		return
+	}
+	e.active = false
+	flushExitRules(false)
+	for ip := range e.bypass {
+		execCommand("ip", true, ipCmd(ip), "rule", "del", "to", ip, "lookup", "main", "priority", exitBypassPrio)
+	}
+	gLog.Printf(LvINFO, "exit node routing cleared")
+}
+
+// flushExitRules deletes the policy routing of exit node, with bypass the rules of every bypass ip too
+func flushExitRules(bypass bool) {
+	prios := []string{exitTablePrio, exitSuppressPrio}
+	if bypass {
+		prios = append(prios, exitBypassPrio)
+	}
+	for _, family := range []string{"-4", "-6"} {
+		for _, prio := range prios {
+			for i := 0; i < 256; i++ { // one rule per del
+				if execCommand("ip", true, family, "rule", "del", "priority", prio) != nil {
+					break
+				}
+			}
+		}
+		execCommand("ip", true, family, "route", "flush", "table", exitRouteTable)
+	}
+}
+
+// clearStale removes the exit node routing left by a crashed process
+func (e *exitRoute) clearStale() {
+	if runtime.GOOS != "linux" || isNetstackMode() {
+		return
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if !e.active {
+		flushExitRules(true)
+	}
+}
+
+// enableExitForward makes this node forward the internet traffic of the clients
+func enableExitForward() {
+	if runtime.GOOS != "linux" {
+		gLog.Printf(LvWARN, "exit node is not supported on %s", runtime.GOOS)
+		return
+	}
+	old, err := os.ReadFile(ipForwardPath)
+	if err == nil && strings.TrimSpace(string(old)) == "1" {
+		return
+	}
+	if err := execCommand("sysctl", true, "-w", "net.ipv4.ip_forward=1"); err != nil {
+		gLog.Printf(LvERROR, "enable ip forward error:%s", err)
+		return
+	}
+	if ipForwardOld == "" && len(old) > 0 {
+		ipForwardOld = strings.TrimSpace(string(old))
+	}
+}
+
+// restoreExitForward restores the ip_forward changed by enableExitForward
+func restoreExitForward() {
+	if ipForwardOld == "" {
+		return
+	}
+	if err := execCommand("sysctl", true, "-w", "net.ipv4.ip_forward="+ipForwardOld); err != nil {
+		gLog.Printf(LvERROR, "restore ip forward error:%s", err)
+	}
+	ipForwardOld = ""
+}
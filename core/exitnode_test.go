@@ -0,0 +1,51 @@
+package openp2p
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExitNextHop(t *testing.T) {
+	var nilRoute *exitRoute
+	if nilRoute.nextHop(0x08080808) != nil || nilRoute.enabled() {
+		t.Error("nil exit route should not route")
+	}
+	sdwan := &SDWANInfo{Nodes: []*SDWANNode{{Name: "office", IP: "10.2.3.1"}, {Name: "exit1", IP: "10.2.3.9", ExitNode: 1}}}
+	if _, err := findExitNode(sdwan, "office"); err == nil {
+		t.Error("not designated node should not be exit node")
+	}
+	if _, err := findExitNode(sdwan, "nonexist"); err == nil {
+		t.Error("nonexist node should not be exit node")
+	}
+	node, err := findExitNode(sdwan, "exit1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gConf.Network.SDWANMode = SDWANModeNetstack // no system route in test
+	defer func() { gConf.Network.SDWANMode = "" }()
+	_, subnet, _ := net.ParseCIDR("10.2.3.0/24")
+	e := newExitRoute()
+	if err = e.setup(node, subnet, "optun"); err != nil {
+		t.Fatal(err)
+	}
+	if hop := e.nextHop(0x08080808); hop == nil || hop.id != NodeNameToID("exit1") {
+		t.Errorf("internet traffic should be routed to exit node:%v", hop)
+	}
+	if e.nextHop(0x0a020305) != nil {
+		t.Error("sdwan subnet should not be routed to exit node")
+	}
+	e.clear()
+	if e.enabled() || e.nextHop(0x08080808) != nil {
+		t.Error("cleared exit route should not route")
+	}
+}
+
+func TestExitDNS(t *testing.T) {
+	d := newSDWANDNS()
+	d.update(&SDWANInfo{Name: "mynet"})
+	d.upstream = []string{"192.168.1.1:53"}
+	d.setExitDNS(defaultExitDNS)
+	if _, server, _ := d.answer(dnsQuery(t, "example.com.", 1), true); server != "1.1.1.1:53" {
+		t.Errorf("other names should be resolved through exit node:%s", server)
+	}
+}
@@ -0,0 +1,151 @@
+package openp2p
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The sdwan firewall rules allow forwarding through the tun and masquerade the traffic to the network
+// resources. The rules are kept in the manager and applied as a whole, so every change replaces the
+// rules of the backend atomically. nftables is preferred, iptables is the fallback.
+
+const firewallName = "OPSDWAN" // the iptables chain, lower case for nftables table
+
+type firewallRules struct {
+	tunName  string
+	forward  bool
+	localNet string   // the sdwan subnet
+	snat     []string // the other sources masqueraded out of non-tun
+}
+
+type firewall interface {
+	name() string
+	apply(rules *firewallRules) error
+	clear() error
+}
+
+type firewallManager struct {
+	mtx     sync.Mutex
+	backend firewall
+	rules   firewallRules
+}
+
+var gFirewall = &firewallManager{}
+
+// selectFirewall uses iptables when it's the legacy one, because the nftables accept can't override
+// the legacy FORWARD drop policy
+func selectFirewall() firewall {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	out, err := exec.Command("iptables", "-V").CombinedOutput()
+	hasIptables := err == nil
+	if hasIptables && strings.Contains(string(out), "legacy") {
+		return &iptablesFirewall{}
+	}
+	nft, err := newNFTFirewall()
+	if err == nil {
+		return nft
+	}
+	gLog.Printf(LvWARN, "nftables not available:%s", err)
+	if hasIptables {
+		return &iptablesFirewall{}
+	}
+	return nil
+}
+
+func (m *firewallManager) update(f func(rules *firewallRules)) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f(&m.rules)
+	if m.backend == nil {
+		m.backend = selectFirewall()
+		if m.backend == nil {
+			return fmt.Errorf("no firewall on %s", runtime.GOOS)
+		}
+		gLog.Printf(LvINFO, "firewall backend %s", m.backend.name())
+	}
+	rules := m.rules
+	rules.snat = append([]string(nil), m.rules.snat...)
+	if err := m.backend.apply(&rules); err != nil {
+		gLog.Printf(LvERROR, "firewall %s apply error:%s", m.backend.name(), err)
+		return err
+	}
+	return nil
+}
+
+// clearStale removes the rules of both backends left by a crashed process, called at start
+func (m *firewallManager) clearStale() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if nft, err := newNFTFirewall(); err == nil {
+		nft.clear()
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		(&iptablesFirewall{}).clear()
+	}
+}
+
+// cleanup removes all the rules, called on exit
+func (m *firewallManager) cleanup() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rules = firewallRules{}
+	if m.backend == nil {
+		return
+	}
+	if err := m.backend.clear(); err != nil {
+		gLog.Printf(LvWARN, "firewall %s clear error:%s", m.backend.name(), err)
+	}
+}
+
+func allowTunForward(tunName string) error {
+	if runtime.GOOS != "linux" { // only support Linux
+		return nil
+	}
+	return gFirewall.update(func(rules *firewallRules) {
+		rules.tunName = tunName
+		rules.forward = true
+	})
+}
+
+func clearSNATRule() error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	return gFirewall.update(func(rules *firewallRules) {
+		rules.localNet = ""
+		rules.snat = nil
+	})
+}
+
+func initSNATRule(tunName, localNet string) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	return gFirewall.update(func(rules *firewallRules) {
+		rules.tunName = tunName
+		rules.localNet = localNet
+		rules.snat = nil
+	})
+}
+
+func addSNATRule(target string) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	return gFirewall.update(func(rules *firewallRules) {
+		for _, s := range rules.snat {
+			if s == target {
+				return
+			}
+		}
+		rules.snat = append(rules.snat, target)
+	})
+}
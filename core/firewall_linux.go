@@ -0,0 +1,161 @@
+//go:build !android
+// +build !android
+
+package openp2p
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftFirewall owns the table "ip opsdwan" by netlink. Every apply deletes and recreates the table in one
+// batch, the kernel commits it as a transaction. An accept of this table doesn't override a drop of the
+// others at the same hook, so nftables isn't used when another forward chain drops by policy, like the
+// FORWARD of iptables-nft or firewalld.
+type nftFirewall struct {
+	table *nftables.Table
+}
+
+func newNFTFirewall() (firewall, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ListTablesOfFamily(nftables.TableFamilyIPv4); err != nil {
+		return nil, err
+	}
+	table := &nftables.Table{Name: strings.ToLower(firewallName), Family: nftables.TableFamilyIPv4}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	if chain := forwardDropChain(chains, table.Name); chain != "" {
+		return nil, fmt.Errorf("forward chain %s drops by policy", chain)
+	}
+	return &nftFirewall{table: table}, nil
+}
+
+// forwardDropChain returns the forward chain of other tables with drop policy
+func forwardDropChain(chains []*nftables.Chain, own string) string {
+	for _, c := range chains {
+		if c.Table == nil || c.Table.Name == own || c.Hooknum == nil || *c.Hooknum != *nftables.ChainHookForward {
+			continue
+		}
+		if c.Policy != nil && *c.Policy == nftables.ChainPolicyDrop {
+			return c.Table.Name + " " + c.Name
+		}
+	}
+	return ""
+}
+
+func (f *nftFirewall) name() string {
+	return "nftables"
+}
+
+// ifname is compared with the zero padded interface name
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+func matchIfname(key expr.MetaKey, name string, op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: ifname(name)},
+	}
+}
+
+// ip saddr (!=) cidr
+func matchSaddr(cidr string, op expr.CmpOp) ([]expr.Any, error) {
+	if !strings.Contains(cidr, "/") {
+		cidr += "/32"
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("wrong ipv4 cidr %s", cidr)
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ipnet.Mask, Xor: make([]byte, 4)},
+		&expr.Cmp{Op: op, Register: 1, Data: ipnet.IP.To4()},
+	}, nil
+}
+
+// masquerade when oifname oifOp tun and ip saddr sOp saddr
+type nftMasq struct {
+	oifOp expr.CmpOp
+	saddr string
+	sOp   expr.CmpOp
+}
+
+// nftRules generates the chains and their rules of the table
+func nftRules(table *nftables.Table, rules *firewallRules) ([]*nftables.Chain, []*nftables.Rule, error) {
+	chains := []*nftables.Chain{}
+	res := []*nftables.Rule{}
+	if rules.forward {
+		accept := nftables.ChainPolicyAccept
+		chain := &nftables.Chain{Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+			Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Policy: &accept}
+		chains = append(chains, chain)
+		for _, key := range []expr.MetaKey{expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME} {
+			exprs := append(matchIfname(key, rules.tunName, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictAccept})
+			res = append(res, &nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+		}
+	}
+	if rules.localNet != "" {
+		chain := &nftables.Chain{Name: "postrouting", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}
+		chains = append(chains, chain)
+		// to tun from the others, and out of tun from sdwan and the resources
+		masq := []nftMasq{{expr.CmpOpEq, rules.localNet, expr.CmpOpNeq}, {expr.CmpOpNeq, rules.localNet, expr.CmpOpEq}}
+		for _, target := range rules.snat {
+			masq = append(masq, nftMasq{expr.CmpOpNeq, target, expr.CmpOpEq})
+		}
+		for _, m := range masq {
+			saddr, err := matchSaddr(m.saddr, m.sOp)
+			if err != nil {
+				return nil, nil, err
+			}
+			exprs := append(matchIfname(expr.MetaKeyOIFNAME, rules.tunName, m.oifOp), saddr...)
+			res = append(res, &nftables.Rule{Table: table, Chain: chain, Exprs: append(exprs, &expr.Masq{})})
+		}
+	}
+	return chains, res, nil
+}
+
+func (f *nftFirewall) apply(rules *firewallRules) error {
+	chains, res, err := nftRules(f.table, rules)
+	if err != nil {
+		return err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	conn.AddTable(f.table) // make sure the table exists before deleting
+	conn.DelTable(f.table)
+	conn.AddTable(f.table)
+	for _, chain := range chains {
+		conn.AddChain(chain)
+	}
+	for _, r := range res {
+		conn.AddRule(r)
+	}
+	return conn.Flush()
+}
+
+func (f *nftFirewall) clear() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	conn.AddTable(f.table)
+	conn.DelTable(f.table)
+	return conn.Flush()
+}
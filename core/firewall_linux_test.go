@@ -0,0 +1,49 @@
+//go:build !android
+// +build !android
+
+package openp2p
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestNFTRules(t *testing.T) {
+	table := &nftables.Table{Name: "opsdwan", Family: nftables.TableFamilyIPv4}
+	chains, rules, err := nftRules(table, &firewallRules{tunName: "optun", forward: true, localNet: "10.2.3.0/24", snat: []string{"192.168.1.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 2 || chains[0].Name != "forward" || chains[1].Name != "postrouting" {
+		t.Fatalf("chains wrong:%v", chains)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("rules %d, want 2 forward and 3 masquerade", len(rules))
+	}
+	if v, ok := rules[0].Exprs[len(rules[0].Exprs)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictAccept || rules[0].Chain != chains[0] {
+		t.Errorf("forward rule wrong:%v", rules[0].Exprs)
+	}
+	for _, r := range rules[2:] {
+		if _, ok := r.Exprs[len(r.Exprs)-1].(*expr.Masq); !ok || r.Chain != chains[1] {
+			t.Errorf("masquerade rule wrong:%v", r.Exprs)
+		}
+	}
+	if _, _, err = nftRules(table, &firewallRules{tunName: "optun", localNet: "10.2.3.0/24", snat: []string{"wrong"}}); err == nil {
+		t.Error("wrong snat should fail")
+	}
+	drop, accept := nftables.ChainPolicyDrop, nftables.ChainPolicyAccept
+	foreign := []*nftables.Chain{
+		{Name: "forward", Table: table, Hooknum: nftables.ChainHookForward, Policy: &drop},
+		{Name: "INPUT", Table: &nftables.Table{Name: "filter"}, Hooknum: nftables.ChainHookInput, Policy: &drop},
+		{Name: "FORWARD", Table: &nftables.Table{Name: "filter"}, Hooknum: nftables.ChainHookForward, Policy: &accept},
+	}
+	if c := forwardDropChain(foreign, table.Name); c != "" {
+		t.Errorf("%s should be ignored", c)
+	}
+	foreign[2].Policy = &drop
+	if c := forwardDropChain(foreign, table.Name); c != "filter FORWARD" {
+		t.Errorf("drop chain wrong:%s", c)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || android
+// +build !linux android
+
+package openp2p
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newNFTFirewall() (firewall, error) {
+	return nil, fmt.Errorf("nftables not support %s", runtime.GOOS)
+}
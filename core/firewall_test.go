@@ -0,0 +1,62 @@
+package openp2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fakeFirewall struct {
+	applied []firewallRules
+}
+
+func (f *fakeFirewall) name() string {
+	return "fake"
+}
+
+func (f *fakeFirewall) apply(rules *firewallRules) error {
+	f.applied = append(f.applied, *rules)
+	return nil
+}
+
+func (f *fakeFirewall) clear() error {
+	f.applied = nil
+	return nil
+}
+
+func TestFirewallManager(t *testing.T) {
+	fake := &fakeFirewall{}
+	m := &firewallManager{backend: fake}
+	m.update(func(r *firewallRules) { r.tunName = "optun"; r.forward = true })
+	m.update(func(r *firewallRules) { r.localNet = "10.2.3.0/24" })
+	m.update(func(r *firewallRules) { r.snat = append(r.snat, "192.168.1.0/24") })
+	last := fake.applied[len(fake.applied)-1]
+	want := firewallRules{tunName: "optun", forward: true, localNet: "10.2.3.0/24", snat: []string{"192.168.1.0/24"}}
+	if !reflect.DeepEqual(last, want) {
+		t.Errorf("rules %+v, want %+v", last, want)
+	}
+	m.cleanup()
+	if len(fake.applied) != 0 || m.rules.forward {
+		t.Error("cleanup failed")
+	}
+}
+
+func TestIptablesRestoreInput(t *testing.T) {
+	rules := &firewallRules{tunName: "optun", forward: true, localNet: "10.2.3.0/24", snat: []string{"192.168.1.0/24"}}
+	want := "*filter\n:OPSDWANB - [0:0]\n-A OPSDWANB -i optun -j ACCEPT\n-A OPSDWANB -o optun -j ACCEPT\n" +
+		"-I FORWARD -j OPSDWANB\n-D FORWARD -j OPSDWAN\n-F OPSDWAN\n-X OPSDWAN\nCOMMIT\n"
+	if got := iptablesRestoreInput(rules, iptablesTables[0], "OPSDWAN"); got != want {
+		t.Errorf("swap to the other chain:\n%s", got)
+	}
+	want = "*nat\n:OPSDWAN - [0:0]\n-A OPSDWAN -o optun ! -s 10.2.3.0/24 -j MASQUERADE\n-A OPSDWAN ! -o optun -s 10.2.3.0/24 -j MASQUERADE\n" +
+		"-A OPSDWAN ! -o optun -s 192.168.1.0/24 -j MASQUERADE\n-A POSTROUTING -j OPSDWAN\nCOMMIT\n"
+	if got := iptablesRestoreInput(rules, iptablesTables[1], ""); got != want {
+		t.Errorf("first apply:\n%s", got)
+	}
+	rules.localNet = ""
+	if got := iptablesRestoreInput(rules, iptablesTables[1], "OPSDWANB"); got != "*nat\n-D POSTROUTING -j OPSDWANB\n-F OPSDWANB\n-X OPSDWANB\nCOMMIT\n" {
+		t.Errorf("remove the rules:\n%s", got)
+	}
+	if got := iptablesRestoreInput(rules, iptablesTables[1], ""); got != "" {
+		t.Errorf("nothing to do:\n%s", got)
+	}
+}
@@ -59,6 +59,27 @@ func handlePush(subType uint16, msg []byte) error {
 				GNetwork.push(r.From, MsgPushAddRelayTunnelRsp, "error") // compatible with old version client, trigger unmarshal error
 			}
 		}(req)
+	case MsgPushRelayHopReq:
+		req := RelayHopReq{}
+		if err = json.Unmarshal(msg[openP2PHeaderSize+PushHeaderSize:], &req); err != nil {
+			gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+			return err
+		}
+		go handleRelayHop(req)
+	case MsgPushRelayHopClose:
+		req := RelayHopClose{}
+		if err = json.Unmarshal(msg[openP2PHeaderSize+PushHeaderSize:], &req); err != nil {
+			gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+			return err
+		}
+		handleRelayHopClose(req)
+	case MsgPushRelayProbeReq:
+		req := RelayProbeReq{}
+		if err = json.Unmarshal(msg[openP2PHeaderSize+PushHeaderSize:], &req); err != nil {
+			gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+			return err
+		}
+		go handleRelayProbe(req)
 	case MsgPushServerSideSaveMemApp:
 		req := ServerSideSaveMemApp{}
 		if err = json.Unmarshal(msg[openP2PHeaderSize+PushHeaderSize:], &req); err != nil {
@@ -144,6 +165,8 @@ func handlePush(subType uint16, msg []byte) error {
 		err = handleLog(msg)
 	case MsgPushReportGoroutine:
 		err = handleReportGoroutine()
+	case MsgPushReportRelayUsage:
+		err = handleReportRelayUsage()
 	case MsgPushCheckRemoteService:
 		err = handleCheckRemoteService(msg)
 	case MsgPushEditApp:
@@ -218,6 +241,7 @@ func handleEditApp(msg []byte) (err error) {
 	newConf.SrcPort = newApp.SrcPort
 	newConf.RelayNode = newApp.SpecRelayNode
 	newConf.PunchPriority = newApp.PunchPriority
+	newConf.Bonding = newApp.Bonding
 	gConf.add(newConf, false)
 	if newApp.Protocol0 != "" && newApp.SrcPort0 != 0 { // not edit
 		GNetwork.DeleteApp(oldConf) // DeleteApp may cost some times, execute at the end
@@ -244,9 +268,7 @@ func handleConnectReq(msg []byte) (err error) {
 		GNetwork.push(req.From, MsgPushConnectRsp, rsp)
 		return ErrVersionNotCompatible
 	}
-	// verify totp token or token
-	t := totp.TOTP{Step: totp.RelayTOTPStep}
-	if t.Verify(req.Token, gConf.Network.Token, time.Now().Unix()-GNetwork.dt/int64(time.Second)) { // localTs may behind, auto adjust ts
+	if verifyRelayToken(req.Token) {
 		gLog.Printf(LvINFO, "Access Granted")
 		config := AppConfig{}
 		config.peerNatType = req.NatType
@@ -340,6 +362,7 @@ func handleReportApps() (err error) {
 			ConnectTime:   connectTime,
 			IsActive:      appActive,
 			Enabled:       config.Enabled,
+			Bonding:       config.Bonding,
 		}
 		req.Apps = append(req.Apps, appInfo)
 	}
@@ -480,3 +503,9 @@ func handleCheckRemoteService(msg []byte) (err error) {
 	}
 	return GNetwork.write(MsgReport, MsgReportResponse, rsp)
 }
+
+// verifyRelayToken accepts the token, or the relay totp token which the server gives to the nodes using this node
+func verifyRelayToken(token uint64) bool {
+	t := totp.TOTP{Step: totp.RelayTOTPStep}
+	return t.Verify(token, gConf.Network.Token, time.Now().Unix()-GNetwork.dt/int64(time.Second)) // localTs may behind, auto adjust ts
+}
@@ -1,74 +1,139 @@
 package openp2p
 
 import (
-	"log"
+	"fmt"
 	"os/exec"
-	"runtime"
+	"strings"
 )
 
-func allowTunForward() {
-	if runtime.GOOS != "linux" { // only support Linux
-		return
-	}
-	exec.Command("sh", "-c", `iptables -t filter -D FORWARD -i optun -j ACCEPT`).Run()
-	exec.Command("sh", "-c", `iptables -t filter -D FORWARD -o optun -j ACCEPT`).Run()
-	err := exec.Command("sh", "-c", `iptables -t filter -I FORWARD -i optun -j ACCEPT`).Run()
+// iptablesFirewall puts the rules in its own chains, jumped from FORWARD and POSTROUTING.
+// Every apply fills the other one of the two chains and swaps the jump to it in one iptables-restore
+// transaction per table, so a failed apply keeps the old rules.
+type iptablesFirewall struct{}
+
+var iptablesChains = []string{firewallName, firewallName + "B"}
+
+type iptablesTable struct {
+	name string
+	hook string
+}
+
+var iptablesTables = []iptablesTable{{"filter", "FORWARD"}, {"nat", "POSTROUTING"}}
+
+func (f *iptablesFirewall) name() string {
+	return "iptables"
+}
+
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
 	if err != nil {
-		log.Println("allow foward in error:", err)
+		return fmt.Errorf("iptables %s error:%s %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
 	}
-	err = exec.Command("sh", "-c", `iptables -t filter -I FORWARD -o optun -j ACCEPT`).Run()
+	return nil
+}
+
+func iptablesRestore(input string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Println("allow foward out error:", err)
+		return fmt.Errorf("iptables-restore error:%s %s", err, strings.TrimSpace(string(out)))
 	}
+	return nil
 }
 
-func clearSNATRule() {
-	if runtime.GOOS != "linux" {
-		return
+// iptablesRules is the rules of the table in the chain, without the jump
+func iptablesRules(rules *firewallRules, table, chain string) (lines []string) {
+	switch table {
+	case "filter":
+		if rules.forward {
+			lines = append(lines,
+				fmt.Sprintf("-A %s -i %s -j ACCEPT", chain, rules.tunName),
+				fmt.Sprintf("-A %s -o %s -j ACCEPT", chain, rules.tunName))
+		}
+	case "nat":
+		if rules.localNet != "" {
+			lines = append(lines,
+				fmt.Sprintf("-A %s -o %s ! -s %s -j MASQUERADE", chain, rules.tunName, rules.localNet),
+				fmt.Sprintf("-A %s ! -o %s -s %s -j MASQUERADE", chain, rules.tunName, rules.localNet))
+			for _, target := range rules.snat {
+				lines = append(lines, fmt.Sprintf("-A %s ! -o %s -s %s -j MASQUERADE", chain, rules.tunName, target))
+			}
+		}
 	}
-	execCommand("iptables", true, "-t", "nat", "-D", "POSTROUTING", "-j", "OPSDWAN")
-	execCommand("iptables", true, "-t", "nat", "-F", "OPSDWAN")
-	execCommand("iptables", true, "-t", "nat", "-X", "OPSDWAN")
+	return
 }
 
-func initSNATRule(localNet string) {
-	if runtime.GOOS != "linux" {
-		return
+// iptablesRestoreInput swaps the jump from the active chain old ("" if none) to the new rules.
+// It returns "" if nothing to do
+func iptablesRestoreInput(rules *firewallRules, t iptablesTable, old string) string {
+	next := iptablesChains[0]
+	if old == next {
+		next = iptablesChains[1]
 	}
-	clearSNATRule()
-
-	err := execCommand("iptables", true, "-t", "nat", "-N", "OPSDWAN")
-	if err != nil {
-		log.Println("iptables new sdwan chain error:", err)
-		return
+	lines := iptablesRules(rules, t.name, next)
+	if len(lines) == 0 && old == "" {
+		return ""
 	}
-	err = execCommand("iptables", true, "-t", "nat", "-A", "POSTROUTING", "-j", "OPSDWAN")
-	if err != nil {
-		log.Println("iptables append postrouting error:", err)
-		return
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "*%s\n", t.name)
+	if len(lines) > 0 {
+		fmt.Fprintf(b, ":%s - [0:0]\n", next) // flushes the stale one
+		for _, l := range lines {
+			b.WriteString(l + "\n")
+		}
+		if t.name == "filter" {
+			fmt.Fprintf(b, "-I %s -j %s\n", t.hook, next)
+		} else {
+			fmt.Fprintf(b, "-A %s -j %s\n", t.hook, next)
+		}
 	}
-	err = execCommand("iptables", true, "-t", "nat", "-A", "OPSDWAN",
-		"-o", "optun", "!", "-s", localNet, "-j", "MASQUERADE")
-	if err != nil {
-		log.Println("add optun snat error:", err)
-		return
+	if old != "" {
+		fmt.Fprintf(b, "-D %s -j %s\n-F %s\n-X %s\n", t.hook, old, old, old)
 	}
-	err = execCommand("iptables", true, "-t", "nat", "-A", "OPSDWAN", "!", "-o", "optun",
-		"-s", localNet, "-j", "MASQUERADE")
-	if err != nil {
-		log.Println("add optun snat error:", err)
-		return
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// activeChain is the chain jumped from the hook, "" if none
+func (f *iptablesFirewall) activeChain(t iptablesTable) string {
+	for _, chain := range iptablesChains {
+		if iptables("-t", t.name, "-C", t.hook, "-j", chain) == nil {
+			return chain
+		}
 	}
+	return ""
 }
 
-func addSNATRule(target string) {
-	if runtime.GOOS != "linux" {
-		return
+func (f *iptablesFirewall) apply(rules *firewallRules) error {
+	for _, t := range iptablesTables {
+		input := iptablesRestoreInput(rules, t, f.activeChain(t))
+		if input == "" {
+			continue
+		}
+		if err := iptablesRestore(input); err != nil {
+			return err
+		}
 	}
-	err := execCommand("iptables", true, "-t", "nat", "-A", "OPSDWAN", "!", "-o", "optun",
-		"-s", target, "-j", "MASQUERADE")
-	if err != nil {
-		log.Println("iptables add optun snat error:", err)
-		return
+	return nil
+}
+
+func (f *iptablesFirewall) clear() error {
+	var err error
+	for _, t := range iptablesTables {
+		for _, chain := range iptablesChains {
+			if iptables("-t", t.name, "-L", chain, "-n") != nil { // not exist
+				continue
+			}
+			for iptables("-t", t.name, "-D", t.hook, "-j", chain) == nil {
+			}
+			if e := iptables("-t", t.name, "-F", chain); e != nil {
+				err = e
+			}
+			if e := iptables("-t", t.name, "-X", chain); e != nil {
+				err = e
+			}
+		}
 	}
+	return err
 }
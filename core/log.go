@@ -95,6 +95,13 @@ func (l *logger) setLevel(level LogLevel) {
 	l.level = level
 }
 
+// enabled reports whether the level will be logged, check it before building params in the hot path
+func (l *logger) enabled(level LogLevel) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return level >= l.level
+}
+
 func (l *logger) setMaxSize(size int64) {
 	l.mtx.Lock()
 	defer l.mtx.Unlock()
@@ -191,3 +191,17 @@ func publicIPTest(publicIP string, echoPort int) (hasPublicIP int, hasUPNPorNATP
 	}
 	return
 }
+
+// addTCPPortMapping maps the tcp port on the UPNP or NAT-PMP router to the same port
+func addTCPPortMapping(port int) bool {
+	nat, err := Discover()
+	if err != nil || nat == nil {
+		gLog.Println(LvDEBUG, "could not perform UPNP discover:", err)
+		return false
+	}
+	if _, err = nat.AddPortMapping("tcp", port, port, "openp2p", 604800); err != nil { // 7 days for tcp connection
+		gLog.Printf(LvERROR, "could not add tcp UPNP port mapping %d:%s", port, err)
+		return false
+	}
+	return true
+}
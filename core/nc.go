@@ -0,0 +1,159 @@
+package openp2p
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// "openp2p nc HOST PORT" pipes stdin and stdout to a tcp port on the node over an overlay connection, for
+// ssh -o ProxyCommand='openp2p nc %h %p'. The running node hijacks the control api request as the local end
+// of the connection, like the tcp connection accepted by an app. Without an app to the node, an ephemeral
+// app is added for the connections and deleted with the last one, its id differs from the memapp of the
+// node. nc requires the running node.
+
+const (
+	ncConnectTimeout = time.Second * 30
+	ncAppName        = "nc"
+)
+
+var (
+	ncMtx  sync.Mutex
+	ncRefs = make(map[string]int) // the connections of the ephemeral apps by node
+)
+
+func init() {
+	ctlHandle("/nc", handleNC)
+}
+
+// ncApp finds the app to the node or adds an ephemeral one, and waits for its tunnel.
+// release is called when the connection ends
+func ncApp(ctx context.Context, node string) (*p2pApp, func(), error) {
+	release := func() {}
+	if app, t := peerTunnel(node); app != nil && t != nil {
+		return app, release, nil
+	}
+	config := AppConfig{Enabled: 1, AppName: ncAppName, PeerNode: node, Protocol: "tcp", peerToken: gConf.Network.Token}
+	ncMtx.Lock()
+	i, ok := GNetwork.apps.Load(config.ID())
+	if !ok {
+		if err := GNetwork.AddApp(config); err != nil {
+			ncMtx.Unlock()
+			return nil, release, err
+		}
+		i, _ = GNetwork.apps.Load(config.ID())
+	}
+	ncRefs[node]++
+	release = func() {
+		ncMtx.Lock()
+		defer ncMtx.Unlock()
+		if ncRefs[node]--; ncRefs[node] == 0 {
+			delete(ncRefs, node)
+			GNetwork.DeleteApp(config)
+		}
+	}
+	ncMtx.Unlock()
+	app := i.(*p2pApp)
+	timeout := time.After(ncConnectTimeout)
+	for app.Tunnel() == nil {
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, func() {}, ctx.Err()
+		case <-timeout:
+			release()
+			if app.config.errMsg != "" {
+				return nil, func() {}, fmt.Errorf("%w: %s", ErrConnectNodeTimeout, app.config.errMsg)
+			}
+			return nil, func() {}, ErrConnectNodeTimeout
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+	return app, release, nil
+}
+
+// handleNC connects the hijacked request to host:port on the node until either side closes
+func handleNC(w http.ResponseWriter, r *http.Request) {
+	if GNetwork == nil || !GNetwork.online {
+		http.Error(w, "openp2p is not online", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	node, host := q.Get("node"), q.Get("host")
+	port, _ := strconv.Atoi(q.Get("port"))
+	if node == "" || host == "" || port <= 0 || port > 65535 {
+		http.Error(w, "wrong node, host or port", http.StatusBadRequest)
+		return
+	}
+	app, release, err := ncApp(r.Context(), node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	defer release()
+	conn, err := ctlHijack(w)
+	if err != nil {
+		gLog.Printf(LvERROR, "nc hijack error:%s", err)
+		return
+	}
+	gLog.Printf(LvINFO, "nc to %s %s:%d start", node, host, port)
+	defer gLog.Printf(LvINFO, "nc to %s %s:%d end", node, host, port)
+	app.newOverlayConn(conn, host, port).run()
+}
+
+// ncPipe copies stdin to the connection and the connection to stdout
+func ncPipe(conn io.ReadWriteCloser) {
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+	conn.Close()
+}
+
+func ncCmd(args []string) {
+	fset := flag.NewFlagSet("nc", flag.ExitOnError)
+	node := fset.String("node", "", "connect HOST through this node, default HOST is the node and connect its localhost")
+	fset.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: openp2p nc [-node NODE] HOST PORT")
+		fmt.Fprintf(os.Stderr, "  ssh -o ProxyCommand='openp2p nc %%h %%p' user@NODE\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	host := fset.Arg(0)
+	port, err := strconv.Atoi(fset.Arg(1))
+	if err != nil {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if *node == "" {
+		*node, host = host, "127.0.0.1"
+	}
+	gLog.setMode(LogFile) // stdout is the connection
+	gConf.load()
+	query := url.Values{}
+	query.Set("node", *node)
+	query.Set("host", host)
+	query.Set("port", strconv.Itoa(port))
+	conn, err := ctlDial("/nc", query)
+	if errors.Is(err, ErrCtlNotRunning) {
+		err = ErrNCNotRunning
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nc error:", err)
+		os.Exit(1)
+	}
+	ncPipe(conn)
+}
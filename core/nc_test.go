@@ -0,0 +1,82 @@
+package openp2p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCtlDial(t *testing.T) {
+	ctlHandle("/test/echo", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ctlHijack(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	oldPath := ctlSecretPath
+	defer func() { ctlSecretPath = oldPath }()
+	ctlSecretPath = filepath.Join(t.TempDir(), "ctl.secret")
+	if _, err = ctlDial("/test/echo", nil); !errors.Is(err, ErrCtlNotRunning) {
+		t.Errorf("no secret error %v", err)
+	}
+	if err = initCtlSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(ctlSecretPath); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("secret file mode %v %v", fi.Mode(), err)
+	}
+	go http.Serve(l, ctlMux)
+	old := gConf.Network.CtlPort
+	defer func() { gConf.Network.CtlPort = old }()
+	gConf.Network.CtlPort = l.Addr().(*net.TCPAddr).Port
+	conn, err := ctlDial("/test/echo", url.Values{"node": {"NAS1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("SSH-2.0-OpenSSH")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 15)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-OpenSSH" {
+		t.Errorf("echo %q %v", buf, err)
+	}
+	conn.Close()
+	if _, err = ctlDial("/test/none", nil); err == nil || errors.Is(err, ErrCtlNotRunning) {
+		t.Errorf("not found error %v", err)
+	}
+	os.WriteFile(ctlSecretPath, []byte("wrong"), 0600)
+	if _, err = ctlDial("/test/echo", nil); err == nil || errors.Is(err, ErrCtlNotRunning) {
+		t.Errorf("wrong secret error %v", err)
+	}
+	closed, _ := net.Listen("tcp4", "127.0.0.1:0")
+	closed.Close()
+	gConf.Network.CtlPort = closed.Addr().(*net.TCPAddr).Port
+	if _, err = ctlDial("/test/echo", nil); !errors.Is(err, ErrCtlNotRunning) {
+		t.Errorf("not running error %v", err)
+	}
+}
+
+func TestNCAppID(t *testing.T) {
+	memapp := AppConfig{PeerNode: "NAS1"}
+	nc := AppConfig{AppName: ncAppName, PeerNode: "NAS1", Protocol: "tcp"}
+	if nc.ID() == memapp.ID() || nc.ID() != (&AppConfig{AppName: ncAppName, PeerNode: "NAS1"}).ID() {
+		t.Errorf("nc app id %d, memapp id %d", nc.ID(), memapp.ID())
+	}
+	if !memapp.isMemApp() || nc.isMemApp() {
+		t.Error("only the memapp is memapp")
+	}
+}
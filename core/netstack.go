@@ -0,0 +1,401 @@
+package openp2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// The netstack mode runs the sdwan virtual network in userspace with gVisor, it needs neither root nor TUN.
+// The applications reach the virtual network through the local SOCKS5/HTTP proxies and port forwards,
+// the TCP connections and UDP flows from the virtual network to the exposed ports of this node are forwarded
+// to localhost. The proxies listen on loopback only and dial nothing outside the sdwan, so they don't turn the
+// node into an open proxy.
+
+const (
+	SDWANModeTUN       = "tun"
+	SDWANModeNetstack  = "netstack"
+	netstackNICID      = 1
+	netstackMTU        = 1420
+	netstackQueueSize  = 1024
+	netstackUDPTimeout = time.Minute // an exposed udp flow is closed when both directions are idle
+)
+
+type netstackTun struct {
+	stack     *stack.Stack
+	ep        *channel.Endpoint
+	ctx       context.Context
+	cancel    context.CancelFunc
+	localIP   net.IP
+	routable  func(net.IP) bool // the ip is in the sdwan
+	expose    map[uint16]bool
+	listeners []net.Listener
+	lookup    func(string) net.IP // resolve the sdwan node names
+}
+
+func newNetstackTun(localIP net.IP, routable func(net.IP) bool) (*netstackTun, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+	ep := channel.New(netstackQueueSize, netstackMTU, "")
+	if err := s.CreateNIC(netstackNICID, ep); err != nil {
+		return nil, fmt.Errorf("netstack create nic error:%s", err)
+	}
+	addr := tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: tcpip.AddrFromSlice(localIP.To4()).WithPrefix()}
+	if err := s.AddProtocolAddress(netstackNICID, addr, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("netstack add address %s error:%s", localIP, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: netstackNICID}})
+	ns := &netstackTun{stack: s, ep: ep, localIP: localIP, routable: routable, expose: parseExposePorts(gConf.Network.Expose)}
+	ns.ctx, ns.cancel = context.WithCancel(context.Background())
+	fwd := tcp.NewForwarder(s, 0, 1024, ns.forwardTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, ns.forwardUDP).HandlePacket)
+	return ns, nil
+}
+
+// Read the packets sent by the userspace stack, they are routed to the sdwan nodes
+func (ns *netstackTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	pkt := ns.ep.ReadContext(ns.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for pkt != nil {
+		view := pkt.ToView()
+		sizes[n] = copy(bufs[n][offset:], view.AsSlice())
+		view.Release()
+		pkt.DecRef()
+		n++
+		if n == len(bufs) {
+			break
+		}
+		pkt = ns.ep.Read()
+	}
+	return n, nil
+}
+
+// Write the packets from the sdwan nodes into the userspace stack
+func (ns *netstackTun) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		p := buf[offset:]
+		if len(p) == 0 {
+			continue
+		}
+		proto := ipv4.ProtocolNumber
+		if p[0]>>4 == 6 {
+			proto = ipv6.ProtocolNumber
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(p)}) // copied
+		ns.ep.InjectInbound(proto, pkt)
+		pkt.DecRef()
+	}
+	return len(bufs), nil
+}
+
+func (ns *netstackTun) Close() error {
+	ns.cancel()
+	for _, ln := range ns.listeners {
+		ln.Close()
+	}
+	ns.ep.Close()
+	ns.stack.Close()
+	return nil
+}
+
+// DialContext connects the address in the sdwan through the userspace stack, others are refused
+func (ns *netstackTun) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("wrong port %s", portStr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil && ns.lookup != nil {
+		ip = ns.lookup(host)
+	}
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	if !ns.routable(ip) {
+		return nil, fmt.Errorf("%w: %s", ErrNetstackNotSDWAN, ip)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("sdwan not support ipv6 %s", ip)
+	}
+	fa := tcpip.FullAddress{NIC: netstackNICID, Addr: tcpip.AddrFromSlice(ip.To4()), Port: uint16(port)}
+	switch network {
+	case "tcp", "tcp4":
+		c, err := gonet.DialContextTCP(ctx, ns.stack, fa, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "udp", "udp4":
+		c, err := gonet.DialUDP(ns.stack, nil, &fa, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("netstack not support network %s", network)
+}
+
+// ListenPacket listens udp on the virtual ip in the userspace stack
+func (ns *netstackTun) ListenPacket(address string) (net.PacketConn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("wrong port %s", portStr)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("wrong ipv4 %s", host)
+	}
+	fa := tcpip.FullAddress{NIC: netstackNICID, Addr: tcpip.AddrFromSlice(ip), Port: uint16(port)}
+	c, err := gonet.DialUDP(ns.stack, &fa, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// forward the connections from the sdwan to the exposed local ports
+func (ns *netstackTun) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	if !ns.expose[id.LocalPort] {
+		r.Complete(true)
+		return
+	}
+	local, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(id.LocalPort))), ReadMsgTimeout)
+	if err != nil {
+		gLog.Printf(LvDEBUG, "netstack forward %s:%d to local error:%s", id.RemoteAddress, id.LocalPort, err)
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		gLog.Printf(LvDEBUG, "netstack create endpoint error:%s", tcpErr)
+		r.Complete(true)
+		local.Close()
+		return
+	}
+	r.Complete(false)
+	gLog.Printf(LvDEBUG, "netstack forward %s to local port %d", id.RemoteAddress, id.LocalPort)
+	pipeConn(gonet.NewTCPConn(&wq, ep), local)
+}
+
+// forward the udp flows from the sdwan to the exposed local ports
+func (ns *netstackTun) forwardUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	if !ns.expose[id.LocalPort] {
+		return
+	}
+	local, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(id.LocalPort))))
+	if err != nil {
+		gLog.Printf(LvDEBUG, "netstack forward udp %s:%d to local error:%s", id.RemoteAddress, id.LocalPort, err)
+		return
+	}
+	var wq waiter.Queue
+	ep, udpErr := r.CreateEndpoint(&wq)
+	if udpErr != nil {
+		gLog.Printf(LvDEBUG, "netstack create udp endpoint error:%s", udpErr)
+		local.Close()
+		return
+	}
+	gLog.Printf(LvDEBUG, "netstack forward udp %s to local port %d", id.RemoteAddress, id.LocalPort)
+	go pipeUDP(gonet.NewUDPConn(ns.stack, &wq, ep), local, netstackUDPTimeout)
+}
+
+// pipeUDP copies the datagrams of both directions until they are idle for timeout
+func pipeUDP(a, b net.Conn, timeout time.Duration) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	var active atomic.Int64
+	active.Store(time.Now().UnixNano())
+	copyUDP := func(dst, src net.Conn) {
+		buf := make([]byte, 65536)
+		for {
+			src.SetReadDeadline(time.Now().Add(timeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				// the other direction may be still active
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Now().UnixNano()-active.Load() < int64(timeout) {
+					continue
+				}
+				break
+			}
+			active.Store(time.Now().UnixNano())
+			if _, err = dst.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		once.Do(closeBoth)
+	}
+	go copyUDP(a, b)
+	copyUDP(b, a)
+}
+
+// pipeConn copies both directions until one of them closed
+func pipeConn(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
+
+// "22,80" to port set
+func parseExposePorts(s string) map[uint16]bool {
+	ports := make(map[uint16]bool)
+	for _, p := range strings.Split(s, ",") {
+		if port, err := strconv.Atoi(strings.TrimSpace(p)); err == nil && port > 0 && port < 65536 {
+			ports[uint16(port)] = true
+		}
+	}
+	return ports
+}
+
+type portForward struct {
+	listen string
+	target string
+}
+
+// "127.0.0.1:2222=10.2.3.4:22,8080=10.2.3.5:80", the listen address without host is on 127.0.0.1
+func parsePortForwards(s string) ([]portForward, error) {
+	res := []portForward{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		arr := strings.Split(item, "=")
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("wrong forward %s", item)
+		}
+		if !strings.Contains(arr[0], ":") {
+			arr[0] = "127.0.0.1:" + arr[0]
+		}
+		if _, _, err := net.SplitHostPort(arr[0]); err != nil {
+			return nil, fmt.Errorf("wrong forward %s:%s", item, err)
+		}
+		if _, _, err := net.SplitHostPort(arr[1]); err != nil {
+			return nil, fmt.Errorf("wrong forward %s:%s", item, err)
+		}
+		res = append(res, portForward{listen: arr[0], target: arr[1]})
+	}
+	return res, nil
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func servePortForward(ln net.Listener, target string, dial dialFunc) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			gLog.Printf(LvERROR, "port forward %s accept error:%s", ln.Addr(), err)
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), ReadMsgTimeout)
+			defer cancel()
+			remote, err := dial(ctx, "tcp", target)
+			if err != nil {
+				gLog.Printf(LvDEBUG, "port forward to %s error:%s", target, err)
+				c.Close()
+				return
+			}
+			pipeConn(c, remote)
+		}()
+	}
+}
+
+// listenProxy listens the proxy on loopback only, ":1080" listens on all interfaces and is refused
+func listenProxy(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, ErrProxyNotLoopback
+	}
+	return net.Listen("tcp", addr)
+}
+
+// start the local proxies and port forwards into the sdwan
+func (ns *netstackTun) serve() {
+	if gConf.Network.SOCKS5 != "" {
+		if ln, err := listenProxy(gConf.Network.SOCKS5); err != nil {
+			gLog.Printf(LvERROR, "socks5 listen %s error:%s", gConf.Network.SOCKS5, err)
+		} else {
+			gLog.Printf(LvINFO, "netstack socks5 proxy on %s", gConf.Network.SOCKS5)
+			ns.listeners = append(ns.listeners, ln)
+			go serveSOCKS5(ln, ns.DialContext)
+		}
+	}
+	if gConf.Network.HTTPListen != "" {
+		if ln, err := listenProxy(gConf.Network.HTTPListen); err != nil {
+			gLog.Printf(LvERROR, "http proxy listen %s error:%s", gConf.Network.HTTPListen, err)
+		} else {
+			gLog.Printf(LvINFO, "netstack http proxy on %s", gConf.Network.HTTPListen)
+			ns.listeners = append(ns.listeners, ln)
+			go serveHTTPProxy(ln, ns.DialContext)
+		}
+	}
+	forwards, err := parsePortForwards(gConf.Network.Forwards)
+	if err != nil {
+		gLog.Printf(LvERROR, "parse forwards error:%s", err)
+	}
+	for _, f := range forwards {
+		ln, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			gLog.Printf(LvERROR, "port forward listen %s error:%s", f.listen, err)
+			continue
+		}
+		gLog.Printf(LvINFO, "netstack port forward %s to %s", f.listen, f.target)
+		ns.listeners = append(ns.listeners, ln)
+		go servePortForward(ln, f.target, ns.DialContext)
+	}
+}
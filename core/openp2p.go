@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -14,7 +16,8 @@ var GNetwork *P2PNetwork
 func Run() {
 	rand.Seed(time.Now().UnixNano())
 	baseDir := filepath.Dir(os.Args[0])
-	os.Chdir(baseDir) // for system service
+	workDir, _ := os.Getwd() // the relative paths of the commands
+	os.Chdir(baseDir)        // for system service
 	gLog = NewLogger(baseDir, ProductName, LvDEBUG, 1024*1024, LogFile|LogConsole)
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
@@ -27,6 +30,24 @@ func Run() {
 		case "uninstall":
 			uninstall()
 			return
+		case "capture":
+			captureCmd(os.Args[2:], workDir)
+			return
+		case "doctor":
+			doctorCmd(os.Args[2:])
+			return
+		case "status":
+			statusCmd(os.Args[2:])
+			return
+		case "ping":
+			pingCmd(os.Args[2:])
+			return
+		case "speedtest":
+			speedtestCmd(os.Args[2:])
+			return
+		case "nc":
+			ncCmd(os.Args[2:])
+			return
 		}
 	} else {
 		installByFilename()
@@ -43,6 +64,7 @@ func Run() {
 
 	gLog.Println(LvINFO, &gConf)
 	setFirewall()
+	gFirewall.clearStale()
 	err := setRLimit()
 	if err != nil {
 		gLog.Println(LvINFO, "setRLimit error:", err)
@@ -53,8 +75,7 @@ func Run() {
 		return
 	}
 	// gLog.Println(LvINFO, "waiting for connection...")
-	forever := make(chan bool)
-	<-forever
+	waitForExit()
 }
 
 // for Android app
@@ -97,6 +118,7 @@ func RunCmd(cmd string) {
 
 	parseParams("", cmd)
 	setFirewall()
+	gFirewall.clearStale()
 	err := setRLimit()
 	if err != nil {
 		gLog.Println(LvINFO, "setRLimit error:", err)
@@ -106,8 +128,7 @@ func RunCmd(cmd string) {
 		gLog.Println(LvERROR, "P2PNetwork login error")
 		return
 	}
-	forever := make(chan bool)
-	<-forever
+	waitForExit()
 }
 
 func GetToken(baseDir string) string {
@@ -116,6 +137,30 @@ func GetToken(baseDir string) string {
 	return fmt.Sprintf("%d", gConf.Network.Token)
 }
 
+// waitForExit blocks until killed, the system settings are restored before exit
+func waitForExit() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	gLog.Printf(LvINFO, "openp2p exit by %s", sig)
+	cleanupSystem()
+	os.Exit(0)
+}
+
+// cleanupSystem removes the routes, dns and firewall rules set by sdwan
+func cleanupSystem() {
+	if GNetwork != nil && GNetwork.sdwan != nil {
+		GNetwork.sdwan.exit.clear()
+		if GNetwork.sdwan.dns != nil {
+			GNetwork.sdwan.dns.stop()
+		}
+		GNetwork.sdwan.stopReflector()
+	}
+	restoreExitForward()
+	gFirewall.cleanup()
+}
+
 func Stop() {
+	cleanupSystem()
 	os.Exit(0)
 }
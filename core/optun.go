@@ -9,10 +9,63 @@ var AndroidSDWANConfig chan []byte
 type optun struct {
 	tunName string
 	dev     tun.Device
+	queues  []tun.Device // multi-queue devices, queues[0] is dev
+	ns      *netstackTun // userspace netstack instead of the tun device
+	tap     *tapDevice   // layer 2 tap instead of the tun device
+	vnetHdr int          // headroom of the virtio net header, linux only
+}
+
+// headroom is the offset of the ip packet in the read and write buffers
+func (t *optun) headroom() int {
+	return PIHeaderSize + t.vnetHdr
+}
+
+func (t *optun) queueNum() int {
+	if len(t.queues) == 0 {
+		return 1
+	}
+	return len(t.queues)
+}
+
+// packets per read or write, the device supports large batch when offloads are enabled
+func (t *optun) batchSize() int {
+	if t.dev != nil && t.dev.BatchSize() > ReadTunBuffNum {
+		return t.dev.BatchSize()
+	}
+	return ReadTunBuffNum
+}
+
+func (t *optun) readQueue(q int, bufs [][]byte, sizes []int, offset int) (int, error) {
+	if t.ns != nil {
+		return t.ns.Read(bufs, sizes, offset)
+	}
+	if q == 0 || q >= len(t.queues) {
+		return t.Read(bufs, sizes, offset)
+	}
+	return t.queues[q].Read(bufs, sizes, offset)
+}
+
+func (t *optun) writeQueue(q int, bufs [][]byte, offset int) (int, error) {
+	if t.ns != nil {
+		return t.ns.Write(bufs, offset)
+	}
+	if q == 0 || q >= len(t.queues) {
+		return t.Write(bufs, offset)
+	}
+	return t.queues[q].Write(bufs, offset)
 }
 
 func (t *optun) Stop() error {
+	if t.ns != nil {
+		return t.ns.Close()
+	}
+	if t.tap != nil {
+		return t.tap.Close()
+	}
 	t.dev.Close()
+	for i := 1; i < len(t.queues); i++ {
+		t.queues[i].Close()
+	}
 	return nil
 }
 func init() {
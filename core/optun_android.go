@@ -27,9 +27,14 @@ func (t *optun) Read(bufs [][]byte, sizes []int, offset int) (n int, err error)
 	return 1, nil
 }
 
+// the buffers are reused after Write returned, copy them
 func (t *optun) Write(bufs [][]byte, offset int) (int, error) {
-	AndroidWriteTun <- bufs[0]
-	return len(bufs[0]), nil
+	for _, buf := range bufs {
+		p := make([]byte, len(buf)-offset)
+		copy(p, buf[offset:])
+		AndroidWriteTun <- p
+	}
+	return len(bufs), nil
 }
 
 func AndroidRead(data []byte, len int) {
@@ -64,6 +69,11 @@ func setTunAddr(ifname, localAddr, remoteAddr string, wintun interface{}) error
 	return nil
 }
 
+func setTunMTU(ifname string, mtu int, wintun interface{}) error {
+	// TODO:
+	return nil
+}
+
 func addRoute(dst, gw, ifname string) error {
 	// TODO:
 	return nil
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/openp2p-cn/wireguard-go/tun"
@@ -17,7 +18,7 @@ const (
 func (t *optun) Start(localAddr string, detail *SDWANInfo) error {
 	var err error
 	t.tunName = tunIfaceName
-	t.dev, err = tun.CreateTUN(t.tunName, 1420)
+	t.dev, err = tun.CreateTUN(t.tunName, tunMTU())
 	if err != nil {
 		return err
 	}
@@ -46,6 +47,10 @@ func setTunAddr(ifname, localAddr, remoteAddr string, wintun interface{}) error
 	return err
 }
 
+func setTunMTU(ifname string, mtu int, wintun interface{}) error {
+	return exec.Command("ifconfig", ifname, "mtu", strconv.Itoa(mtu)).Run()
+}
+
 func addRoute(dst, gw, ifname string) error {
 	err := exec.Command("route", "add", dst, gw).Run()
 	return err
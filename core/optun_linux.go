@@ -7,16 +7,20 @@ package openp2p
 import (
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
 
 	"github.com/openp2p-cn/wireguard-go/tun"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	tunIfaceName = "optun"
 	PIHeaderSize = 0
+	// headroom for the virtio net header(10 bytes) when the device is opened with IFF_VNET_HDR
+	vnetHdrHeadroom = 16
 )
 
 var previousIP = ""
@@ -24,13 +28,94 @@ var previousIP = ""
 func (t *optun) Start(localAddr string, detail *SDWANInfo) error {
 	var err error
 	t.tunName = tunIfaceName
-	t.dev, err = tun.CreateTUN(t.tunName, 1420)
+	if gConf.Network.TunQueues > 1 {
+		t.queues, err = createMultiQueueTUN(t.tunName, tunMTU(), gConf.Network.TunQueues)
+		if err == nil {
+			t.dev = t.queues[0]
+			t.setVnetHdr()
+			gLog.Printf(LvINFO, "create tun with %d queues, batch size %d", len(t.queues), t.dev.BatchSize())
+			return nil
+		}
+		gLog.Printf(LvWARN, "create multi-queue tun error:%s, use single queue", err)
+	}
+	t.dev, err = tun.CreateTUN(t.tunName, tunMTU())
 	if err != nil {
 		return err
 	}
+	t.setVnetHdr()
+	gLog.Printf(LvDEBUG, "create tun batch size %d", t.dev.BatchSize())
 	return nil
 }
 
+// setVnetHdr reserves the virtio net header only if the device is opened with IFF_VNET_HDR,
+// tun.CreateTUN falls back to a plain device when the kernel doesn't support the offloads
+func (t *optun) setVnetHdr() {
+	t.vnetHdr = 0
+	f := t.dev.File()
+	if f == nil {
+		return
+	}
+	rc, err := f.SyscallConn() // f.Fd() would set the device blocking
+	if err != nil {
+		return
+	}
+	var flags uint16
+	rc.Control(func(fd uintptr) {
+		ifr, err := unix.NewIfreq("")
+		if err != nil {
+			return
+		}
+		if err = unix.IoctlIfreq(int(fd), unix.TUNGETIFF, ifr); err == nil {
+			flags = ifr.Uint16()
+		}
+	})
+	if flags&unix.IFF_VNET_HDR != 0 {
+		t.vnetHdr = vnetHdrHeadroom
+	}
+	gLog.Printf(LvDEBUG, "tun flags=%#x, headroom=%d", flags, t.headroom())
+}
+
+// open the queues like tun.CreateTUN with IFF_MULTI_QUEUE, IFF_VNET_HDR makes the device enable TCP/UDP offloads
+func createMultiQueueTUN(name string, mtu int, num int) ([]tun.Device, error) {
+	devs := []tun.Device{}
+	closeAll := func() {
+		for _, dev := range devs {
+			dev.Close()
+		}
+	}
+	for i := 0; i < num; i++ {
+		fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		ifr, err := unix.NewIfreq(name)
+		if err != nil {
+			unix.Close(fd)
+			closeAll()
+			return nil, err
+		}
+		ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR | unix.IFF_MULTI_QUEUE)
+		if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+			unix.Close(fd)
+			closeAll()
+			return nil, fmt.Errorf("TUNSETIFF queue %d error:%s", i, err)
+		}
+		if err = unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+			closeAll()
+			return nil, err
+		}
+		dev, err := tun.CreateTUNFromFile(os.NewFile(uintptr(fd), "/dev/net/tun"), mtu)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		devs = append(devs, dev)
+	}
+	return devs, nil
+}
+
 func (t *optun) Read(bufs [][]byte, sizes []int, offset int) (n int, err error) {
 	return t.dev.Read(bufs, sizes, offset)
 }
@@ -44,7 +129,7 @@ func setTunAddr(ifname, localAddr, remoteAddr string, wintun interface{}) error
 	if err != nil {
 		return err
 	}
-	netlink.LinkSetMTU(ifce, 1375)
+	netlink.LinkSetMTU(ifce, tunMTU())
 	netlink.LinkSetTxQLen(ifce, 100)
 	netlink.LinkSetUp(ifce)
 
@@ -80,6 +165,14 @@ func setTunAddr(ifname, localAddr, remoteAddr string, wintun interface{}) error
 	return netlink.AddrAdd(ifce, addr)
 }
 
+func setTunMTU(ifname string, mtu int, wintun interface{}) error {
+	ifce, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetMTU(ifce, mtu)
+}
+
 func addRoute(dst, gw, ifname string) error {
 	_, networkid, err := net.ParseCIDR(dst)
 	if err != nil {
@@ -13,7 +13,7 @@ const (
 func (t *optun) Start(localAddr string, detail *SDWANInfo) error {
 	var err error
 	t.tunName = tunIfaceName
-	t.dev, err = tun.CreateTUN(t.tunName, 1420)
+	t.dev, err = tun.CreateTUN(t.tunName, tunMTU())
 
 	if err != nil {
 		return err
@@ -26,6 +26,10 @@ func (t *optun) Start(localAddr string, detail *SDWANInfo) error {
 	return nil
 }
 
+func setTunMTU(ifname string, mtu int, wintun interface{}) error {
+	return nil
+}
+
 func addRoute(dst, gw, ifname string) error {
 	return nil
 }
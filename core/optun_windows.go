@@ -42,9 +42,9 @@ func (t *optun) Start(localAddr string, detail *SDWANInfo) error {
 		Data3: 0x4567,
 		Data4: [8]byte{0x80, 0x42, 0x83, 0x7e, 0xf4, 0x56, 0xce, 0x13},
 	}
-	t.dev, err = tun.CreateTUNWithRequestedGUID(t.tunName, uuid, 1420)
+	t.dev, err = tun.CreateTUNWithRequestedGUID(t.tunName, uuid, tunMTU())
 	if err != nil { // retry
-		t.dev, err = tun.CreateTUNWithRequestedGUID(t.tunName, uuid, 1420)
+		t.dev, err = tun.CreateTUNWithRequestedGUID(t.tunName, uuid, tunMTU())
 	}
 
 	if err != nil {
@@ -78,6 +78,17 @@ func setTunAddr(ifname, localAddr, remoteAddr string, wintun interface{}) error
 	return nil
 }
 
+func setTunMTU(ifname string, mtu int, wintun interface{}) error {
+	nativeTunDevice := wintun.(*tun.NativeTun)
+	link := winipcfg.LUID(nativeTunDevice.LUID())
+	iface, err := link.IPInterface(windows.AF_INET)
+	if err != nil {
+		return err
+	}
+	iface.NLMTU = uint32(mtu)
+	return iface.Set()
+}
+
 func addRoute(dst, gw, ifname string) error {
 	_, dstNet, err := net.ParseCIDR(dst)
 	if err != nil {
@@ -1,8 +1,7 @@
 package openp2p
 
 import (
-	"bytes"
-	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"net"
 	"time"
@@ -33,10 +32,14 @@ type overlayConn struct {
 	appID       uint64 // TODO: del
 	appKey      uint64 // TODO: del
 	appKeyBytes []byte // TODO: del
+	cbc         *cbcCipher
+	bond        *overlayBond
+	qosQueued   bool // written by the qos queues of the tunnel
+	qosClass    int
 	// for udp
 	connUDP       *net.UDPConn
 	remoteAddr    net.Addr
-	udpData       chan []byte
+	udpData       chan frameBuffer
 	lastReadUDPTs time.Time
 }
 
@@ -44,15 +47,9 @@ func (oConn *overlayConn) run() {
 	gLog.Printf(LvDEBUG, "%d overlayConn run start", oConn.id)
 	defer gLog.Printf(LvDEBUG, "%d overlayConn run end", oConn.id)
 	oConn.lastReadUDPTs = time.Now()
-	buffer := make([]byte, ReadBuffLen+PaddingSize) // 16 bytes for padding
-	reuseBuff := buffer[:ReadBuffLen]
-	encryptData := make([]byte, ReadBuffLen+PaddingSize) // 16 bytes for padding
-	tunnelHead := new(bytes.Buffer)
-	relayHead := new(bytes.Buffer)
-	binary.Write(relayHead, binary.LittleEndian, oConn.rtid)
-	binary.Write(tunnelHead, binary.LittleEndian, oConn.id)
+	buffer := make([]byte, PoolBufferSize) // headroom for headers, 16 bytes for padding
 	for oConn.running && oConn.tunnel.isRuning() {
-		readBuff, dataLen, err := oConn.Read(reuseBuff)
+		readBuff, dataLen, err := oConn.Read(buffer)
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
 				continue
@@ -61,21 +58,29 @@ func (oConn *overlayConn) run() {
 			gLog.Printf(LvDEBUG, "overlayConn %d read error:%s,close it", oConn.id, err)
 			break
 		}
-		payload := readBuff[:dataLen]
+		// the payload is at readBuff[FrameHeadroom:], encrypt it in place and write the headers in front of it
+		start, end := FrameHeadroom, FrameHeadroom+dataLen
 		if oConn.appKey != 0 {
-			payload, _ = encryptBytes(oConn.appKeyBytes, encryptData, readBuff[:dataLen], dataLen)
+			payload, _ := oConn.cbc.encrypt(readBuff[start:], readBuff[start:], dataLen)
+			end = start + len(payload)
 		}
-		writeBytes := append(tunnelHead.Bytes(), payload...)
+		if oConn.bond != nil {
+			if end > start { // the empty segment ends the connection
+				oConn.bond.write(readBuff[start:end])
+			}
+			continue
+		}
+		start = prependID(readBuff, start, oConn.id)
 		// TODO: app.write
-		if oConn.rtid == 0 {
-			oConn.tunnel.conn.WriteBytes(MsgP2P, MsgOverlayData, writeBytes)
-			gLog.Printf(LvDev, "write overlay data to tid:%d,oid:%d bodylen=%d", oConn.tunnel.id, oConn.id, len(writeBytes))
+		frame := prependHeaders(readBuff, start, end, MsgOverlayData, oConn.rtid)
+		if oConn.qosQueued {
+			oConn.tunnel.queueAppFrame(oConn.qosClass, frame)
 		} else {
-			// write raley data
-			all := append(relayHead.Bytes(), encodeHeader(MsgP2P, MsgOverlayData, uint32(len(writeBytes)))...)
-			all = append(all, writeBytes...)
-			oConn.tunnel.conn.WriteBytes(MsgP2P, MsgRelayData, all)
-			gLog.Printf(LvDev, "write relay data to tid:%d,rtid:%d,oid:%d bodylen=%d", oConn.tunnel.id, oConn.rtid, oConn.id, len(writeBytes))
+			oConn.tunnel.txBytes.Add(uint64(len(frame)))
+			oConn.tunnel.conn.WriteBuffer(frame)
+		}
+		if gLog.enabled(LvDev) {
+			gLog.Printf(LvDev, "write overlay data to tid:%d,rtid:%d,oid:%d bodylen=%d", oConn.tunnel.id, oConn.rtid, oConn.id, end-start)
 		}
 	}
 	if oConn.connTCP != nil {
@@ -85,11 +90,32 @@ func (oConn *overlayConn) run() {
 		oConn.connUDP.Close()
 	}
 	oConn.tunnel.overlayConns.Delete(oConn.id)
+	if oConn.bond != nil {
+		acked := oConn.bond.finish(BondCloseTimeout)
+		oConn.bond.close()
+		overlayBonds.Delete(oConn.id)
+		if acked { // the peer closes by the end segment
+			return
+		}
+	}
 	// notify peer disconnect
 	req := OverlayDisconnectReq{ID: oConn.id}
+	if oConn.qosQueued { // after the queued data
+		data, _ := json.Marshal(&req)
+		buf := make([]byte, FrameHeadroom+len(data))
+		copy(buf[FrameHeadroom:], data)
+		oConn.tunnel.queueAppFrame(oConn.qosClass, prependHeaders(buf, FrameHeadroom, len(buf), MsgOverlayDisconnectReq, oConn.rtid))
+		return
+	}
 	oConn.tunnel.WriteMessage(oConn.rtid, MsgP2P, MsgOverlayDisconnectReq, &req)
 }
 
+// setQoS queues the connection by the class of the matched qos rule
+func (oConn *overlayConn) setQoS(node, appName, protocol string, dstPort int) {
+	oConn.qosClass, oConn.qosQueued = qosAppClass(node, appName, protocol, dstPort)
+}
+
+// read the payload into buff[FrameHeadroom:], the headroom is reserved for the frame headers
 func (oConn *overlayConn) Read(reuseBuff []byte) (buff []byte, dataLen int, err error) {
 	if !oConn.running {
 		err = ErrOverlayConnDisconnect
@@ -102,15 +128,22 @@ func (oConn *overlayConn) Read(reuseBuff []byte) (buff []byte, dataLen int, err
 		}
 		if oConn.remoteAddr != nil { // as server
 			select {
-			case buff = <-oConn.udpData:
-				dataLen = len(buff) - PaddingSize
+			case fb := <-oConn.udpData:
+				dataLen = len(fb.data)
+				if FrameHeadroom+dataLen+PaddingSize <= len(reuseBuff) {
+					copy(reuseBuff[FrameHeadroom:], fb.data)
+					putBuffer(fb.buf)
+					buff = reuseBuff
+				} else { // large datagram in its own buffer
+					buff = *fb.buf
+				}
 				oConn.lastReadUDPTs = time.Now()
 			case <-time.After(time.Second * 10):
 				err = ErrDeadlineExceeded
 			}
 		} else { // as client
 			oConn.connUDP.SetReadDeadline(time.Now().Add(UDPReadTimeout))
-			dataLen, _, err = oConn.connUDP.ReadFrom(reuseBuff)
+			dataLen, _, err = oConn.connUDP.ReadFrom(reuseBuff[FrameHeadroom : FrameHeadroom+ReadBuffLen])
 			if err == nil {
 				oConn.lastReadUDPTs = time.Now()
 			}
@@ -120,7 +153,7 @@ func (oConn *overlayConn) Read(reuseBuff []byte) (buff []byte, dataLen int, err
 	}
 	if oConn.connTCP != nil {
 		oConn.connTCP.SetReadDeadline(time.Now().Add(UDPReadTimeout))
-		dataLen, err = oConn.connTCP.Read(reuseBuff)
+		dataLen, err = oConn.connTCP.Read(reuseBuff[FrameHeadroom : FrameHeadroom+ReadBuffLen])
 		buff = reuseBuff
 	}
 
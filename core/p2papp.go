@@ -25,6 +25,9 @@ type p2pApp struct {
 	relayMode    string // public/private
 	hbTimeRelay  time.Time
 	hbMtx        sync.Mutex
+	relayHbSend  time.Time // the relay heartbeat rtt is measured end to end
+	relayHbAck   time.Time
+	relayRTT     time.Duration
 	running      bool
 	id           uint64
 	key          uint64 // aes
@@ -37,6 +40,9 @@ type p2pApp struct {
 	nextRetryRelayTime time.Time
 	errMsg             string
 	connectTime        time.Time
+	relaySelectTime    time.Time
+	relayChain         []string  // the hops of the relay tunnel, torn down with it
+	relaySwitch        [2]string // the old and new central relay node, guarded by hbMtx
 }
 
 func (app *p2pApp) Tunnel() *P2PTunnel {
@@ -72,6 +78,17 @@ func (app *p2pApp) setRelayTunnel(t *P2PTunnel) {
 	app.relayTunnel = t
 }
 
+// nodeTunnel returns the tunnel and the relay tunnel id in one lock, so a frame is built and written on the same path
+// while the tun readers write concurrently
+func (app *p2pApp) nodeTunnel() (*P2PTunnel, uint64) {
+	app.tunnelMtx.Lock()
+	defer app.tunnelMtx.Unlock()
+	if app.directTunnel != nil {
+		return app.directTunnel, 0
+	}
+	return app.relayTunnel, app.rtid
+}
+
 func (app *p2pApp) isDirect() bool {
 	return app.directTunnel != nil
 }
@@ -100,7 +117,9 @@ func (app *p2pApp) RetryTime() time.Time {
 func (app *p2pApp) checkP2PTunnel() error {
 	for app.running {
 		app.checkDirectTunnel()
+		app.applyRelaySwitch()
 		app.checkRelayTunnel()
+		app.checkRelaySwitch()
 		time.Sleep(time.Second * 3)
 	}
 	return nil
@@ -217,7 +236,7 @@ func (app *p2pApp) buildDirectTunnel() error {
 	app.setDirectTunnel(t)
 
 	// if memapp notify peer addmemapp
-	if app.config.SrcPort == 0 {
+	if app.config.isMemApp() {
 		req := ServerSideSaveMemApp{From: gConf.Network.Node, Node: gConf.Network.Node, TunnelID: t.id, RelayTunnelID: 0, AppID: app.id}
 		pn.push(app.config.PeerNode, MsgPushServerSideSaveMemApp, &req)
 		gLog.Printf(LvDEBUG, "push %s ServerSideSaveMemApp: %s", app.config.LogPeerNode(), prettyJson(req))
@@ -228,7 +247,8 @@ func (app *p2pApp) buildDirectTunnel() error {
 
 func (app *p2pApp) checkRelayTunnel() error {
 	// if app.config.ForceRelay == 1 && (gConf.sdwan.CentralNode == app.config.PeerNode && compareVersion(app.config.peerVersion, SupportDualTunnelVersion) < 0) {
-	if app.config.SrcPort == 0 && (gConf.sdwan.CentralNode == app.config.PeerNode || gConf.sdwan.CentralNode == gConf.Network.Node) { // memapp central node not build relay tunnel
+	sdwan := gConf.getSDWAN()
+	if app.config.isMemApp() && (isCentralNode(&sdwan, app.config.PeerNode) || isCentralNode(&sdwan, gConf.Network.Node)) { // memapp central node not build relay tunnel
 		return nil
 	}
 	app.hbMtx.Lock()
@@ -246,6 +266,7 @@ func (app *p2pApp) checkRelayTunnel() error {
 	if app.retryRelayNum > 0 { // first time not show reconnect log
 		gLog.Printf(LvINFO, "detect app %s appid:%d relay disconnect, reconnecting the %d times...", app.config.LogPeerNode(), app.id, app.retryRelayNum)
 	}
+	app.closeRelayChain()
 	app.setRelayTunnel(nil) // reset relayTunnel
 	app.retryRelayNum++
 	app.retryRelayTime = time.Now()
@@ -322,12 +343,17 @@ func (app *p2pApp) buildRelayTunnel() error {
 	pn.push(config.PeerNode, MsgPushAPPKey, &syncKeyReq)
 	app.setRelayTunnelID(rtid)
 	app.setRelayTunnel(t)
+	app.relayChain = nil
+	if chain, _ := config.relayChain(); len(chain) > 1 {
+		app.relayChain = chain
+	}
 	app.relayNode = relayNode
 	app.relayMode = relayMode
 	app.hbTimeRelay = time.Now()
+	app.relaySelectTime = time.Now()
 
 	// if memapp notify peer addmemapp
-	if config.SrcPort == 0 {
+	if config.isMemApp() {
 		req := ServerSideSaveMemApp{From: gConf.Network.Node, Node: relayNode, TunnelID: rtid, RelayTunnelID: t.id, AppID: app.id, RelayMode: relayMode}
 		pn.push(config.PeerNode, MsgPushServerSideSaveMemApp, &req)
 		gLog.Printf(LvDEBUG, "push %s relay ServerSideSaveMemApp: %s", config.LogPeerNode(), prettyJson(req))
@@ -350,7 +376,9 @@ func (app *p2pApp) RelayHead() *bytes.Buffer {
 }
 
 func (app *p2pApp) setRelayTunnelID(rtid uint64) {
+	app.tunnelMtx.Lock()
 	app.rtid = rtid
+	app.tunnelMtx.Unlock()
 	app.relayHead = new(bytes.Buffer)
 	binary.Write(app.relayHead, binary.LittleEndian, app.rtid)
 }
@@ -379,6 +407,60 @@ func (app *p2pApp) updateHeartbeat() {
 	app.hbTimeRelay = time.Now()
 }
 
+func (app *p2pApp) ackRelayHeartbeat() {
+	app.hbMtx.Lock()
+	defer app.hbMtx.Unlock()
+	app.relayHbAck = time.Now()
+	if !app.relayHbSend.IsZero() {
+		app.relayRTT = app.relayHbAck.Sub(app.relayHbSend)
+	}
+}
+
+func (app *p2pApp) writeRelayHeartbeat() error {
+	app.hbMtx.Lock()
+	app.relayHbSend = time.Now()
+	app.hbMtx.Unlock()
+	req := RelayHeartbeat{From: gConf.Network.Node, RelayTunnelID: app.RelayTunnel().id,
+		AppID: app.id}
+	return app.RelayTunnel().WriteMessage(app.rtid, MsgP2P, MsgRelayHeartbeat, &req)
+}
+
+// RTT is the last heartbeat rtt to the peer, through the relay node if it's relayed
+func (app *p2pApp) RTT() time.Duration {
+	if t := app.DirectTunnel(); t != nil {
+		return time.Duration(t.rtt.Load())
+	}
+	app.hbMtx.Lock()
+	defer app.hbMtx.Unlock()
+	return app.relayRTT
+}
+
+// ping measures the rtt to the peer by the tunnel heartbeat, return 0 if timeout
+func (app *p2pApp) ping(timeout time.Duration) time.Duration {
+	if t := app.DirectTunnel(); t != nil {
+		return t.measureRTT(timeout)
+	}
+	if app.RelayTunnel() == nil {
+		return 0
+	}
+	if err := app.writeRelayHeartbeat(); err != nil {
+		return 0
+	}
+	app.hbMtx.Lock()
+	sent := app.relayHbSend
+	app.hbMtx.Unlock()
+	for time.Since(sent) < timeout {
+		app.hbMtx.Lock()
+		ackTime := app.relayHbAck
+		app.hbMtx.Unlock()
+		if ackTime.After(sent) {
+			return ackTime.Sub(sent)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	return 0
+}
+
 func (app *p2pApp) listenTCP() error {
 	gLog.Printf(LvDEBUG, "tcp accept on port %d start", app.config.SrcPort)
 	defer gLog.Printf(LvDEBUG, "tcp accept on port %d end", app.config.SrcPort)
@@ -415,47 +497,56 @@ func (app *p2pApp) listenTCP() error {
 				continue
 			}
 		}
-		oConn := overlayConn{
-			tunnel:   app.Tunnel(),
-			app:      app,
-			connTCP:  conn,
-			id:       rand.Uint64(),
-			isClient: true,
-			appID:    app.id,
-			appKey:   app.key,
-			running:  true,
-		}
-		if !app.isDirect() {
-			oConn.rtid = app.rtid
-		}
-		// pre-calc key bytes for encrypt
-		if oConn.appKey != 0 {
-			encryptKey := make([]byte, AESKeySize)
-			binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
-			binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
-			oConn.appKeyBytes = encryptKey
-		}
-		app.Tunnel().overlayConns.Store(oConn.id, &oConn)
-		gLog.Printf(LvDEBUG, "Accept TCP overlayID:%d, %s", oConn.id, oConn.connTCP.RemoteAddr())
-		// tell peer connect
-		req := OverlayConnectReq{ID: oConn.id,
-			Token:    gConf.Network.Token,
-			DstIP:    app.config.DstHost,
-			DstPort:  app.config.DstPort,
-			Protocol: app.config.Protocol,
-			AppID:    app.id,
-		}
-		if !app.isDirect() {
-			req.RelayTunnelID = app.Tunnel().id
-		}
-		app.Tunnel().WriteMessage(app.RelayTunnelID(), MsgP2P, MsgOverlayConnectReq, &req)
-		// TODO: wait OverlayConnectRsp instead of sleep
-		time.Sleep(time.Second) // waiting remote node connection ok
+		oConn := app.newOverlayConn(conn, app.config.DstHost, app.config.DstPort)
 		go oConn.run()
 	}
 	return nil
 }
 
+// newOverlayConn tells the peer to connect dstHost:dstPort for the tcp connection, the caller runs it
+func (app *p2pApp) newOverlayConn(conn net.Conn, dstHost string, dstPort int) *overlayConn {
+	oConn := overlayConn{
+		tunnel:   app.Tunnel(),
+		app:      app,
+		connTCP:  conn,
+		id:       rand.Uint64(),
+		isClient: true,
+		appID:    app.id,
+		appKey:   app.key,
+		running:  true,
+	}
+	if !app.isDirect() {
+		oConn.rtid = app.rtid
+	}
+	oConn.setQoS(app.config.PeerNode, app.config.AppName, app.config.Protocol, dstPort)
+	// pre-calc key bytes for encrypt
+	if oConn.appKey != 0 {
+		encryptKey := make([]byte, AESKeySize)
+		binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
+		binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
+		oConn.appKeyBytes = encryptKey
+		oConn.cbc, _ = newCBCCipher(encryptKey)
+	}
+	app.Tunnel().overlayConns.Store(oConn.id, &oConn)
+	gLog.Printf(LvDEBUG, "Accept TCP overlayID:%d, %s", oConn.id, oConn.connTCP.RemoteAddr())
+	// tell peer connect
+	req := OverlayConnectReq{ID: oConn.id,
+		Token:    gConf.Network.Token,
+		DstIP:    dstHost,
+		DstPort:  dstPort,
+		Protocol: "tcp",
+		AppID:    app.id,
+	}
+	if !app.isDirect() {
+		req.RelayTunnelID = app.Tunnel().id
+	}
+	app.initBond(&oConn, &req)
+	app.Tunnel().WriteMessage(app.RelayTunnelID(), MsgP2P, MsgOverlayConnectReq, &req)
+	// TODO: wait OverlayConnectRsp instead of sleep
+	time.Sleep(time.Second) // waiting remote node connection ok
+	return &oConn
+}
+
 func (app *p2pApp) listenUDP() error {
 	gLog.Printf(LvDEBUG, "udp accept on port %d start", app.config.SrcPort)
 	defer gLog.Printf(LvDEBUG, "udp accept on port %d end", app.config.SrcPort)
@@ -484,8 +575,14 @@ func (app *p2pApp) listenUDP() error {
 				time.Sleep(time.Second)
 				continue
 			}
-			dupData := bytes.Buffer{} // should uses memory pool
-			dupData.Write(buffer[:len+PaddingSize])
+			var dupBuf *[]byte
+			if len <= ReadBuffLen {
+				dupBuf = getBuffer()
+			} else {
+				b := make([]byte, FrameHeadroom+len+PaddingSize)
+				dupBuf = &b
+			}
+			dupData := frameBuffer{dupBuf, (*dupBuf)[FrameHeadroom : FrameHeadroom+copy((*dupBuf)[FrameHeadroom:], buffer[:len])]}
 			// load from app.tunnel.overlayConns by remoteAddr error, new udp connection
 			remoteIP := strings.Split(remoteAddr.String(), ":")[0]
 			port, _ := strconv.Atoi(strings.Split(remoteAddr.String(), ":")[1])
@@ -503,7 +600,7 @@ func (app *p2pApp) listenUDP() error {
 					tunnel:     app.Tunnel(),
 					connUDP:    app.listenerUDP,
 					remoteAddr: remoteAddr,
-					udpData:    make(chan []byte, 1000),
+					udpData:    make(chan frameBuffer, 1000),
 					id:         id,
 					isClient:   true,
 					appID:      app.id,
@@ -513,12 +610,14 @@ func (app *p2pApp) listenUDP() error {
 				if !app.isDirect() {
 					oConn.rtid = app.rtid
 				}
+				oConn.setQoS(app.config.PeerNode, app.config.AppName, app.config.Protocol, app.config.DstPort)
 				// calc key bytes for encrypt
 				if oConn.appKey != 0 {
 					encryptKey := make([]byte, AESKeySize)
 					binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
 					binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
 					oConn.appKeyBytes = encryptKey
+					oConn.cbc, _ = newCBCCipher(encryptKey)
 				}
 				app.Tunnel().overlayConns.Store(oConn.id, &oConn)
 				gLog.Printf(LvDEBUG, "Accept UDP overlayID:%d", oConn.id)
@@ -533,11 +632,12 @@ func (app *p2pApp) listenUDP() error {
 				if !app.isDirect() {
 					req.RelayTunnelID = app.Tunnel().id
 				}
+				app.initBond(&oConn, &req)
 				app.Tunnel().WriteMessage(app.RelayTunnelID(), MsgP2P, MsgOverlayConnectReq, &req)
 				// TODO: wait OverlayConnectRsp instead of sleep
 				time.Sleep(time.Second) // waiting remote node connection ok
 				go oConn.run()
-				oConn.udpData <- dupData.Bytes()
+				oConn.udpData <- dupData
 			}
 
 			// load from app.tunnel.overlayConns by remoteAddr ok, write relay data
@@ -545,7 +645,7 @@ func (app *p2pApp) listenUDP() error {
 			if !ok {
 				continue
 			}
-			overlayConn.udpData <- dupData.Bytes()
+			overlayConn.udpData <- dupData
 		}
 	}
 	return nil
@@ -555,6 +655,10 @@ func (app *p2pApp) listen() error {
 	if app.config.SrcPort == 0 {
 		return nil
 	}
+	if app.config.Reverse == 1 {
+		app.listenReverse()
+		return nil
+	}
 	gLog.Printf(LvINFO, "LISTEN ON PORT %s:%d START", app.config.Protocol, app.config.SrcPort)
 	defer gLog.Printf(LvINFO, "LISTEN ON PORT %s:%d END", app.config.Protocol, app.config.SrcPort)
 	app.wg.Add(1)
@@ -587,6 +691,7 @@ func (app *p2pApp) close() {
 	if app.RelayTunnel() != nil {
 		app.RelayTunnel().closeOverlayConns(app.id)
 	}
+	app.closeRelayChain()
 	app.wg.Wait()
 }
 
@@ -602,9 +707,7 @@ func (app *p2pApp) relayHeartbeatLoop() {
 			time.Sleep(TunnelHeartbeatTime)
 			continue
 		}
-		req := RelayHeartbeat{From: gConf.Network.Node, RelayTunnelID: app.RelayTunnel().id,
-			AppID: app.id}
-		err := app.RelayTunnel().WriteMessage(app.rtid, MsgP2P, MsgRelayHeartbeat, &req)
+		err := app.writeRelayHeartbeat()
 		if err != nil {
 			gLog.Printf(LvERROR, "%s appid:%d rtid:%d write relay tunnel heartbeat error %s", app.config.LogPeerNode(), app.id, app.rtid, err)
 			return
@@ -21,9 +21,11 @@ import (
 
 var (
 	v4l            *v4Listener
+	wsl            *wsListener
 	instance       *P2PNetwork
 	onceP2PNetwork sync.Once
 	onceV4Listener sync.Once
+	onceWSListener sync.Once
 )
 
 const (
@@ -41,6 +43,7 @@ var (
 type NodeData struct {
 	NodeID uint64
 	Data   []byte
+	buf    *[]byte // pooled buffer of Data
 }
 
 type P2PNetwork struct {
@@ -63,6 +66,10 @@ type P2PNetwork struct {
 	allTunnels           sync.Map // key: tid
 	apps                 sync.Map //key: config.ID(); value: *p2pApp
 	limiter              *SpeedLimiter
+	relayAcct            *relayAccounting
+	relayRoutes          sync.Map // key: target tunnel id; value: *relayRoute
+	relayHops            sync.Map // key: source tunnel id; value: *relayChainHop
+	relaySelections      sync.Map // key: peer node; value: *relaySelection
 	nodeData             chan *NodeData
 	sdwan                *p2pSDWAN
 	tunnelCloseCh        chan *P2PTunnel
@@ -77,6 +84,8 @@ type msgCtx struct {
 func P2PNetworkInstance() *P2PNetwork {
 	if instance == nil {
 		onceP2PNetwork.Do(func() {
+			relayAcct := newRelayAccounting()
+			relayAcct.load() // the quota usage is restored before relaying
 			instance = &P2PNetwork{
 				restartCh:            make(chan bool, 1),
 				tunnelCloseCh:        make(chan *P2PTunnel, 100),
@@ -84,6 +93,7 @@ func P2PNetworkInstance() *P2PNetwork {
 				online:               false,
 				running:              true,
 				limiter:              newSpeedLimiter(gConf.Network.ShareBandwidth*1024*1024/8, 1),
+				relayAcct:            relayAcct,
 				dt:                   0,
 				ddt:                  0,
 				loginMaxDelaySeconds: DefaultLoginMaxDelaySeconds,
@@ -92,6 +102,9 @@ func P2PNetworkInstance() *P2PNetwork {
 			instance.StartSDWAN()
 			instance.init()
 			go instance.run()
+			go instance.relayAcct.run()
+			go instance.relayRouteLoop()
+			startCtlServer()
 			go func() {
 				for {
 					instance.refreshIPv6()
@@ -152,6 +165,9 @@ func (pn *P2PNetwork) NotifyTunnelClose(t *P2PTunnel) bool {
 }
 
 func (pn *P2PNetwork) Connect(timeout int) bool {
+	if isStaticSDWAN() { // no server
+		return true
+	}
 	// waiting for heartbeat
 	for i := 0; i < (timeout / 1000); i++ {
 		if pn.hbTime.After(time.Now().Add(-NetworkHeartbeatTime)) {
@@ -199,10 +215,29 @@ func (pn *P2PNetwork) autorunApp() {
 func (pn *P2PNetwork) addRelayTunnel(config AppConfig) (*P2PTunnel, uint64, string, error) {
 	gLog.Printf(LvINFO, "addRelayTunnel to %s start", config.LogPeerNode())
 	defer gLog.Printf(LvINFO, "addRelayTunnel to %s end", config.LogPeerNode())
+	chain, err := config.relayChain()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if len(chain) > 1 {
+		t, rtid, err := pn.addRelayChain(config, chain)
+		return t, rtid, "private", err
+	}
 	relayConfig := AppConfig{
-		PeerNode:  config.RelayNode,
 		peerToken: config.peerToken,
 		relayMode: "private"}
+	if len(chain) == 1 {
+		relayConfig.PeerNode = chain[0]
+	}
+	if relayConfig.PeerNode == "" {
+		if sel, err := pn.selectRelay(config, nil); err == nil {
+			relayConfig.PeerNode = sel.Node
+			relayConfig.peerToken = sel.Token
+			relayConfig.relayMode = sel.Mode
+		} else {
+			gLog.Printf(LvDEBUG, "select relay for %s error:%s", config.LogPeerNode(), err)
+		}
+	}
 	if relayConfig.PeerNode == "" {
 		// find existing relay tunnel
 		pn.apps.Range(func(id, i interface{}) bool {
@@ -368,97 +403,61 @@ func (pn *P2PNetwork) addDirectTunnel(config AppConfig, tid uint64) (t *P2PTunne
 	}
 	gLog.Printf(LvDEBUG, "config.peerNode=%s,config.peerVersion=%s,config.peerIP=%s,config.peerLanIP=%s,gConf.Network.publicIP=%s,config.peerIPv6=%s,config.hasIPv4=%d,config.hasUPNPorNATPMP=%d,gConf.Network.hasIPv4=%d,gConf.Network.hasUPNPorNATPMP=%d,config.peerNatType=%d,gConf.Network.natType=%d,",
 		config.LogPeerNode(), config.peerVersion, config.peerIP, config.peerLanIP, gConf.Network.publicIP, config.peerIPv6, config.hasIPv4, config.hasUPNPorNATPMP, gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP, config.peerNatType, gConf.Network.natType)
-	// try Intranet
-	if config.peerIP == gConf.Network.publicIP && compareVersion(config.peerVersion, SupportIntranetVersion) >= 0 { // old version client has no peerLanIP
-		gLog.Println(LvINFO, "try Intranet")
-		config.linkMode = LinkModeIntranet
+	for _, mode := range linkModes(&config) {
+		gLog.Printf(LvINFO, "try %s", mode)
+		config.linkMode = mode
 		config.isUnderlayServer = 0
-		if t, err = pn.newTunnel(config, tid, isClient); err == nil {
-			return t, nil
+		if mode == LinkModeTCP4 && (gConf.Network.hasIPv4 == 1 || gConf.Network.hasUPNPorNATPMP == 1) {
+			config.isUnderlayServer = 1
 		}
-	}
-	// try TCP6
-	if IsIPv6(config.peerIPv6) && IsIPv6(gConf.IPv6()) {
-		gLog.Println(LvINFO, "try TCP6")
-		config.linkMode = LinkModeTCP6
-		config.isUnderlayServer = 0
-		if t, err = pn.newTunnel(config, tid, isClient); err == nil {
-			return t, nil
+		for i := 0; i < linkModeRetry(&config, mode); i++ { // when both 2 nats has restrict firewall, simultaneous punching needs to be very precise, it takes a few tries
+			if t, err = pn.newTunnel(config, tid, isClient); err == nil {
+				return t, nil
+			}
 		}
 	}
+	// TODO: s2s won't return err
+	return nil, err
+}
 
-	// try UDP6? maybe no
-
-	// try TCP4
+// linkModes returns the direct link modes to the peer in the order addDirectTunnel tries, doctor prints it too
+func linkModes(config *AppConfig) []string {
+	modes := []string{}
+	// try WSS first in restrictive network
+	if (gConf.Network.HTTPProxy != "" || config.UnderlayProtocol == "wss") && config.hasIPv4 == 1 && compareVersion(config.peerVersion, SupportWSSVersion) >= 0 {
+		modes = append(modes, LinkModeWSS)
+	}
+	if config.peerIP == gConf.Network.publicIP && compareVersion(config.peerVersion, SupportIntranetVersion) >= 0 { // old version client has no peerLanIP
+		modes = append(modes, LinkModeIntranet)
+	}
+	if IsIPv6(config.peerIPv6) && IsIPv6(gConf.IPv6()) {
+		modes = append(modes, LinkModeTCP6)
+	}
 	if config.hasIPv4 == 1 || gConf.Network.hasIPv4 == 1 || config.hasUPNPorNATPMP == 1 || gConf.Network.hasUPNPorNATPMP == 1 {
-		gLog.Println(LvINFO, "try TCP4")
-		config.linkMode = LinkModeTCP4
-		if gConf.Network.hasIPv4 == 1 || gConf.Network.hasUPNPorNATPMP == 1 {
-			config.isUnderlayServer = 1
-		} else {
-			config.isUnderlayServer = 0
-		}
-		if t, err = pn.newTunnel(config, tid, isClient); err == nil {
-			return t, nil
-		}
+		modes = append(modes, LinkModeTCP4)
 	}
-	// try UDP4? maybe no
-	var primaryPunchFunc func() (*P2PTunnel, error)
-	var secondaryPunchFunc func() (*P2PTunnel, error)
-	funcUDP := func() (t *P2PTunnel, err error) {
-		if config.PunchPriority&PunchPriorityUDPDisable != 0 {
-			return
+	if config.peerNatType == NATCone || gConf.Network.natType == NATCone {
+		if config.PunchPriority&PunchPriorityTCPDisable == 0 {
+			modes = append(modes, LinkModeTCPPunch)
 		}
-		// try UDPPunch
-		for i := 0; i < Cone2ConeUDPPunchMaxRetry; i++ { // when both 2 nats has restrict firewall, simultaneous punching needs to be very precise, it takes a few tries
-			if config.peerNatType == NATCone || gConf.Network.natType == NATCone {
-				gLog.Println(LvINFO, "try UDP4 Punch")
-				config.linkMode = LinkModeUDPPunch
-				config.isUnderlayServer = 0
-				if t, err = pn.newTunnel(config, tid, isClient); err == nil {
-					return t, nil
-				}
-			}
-			if !(config.peerNatType == NATCone && gConf.Network.natType == NATCone) { // not cone2cone, no more try
-				break
-			}
+		if config.PunchPriority&PunchPriorityUDPDisable == 0 {
+			modes = append(modes, LinkModeUDPPunch)
 		}
-		return
 	}
-	funcTCP := func() (t *P2PTunnel, err error) {
-		if config.PunchPriority&PunchPriorityTCPDisable != 0 {
-			return
-		}
-		// try TCPPunch
-		for i := 0; i < Cone2ConeTCPPunchMaxRetry; i++ { // when both 2 nats has restrict firewall, simultaneous punching needs to be very precise, it takes a few tries
-			if config.peerNatType == NATCone || gConf.Network.natType == NATCone {
-				gLog.Println(LvINFO, "try TCP4 Punch")
-				config.linkMode = LinkModeTCPPunch
-				config.isUnderlayServer = 0
-				if t, err = pn.newTunnel(config, tid, isClient); err == nil {
-					gLog.Println(LvINFO, "TCP4 Punch ok")
-					return t, nil
-				}
-			}
+	return modes
+}
+
+// linkModeRetry returns the tries of the link mode
+func linkModeRetry(config *AppConfig, mode string) int {
+	switch mode {
+	case LinkModeTCPPunch:
+		return Cone2ConeTCPPunchMaxRetry
+	case LinkModeUDPPunch:
+		if config.peerNatType == NATCone && gConf.Network.natType == NATCone {
+			return Cone2ConeUDPPunchMaxRetry
 		}
-		return
-	}
-	if config.PunchPriority&PunchPriorityTCPFirst != 0 {
-		primaryPunchFunc = funcTCP
-		secondaryPunchFunc = funcUDP
-	} else {
-		primaryPunchFunc = funcTCP
-		secondaryPunchFunc = funcUDP
 	}
-	if t, err = primaryPunchFunc(); t != nil && err == nil {
-		return t, err
-	}
-	if t, err = secondaryPunchFunc(); t != nil && err == nil {
-		return t, err
-	}
-
-	// TODO: s2s won't return err
-	return nil, err
+	return 1
 }
 
 func (pn *P2PNetwork) newTunnel(config AppConfig, tid uint64, isClient bool) (t *P2PTunnel, err error) {
@@ -469,10 +468,9 @@ func (pn *P2PNetwork) newTunnel(config AppConfig, tid uint64, isClient bool) (t
 	}
 
 	t = &P2PTunnel{
-		config:         config,
-		id:             tid,
-		writeData:      make(chan []byte, WriteDataChanSize),
-		writeDataSmall: make(chan []byte, WriteDataChanSize/30),
+		config:     config,
+		id:         tid,
+		writeQueue: newQoSQueues(),
 	}
 	t.initPort()
 	if isClient {
@@ -491,20 +489,44 @@ func (pn *P2PNetwork) newTunnel(config AppConfig, tid uint64, isClient bool) (t
 	pn.allTunnels.Store(tid, t)
 	return
 }
+
+// gatewayTLSConfig trusts the system roots and the roots of the gateway cert
+func gatewayTLSConfig() *tls.Config {
+	caCertPool, errCert := x509.SystemCertPool()
+	if errCert != nil {
+		gLog.Println(LvERROR, "Failed to load system root CAs:", errCert)
+		caCertPool = x509.NewCertPool()
+	}
+	caCertPool.AppendCertsFromPEM([]byte(rootCA))
+	caCertPool.AppendCertsFromPEM([]byte(ISRGRootX1))
+	return &tls.Config{
+		RootCAs:            caCertPool,
+		InsecureSkipVerify: false} // let's encrypt root cert "DST Root CA X3" expired at 2021/09/29. many old system(windows server 2008 etc) will not trust our cert
+}
+
 func (pn *P2PNetwork) init() error {
 	gLog.Println(LvINFO, "P2PNetwork init start")
 	defer gLog.Println(LvINFO, "P2PNetwork init end")
 	pn.wgReconnect.Add(1)
 	defer pn.wgReconnect.Done()
+	if isStaticSDWAN() {
+		return pn.initStatic()
+	}
 	var err error
 	for {
 		// detect nat type
 		gConf.Network.publicIP, gConf.Network.natType, err = getNATType(gConf.Network.ServerHost, gConf.Network.UDPPort1, gConf.Network.UDPPort2)
 		if err != nil {
-			gLog.Println(LvDEBUG, "detect NAT type error:", err)
-			break
+			if gConf.Network.HTTPProxy == "" {
+				gLog.Println(LvDEBUG, "detect NAT type error:", err)
+				break
+			}
+			// udp blocked, login through http proxy
+			gLog.Println(LvINFO, "detect NAT type error, use http proxy:", err)
+			gConf.Network.natType = NATUnknown
+			err = nil
 		}
-		if gConf.Network.hasIPv4 == 0 && gConf.Network.hasUPNPorNATPMP == 0 { // if already has ipv4 or upnp no need test again
+		if gConf.Network.publicIP != "" && gConf.Network.hasIPv4 == 0 && gConf.Network.hasUPNPorNATPMP == 0 { // if already has ipv4 or upnp no need test again
 			gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP = publicIPTest(gConf.Network.publicIP, gConf.Network.TCPPort)
 		}
 
@@ -529,21 +551,27 @@ func (pn *P2PNetwork) init() error {
 				go v4l.start()
 			})
 		}
+		if gConf.Network.WSSPort > 0 && (gConf.Network.hasIPv4 == 1 || gConf.Network.hasUPNPorNATPMP == 1) {
+			onceWSListener.Do(func() {
+				l, err := newWSListener(gConf.Network.WSSPort)
+				if err != nil {
+					gLog.Println(LvERROR, "wsListener init error:", err)
+					return
+				}
+				if gConf.Network.hasIPv4 == 0 && !addTCPPortMapping(gConf.Network.WSSPort) {
+					l.listener.Close()
+					return
+				}
+				wsl = l
+				go wsl.start()
+			})
+		}
 		gLog.Printf(LvINFO, "hasIPv4:%d, UPNP:%d, NAT type:%d, publicIP:%s", gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP, gConf.Network.natType, gConf.Network.publicIP)
 		gatewayURL := fmt.Sprintf("%s:%d", gConf.Network.ServerHost, gConf.Network.ServerPort)
 		uri := "/api/v1/login"
-		caCertPool, errCert := x509.SystemCertPool()
-		if errCert != nil {
-			gLog.Println(LvERROR, "Failed to load system root CAs:", errCert)
-			caCertPool = x509.NewCertPool()
-		}
-		caCertPool.AppendCertsFromPEM([]byte(rootCA))
-		caCertPool.AppendCertsFromPEM([]byte(ISRGRootX1))
-		config := tls.Config{
-			RootCAs:            caCertPool,
-			InsecureSkipVerify: false} // let's encrypt root cert "DST Root CA X3" expired at 2021/09/29. many old system(windows server 2008 etc) will not trust our cert
-		websocket.DefaultDialer.TLSClientConfig = &config
+		websocket.DefaultDialer.TLSClientConfig = gatewayTLSConfig()
 		websocket.DefaultDialer.HandshakeTimeout = ClientAPITimeout
+		websocket.DefaultDialer.Proxy = httpProxy()
 		u := url.URL{Scheme: "wss", Host: gatewayURL, Path: uri}
 		q := u.Query()
 		q.Add("node", gConf.Network.Node)
@@ -708,17 +736,30 @@ func (pn *P2PNetwork) write(mainType uint16, subType uint16, packet interface{})
 	return err
 }
 
-func (pn *P2PNetwork) relay(to uint64, body []byte) error {
+// relay the MsgRelayData frame to the target tunnel, deliver the inner frame if it is on this node
+func (pn *P2PNetwork) relay(from *P2PTunnel, to uint64, frame []byte) error {
+	if relayHeaderLen(frame) == RelayHeaderSize { // from the source, the later hops keep the stamp
+		stampRelayNodeID(frame[openP2PHeaderSize+RelayHeaderSize:], from.peerNodeID)
+	}
 	i, ok := pn.allTunnels.Load(to)
 	if !ok {
-		return ErrRelayTunnelNotFound
+		return pn.forwardRelay(from, to, frame)
 	}
+	body := frame[openP2PHeaderSize+relayHeaderLen(frame):]
 	tunnel := i.(*P2PTunnel)
+	if err := pn.relayAcct.add(from.config.PeerNode, tunnel.config.PeerNode, len(body)); err != nil {
+		return err
+	}
 	if tunnel.config.shareBandwidth > 0 {
 		pn.limiter.Add(len(body), true)
 	}
 	var err error
-	if err = tunnel.conn.WriteBuffer(body); err != nil {
+	if isNodeDataFrame(body) {
+		err = tunnel.writeNodeFrame(body)
+	} else {
+		err = tunnel.conn.WriteBuffer(body)
+	}
+	if err != nil {
 		gLog.Printf(LvERROR, "relay to %d len=%d error:%s", to, len(body), err)
 	}
 	return err
@@ -811,11 +852,14 @@ func (pn *P2PNetwork) read(node string, mainType uint16, subType uint16, timeout
 	}
 }
 
-func (pn *P2PNetwork) updateAppHeartbeat(appID uint64) {
+func (pn *P2PNetwork) updateAppHeartbeat(appID uint64, ack bool) {
 	pn.apps.Range(func(id, i interface{}) bool {
 		app := i.(*p2pApp)
 		if app.id == appID {
 			app.updateHeartbeat()
+			if ack {
+				app.ackRelayHeartbeat()
+			}
 		}
 		return true
 	})
@@ -824,27 +868,35 @@ func (pn *P2PNetwork) updateAppHeartbeat(appID uint64) {
 // ipv6 will expired need to refresh.
 func (pn *P2PNetwork) refreshIPv6() {
 	for i := 0; i < 2; i++ {
-		client := &http.Client{Timeout: time.Second * 10}
-		r, err := client.Get("http://ipv6.ddnspod.com/")
+		ip, err := publicIPv6()
 		if err != nil {
 			gLog.Println(LvDEBUG, "refreshIPv6 error:", err)
 			continue
 		}
-		defer r.Body.Close()
-		buf := make([]byte, 1024)
-		n, err := r.Body.Read(buf)
-		if n <= 0 {
-			gLog.Println(LvINFO, "refreshIPv6 error:", err, n)
-			continue
-		}
-		if IsIPv6(string(buf[:n])) {
-			gConf.setIPv6(string(buf[:n]))
+		if IsIPv6(ip) {
+			gConf.setIPv6(ip)
 		}
 		break
 	}
 
 }
 
+// publicIPv6 returns the ipv6 address seen by the internet
+func publicIPv6() (string, error) {
+	client := &http.Client{Timeout: time.Second * 10}
+	r, err := client.Get("http://ipv6.ddnspod.com/")
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	buf := make([]byte, 1024)
+	n, err := r.Body.Read(buf)
+	if n <= 0 {
+		return "", fmt.Errorf("read %d: %v", n, err)
+	}
+	return string(buf[:n]), nil
+}
+
 func (pn *P2PNetwork) requestPeerInfo(config *AppConfig) error {
 	// request peer info
 	// TODO: multi-thread issue
@@ -893,8 +945,8 @@ func (pn *P2PNetwork) ConnectNode(node string) error {
 	config.PeerNode = node
 	sdwan := gConf.getSDWAN()
 	config.PunchPriority = int(sdwan.PunchPriority)
-	if node != sdwan.CentralNode && gConf.Network.Node != sdwan.CentralNode { // neither is centralnode
-		config.RelayNode = sdwan.CentralNode
+	if !isCentralNode(&sdwan, node) && !isCentralNode(&sdwan, gConf.Network.Node) { // neither is centralnode
+		config.RelayNode = pn.sdwan.central.current(centralNodes(&sdwan))
 		config.ForceRelay = int(sdwan.ForceRelay)
 		if sdwan.Mode == SDWANModeCentral {
 			config.ForceRelay = 1
@@ -912,26 +964,39 @@ func (pn *P2PNetwork) WriteNode(nodeID uint64, buff []byte) error {
 	}
 	var err error
 	app := i.(*p2pApp)
-	if app.Tunnel() == nil {
+	t, rtid := app.nodeTunnel()
+	if t == nil {
 		return errors.New("peer tunnel nil")
 	}
 	// TODO: move to app.write
-	gLog.Printf(LvDev, "%d tunnel write node data bodylen=%d, relay=%t", app.Tunnel().id, len(buff), !app.isDirect())
-	if app.isDirect() { // direct
-		app.Tunnel().asyncWriteNodeData(MsgP2P, MsgNodeData, buff)
-	} else { // relay
-		fromNodeIDHead := new(bytes.Buffer)
-		binary.Write(fromNodeIDHead, binary.LittleEndian, gConf.nodeID())
-		all := app.RelayHead().Bytes()
-		all = append(all, encodeHeader(MsgP2P, MsgRelayNodeData, uint32(len(buff)+overlayHeaderSize))...)
-		all = append(all, fromNodeIDHead.Bytes()...)
-		all = append(all, buff...)
-		app.Tunnel().asyncWriteNodeData(MsgP2P, MsgRelayData, all)
+	if gLog.enabled(LvDev) {
+		gLog.Printf(LvDev, "%d tunnel write node data bodylen=%d, relay=%t", t.id, len(buff), rtid != 0)
 	}
-
+	buf, frame := nodeFrame(buff, rtid)
+	t.asyncWriteNodeData(buf, frame, qosNodeClass(nodeID, buff))
 	return err
 }
 
+// relayedBy reports whether the node data of nodeID is expected from the relay tunnel t
+func (pn *P2PNetwork) relayedBy(nodeID uint64, t *P2PTunnel) bool {
+	i, ok := pn.apps.Load(nodeID)
+	return ok && i.(*p2pApp).RelayTunnel() == t
+}
+
+// NodeMTU returns the largest ip packet to the node sent as datagram, tunMTU if the path isn't limited
+func (pn *P2PNetwork) NodeMTU(nodeID uint64) int {
+	i, ok := pn.apps.Load(nodeID)
+	if !ok {
+		return tunMTU()
+	}
+	app := i.(*p2pApp)
+	t := app.Tunnel()
+	if t == nil || t.pmtu.Load() == 0 {
+		return tunMTU()
+	}
+	return frameMTU(int(t.pmtu.Load()), app.isDirect())
+}
+
 func (pn *P2PNetwork) WriteBroadcast(buff []byte) error {
 	///
 	pn.apps.Range(func(id, i interface{}) bool {
@@ -942,26 +1007,16 @@ func (pn *P2PNetwork) WriteBroadcast(buff []byte) error {
 		// binary.BigEndian.PutUint16(buff[10:12], ipChecksum)
 		// binary.BigEndian.PutUint16(buff[26:28], 0x082e)
 		app := i.(*p2pApp)
-		if app.Tunnel() == nil {
+		t, rtid := app.nodeTunnel()
+		if t == nil {
 			return true
 		}
-		if app.config.SrcPort != 0 { // normal portmap app
+		if !app.config.isMemApp() { // normal portmap app or nc
 			return true
 		}
-		if app.config.peerIP == gConf.Network.publicIP { // mostly in a lan
-			return true
-		}
-		if app.isDirect() { // direct
-			app.Tunnel().conn.WriteBytes(MsgP2P, MsgNodeData, buff)
-		} else { // relay
-			fromNodeIDHead := new(bytes.Buffer)
-			binary.Write(fromNodeIDHead, binary.LittleEndian, gConf.nodeID())
-			all := app.RelayHead().Bytes()
-			all = append(all, encodeHeader(MsgP2P, MsgRelayNodeData, uint32(len(buff)+overlayHeaderSize))...)
-			all = append(all, fromNodeIDHead.Bytes()...)
-			all = append(all, buff...)
-			app.Tunnel().conn.WriteBytes(MsgP2P, MsgRelayData, all)
-		}
+		buf, frame := nodeFrame(buff, rtid)
+		t.writeNodeFrame(frame)
+		putBuffer(buf)
 		return true
 	})
 	return nil
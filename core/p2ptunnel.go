@@ -21,7 +21,9 @@ var buildTunnelMtx sync.Mutex
 type P2PTunnel struct {
 	conn           underlay
 	hbTime         time.Time
+	hbSendTime     time.Time
 	hbMtx          sync.Mutex
+	pings          map[uint64]chan time.Time // nonce: the ack time, waited by measureRTT
 	config         AppConfig
 	localHoleAddr  *net.UDPAddr // local hole address
 	remoteHoleAddr *net.UDPAddr // remote hole address
@@ -34,8 +36,14 @@ type P2PTunnel struct {
 	coneNatPort    int
 	linkModeWeb    string // use config.linkmode
 	punchTs        uint64
-	writeData      chan []byte
-	writeDataSmall chan []byte
+	writeQueue     *qosQueues
+	peerNodeID     uint64
+	pmtu           atomic.Int32 // the largest frame sent as datagram, 0 if unknown
+	pmtuAck        atomic.Int32
+	rtt            atomic.Int64                  // the last heartbeat rtt in nanoseconds
+	rxBytes        atomic.Uint64                 // the frames read
+	txBytes        atomic.Uint64                 // the sdwan and overlay data written
+	streamFlows    [streamFlowSlots]atomic.Int64 // until when the flows hashed to the slot are written to the stream
 }
 
 func (t *P2PTunnel) initPort() {
@@ -105,6 +113,8 @@ func (t *P2PTunnel) connect() error {
 	t.config.peerVersion = rsp.Version
 	t.config.peerConeNatPort = rsp.ConeNatPort
 	t.config.peerIP = rsp.FromIP
+	t.config.peerWSSPort = rsp.WSSPort
+	t.config.peerWSSCert = rsp.WSSCert
 	t.punchTs = rsp.PunchTs
 	err := t.start()
 	if err != nil {
@@ -143,7 +153,7 @@ func (t *P2PTunnel) checkActive() bool {
 		return false
 	}
 	hbt := time.Now()
-	t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, nil)
+	t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, heartbeatBody)
 	isActive := false
 	// wait at most 5s
 	for i := 0; i < 50 && !isActive; i++ {
@@ -158,6 +168,72 @@ func (t *P2PTunnel) checkActive() bool {
 	return isActive
 }
 
+// measure the round trip time by the tunnel heartbeat with a nonce, which the peer echoes in the ack,
+// so the concurrent measures and the heartbeat of writeLoop don't take each other's ack. return 0 if timeout
+func (t *P2PTunnel) measureRTT(timeout time.Duration) time.Duration {
+	if !t.isActive() {
+		return 0
+	}
+	nonce := rand.Uint64()
+	for nonce == 0 { // the periodic heartbeat
+		nonce = rand.Uint64()
+	}
+	ch := make(chan time.Time, 1)
+	t.hbMtx.Lock()
+	if t.pings == nil {
+		t.pings = make(map[uint64]chan time.Time)
+	}
+	t.pings[nonce] = ch
+	t.hbMtx.Unlock()
+	defer func() {
+		t.hbMtx.Lock()
+		delete(t.pings, nonce)
+		t.hbMtx.Unlock()
+	}()
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, nonce)
+	hbt := time.Now()
+	if err := t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, body); err != nil {
+		return 0
+	}
+	select {
+	case ackTime := <-ch:
+		return ackTime.Sub(hbt)
+	case <-time.After(timeout):
+	}
+	return 0
+}
+
+// heartbeatBody is the nonce 0 of the periodic heartbeat, the new peers echo it
+var heartbeatBody = make([]byte, 8)
+
+// handleHeartbeatAck records the ack of the heartbeat, the one with the nonce is sent to its measureRTT.
+// The old peers ack without the nonce, their ack wakes all the pending measureRTT
+func (t *P2PTunnel) handleHeartbeatAck(body []byte, now time.Time) {
+	t.hbMtx.Lock()
+	defer t.hbMtx.Unlock()
+	t.hbTime = now
+	if len(body) >= 8 {
+		if ch, ok := t.pings[binary.LittleEndian.Uint64(body)]; ok {
+			select {
+			case ch <- now:
+			default:
+			}
+			return
+		}
+	} else {
+		for _, ch := range t.pings {
+			select {
+			case ch <- now:
+			default:
+			}
+		}
+	}
+	if !t.hbSendTime.IsZero() {
+		t.rtt.Store(int64(now.Sub(t.hbSendTime)))
+	}
+}
+
 // call when user delete tunnel
 func (t *P2PTunnel) close() {
 	GNetwork.NotifyTunnelClose(t)
@@ -173,6 +249,10 @@ func (t *P2PTunnel) close() {
 }
 
 func (t *P2PTunnel) start() error {
+	if GNetwork.sdwan != nil { // before punching, the underlay must not be routed to exit node
+		GNetwork.sdwan.exit.addBypass(t.config.peerIP)
+		GNetwork.sdwan.exit.addBypass(t.config.peerIPv6)
+	}
 	if t.config.linkMode == LinkModeUDPPunch {
 		if err := t.handshake(); err != nil {
 			return err
@@ -242,6 +322,8 @@ func (t *P2PTunnel) connectUnderlay() (err error) {
 		t.conn, err = t.connectUnderlayTCP()
 	case LinkModeUDPPunch:
 		t.conn, err = t.connectUnderlayUDP()
+	case LinkModeWSS:
+		t.conn, err = t.connectUnderlayWS()
 
 	}
 	if err != nil {
@@ -484,6 +566,50 @@ func (t *P2PTunnel) connectUnderlayTCPSymmetric() (c underlay, err error) {
 	}
 }
 
+func (t *P2PTunnel) connectUnderlayWS() (c underlay, err error) {
+	gLog.Printf(LvDEBUG, "connectUnderlayWS %s start ", t.config.LogPeerNode())
+	defer gLog.Printf(LvDEBUG, "connectUnderlayWS %s end ", t.config.LogPeerNode())
+	// server side
+	if t.config.isUnderlayServer == 1 {
+		if wsl == nil {
+			return nil, ErrWSSNotListen
+		}
+		ul := wsl.getUnderlayWS(t.id)
+		if ul == nil {
+			return nil, fmt.Errorf("wait WSS connection timeout")
+		}
+		gLog.Println(LvINFO, "WSS connection ok")
+		t.linkModeWeb = LinkModeWSS
+		return ul, nil
+	}
+	// client side
+	if t.config.peerWSSPort == 0 {
+		return nil, ErrWSSNotListen
+	}
+	ul, err := dialWS(t.config.peerIP, t.config.peerWSSPort, t.config.peerWSSCert, UnderlayConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("WSS dial to %s:%d error:%s", t.config.peerIP, t.config.peerWSSPort, err)
+	}
+	handshakeBegin := time.Now()
+	tidBuff := new(bytes.Buffer)
+	binary.Write(tidBuff, binary.LittleEndian, t.id)
+	ul.WriteBytes(MsgP2P, MsgTunnelHandshake, tidBuff.Bytes()) //  tunnelID
+	ul.SetReadDeadline(time.Now().Add(UnderlayConnectTimeout))
+	_, buff, err := ul.ReadBuffer()
+	ul.SetReadDeadline(time.Time{})
+	if err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("read MsgTunnelHandshake error:%s", err)
+	}
+	if buff != nil {
+		gLog.Println(LvDEBUG, "hello ", string(buff))
+	}
+	gLog.Println(LvINFO, "rtt=", time.Since(handshakeBegin))
+	gLog.Println(LvINFO, "WSS connection ok")
+	t.linkModeWeb = LinkModeWSS
+	return ul, nil
+}
+
 func (t *P2PTunnel) connectUnderlayTCP6() (c underlay, err error) {
 	gLog.Printf(LvDEBUG, "connectUnderlayTCP6 %s start ", t.config.LogPeerNode())
 	defer gLog.Printf(LvDEBUG, "connectUnderlayTCP6 %s end ", t.config.LogPeerNode())
@@ -532,16 +658,25 @@ func (t *P2PTunnel) connectUnderlayTCP6() (c underlay, err error) {
 
 func (t *P2PTunnel) readLoop() {
 	decryptData := make([]byte, ReadBuffLen+PaddingSize) // 16 bytes for padding
+	readBuf := make([]byte, PoolBufferSize)              // reused by every frame, handlers must copy the body if they keep it
+	head := openP2PHeader{}
+	t.peerNodeID = NodeNameToID(t.config.PeerNode)
 	gLog.Printf(LvDEBUG, "%d tunnel readloop start", t.id)
+	if du, ok := t.conn.(datagramUnderlay); ok && du.SupportsDatagrams() {
+		go t.readDatagramLoop(du)
+		go t.pmtuLoop(du)
+	}
 	for t.isRuning() {
 		t.conn.SetReadDeadline(time.Now().Add(TunnelHeartbeatTime * 2))
-		head, body, err := t.conn.ReadBuffer()
+		frame, err := t.conn.ReadFrame(&readBuf, &head)
 		if err != nil {
 			if t.isRuning() {
 				gLog.Printf(LvERROR, "%d tunnel read error:%s", t.id, err)
 			}
 			break
 		}
+		t.rxBytes.Add(uint64(len(frame)))
+		body := frame[openP2PHeaderSize:]
 		if head.MainType != MsgP2P {
 			gLog.Printf(LvWARN, "%d head.MainType != MsgP2P", t.id)
 			continue
@@ -552,20 +687,24 @@ func (t *P2PTunnel) readLoop() {
 			t.hbMtx.Lock()
 			t.hbTime = time.Now()
 			t.hbMtx.Unlock()
-			t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeatAck, nil)
+			t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeatAck, body) // echo the nonce of measureRTT
 			gLog.Printf(LvDev, "%d read tunnel heartbeat", t.id)
 		case MsgTunnelHeartbeatAck:
-			t.hbMtx.Lock()
-			t.hbTime = time.Now()
-			t.hbMtx.Unlock()
+			t.handleHeartbeatAck(body, time.Now())
 			gLog.Printf(LvDev, "%d read tunnel heartbeat ack", t.id)
+		case MsgTunnelMTUProbeAck:
+			if len(body) >= 4 {
+				t.pmtuAck.Store(int32(binary.LittleEndian.Uint32(body)))
+			}
 		case MsgOverlayData:
 			if len(body) < overlayHeaderSize {
 				gLog.Printf(LvWARN, "%d len(body) < overlayHeaderSize", t.id)
 				continue
 			}
 			overlayID := binary.LittleEndian.Uint64(body[:8])
-			gLog.Printf(LvDev, "%d tunnel read overlay data %d bodylen=%d", t.id, overlayID, head.DataLen)
+			if gLog.enabled(LvDev) {
+				gLog.Printf(LvDev, "%d tunnel read overlay data %d bodylen=%d", t.id, overlayID, head.DataLen)
+			}
 			s, ok := t.overlayConns.Load(overlayID)
 			if !ok {
 				// debug level, when overlay connection closed, always has some packet not found tunnel
@@ -579,24 +718,28 @@ func (t *P2PTunnel) readLoop() {
 			payload := body[overlayHeaderSize:]
 			var err error
 			if overlayConn.appKey != 0 {
-				payload, _ = decryptBytes(overlayConn.appKeyBytes, decryptData, body[overlayHeaderSize:], int(head.DataLen-uint32(overlayHeaderSize)))
+				payload, _ = overlayConn.cbc.decrypt(decryptData, body[overlayHeaderSize:], int(head.DataLen-uint32(overlayHeaderSize)))
 			}
 			_, err = overlayConn.Write(payload)
 			if err != nil {
 				gLog.Println(LvERROR, "overlay write error:", err)
 			}
+		case MsgOverlayBondData, MsgOverlayBondAck, MsgOverlayBondProbe:
+			handleBondMessage(head.SubType, body, decryptData)
 		case MsgNodeData:
-			t.handleNodeData(head, body, false)
+			t.handleNodeData(&head, body, false)
 		case MsgRelayNodeData:
-			t.handleNodeData(head, body, true)
-		case MsgRelayData:
-			if len(body) < 8 {
+			t.handleNodeData(&head, body, true)
+		case MsgRelayData, MsgRelayHopData:
+			if len(body) < relayHeaderLen(frame) {
 				continue
 			}
 			tunnelID := binary.LittleEndian.Uint64(body[:8])
-			gLog.Printf(LvDev, "relay data to %d, len=%d", tunnelID, head.DataLen-RelayHeaderSize)
-			if err := GNetwork.relay(tunnelID, body[RelayHeaderSize:]); err != nil {
-				gLog.Printf(LvERROR, "%s:%d relay to %d len=%d error:%s", t.config.LogPeerNode(), t.id, tunnelID, len(body), ErrRelayTunnelNotFound)
+			if gLog.enabled(LvDev) {
+				gLog.Printf(LvDev, "relay data to %d, len=%d", tunnelID, head.DataLen-RelayHeaderSize)
+			}
+			if err := GNetwork.relay(t, tunnelID, frame); err != nil && err != ErrRelayQuotaExceeded {
+				gLog.Printf(LvERROR, "%s:%d relay to %d len=%d error:%s", t.config.LogPeerNode(), t.id, tunnelID, len(body), err)
 			}
 		case MsgRelayHeartbeat:
 			req := RelayHeartbeat{}
@@ -607,7 +750,7 @@ func (t *P2PTunnel) readLoop() {
 			// TODO: debug relay heartbeat
 			gLog.Printf(LvDEBUG, "read MsgRelayHeartbeat from rtid:%d,appid:%d", req.RelayTunnelID, req.AppID)
 			// update app hbtime
-			GNetwork.updateAppHeartbeat(req.AppID)
+			GNetwork.updateAppHeartbeat(req.AppID, false)
 			req.From = gConf.Network.Node
 			t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgRelayHeartbeatAck, &req)
 		case MsgRelayHeartbeatAck:
@@ -619,7 +762,39 @@ func (t *P2PTunnel) readLoop() {
 			}
 			// TODO: debug relay heartbeat
 			gLog.Printf(LvDEBUG, "read MsgRelayHeartbeatAck to appid:%d", req.AppID)
-			GNetwork.updateAppHeartbeat(req.AppID)
+			GNetwork.updateAppHeartbeat(req.AppID, true)
+		case MsgSpeedTestData:
+			handleSpeedTestData(body)
+		case MsgSpeedTestReq:
+			req := SpeedTestReq{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			t.handleSpeedTestReq(&req)
+		case MsgSpeedTestRsp, MsgSpeedTestEnd, MsgSpeedTestResult:
+			handleSpeedTestMsg(head.SubType, body)
+		case MsgReverseListenReq:
+			req := ReverseListenReq{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			t.handleReverseListenReq(&req)
+		case MsgReverseListenRsp:
+			rsp := ReverseListenRsp{}
+			if err := json.Unmarshal(body, &rsp); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(rsp), err)
+				continue
+			}
+			handleReverseListenRsp(&rsp)
+		case MsgReverseCloseReq:
+			req := ReverseCloseReq{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			t.handleReverseCloseReq(&req)
 		case MsgOverlayConnectReq:
 			req := OverlayConnectReq{}
 			if err := json.Unmarshal(body, &req); err != nil {
@@ -643,6 +818,7 @@ func (t *P2PTunnel) readLoop() {
 				appKey:   GetKey(req.AppID),
 				running:  true,
 			}
+			oConn.setQoS(t.config.PeerNode, "", req.Protocol, req.DstPort) // the app name is known by the peer
 			if req.Protocol == "udp" {
 				oConn.connUDP, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(req.DstIP), Port: req.DstPort})
 			} else {
@@ -660,9 +836,11 @@ func (t *P2PTunnel) readLoop() {
 				binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
 				binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
 				oConn.appKeyBytes = encryptKey
+				oConn.cbc, _ = newCBCCipher(encryptKey)
 			}
 
 			t.overlayConns.Store(oConn.id, &oConn)
+			initPeerBond(t, &oConn, &req)
 			go oConn.run()
 		case MsgOverlayDisconnectReq:
 			req := OverlayDisconnectReq{}
@@ -692,27 +870,37 @@ func (t *P2PTunnel) writeLoop() {
 	defer tc.Stop()
 	gLog.Printf(LvDEBUG, "%s:%d tunnel writeLoop start", t.config.LogPeerNode(), t.id)
 	defer gLog.Printf(LvDEBUG, "%s:%d tunnel writeLoop end", t.config.LogPeerNode(), t.id)
+	heartbeat := func() bool {
+		t.hbMtx.Lock()
+		t.hbSendTime = time.Now()
+		t.hbMtx.Unlock()
+		err := t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, heartbeatBody)
+		if err != nil {
+			gLog.Printf(LvERROR, "%d write tunnel heartbeat error %s", t.id, err)
+			t.close()
+			return false
+		}
+		gLog.Printf(LvDev, "%d write tunnel heartbeat ok", t.id)
+		return true
+	}
 	for t.isRuning() {
-		select {
-		case buff := <-t.writeDataSmall:
-			t.conn.WriteBuffer(buff)
-			// gLog.Printf(LvDEBUG, "write icmp %d", time.Now().Unix())
-		default:
-			select {
-			case buff := <-t.writeDataSmall:
-				t.conn.WriteBuffer(buff)
-				// gLog.Printf(LvDEBUG, "write icmp %d", time.Now().Unix())
-			case buff := <-t.writeData:
-				t.conn.WriteBuffer(buff)
+		if wb, ok := t.writeQueue.pop(); ok {
+			t.writeQueued(wb.data)
+			putBuffer(wb.buf)
+			select { // the heartbeat isn't delayed by the saturated queues
 			case <-tc.C:
-				// tunnel send
-				err := t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, nil)
-				if err != nil {
-					gLog.Printf(LvERROR, "%d write tunnel heartbeat error %s", t.id, err)
-					t.close()
+				if !heartbeat() {
 					return
 				}
-				gLog.Printf(LvDev, "%d write tunnel heartbeat ok", t.id)
+			default:
+			}
+			continue
+		}
+		select {
+		case <-t.writeQueue.notify:
+		case <-tc.C:
+			if !heartbeat() {
+				return
 			}
 		}
 	}
@@ -735,6 +923,10 @@ func (t *P2PTunnel) listen() error {
 		PunchTs:         uint64(time.Now().UnixNano() + int64(PunchTsDelay) - GNetwork.dt),
 		Version:         OpenP2PVersion,
 	}
+	if wsl != nil {
+		rsp.WSSPort = wsl.port
+		rsp.WSSCert = wsl.cert
+	}
 	t.punchTs = rsp.PunchTs
 	// only private node set ipv6
 	if t.config.fromToken == gConf.Network.Token {
@@ -758,38 +950,118 @@ func (t *P2PTunnel) closeOverlayConns(appID uint64) {
 }
 
 func (t *P2PTunnel) handleNodeData(head *openP2PHeader, body []byte, isRelay bool) {
-	gLog.Printf(LvDev, "%d tunnel read node data bodylen=%d, relay=%t", t.id, head.DataLen, isRelay)
+	if gLog.enabled(LvDev) {
+		gLog.Printf(LvDev, "%d tunnel read node data bodylen=%d, relay=%t", t.id, head.DataLen, isRelay)
+	}
 	ch := GNetwork.nodeData
 	// if body[9] == 1 { // TODO: deal relay
 	// 	ch = GNetwork.nodeDataSmall
 	// 	gLog.Printf(LvDEBUG, "read icmp %d", time.Now().Unix())
 	// }
+	var nodeID uint64
 	if isRelay {
-		fromPeerID := binary.LittleEndian.Uint64(body[:8])
-		ch <- &NodeData{fromPeerID, body[8:]} // TODO: cache peerNodeID; encrypt/decrypt
+		if len(body) < 8 {
+			return
+		}
+		nodeID = binary.LittleEndian.Uint64(body[:8]) // stamped by the relay
+		body = body[8:]
+		if !GNetwork.relayedBy(nodeID, t) {
+			gLog.Printf(LvDev, "%d tunnel drop node data of %d not relayed by it", t.id, nodeID)
+			return
+		}
 	} else {
-		ch <- &NodeData{NodeNameToID(t.config.PeerNode), body} // TODO: cache peerNodeID; encrypt/decrypt
+		nodeID = t.peerNodeID
 	}
+	ch <- newNodeData(nodeID, body) // TODO: encrypt/decrypt
 }
 
-func (t *P2PTunnel) asyncWriteNodeData(mainType, subType uint16, data []byte) {
-	writeBytes := append(encodeHeader(mainType, subType, uint32(len(data))), data...)
-	// if len(data) < 192 {
-	if data[9] == 1 { // icmp
-		select {
-		case t.writeDataSmall <- writeBytes:
-			// gLog.Printf(LvWARN, "%s:%d t.writeDataSmall write %d", t.config.PeerNode, t.id, len(t.writeDataSmall))
-		default:
-			gLog.Printf(LvWARN, "%s:%d t.writeDataSmall is full, drop it", t.config.LogPeerNode(), t.id)
+// writeNodeFrame sends the sdwan packets as datagram if the underlay supports, otherwise through the stream.
+// The frames larger than the datagram limit go through the stream too, and the flow keeps using the stream
+// for streamFlowTimeout, so the packets of one flow aren't reordered by the two paths.
+func (t *P2PTunnel) writeNodeFrame(frame []byte) error {
+	t.txBytes.Add(uint64(len(frame)))
+	if du, ok := t.conn.(datagramUnderlay); ok && du.SupportsDatagrams() {
+		slot := &t.streamFlows[flowHash(nodeFramePacket(frame))%streamFlowSlots]
+		now := time.Now().UnixNano()
+		if slot.Load() < now {
+			if err := du.WriteDatagram(frame); err == nil {
+				return nil
+			}
 		}
-	} else {
-		select {
-		case t.writeData <- writeBytes:
-		default:
-			gLog.Printf(LvWARN, "%s:%d t.writeData is full, drop it", t.config.LogPeerNode(), t.id)
+		slot.Store(now + int64(streamFlowTimeout))
+	}
+	return t.conn.WriteBuffer(frame)
+}
+
+// readDatagramLoop handles the sdwan packets received as datagram, they may be lost or out of order
+func (t *P2PTunnel) readDatagramLoop(du datagramUnderlay) {
+	gLog.Printf(LvDEBUG, "%d tunnel datagram readloop start", t.id)
+	defer gLog.Printf(LvDEBUG, "%d tunnel datagram readloop end", t.id)
+	head := openP2PHeader{}
+	for t.isRuning() {
+		frame, err := du.ReadDatagram()
+		if err != nil {
+			break
+		}
+		t.rxBytes.Add(uint64(len(frame)))
+		if isMTUProbeFrame(frame) {
+			t.handleMTUProbe(frame)
+			continue
+		}
+		if isSpeedTestFrame(frame) {
+			handleSpeedTestData(frame[openP2PHeaderSize:])
+			continue
+		}
+		if !isNodeDataFrame(frame) {
+			continue
+		}
+		parseP2PHeader(frame, &head)
+		if int(head.DataLen)+openP2PHeaderSize != len(frame) {
+			continue
 		}
+		body := frame[openP2PHeaderSize:]
+		switch head.SubType {
+		case MsgNodeData:
+			t.handleNodeData(&head, body, false)
+		case MsgRelayNodeData:
+			t.handleNodeData(&head, body, true)
+		case MsgRelayData, MsgRelayHopData:
+			GNetwork.relay(t, binary.LittleEndian.Uint64(body[:8]), frame)
+		}
+	}
+}
+
+// writeQueued writes the frame popped from the qos queues
+func (t *P2PTunnel) writeQueued(frame []byte) {
+	if isNodeDataFrame(frame) {
+		t.writeNodeFrame(frame)
+		return
 	}
+	t.txBytes.Add(uint64(len(frame)))
+	t.conn.WriteBuffer(frame) // the app data is never sent as datagram
+}
+
+// queueAppFrame copies the frame of the app connection to the qos queue, waits while the queue is full
+func (t *P2PTunnel) queueAppFrame(class int, frame []byte) {
+	buf := getBuffer()
+	if len(frame) > len(*buf) {
+		*buf = make([]byte, len(frame))
+	}
+	n := copy(*buf, frame)
+	if !t.writeQueue.pushWait(class, frameBuffer{buf, (*buf)[:n]}, t.isRuning) {
+		putBuffer(buf)
+	}
+}
 
+// asyncWriteNodeData queues the frame built by the caller in a pooled buffer, the writeLoop releases it
+func (t *P2PTunnel) asyncWriteNodeData(buf *[]byte, frame []byte, class int) {
+	if t.writeQueue.push(class, frameBuffer{buf, frame}) {
+		return
+	}
+	putBuffer(buf)
+	if n := t.writeQueue.drop(class); n == 1 || n%1000 == 0 {
+		gLog.Printf(LvWARN, "%s:%d %s queue is full, %d dropped", t.config.LogPeerNode(), t.id, qosClassNames[class], n)
+	}
 }
 
 func (t *P2PTunnel) WriteMessage(rtid uint64, mainType uint16, subType uint16, req interface{}) error {
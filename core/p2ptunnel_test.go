@@ -1,8 +1,11 @@
 package openp2p
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestSelectPriority(t *testing.T) {
@@ -22,3 +25,156 @@ func TestSelectPriority(t *testing.T) {
 	}
 
 }
+
+type datagramBenchUnderlay struct {
+	benchUnderlay
+	datagrams [][]byte
+	maxSize   int
+}
+
+func (u *datagramBenchUnderlay) SupportsDatagrams() bool { return true }
+
+func (u *datagramBenchUnderlay) WriteDatagram(b []byte) error {
+	if len(b) > u.maxSize {
+		return errors.New("message too large")
+	}
+	u.datagrams = append(u.datagrams, append([]byte(nil), b...))
+	return nil
+}
+
+func (u *datagramBenchUnderlay) ReadDatagram() ([]byte, error) {
+	return nil, errors.New("closed")
+}
+
+func TestIsNodeDataFrame(t *testing.T) {
+	packet := []byte("ip packet")
+	if !isNodeDataFrame(testFrame(MsgNodeData, packet)) {
+		t.Error("MsgNodeData should be node data")
+	}
+	relayHead := make([]byte, RelayHeaderSize+8)
+	relayNode := testFrame(MsgRelayData, append(relayHead[:RelayHeaderSize], testFrame(MsgRelayNodeData, append(relayHead[RelayHeaderSize:], packet...))...))
+	if !isNodeDataFrame(relayNode) {
+		t.Error("relayed MsgRelayNodeData should be node data")
+	}
+	if isNodeDataFrame(testRelayOverlayFrame(1, 2, packet)) {
+		t.Error("relayed overlay data should be reliable")
+	}
+	if isNodeDataFrame(testFrame(MsgTunnelHeartbeat, nil)) || isNodeDataFrame(testFrame(MsgRelayData, []byte{1})) {
+		t.Error("control message should be reliable")
+	}
+}
+
+func TestWriteNodeFrame(t *testing.T) {
+	ul := &datagramBenchUnderlay{maxSize: 100}
+	tunnel := &P2PTunnel{conn: ul}
+	small := testFrame(MsgNodeData, make([]byte, 50))
+	large := testFrame(MsgNodeData, make([]byte, 200))
+	tunnel.writeNodeFrame(small)
+	tunnel.writeNodeFrame(large)
+	if len(ul.datagrams) != 1 || !bytes.Equal(ul.datagrams[0], small) {
+		t.Errorf("small frame should be sent as datagram:%d", len(ul.datagrams))
+	}
+	if ul.written != len(large) {
+		t.Errorf("large frame should fallback to stream:%d", ul.written)
+	}
+	// the peer doesn't support datagram
+	tunnel.conn = &benchUnderlay{}
+	tunnel.writeNodeFrame(small)
+	if tunnel.conn.(*benchUnderlay).written != len(small) {
+		t.Error("should fallback to stream")
+	}
+}
+
+func TestWriteNodeFrameFlow(t *testing.T) {
+	ul := &datagramBenchUnderlay{maxSize: 100}
+	tunnel := &P2PTunnel{conn: ul}
+	flowA := testIPv4Packet(0x0a020301, 0x0a020302, 6, 40000, 22)
+	flowB := testIPv4Packet(0x0a020301, 0x0a020302, 6, 40001, 22)
+	if flowHash(flowA)%streamFlowSlots == flowHash(flowB)%streamFlowSlots {
+		t.Fatal("the flows share a slot")
+	}
+	large := testFrame(MsgNodeData, append(flowA, make([]byte, 100)...))
+	tunnel.writeNodeFrame(large)
+	tunnel.writeNodeFrame(testFrame(MsgNodeData, flowA))
+	if len(ul.datagrams) != 0 || ul.written != len(large)+openP2PHeaderSize+len(flowA) {
+		t.Errorf("the flow should stay on the stream:%d", len(ul.datagrams))
+	}
+	relayHead := make([]byte, RelayHeaderSize+8)
+	relayB := testFrame(MsgRelayData, append(relayHead[:RelayHeaderSize], testFrame(MsgRelayNodeData, append(relayHead[RelayHeaderSize:], flowB...))...))
+	tunnel.writeNodeFrame(relayB)
+	if len(ul.datagrams) != 1 {
+		t.Error("the other flow should be sent as datagram")
+	}
+	tunnel.streamFlows[flowHash(flowA)%streamFlowSlots].Store(0) // timeout
+	tunnel.writeNodeFrame(testFrame(MsgNodeData, flowA))
+	if len(ul.datagrams) != 2 {
+		t.Error("the flow should go back to datagram")
+	}
+}
+
+// echoUnderlay acks the heartbeat like the peer, the ack of the nonce is delayed
+// echoUnderlay acks the periodic heartbeat at once and the measureRTT after the delay
+type echoUnderlay struct {
+	benchUnderlay
+	tunnel *P2PTunnel
+	delay  time.Duration
+	old    bool // the old peer acks without the nonce
+}
+
+func (u *echoUnderlay) WriteBytes(mainType uint16, subType uint16, data []byte) error {
+	if subType == MsgTunnelHeartbeat {
+		body := append([]byte(nil), data...)
+		go func() {
+			if !bytes.Equal(body, heartbeatBody) {
+				time.Sleep(u.delay)
+			}
+			if u.old {
+				body = nil
+			}
+			u.tunnel.handleHeartbeatAck(body, time.Now())
+		}()
+	}
+	return nil
+}
+
+func TestMeasureRTT(t *testing.T) {
+	tunnel := &P2PTunnel{running: true, hbTime: time.Now()}
+	ul := &echoUnderlay{tunnel: tunnel, delay: time.Millisecond * 50}
+	tunnel.conn = ul
+	// the heartbeat of writeLoop is acked at once, it isn't taken as the ack of the measure
+	tunnel.hbSendTime = time.Now()
+	done := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- tunnel.measureRTT(time.Second) }()
+	}
+	ul.WriteBytes(MsgP2P, MsgTunnelHeartbeat, heartbeatBody)
+	for i := 0; i < 2; i++ {
+		if rtt := <-done; rtt < ul.delay {
+			t.Errorf("rtt %s, want at least %s", rtt, ul.delay)
+		}
+	}
+	if rtt := time.Duration(tunnel.rtt.Load()); rtt <= 0 || rtt >= ul.delay {
+		t.Errorf("heartbeat rtt %s", rtt)
+	}
+	if len(tunnel.pings) != 0 {
+		t.Errorf("%d pings left", len(tunnel.pings))
+	}
+}
+
+func TestMeasureRTTOldPeer(t *testing.T) {
+	tunnel := &P2PTunnel{running: true, hbTime: time.Now()}
+	ul := &echoUnderlay{tunnel: tunnel, delay: time.Millisecond * 50, old: true}
+	tunnel.conn = ul
+	start := time.Now()
+	if rtt := tunnel.measureRTT(time.Second); rtt < ul.delay || time.Since(start) > time.Millisecond*500 {
+		t.Errorf("rtt %s of the old peer, want at least %s without timeout", rtt, ul.delay)
+	}
+	tunnel.hbMtx.Lock()
+	tunnel.hbSendTime = time.Now()
+	tunnel.hbMtx.Unlock()
+	ul.WriteBytes(MsgP2P, MsgTunnelHeartbeat, heartbeatBody)
+	time.Sleep(time.Millisecond * 100)
+	if rtt := time.Duration(tunnel.rtt.Load()); rtt <= 0 || rtt >= ul.delay*2 {
+		t.Errorf("heartbeat rtt %s of the old peer", rtt)
+	}
+}
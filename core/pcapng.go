@@ -0,0 +1,293 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// pcapng blocks, https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+// Interface 0 is the IP packets of tun, interface 1 is the ethernet frames of tap.
+
+const (
+	pcapngSHB         = 0x0A0D0D0A
+	pcapngIDB         = 1
+	pcapngEPB         = 6
+	pcapngLinkRaw     = 101
+	pcapngLinkEther   = 1
+	pcapngOptComment  = 1
+	pcapngOptIfName   = 2
+	pcapngOptEPBFlags = 2
+	pcapngIfaceTun    = 0
+	pcapngIfaceTap    = 1
+)
+
+func pcapngPad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// pcapngBlock wraps the body with the block type and the total length
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	total := 12 + len(body)
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	return b
+}
+
+// pcapngOption appends the option padded to 32 bits
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pcapngPad(len(value)))...)
+}
+
+// pcapngHeader is the section header and the interfaces
+func pcapngHeader(snaplen int) []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff) // unknown section length
+	shb = pcapngOption(shb, pcapngOptComment, []byte("openp2p "+OpenP2PVersion))
+	shb = pcapngOption(shb, 0, nil)
+	res := pcapngBlock(pcapngSHB, shb)
+	for _, iface := range []struct {
+		linkType uint16
+		name     string
+	}{{pcapngLinkRaw, "sdwan"}, {pcapngLinkEther, "sdwan-tap"}} {
+		idb := binary.LittleEndian.AppendUint16(nil, iface.linkType)
+		idb = binary.LittleEndian.AppendUint16(idb, 0)
+		idb = binary.LittleEndian.AppendUint32(idb, uint32(snaplen))
+		idb = pcapngOption(idb, pcapngOptIfName, []byte(iface.name))
+		idb = pcapngOption(idb, 0, nil)
+		res = append(res, pcapngBlock(pcapngIDB, idb)...)
+	}
+	return res
+}
+
+// pcapngPacket is the enhanced packet block, inbound is from the peer
+func pcapngPacket(iface int, ts time.Time, p []byte, snaplen int, inbound bool, comment string) []byte {
+	capLen := len(p)
+	if capLen > snaplen {
+		capLen = snaplen
+	}
+	us := uint64(ts.UnixMicro())
+	epb := make([]byte, 20, 20+capLen+pcapngPad(capLen)+32+len(comment))
+	binary.LittleEndian.PutUint32(epb[0:4], uint32(iface))
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(us>>32))
+	binary.LittleEndian.PutUint32(epb[8:12], uint32(us))
+	binary.LittleEndian.PutUint32(epb[12:16], uint32(capLen))
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(len(p)))
+	epb = append(epb, p[:capLen]...)
+	epb = append(epb, make([]byte, pcapngPad(capLen))...)
+	flags := uint32(2) // outbound
+	if inbound {
+		flags = 1
+	}
+	epb = pcapngOption(epb, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	if comment != "" {
+		epb = pcapngOption(epb, pcapngOptComment, []byte(comment))
+	}
+	epb = pcapngOption(epb, 0, nil)
+	return pcapngBlock(pcapngEPB, epb)
+}
+
+// capturePacket is the packet seen by the capture filter
+type capturePacket struct {
+	data    []byte
+	ether   bool
+	inbound bool
+	nodeID  uint64
+}
+
+// captureFilter is the compiled BPF-style expression, nil matches all
+type captureFilter func(p *capturePacket, ip *flowKey, ipOK bool) bool
+
+// parseCaptureFilter compiles the expression like "host 10.2.3.4 and (tcp port 22 or icmp) and not node NAS1".
+// The primitives: [src|dst] host IP, [src|dst] net CIDR, [src|dst] port N[-M], tcp, udp, icmp, ip, arp,
+// node NAME, in, out. They're combined by and, or, not and parentheses, like tcpdump.
+func parseCaptureFilter(s string) (captureFilter, error) {
+	s = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(s)
+	p := &filterParser{tokens: strings.Fields(s)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	f, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) expr() (captureFilter, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *capturePacket, k *flowKey, ok bool) bool { return l(c, k, ok) || right(c, k, ok) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) term() (captureFilter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and":
+			p.pos++
+		case "", "or", ")":
+			return left, nil
+		} // adjacent primitives are and, like "tcp port 22"
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *capturePacket, k *flowKey, ok bool) bool { return l(c, k, ok) && right(c, k, ok) }
+	}
+}
+
+func (p *filterParser) factor() (captureFilter, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *capturePacket, k *flowKey, ok bool) bool { return !f(c, k, ok) }, nil
+	case "(":
+		p.pos++
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return f, nil
+	}
+	return p.primitive()
+}
+
+func (p *filterParser) primitive() (captureFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	dir := ""
+	if tok = strings.ToLower(tok); tok == "src" || tok == "dst" {
+		dir = tok
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+		tok = strings.ToLower(tok)
+		if tok != "host" && tok != "net" && tok != "port" { // "src 10.2.3.4"
+			p.pos--
+			tok = "host"
+		}
+	}
+	matchIP := func(k *flowKey, match func(uint32) bool) bool {
+		return (dir != "dst" && match(k.src)) || (dir != "src" && match(k.dst))
+	}
+	switch tok {
+	case "host", "net":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == "host" && !strings.Contains(arg, "/") {
+			arg += "/32"
+		}
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("wrong %s %s in filter", tok, arg)
+		}
+		ip := binary.BigEndian.Uint32(ipnet.IP.To4())
+		mask := binary.BigEndian.Uint32(ipnet.Mask)
+		return func(c *capturePacket, k *flowKey, ok bool) bool {
+			return ok && matchIP(k, func(a uint32) bool { return a&mask == ip })
+		}, nil
+	case "port":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		ports, err := parsePortRanges(arg)
+		if err != nil || len(ports) == 0 {
+			return nil, fmt.Errorf("wrong port %s in filter", arg)
+		}
+		inRange := func(port uint16) bool {
+			for _, r := range ports {
+				if port >= r[0] && port <= r[1] {
+					return true
+				}
+			}
+			return false
+		}
+		return func(c *capturePacket, k *flowKey, ok bool) bool {
+			if !ok || (k.proto != IPProtoTCP && k.proto != IPProtoUDP) {
+				return false
+			}
+			return (dir != "dst" && inRange(k.sport)) || (dir != "src" && inRange(k.dport))
+		}, nil
+	case "tcp", "udp", "icmp":
+		proto := map[string]byte{"tcp": IPProtoTCP, "udp": IPProtoUDP, "icmp": IPProtoICMP}[tok]
+		return func(c *capturePacket, k *flowKey, ok bool) bool { return ok && k.proto == proto }, nil
+	case "ip":
+		return func(c *capturePacket, k *flowKey, ok bool) bool { return ok }, nil
+	case "arp":
+		return func(c *capturePacket, k *flowKey, ok bool) bool {
+			return c.ether && len(c.data) >= ethHeaderSize && binary.BigEndian.Uint16(c.data[12:14]) == 0x0806
+		}, nil
+	case "node":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		id := NodeNameToID(arg)
+		return func(c *capturePacket, k *flowKey, ok bool) bool { return c.nodeID == id }, nil
+	case "in", "out":
+		inbound := tok == "in"
+		return func(c *capturePacket, k *flowKey, ok bool) bool { return c.inbound == inbound }, nil
+	}
+	return nil, fmt.Errorf("unknown %s in filter", tok)
+}
@@ -0,0 +1,77 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestParseCaptureFilter(t *testing.T) {
+	ssh := testIPv4Packet(0x0a020301, 0x0a020304, IPProtoTCP, 40000, 22)
+	dns := testIPv4Packet(0x0a020304, 0x0a020301, IPProtoUDP, 53, 40000)
+	ping := testIPv4Packet(0x0a020301, 0x0a020309, IPProtoICMP, 0, 0)
+	nas := NodeNameToID("NAS1")
+	cases := []struct {
+		filter string
+		want   [3]bool // ssh out to NAS1, dns in from NAS1, ping out to other
+	}{
+		{"", [3]bool{true, true, true}},
+		{"host 10.2.3.4", [3]bool{true, true, false}},
+		{"dst host 10.2.3.4", [3]bool{true, false, false}},
+		{"src 10.2.3.4", [3]bool{false, true, false}},
+		{"net 10.2.3.0/24 and not icmp", [3]bool{true, true, false}},
+		{"tcp port 22", [3]bool{true, false, false}},
+		{"udp src port 50-60", [3]bool{false, true, false}},
+		{"icmp || (node NAS1 && in)", [3]bool{false, true, true}},
+		{"!node NAS1 or out and tcp", [3]bool{true, false, true}},
+	}
+	for _, c := range cases {
+		f, err := parseCaptureFilter(c.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", c.filter, err)
+		}
+		for i, pkt := range []capturePacket{
+			{data: ssh, nodeID: nas},
+			{data: dns, nodeID: nas, inbound: true},
+			{data: ping, nodeID: 1},
+		} {
+			var key flowKey
+			_, ok := parseFlow(pkt.data, &key)
+			if got := f == nil || f(&pkt, &key, ok); got != c.want[i] {
+				t.Errorf("%s packet %d got %v", c.filter, i, got)
+			}
+		}
+	}
+	for _, s := range []string{"host", "host 10.2.3", "port x", "tcp and", "(tcp", "tcp)", "foo"} {
+		if _, err := parseCaptureFilter(s); err == nil {
+			t.Errorf("%s should be wrong", s)
+		}
+	}
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	checkBlocks := func(b []byte, types ...uint32) {
+		for _, typ := range types {
+			if len(b) < 12 {
+				t.Fatalf("short block %d", len(b))
+			}
+			total := int(binary.LittleEndian.Uint32(b[4:8]))
+			if binary.LittleEndian.Uint32(b[0:4]) != typ || total%4 != 0 || total > len(b) ||
+				binary.LittleEndian.Uint32(b[total-4:total]) != uint32(total) {
+				t.Fatalf("wrong block type %x total %d", typ, total)
+			}
+			b = b[total:]
+		}
+		if len(b) != 0 {
+			t.Errorf("%d bytes left", len(b))
+		}
+	}
+	checkBlocks(pcapngHeader(captureDefaultSnaplen), pcapngSHB, pcapngIDB, pcapngIDB)
+	p := make([]byte, 101)
+	b := pcapngPacket(pcapngIfaceTun, time.Now(), p, 64, true, "from NAS1 tunnel 1 direct")
+	checkBlocks(b, pcapngEPB)
+	if capLen, origLen := binary.LittleEndian.Uint32(b[20:24]), binary.LittleEndian.Uint32(b[24:28]); capLen != 64 || origLen != 101 {
+		t.Errorf("capLen %d origLen %d", capLen, origLen)
+	}
+	checkBlocks(pcapngPacket(pcapngIfaceTap, time.Now(), p, captureDefaultSnaplen, false, ""), pcapngEPB)
+}
@@ -0,0 +1,257 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The sdwan packets are sent as datagrams when the underlay supports, the larger ones fall back to the
+// reliable stream, which reorders them and causes TCP-over-TCP meltdown. Every datagram tunnel discovers
+// the largest frame it carries by probing, then the packets to the node are kept under the path mtu:
+//   - the TCP SYNs in both directions have their MSS clamped
+//   - the oversized IPv4 packets with DF are answered with ICMP fragmentation needed
+//   - the oversized IPv6 packets are answered with ICMPv6 packet too big
+//   - the tun mtu follows the largest path mtu of the nodes
+//
+// quic-go limits the DATAGRAM frame to 1200 bytes whatever the path mtu is, so the search starts from
+// pmtuProbeMin and the path mtu of a quic tunnel is about 1200. The packets between it and minTunMTU
+// go through the stream, and their flows stay there.
+
+const (
+	minTunMTU          = 1280
+	maxTunMTU          = 9000
+	defaultTunMTU      = 1375
+	pmtuProbeInterval  = time.Minute * 10
+	pmtuProbeTimeout   = time.Millisecond * 300
+	pmtuProbeRetry     = 2
+	pmtuProbeStep      = 8
+	pmtuProbeMin       = 576                 // the smallest ipv4 packet every host accepts
+	relayFrameOverhead = RelayHeaderSize + 8 // the rtid and the from node id
+)
+
+// tunMTU is the configured max mtu of tun
+func tunMTU() int {
+	if gConf.Network.TunMTU >= minTunMTU && gConf.Network.TunMTU <= maxTunMTU {
+		return gConf.Network.TunMTU
+	}
+	return defaultTunMTU
+}
+
+// readTunBuffSize fits the largest packet of tun
+func readTunBuffSize() int {
+	if tunMTU() > ReadTunBuffSize {
+		return tunMTU()
+	}
+	return ReadTunBuffSize
+}
+
+// frameMTU converts the max frame size of tunnel to the max ip packet size
+func frameMTU(frame int, isDirect bool) int {
+	mtu := frame - openP2PHeaderSize
+	if !isDirect {
+		mtu -= openP2PHeaderSize + relayFrameOverhead
+	}
+	if mtu > tunMTU() {
+		mtu = tunMTU()
+	}
+	if mtu < minTunMTU {
+		mtu = minTunMTU
+	}
+	return mtu
+}
+
+func isMTUProbeFrame(frame []byte) bool {
+	return len(frame) >= openP2PHeaderSize+4 && binary.LittleEndian.Uint16(frame[4:6]) == MsgP2P &&
+		binary.LittleEndian.Uint16(frame[6:8]) == MsgTunnelMTUProbe
+}
+
+// handleMTUProbe acks the probe through the stream, the body is the probe size
+func (t *P2PTunnel) handleMTUProbe(frame []byte) {
+	ack := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ack, uint32(len(frame)))
+	t.conn.WriteBytes(MsgP2P, MsgTunnelMTUProbeAck, ack)
+}
+
+// probeMTU sends a datagram of size bytes, returns whether the peer received it
+func (t *P2PTunnel) probeMTU(du datagramUnderlay, size int) bool {
+	frame := make([]byte, size)
+	putHeader(frame, MsgP2P, MsgTunnelMTUProbe, uint32(size-openP2PHeaderSize))
+	binary.LittleEndian.PutUint32(frame[openP2PHeaderSize:], uint32(size))
+	for i := 0; i < pmtuProbeRetry; i++ {
+		if err := du.WriteDatagram(frame); err != nil { // larger than the datagram limit
+			return false
+		}
+		start := time.Now()
+		for time.Since(start) < pmtuProbeTimeout {
+			if int(t.pmtuAck.Load()) == size {
+				return true
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+	return false
+}
+
+// discoverPMTU searches the largest frame carried by datagram, 0 if the peer doesn't ack the probe
+func (t *P2PTunnel) discoverPMTU(du datagramUnderlay) int {
+	lo := pmtuProbeMin + openP2PHeaderSize
+	hi := tunMTU() + openP2PHeaderSize*2 + relayFrameOverhead
+	if !t.probeMTU(du, lo) {
+		return 0
+	}
+	for hi-lo > pmtuProbeStep && t.isRuning() {
+		mid := (lo + hi) / 2
+		if t.probeMTU(du, mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if t.probeMTU(du, hi) {
+		return hi
+	}
+	return lo
+}
+
+// pmtuLoop discovers the path mtu periodically, the path may change
+func (t *P2PTunnel) pmtuLoop(du datagramUnderlay) {
+	for t.isRuning() {
+		pmtu := t.discoverPMTU(du)
+		if old := t.pmtu.Swap(int32(pmtu)); int(old) != pmtu {
+			gLog.Printf(LvINFO, "%s:%d tunnel path mtu %d", t.config.LogPeerNode(), t.id, pmtu)
+			if GNetwork.sdwan != nil {
+				GNetwork.sdwan.updateTunMTU()
+			}
+		}
+		for i := time.Duration(0); i < pmtuProbeInterval && t.isRuning(); i += time.Second {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// csumAdd adds b to the ones' complement sum
+func csumAdd(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+func csumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// isTCPSYN reports whether p is an unfragmented IPv4 TCP SYN
+func isTCPSYN(p []byte) bool {
+	if len(p) < 20 || p[0]>>4 != 4 || p[9] != IPProtoTCP || binary.BigEndian.Uint16(p[6:8])&0x1fff != 0 {
+		return false
+	}
+	ihl := int(p[0]&0x0f) * 4
+	return ihl >= 20 && len(p) >= ihl+20 && p[ihl+13]&0x02 != 0
+}
+
+// clampMSS lowers the MSS option of TCP SYN to fit mtu, returns whether p is changed
+func clampMSS(p []byte, mtu int) bool {
+	if !isTCPSYN(p) {
+		return false
+	}
+	ihl := int(p[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(p[2:4]))
+	if totalLen > len(p) {
+		return false
+	}
+	p = p[:totalLen]
+	tcp := p[ihl:]
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < 20 || dataOff > len(tcp) {
+		return false
+	}
+	maxMSS := uint16(mtu - 40)
+	opts := tcp[20:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // end of options
+			return false
+		case 1: // nop
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false
+		}
+		if opts[i] == 2 && opts[i+1] == 4 {
+			if binary.BigEndian.Uint16(opts[i+2:]) <= maxMSS {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[i+2:], maxMSS)
+			setTCPChecksum(p, ihl)
+			return true
+		}
+		i += int(opts[i+1])
+	}
+	return false
+}
+
+// setTCPChecksum recalculates the checksum with the pseudo header, only for the rare SYN
+func setTCPChecksum(p []byte, ihl int) {
+	tcp := p[ihl:]
+	binary.BigEndian.PutUint16(tcp[16:18], 0)
+	sum := csumAdd(0, p[12:20])
+	sum += uint32(IPProtoTCP) + uint32(len(tcp))
+	sum = csumAdd(sum, tcp)
+	binary.BigEndian.PutUint16(tcp[16:18], csumFold(sum))
+}
+
+// icmpFragNeeded builds the ICMP fragmentation needed of the IPv4 packet p, as if from its destination
+func icmpFragNeeded(p []byte, mtu int) []byte {
+	ihl := int(p[0]&0x0f) * 4
+	quote := ihl + 8
+	if quote > len(p) {
+		quote = len(p)
+	}
+	b := make([]byte, 20+8+quote)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = IPProtoICMP
+	copy(b[12:16], p[16:20])
+	copy(b[16:20], p[12:16])
+	binary.BigEndian.PutUint16(b[10:12], csumFold(csumAdd(0, b[:20])))
+	icmp := b[20:]
+	icmp[0] = 3 // destination unreachable
+	icmp[1] = 4 // fragmentation needed and DF set
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], p[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], csumFold(csumAdd(0, icmp)))
+	return b
+}
+
+// icmpv6PacketTooBig builds the ICMPv6 packet too big of the IPv6 packet p, as if from its destination
+func icmpv6PacketTooBig(p []byte, mtu int) []byte {
+	quote := len(p)
+	if quote > minTunMTU-40-8 { // the error fits the minimum ipv6 mtu
+		quote = minTunMTU - 40 - 8
+	}
+	b := make([]byte, 40+8+quote)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+quote))
+	b[6] = IPProtoICMPv6
+	b[7] = 64
+	copy(b[8:24], p[24:40])
+	copy(b[24:40], p[8:24])
+	icmp := b[40:]
+	icmp[0] = 2 // packet too big
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], p[:quote])
+	sum := csumAdd(0, b[8:40])
+	sum += uint32(IPProtoICMPv6) + uint32(len(icmp))
+	binary.BigEndian.PutUint16(icmp[2:4], csumFold(csumAdd(sum, icmp)))
+	return b
+}
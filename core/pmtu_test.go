@@ -0,0 +1,133 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tcpSYN builds an IPv4 TCP SYN with the MSS option
+func tcpSYN(mss uint16) []byte {
+	p := testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 22)
+	p = append(p[:40], 1, 1, 2, 4, 0, 0, 0, 0) // nop nop mss eol
+	binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+	p[32] = 7 << 4 // data offset 28 bytes
+	p[33] = 0x02   // SYN
+	binary.BigEndian.PutUint16(p[44:46], mss)
+	setTCPChecksum(p, 20)
+	return p
+}
+
+func tcpChecksumOK(p []byte) bool {
+	sum := csumAdd(0, p[12:20])
+	sum += uint32(IPProtoTCP) + uint32(len(p)-20)
+	return csumFold(csumAdd(sum, p[20:])) == 0
+}
+
+func TestClampMSS(t *testing.T) {
+	p := tcpSYN(1460)
+	if !clampMSS(p, 1280) {
+		t.Fatal("mss should be clamped")
+	}
+	if mss := binary.BigEndian.Uint16(p[44:46]); mss != 1240 {
+		t.Errorf("mss=%d, want 1240", mss)
+	}
+	if !tcpChecksumOK(p) {
+		t.Error("wrong tcp checksum after clamping")
+	}
+	if clampMSS(tcpSYN(1200), 1280) {
+		t.Error("small mss should not be changed")
+	}
+	ack := tcpSYN(1460)
+	ack[33] = 0x10
+	if clampMSS(ack, 1280) {
+		t.Error("only SYN should be clamped")
+	}
+}
+
+func TestICMPFragNeeded(t *testing.T) {
+	p := testIPv4Packet(0x0a020301, 0x0a020302, IPProtoUDP, 5000, 53)
+	b := icmpFragNeeded(p, 1300)
+	if csumFold(csumAdd(0, b[:20])) != 0 || csumFold(csumAdd(0, b[20:])) != 0 {
+		t.Error("wrong checksum")
+	}
+	if binary.BigEndian.Uint32(b[12:16]) != 0x0a020302 || binary.BigEndian.Uint32(b[16:20]) != 0x0a020301 {
+		t.Error("the icmp should be from the original destination")
+	}
+	if b[20] != 3 || b[21] != 4 || binary.BigEndian.Uint16(b[26:28]) != 1300 {
+		t.Errorf("wrong icmp type=%d code=%d mtu=%d", b[20], b[21], binary.BigEndian.Uint16(b[26:28]))
+	}
+	// the acl passes it as the error of the tracked flow
+	acl := newSDWANACL()
+	acl.enabled.Store(true)
+	acl.track(p)
+	if !acl.allow(0, b) {
+		t.Error("acl should allow the icmp error of tracked flow")
+	}
+}
+
+func TestFrameMTU(t *testing.T) {
+	if mtu := frameMTU(1300+openP2PHeaderSize, true); mtu != 1300 {
+		t.Errorf("direct mtu=%d, want 1300", mtu)
+	}
+	if mtu := frameMTU(1300+openP2PHeaderSize*2+relayFrameOverhead, false); mtu != 1300 {
+		t.Errorf("relay mtu=%d, want 1300", mtu)
+	}
+	if mtu := frameMTU(100000, true); mtu != tunMTU() {
+		t.Errorf("mtu=%d, want tunMTU %d", mtu, tunMTU())
+	}
+	if mtu := frameMTU(500, true); mtu != minTunMTU {
+		t.Errorf("mtu=%d, want %d", mtu, minTunMTU)
+	}
+}
+
+// ackUnderlay acks every probe the datagram carries, like the peer does
+type ackUnderlay struct {
+	datagramBenchUnderlay
+	tunnel *P2PTunnel
+}
+
+func (u *ackUnderlay) WriteDatagram(b []byte) error {
+	if err := u.datagramBenchUnderlay.WriteDatagram(b); err != nil {
+		return err
+	}
+	u.tunnel.pmtuAck.Store(int32(len(b)))
+	return nil
+}
+
+func TestDiscoverPMTU(t *testing.T) {
+	for _, maxSize := range []int{1200, 1400} { // the quic datagram limit and a larger path
+		tunnel := &P2PTunnel{running: true}
+		ul := &ackUnderlay{datagramBenchUnderlay{maxSize: maxSize}, tunnel}
+		pmtu := tunnel.discoverPMTU(ul)
+		if pmtu > maxSize || pmtu <= maxSize-pmtuProbeStep {
+			t.Errorf("pmtu=%d, want about %d", pmtu, maxSize)
+		}
+	}
+	tunnel := &P2PTunnel{running: true}
+	if pmtu := tunnel.discoverPMTU(&datagramBenchUnderlay{maxSize: 400}); pmtu != 0 {
+		t.Errorf("pmtu=%d, want 0 without datagram", pmtu)
+	}
+}
+
+func TestICMPv6PacketTooBig(t *testing.T) {
+	p := make([]byte, 1400)
+	p[0] = 0x60
+	p[6] = IPProtoUDP
+	p[23] = 1 // ::1
+	p[39] = 2 // ::2
+	b := icmpv6PacketTooBig(p, 1300)
+	if len(b) != minTunMTU {
+		t.Fatalf("len=%d, want %d", len(b), minTunMTU)
+	}
+	if b[6] != IPProtoICMPv6 || b[23] != 2 || b[39] != 1 {
+		t.Errorf("wrong header next=%d src=%d dst=%d", b[6], b[23], b[39])
+	}
+	if b[40] != 2 || b[41] != 0 || binary.BigEndian.Uint32(b[44:48]) != 1300 {
+		t.Errorf("wrong icmpv6 type=%d code=%d mtu=%d", b[40], b[41], binary.BigEndian.Uint32(b[44:48]))
+	}
+	sum := csumAdd(0, b[8:40])
+	sum += uint32(IPProtoICMPv6) + uint32(len(b)-40)
+	if csumFold(csumAdd(sum, b[40:])) != 0 {
+		t.Error("wrong icmpv6 checksum")
+	}
+}
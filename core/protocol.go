@@ -10,7 +10,7 @@ import (
 	"time"
 )
 
-const OpenP2PVersion = "3.21.12"
+const OpenP2PVersion = "3.22.0"
 const ProductName string = "openp2p"
 const LeastSupportVersion = "3.0.0"
 const SyncServerTimeVersion = "3.9.0"
@@ -18,6 +18,9 @@ const SymmetricSimultaneouslySendVersion = "3.10.7"
 const PublicIPVersion = "3.11.2"
 const SupportIntranetVersion = "3.14.5"
 const SupportDualTunnelVersion = "3.15.5"
+const SupportBondingVersion = "3.22.0"
+const SupportRelaySelectVersion = "3.22.0"
+const SupportWSSVersion = "3.22.0"
 
 const (
 	IfconfigPort1 = 27180
@@ -109,6 +112,12 @@ const (
 	MsgPushReportMemApps        = 17
 	MsgPushServerSideSaveMemApp = 18
 	MsgPushCheckRemoteService   = 19
+	MsgPushReportRelayUsage     = 20
+	MsgPushRelayHopReq          = 21
+	MsgPushRelayHopRsp          = 22
+	MsgPushRelayProbeReq        = 23
+	MsgPushRelayProbeRsp        = 24
+	MsgPushRelayHopClose        = 25
 )
 
 // MsgP2P sub type message
@@ -128,6 +137,22 @@ const (
 	MsgRelayHeartbeatAck
 	MsgNodeData
 	MsgRelayNodeData
+	MsgOverlayBondData
+	MsgOverlayBondAck
+	MsgOverlayBondProbe
+	MsgTunnelMTUProbe
+	MsgTunnelMTUProbeAck
+	MsgStaticHandshake
+	MsgStaticHandshakeAck
+	MsgSpeedTestReq
+	MsgSpeedTestRsp
+	MsgSpeedTestData
+	MsgSpeedTestEnd
+	MsgSpeedTestResult
+	MsgReverseListenReq
+	MsgReverseListenRsp
+	MsgReverseCloseReq
+	MsgRelayHopData
 )
 
 // MsgRelay sub type message
@@ -145,6 +170,7 @@ const (
 	MsgReportLog
 	MsgReportMemApps
 	MsgReportResponse
+	MsgReportRelayUsage
 )
 
 const (
@@ -205,6 +231,7 @@ const (
 	LinkModeTCP4     = "tcp4"
 	LinkModeUDP6     = "udp6"
 	LinkModeUDP4     = "udp4"
+	LinkModeWSS      = "wss" // websocket over tls, through http proxy
 )
 
 const (
@@ -281,6 +308,8 @@ type PushConnectRsp struct {
 	ID              uint64 `json:"id,omitempty"`
 	PunchTs         uint64 `json:"punchts,omitempty"` // server timestamp
 	Version         string `json:"version,omitempty"`
+	WSSPort         int    `json:"wssPort,omitempty"`
+	WSSCert         []byte `json:"wssCert,omitempty"` // the self-signed cert of the wss listener, the only one trusted by the peer
 }
 type PushRsp struct {
 	Error  int    `json:"error,omitempty"`
@@ -320,7 +349,37 @@ type OverlayConnectReq struct {
 	Protocol      string `json:"protocol,omitempty"`
 	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // if not 0 relay
 	AppID         uint64 `json:"appID,omitempty"`
+	// bonding, stripe this overlay connection across these paths, empty no bonding
+	BondPaths []BondPath `json:"bondPaths,omitempty"`
 }
+
+// BondPath is one path of the bonding, in the same order on both sides
+type BondPath struct {
+	TunnelID      uint64 `json:"tunnelID,omitempty"`      // peer's tunnel id of this path
+	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // sender's tunnel id to the relay node, peer use it as rtid. 0 direct
+}
+
+// ReverseListenReq asks the peer to listen on SrcPort for the reverse app, the accepted connections come back
+// by OverlayConnectReq to DstIP:DstPort. It's repeated as the heartbeat of the listener
+type ReverseListenReq struct {
+	AppID         uint64 `json:"appID,omitempty"`
+	Token         uint64 `json:"token,omitempty"` // not totp token
+	SrcPort       int    `json:"srcPort,omitempty"`
+	Whitelist     string `json:"whitelist,omitempty"`
+	DstIP         string `json:"dstIP,omitempty"`
+	DstPort       int    `json:"dstPort,omitempty"`
+	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // if not 0 relay
+}
+
+type ReverseListenRsp struct {
+	AppID uint64 `json:"appID,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReverseCloseReq struct {
+	AppID uint64 `json:"appID,omitempty"`
+}
+
 type OverlayDisconnectReq struct {
 	ID uint64 `json:"id,omitempty"`
 }
@@ -348,6 +407,46 @@ type AddRelayTunnelReq struct {
 	AppKey        uint64 `json:"appKey,omitempty"` // deprecated
 }
 
+type RelayCandidate struct {
+	Node  string `json:"node,omitempty"`
+	Token uint64 `json:"token,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+}
+
+type RelayProbeReq struct {
+	From       string           `json:"from,omitempty"`
+	Token      uint64           `json:"token,omitempty"` // not totp token
+	Candidates []RelayCandidate `json:"candidates,omitempty"`
+}
+
+type RelayProbeRsp struct {
+	RTT map[string]int64 `json:"rtt,omitempty"` // node: rtt in microseconds, unreachable node not included
+}
+
+type RelayHopReq struct {
+	From         string `json:"from,omitempty"`
+	Token        uint64 `json:"token,omitempty"` // relay token of this hop, verified like the connect request
+	Hop          int    `json:"hop,omitempty"`
+	NextNode     string `json:"nextNode,omitempty"` // empty on the last hop
+	NextToken    uint64 `json:"nextToken,omitempty"`
+	PrevTunnelID uint64 `json:"prevTunnelID,omitempty"` // tunnel to the previous hop, 0 on the first hop
+	SrcTunnelID  uint64 `json:"srcTunnelID,omitempty"`  // source node's tunnel to the first hop
+	DstTunnelID  uint64 `json:"dstTunnelID,omitempty"`  // peer node's tunnel to the last hop
+}
+
+type RelayHopRsp struct {
+	TunnelID uint64 `json:"tunnelID,omitempty"` // tunnel to the next hop
+	Error    string `json:"error,omitempty"`
+}
+
+// RelayHopClose tears down a hop of the relay chain from the source node,
+// or tells the source node that the hop is down
+type RelayHopClose struct {
+	From        string `json:"from,omitempty"`
+	Token       uint64 `json:"token,omitempty"`
+	SrcTunnelID uint64 `json:"srcTunnelID,omitempty"`
+}
+
 type APPKeySync struct {
 	AppID  uint64 `json:"appID,omitempty"`
 	AppKey uint64 `json:"appKey,omitempty"`
@@ -412,12 +511,102 @@ type AppInfo struct {
 	ConnectTime    string `json:"connectTime,omitempty"`
 	IsActive       int    `json:"isActive,omitempty"`
 	Enabled        int    `json:"enabled,omitempty"`
+	Bonding        int    `json:"bonding,omitempty"`
 }
 
 type ReportApps struct {
 	Apps []AppInfo
 }
 
+// NodeStatus is the status of the running node for "openp2p status"
+type NodeStatus struct {
+	Node            string      `json:"node,omitempty"`
+	Version         string      `json:"version,omitempty"`
+	Online          int         `json:"online,omitempty"`
+	PublicIP        string      `json:"publicIP,omitempty"`
+	IPv6            string      `json:"IPv6,omitempty"`
+	LanIP           string      `json:"lanIP,omitempty"`
+	NatType         int         `json:"natType,omitempty"`
+	HasIPv4         int         `json:"hasIPv4,omitempty"`
+	HasUPNPorNATPMP int         `json:"hasUPNPorNATPMP,omitempty"`
+	SDWANIP         string      `json:"sdwanIP,omitempty"`
+	Apps            []AppStatus `json:"apps,omitempty"`
+}
+
+type AppStatus struct {
+	AppName   string            `json:"appName,omitempty"`
+	Protocol  string            `json:"protocol,omitempty"`
+	SrcPort   int               `json:"srcPort,omitempty"`
+	Reverse   int               `json:"reverse,omitempty"` // 1: SrcPort is on the peer
+	PeerNode  string            `json:"peerNode,omitempty"`
+	DstHost   string            `json:"dstHost,omitempty"`
+	DstPort   int               `json:"dstPort,omitempty"`
+	IsActive  int               `json:"isActive,omitempty"`
+	LinkMode  string            `json:"linkMode,omitempty"`
+	RelayNode string            `json:"relayNode,omitempty"` // empty if direct
+	TunnelID  uint64            `json:"tunnelID,omitempty"`
+	RTT       int64             `json:"rtt,omitempty"` // microseconds
+	TxBytes   uint64            `json:"txBytes,omitempty"`
+	RxBytes   uint64            `json:"rxBytes,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	QoSDrops  map[string]uint64 `json:"qosDrops,omitempty"` // the sdwan packets dropped by the full queues of every class
+}
+
+// PingRsp is the overlay ping result of "openp2p ping", RTT 0 is timeout
+type PingRsp struct {
+	PeerNode  string `json:"peerNode,omitempty"`
+	RTT       int64  `json:"rtt,omitempty"` // microseconds
+	LinkMode  string `json:"linkMode,omitempty"`
+	RelayNode string `json:"relayNode,omitempty"` // empty if direct
+	TunnelID  uint64 `json:"tunnelID,omitempty"`
+}
+
+// SpeedTestReq starts "openp2p speedtest" on the peer, the data frames follow the response
+type SpeedTestReq struct {
+	ID            uint64 `json:"id,omitempty"`
+	Mode          string `json:"mode,omitempty"`      // tcp: the reliable stream, udp: the datagrams
+	Direction     string `json:"direction,omitempty"` // up: to the peer, down: from the peer, both
+	Streams       int    `json:"streams,omitempty"`
+	Duration      int64  `json:"duration,omitempty"`  // milliseconds
+	Bandwidth     int    `json:"bandwidth,omitempty"` // Mbps, udp mode sending rate
+	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"`
+}
+
+type SpeedTestRsp struct {
+	ID    uint64 `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SpeedTestEnd is sent when the sender finished, the receiver replies the result
+type SpeedTestEnd struct {
+	ID     uint64 `json:"id,omitempty"`
+	Frames uint64 `json:"frames,omitempty"` // sent
+}
+
+type SpeedTestResult struct {
+	ID       uint64 `json:"id,omitempty"`
+	Bytes    uint64 `json:"bytes,omitempty"`    // received
+	Frames   uint64 `json:"frames,omitempty"`   // received
+	Duration int64  `json:"duration,omitempty"` // milliseconds, from the first frame to the last
+	Jitter   int64  `json:"jitter,omitempty"`   // microseconds
+}
+
+type RelayUsageInfo struct {
+	Node      string `json:"node,omitempty"`
+	Tx        int64  `json:"tx,omitempty"`
+	Rx        int64  `json:"rx,omitempty"`
+	Daily     int64  `json:"daily,omitempty"`
+	Monthly   int64  `json:"monthly,omitempty"`
+	Dropped   int64  `json:"dropped,omitempty"`
+	DailyMB   int64  `json:"dailyMB,omitempty"`
+	MonthlyMB int64  `json:"monthlyMB,omitempty"`
+	Bandwidth int    `json:"bandwidth,omitempty"`
+}
+
+type ReportRelayUsage struct {
+	Usage []RelayUsageInfo
+}
+
 type ReportLogReq struct {
 	FileName string `json:"fileName,omitempty"`
 	Offset   int64  `json:"offset,omitempty"`
@@ -490,18 +679,33 @@ type SDWANNode struct {
 	IP       string `json:"ip,omitempty"`
 	Resource string `json:"resource,omitempty"`
 	Enable   int32  `json:"enable,omitempty"`
+	Tags     string `json:"tags,omitempty"`     // comma separated, used by SDWANRule.Src
+	ExitNode int32  `json:"exitNode,omitempty"` // 1: the clients can route internet traffic through this node
+	Endpoint string `json:"endpoint,omitempty"` // host:port of the static sdwan listener, empty for lan discovery
+}
+
+// SDWANRule filters the packets into this node, the first matched rule is applied.
+// No rules means allow all, otherwise the unmatched packets are denied.
+type SDWANRule struct {
+	Src    string `json:"src,omitempty"`    // node name, tag:xxx or * for any node
+	Dst    string `json:"dst,omitempty"`    // ip or cidr, * for any
+	Proto  string `json:"proto,omitempty"`  // tcp, udp, icmp or * for any
+	Ports  string `json:"ports,omitempty"`  // destination ports like 22,8000-8080, empty for any
+	Action string `json:"action,omitempty"` // allow or deny
 }
 
 type SDWANInfo struct {
-	ID            uint64 `json:"id,omitempty"`
-	Name          string `json:"name,omitempty"`
-	Gateway       string `json:"gateway,omitempty"`
-	Mode          string `json:"mode,omitempty"` // default: fullmesh; central
-	CentralNode   string `json:"centralNode,omitempty"`
-	ForceRelay    int32  `json:"forceRelay,omitempty"`
-	PunchPriority int32  `json:"punchPriority,omitempty"`
-	Enable        int32  `json:"enable,omitempty"`
+	ID            uint64   `json:"id,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Gateway       string   `json:"gateway,omitempty"`
+	Mode          string   `json:"mode,omitempty"` // default: fullmesh; central
+	CentralNode   string   `json:"centralNode,omitempty"`
+	CentralNodes  []string `json:"centralNodes,omitempty"` // the standby central nodes in priority order
+	ForceRelay    int32    `json:"forceRelay,omitempty"`
+	PunchPriority int32    `json:"punchPriority,omitempty"`
+	Enable        int32    `json:"enable,omitempty"`
 	Nodes         []*SDWANNode
+	Rules         []*SDWANRule `json:"rules,omitempty"`
 }
 
 const (
@@ -509,6 +713,18 @@ const (
 	SDWANModeCentral  = "central"
 )
 
+// StaticHello is the handshake of static sdwan nodes authenticated by the shared token, it's also the lan discovery beacon
+type StaticHello struct {
+	Network  string `json:"network,omitempty"`
+	Node     string `json:"node,omitempty"`
+	TunnelID uint64 `json:"tunnelID,omitempty"`
+	IP       string `json:"ip,omitempty"`   // the beacon is sent from
+	Port     int    `json:"port,omitempty"` // tcp listen port
+	Ts       int64  `json:"ts,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
 type ServerSideSaveMemApp struct {
 	From          string `json:"from,omitempty"`
 	Node          string `json:"node,omitempty"`          // for server side findtunnel, maybe relayNode
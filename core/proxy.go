@@ -0,0 +1,187 @@
+package openp2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version      = 5
+	socks5CmdConnect   = 1
+	socks5AtypIPv4     = 1
+	socks5AtypDomain   = 3
+	socks5AtypIPv6     = 4
+	socks5RepSuccess   = 0
+	socks5RepFailure   = 1
+	socks5RepCmdUnsupp = 7
+	socks5RepAtypUnsup = 8
+)
+
+// serveSOCKS5 serves the SOCKS5 CONNECT without authentication, it should listen on localhost
+func serveSOCKS5(ln net.Listener, dial dialFunc) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			gLog.Printf(LvERROR, "socks5 %s accept error:%s", ln.Addr(), err)
+			return
+		}
+		go func() {
+			remote, err := socks5Handshake(c, dial)
+			if err != nil {
+				gLog.Printf(LvDEBUG, "socks5 %s error:%s", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			pipeConn(c, remote)
+		}()
+	}
+}
+
+// socks5Handshake negotiates with the client and connects the target, return the target conn
+func socks5Handshake(c net.Conn, dial dialFunc) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(ReadMsgTimeout))
+	defer c.SetDeadline(time.Time{})
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write([]byte{socks5Version, 0}); err != nil { // no authentication
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return nil, err
+	}
+	cmd, atyp := buf[1], buf[3]
+	var host string
+	switch atyp {
+	case socks5AtypIPv4:
+		if _, err := io.ReadFull(c, buf[:net.IPv4len]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AtypIPv6:
+		if _, err := io.ReadFull(c, buf[:net.IPv6len]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return nil, err
+		}
+		l := int(buf[0])
+		if _, err := io.ReadFull(c, buf[:l]); err != nil {
+			return nil, err
+		}
+		host = string(buf[:l])
+	default:
+		socks5Reply(c, socks5RepAtypUnsup)
+		return nil, fmt.Errorf("unsupported address type %d", atyp)
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	if cmd != socks5CmdConnect {
+		socks5Reply(c, socks5RepCmdUnsupp)
+		return nil, fmt.Errorf("unsupported command %d", cmd)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ReadMsgTimeout)
+	defer cancel()
+	remote, err := dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		socks5Reply(c, socks5RepFailure)
+		return nil, err
+	}
+	if err = socks5Reply(c, socks5RepSuccess); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+func socks5Reply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveHTTPProxy serves the HTTP CONNECT and plain http requests
+func serveHTTPProxy(ln net.Listener, dial dialFunc) {
+	transport := &http.Transport{DialContext: dial, MaxIdleConns: 16, IdleConnTimeout: time.Minute}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			httpConnect(w, r, dial)
+			return
+		}
+		if r.URL.Host == "" {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Connection")
+		r.Header.Del("Proxy-Authorization")
+		rsp, err := transport.RoundTrip(r)
+		if err != nil {
+			gLog.Printf(LvDEBUG, "http proxy %s error:%s", r.URL.Host, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		for k, vs := range rsp.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(rsp.StatusCode)
+		io.Copy(w, rsp.Body)
+	})
+	err := http.Serve(ln, handler)
+	gLog.Printf(LvERROR, "http proxy %s end:%s", ln.Addr(), err)
+}
+
+func httpConnect(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	remote, err := dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		gLog.Printf(LvDEBUG, "http proxy connect %s error:%s", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	if _, err = c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		remote.Close()
+		c.Close()
+		return
+	}
+	pipeConn(&bufferedConn{Conn: c, r: rw.Reader}, remote)
+}
+
+// bufferedConn reads the data already buffered by the http server first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,127 @@
+package openp2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5Handshake(t *testing.T) {
+	var dialed string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		a, b := net.Pipe()
+		go io.Copy(b, b) // echo
+		return a, nil
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		remote, err := socks5Handshake(server, dial)
+		if err != nil {
+			server.Close()
+			return
+		}
+		pipeConn(server, remote)
+	}()
+	client.Write([]byte{5, 1, 0})
+	rsp := make([]byte, 10)
+	if _, err := io.ReadFull(client, rsp[:2]); err != nil || !bytes.Equal(rsp[:2], []byte{5, 0}) {
+		t.Fatalf("method selection wrong:%v %v", rsp[:2], err)
+	}
+	client.Write(append([]byte{5, socks5CmdConnect, 0, socks5AtypDomain, 8}, []byte("node.lan\x00\x16")...))
+	if _, err := io.ReadFull(client, rsp); err != nil || rsp[1] != socks5RepSuccess {
+		t.Fatalf("connect reply wrong:%v %v", rsp, err)
+	}
+	if dialed != "node.lan:22" {
+		t.Errorf("dial address wrong:%s", dialed)
+	}
+	client.Write([]byte("ping"))
+	if _, err := io.ReadFull(client, rsp[:4]); err != nil || string(rsp[:4]) != "ping" {
+		t.Errorf("relay data wrong:%q %v", rsp[:4], err)
+	}
+}
+
+func TestSOCKS5UnsupportedCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := socks5Handshake(server, nil)
+		errCh <- err
+	}()
+	client.Write([]byte{5, 1, 0})
+	rsp := make([]byte, 10)
+	io.ReadFull(client, rsp[:2])
+	client.Write([]byte{5, 3, 0, socks5AtypIPv4, 10, 2, 3, 4, 0, 53}) // UDP ASSOCIATE
+	if _, err := io.ReadFull(client, rsp); err != nil || rsp[1] != socks5RepCmdUnsupp {
+		t.Errorf("reply wrong:%v %v", rsp, err)
+	}
+	if err := <-errCh; err == nil {
+		t.Error("unsupported command should fail")
+	}
+}
+
+func TestParsePortForwards(t *testing.T) {
+	fs, err := parsePortForwards("127.0.0.1:2222=10.2.3.4:22, 8080=10.2.3.5:80")
+	if err != nil || len(fs) != 2 {
+		t.Fatalf("parse error:%v %v", fs, err)
+	}
+	if fs[0] != (portForward{"127.0.0.1:2222", "10.2.3.4:22"}) || fs[1] != (portForward{"127.0.0.1:8080", "10.2.3.5:80"}) {
+		t.Errorf("parse wrong:%v", fs)
+	}
+	if _, err = parsePortForwards("2222=10.2.3.4"); err == nil {
+		t.Error("target without port should fail")
+	}
+	if ports := parseExposePorts("22, 80,abc,70000"); len(ports) != 2 || !ports[22] || !ports[80] {
+		t.Errorf("expose ports wrong:%v", ports)
+	}
+}
+
+func TestListenProxy(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.168.1.2:0"} {
+		if _, err := listenProxy(addr); !errors.Is(err, ErrProxyNotLoopback) {
+			t.Errorf("%s should be refused:%v", addr, err)
+		}
+	}
+	ln, err := listenProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestNetstackDialOutside(t *testing.T) {
+	ns := &netstackTun{routable: func(ip net.IP) bool { return false }}
+	if _, err := ns.DialContext(context.Background(), "tcp", "1.2.3.4:80"); !errors.Is(err, ErrNetstackNotSDWAN) {
+		t.Errorf("the address outside sdwan should be refused:%v", err)
+	}
+}
+
+func TestPipeUDP(t *testing.T) {
+	a, remote := net.Pipe()
+	b, local := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pipeUDP(a, b, time.Millisecond*200)
+		close(done)
+	}()
+	go remote.Write([]byte("query"))
+	buf := make([]byte, 16)
+	if n, err := local.Read(buf); err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("forward wrong:%q %v", buf[:n], err)
+	}
+	go local.Write([]byte("answer"))
+	if n, err := remote.Read(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("reply wrong:%q %v", buf[:n], err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Error("idle flow should be closed")
+	}
+}
@@ -0,0 +1,322 @@
+package openp2p
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The sdwan packets to a tunnel are queued by class, the writeLoop sends them by deficit round robin, so every
+// class gets the share of its weight when the link is saturated and the interactive packets aren't stuck
+// behind the bulk ones. The packet class is decided by
+//   - the first matched rule of -qos, like tcp:22=interactive,udp:5060-5061=realtime,node:NAS1=bulk
+//   - the DSCP of the IP header
+//   - the default rules, ICMP, DNS and SSH are interactive
+//
+// A full queue drops the packet and counts it. The portmap apps matched by the rules, app:NAME or the port and
+// node rules checked with the protocol and dst port of the app, are queued by their class too. Their connections
+// wait for the queue instead of dropping, so the TCP flow control works as before. The other apps are written by
+// their connections directly.
+
+const (
+	qosRealtime = iota
+	qosInteractive
+	qosDefault
+	qosBulk
+	qosClassNum
+)
+
+const qosQuantum = 1500
+
+var (
+	qosClassNames = [qosClassNum]string{"realtime", "interactive", "default", "bulk"}
+	qosWeights    = [qosClassNum]int{8, 4, 2, 1}
+	qosQueueSizes = [qosClassNum]int{WriteDataChanSize / 30, WriteDataChanSize / 30, WriteDataChanSize, WriteDataChanSize}
+)
+
+type qosRule struct {
+	proto  byte        // 0 for any
+	ports  [][2]uint16 // either port matches, empty for any
+	nodeID uint64      // the peer node, 0 for any
+	app    string      // the portmap app name, the rule doesn't match the sdwan packets
+	class  int
+}
+
+type qosRuleSet struct {
+	src   string
+	rules []qosRule
+}
+
+var gQoSRules atomic.Pointer[qosRuleSet]
+
+func qosClassByName(name string) (int, error) {
+	for i, n := range qosClassNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown qos class %s", name)
+}
+
+// parseQoSRules parses the rules like tcp:22=interactive,udp:5060-5061=realtime,icmp=interactive,node:NAS1=bulk
+func parseQoSRules(s string) ([]qosRule, error) {
+	rules := []qosRule{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		match, className, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("wrong qos rule %s", item)
+		}
+		class, err := qosClassByName(strings.ToLower(strings.TrimSpace(className)))
+		if err != nil {
+			return nil, err
+		}
+		rule := qosRule{class: class}
+		kind, arg, _ := strings.Cut(strings.TrimSpace(match), ":")
+		switch strings.ToLower(kind) {
+		case "app":
+			if arg == "" {
+				return nil, fmt.Errorf("wrong qos rule %s", item)
+			}
+			rule.app = arg
+		case "node":
+			if arg == "" {
+				return nil, fmt.Errorf("wrong qos rule %s", item)
+			}
+			rule.nodeID = NodeNameToID(arg)
+		case "tcp":
+			rule.proto = IPProtoTCP
+		case "udp":
+			rule.proto = IPProtoUDP
+		case "icmp":
+			rule.proto = IPProtoICMP
+		default:
+			return nil, fmt.Errorf("wrong qos rule %s", item)
+		}
+		if arg != "" && rule.proto != 0 {
+			if rule.proto == IPProtoICMP {
+				return nil, fmt.Errorf("wrong qos rule %s", item)
+			}
+			if rule.ports, err = parsePortRanges(arg); err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// currentQoSRules compiles -qos when it changes
+func currentQoSRules() []qosRule {
+	src := gConf.Network.QoS
+	if rs := gQoSRules.Load(); rs != nil && rs.src == src {
+		return rs.rules
+	}
+	rules, err := parseQoSRules(src)
+	if err != nil {
+		gLog.Printf(LvERROR, "qos rules error:%s", err)
+	}
+	gQoSRules.Store(&qosRuleSet{src: src, rules: rules})
+	return rules
+}
+
+func (r *qosRule) match(nodeID uint64, key *flowKey) bool {
+	if r.app != "" {
+		return false
+	}
+	if r.nodeID != 0 && r.nodeID != nodeID {
+		return false
+	}
+	if r.proto != 0 && r.proto != key.proto {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if (key.sport >= pr[0] && key.sport <= pr[1]) || (key.dport >= pr[0] && key.dport <= pr[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// dscpClass maps the DSCP of the IP packet, ok is false for the best effort
+func dscpClass(p []byte) (int, bool) {
+	var dscp byte
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		dscp = p[1] >> 2
+	case len(p) >= 40 && p[0]>>4 == 6:
+		dscp = (p[0]&0x0f)<<2 | p[1]>>6
+	default:
+		return 0, false
+	}
+	switch {
+	case dscp == 46 || dscp == 40 || dscp>>3 == 4: // EF, CS5 and AF4x for voice and video
+		return qosRealtime, true
+	case dscp >= 16: // AF2x, AF3x, CS6 and CS7
+		return qosInteractive, true
+	case dscp >= 8: // CS1 and AF1x
+		return qosBulk, true
+	}
+	return 0, false
+}
+
+// qosClassify returns the class of the packet to nodeID
+func qosClassify(nodeID uint64, p []byte) int {
+	var key flowKey
+	_, ok := parseFlow(p, &key)
+	for i, rules := 0, currentQoSRules(); i < len(rules); i++ {
+		if rules[i].proto == 0 || ok {
+			if rules[i].match(nodeID, &key) {
+				return rules[i].class
+			}
+		}
+	}
+	if class, ok := dscpClass(p); ok {
+		return class
+	}
+	if ok && (key.proto == IPProtoICMP || key.sport == 22 || key.dport == 22 || key.sport == 53 || key.dport == 53) {
+		return qosInteractive
+	}
+	return qosDefault
+}
+
+// qosNodeClass returns the class of the node data, which is an ethernet frame in tap mode
+func qosNodeClass(nodeID uint64, buff []byte) int {
+	if isTapMode() {
+		if len(buff) < ethHeaderSize {
+			return qosDefault
+		}
+		_, buff = ethPayload(buff)
+	}
+	return qosClassify(nodeID, buff)
+}
+
+// qosAppClass returns the class of the portmap app connection, false if no rule matches it
+func qosAppClass(node, appName, protocol string, dstPort int) (int, bool) {
+	key := flowKey{proto: IPProtoTCP, sport: uint16(dstPort), dport: uint16(dstPort)}
+	if strings.ToLower(protocol) == "udp" {
+		key.proto = IPProtoUDP
+	}
+	nodeID := NodeNameToID(node)
+	for i, rules := 0, currentQoSRules(); i < len(rules); i++ {
+		if (rules[i].app != "" && rules[i].app == appName) || rules[i].match(nodeID, &key) {
+			return rules[i].class, true
+		}
+	}
+	return qosDefault, false
+}
+
+// qosQueues are the write queues of a tunnel, the writeLoop is the only consumer
+type qosQueues struct {
+	queues  [qosClassNum]chan frameBuffer
+	drops   [qosClassNum]atomic.Uint64
+	notify  chan struct{}
+	heads   [qosClassNum]*frameBuffer
+	deficit [qosClassNum]int
+	cur     int
+	started bool // the quantum of cur is added
+}
+
+func newQoSQueues() *qosQueues {
+	q := &qosQueues{notify: make(chan struct{}, 1)}
+	for i := range q.queues {
+		q.queues[i] = make(chan frameBuffer, qosQueueSizes[i])
+	}
+	return q
+}
+
+// push queues the frame, returns false and counts the drop when the queue is full
+func (q *qosQueues) push(class int, wb frameBuffer) bool {
+	select {
+	case q.queues[class] <- wb:
+	default:
+		return false
+	}
+	q.wake()
+	return true
+}
+
+func (q *qosQueues) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pushWait queues the frame of the app connection, waits for the room while running
+func (q *qosQueues) pushWait(class int, wb frameBuffer, running func() bool) bool {
+	if q.push(class, wb) {
+		return true
+	}
+	for running() {
+		select {
+		case q.queues[class] <- wb:
+			q.wake()
+			return true
+		case <-time.After(time.Second):
+		}
+	}
+	return false
+}
+
+func (q *qosQueues) drop(class int) uint64 {
+	return q.drops[class].Add(1)
+}
+
+// Drops returns the dropped packets of every class
+func (q *qosQueues) Drops() [qosClassNum]uint64 {
+	res := [qosClassNum]uint64{}
+	for i := range res {
+		res[i] = q.drops[i].Load()
+	}
+	return res
+}
+
+func (q *qosQueues) peek(class int) *frameBuffer {
+	if q.heads[class] == nil {
+		select {
+		case wb := <-q.queues[class]:
+			q.heads[class] = &wb
+		default:
+		}
+	}
+	return q.heads[class]
+}
+
+// pop returns the next frame by deficit round robin, false if all queues are empty
+func (q *qosQueues) pop() (frameBuffer, bool) {
+	for empty := 0; empty < qosClassNum; {
+		c := q.cur
+		head := q.peek(c)
+		if head == nil {
+			q.deficit[c] = 0
+			q.next()
+			empty++
+			continue
+		}
+		empty = 0
+		if !q.started {
+			q.deficit[c] += qosQuantum * qosWeights[c]
+			q.started = true
+		}
+		if len(head.data) <= q.deficit[c] {
+			q.deficit[c] -= len(head.data)
+			q.heads[c] = nil
+			return *head, true
+		}
+		q.next()
+	}
+	return frameBuffer{}, false
+}
+
+func (q *qosQueues) next() {
+	q.cur = (q.cur + 1) % qosClassNum
+	q.started = false
+}
@@ -0,0 +1,148 @@
+package openp2p
+
+import (
+	"testing"
+)
+
+func TestParseQoSRules(t *testing.T) {
+	rules, err := parseQoSRules("tcp:22=interactive, udp:5060-5061=realtime,icmp=interactive,node:NAS1=bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 || rules[1].class != qosRealtime || rules[1].ports[0] != [2]uint16{5060, 5061} || rules[3].nodeID != NodeNameToID("NAS1") {
+		t.Errorf("rules %+v", rules)
+	}
+	for _, s := range []string{"tcp:22", "tcp:22=fast", "sctp=bulk", "icmp:8=bulk", "node:=bulk"} {
+		if _, err := parseQoSRules(s); err == nil {
+			t.Errorf("%s should be wrong", s)
+		}
+	}
+}
+
+func TestQoSClassify(t *testing.T) {
+	old := gConf.Network.QoS
+	defer func() { gConf.Network.QoS = old }()
+	gConf.Network.QoS = "tcp:873=bulk,udp:5060=realtime,node:NAS1=bulk"
+	nas := NodeNameToID("NAS1")
+	cases := []struct {
+		nodeID uint64
+		p      []byte
+		class  int
+	}{
+		{1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 873), qosBulk},
+		{1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoUDP, 5060, 40000), qosRealtime},
+		{1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 22), qosInteractive},
+		{1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoICMP, 0, 0), qosInteractive},
+		{1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 443), qosDefault},
+		{nas, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 22), qosBulk},
+	}
+	for i, c := range cases {
+		if class := qosClassify(c.nodeID, c.p); class != c.class {
+			t.Errorf("case %d class=%s, want %s", i, qosClassNames[class], qosClassNames[c.class])
+		}
+	}
+	ef := testIPv4Packet(0x0a020301, 0x0a020302, IPProtoUDP, 40000, 40002)
+	ef[1] = 46 << 2
+	if class := qosClassify(1, ef); class != qosRealtime {
+		t.Errorf("EF class=%s", qosClassNames[class])
+	}
+	cs1 := testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 22)
+	cs1[1] = 8 << 2
+	if class := qosClassify(1, cs1); class != qosBulk {
+		t.Errorf("CS1 class=%s", qosClassNames[class])
+	}
+	gConf.Network.SDWANMode = SDWANModeTAP
+	defer func() { gConf.Network.SDWANMode = "" }()
+	frame := testEthFrame(ethTypeIPv4, 1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 873))
+	if class := qosNodeClass(1, frame); class != qosBulk {
+		t.Errorf("tap frame class=%s", qosClassNames[class])
+	}
+	if class := qosNodeClass(1, frame[:ethHeaderSize-1]); class != qosDefault {
+		t.Errorf("short tap frame class=%s", qosClassNames[class])
+	}
+}
+
+func TestQoSQueues(t *testing.T) {
+	q := newQoSQueues()
+	bulk, interactive := make([]byte, 1000), make([]byte, 1000)
+	interactive[0] = 1
+	for i := 0; i < 300; i++ {
+		q.push(qosBulk, frameBuffer{data: bulk})
+		q.push(qosInteractive, frameBuffer{data: interactive}) // 100 queued
+	}
+	sent := [2]int{}
+	for i := 0; i < 75; i++ {
+		wb, ok := q.pop()
+		if !ok {
+			t.Fatal("queues should not be empty")
+		}
+		sent[wb.data[0]]++
+	}
+	if sent[1] < sent[0]*3 || sent[0] == 0 {
+		t.Errorf("interactive %d, bulk %d, want about 4:1", sent[1], sent[0])
+	}
+	n := 75
+	for _, ok := q.pop(); ok; _, ok = q.pop() {
+		n++
+	}
+	if n != 400 {
+		t.Errorf("popped %d, want 400", n)
+	}
+	for i := 0; i < qosQueueSizes[qosRealtime]; i++ {
+		q.push(qosRealtime, frameBuffer{data: bulk})
+	}
+	if q.push(qosRealtime, frameBuffer{data: bulk}) {
+		t.Error("full queue should drop")
+	}
+}
+
+func TestQoSAppClass(t *testing.T) {
+	old := gConf.Network.QoS
+	defer func() { gConf.Network.QoS = old }()
+	gConf.Network.QoS = "app:backup=bulk,tcp:3389=interactive,node:NAS1=bulk"
+	if _, err := parseQoSRules("app:=bulk"); err == nil {
+		t.Error("app rule without name should be wrong")
+	}
+	cases := []struct {
+		node, app, protocol string
+		dstPort             int
+		class               int
+		queued              bool
+	}{
+		{"PC1", "backup", "tcp", 873, qosBulk, true},
+		{"PC1", "rdp", "tcp", 3389, qosInteractive, true},
+		{"PC1", "rdp", "udp", 3389, qosDefault, false},
+		{"NAS1", "web", "tcp", 80, qosBulk, true},
+		{"PC1", "web", "tcp", 80, qosDefault, false},
+	}
+	for i, c := range cases {
+		if class, queued := qosAppClass(c.node, c.app, c.protocol, c.dstPort); class != c.class || queued != c.queued {
+			t.Errorf("case %d class=%s queued=%t", i, qosClassNames[class], queued)
+		}
+	}
+	// the app rule doesn't match the sdwan packets
+	if class := qosClassify(1, testIPv4Packet(0x0a020301, 0x0a020302, IPProtoTCP, 40000, 873)); class != qosDefault {
+		t.Errorf("sdwan packet class=%s", qosClassNames[class])
+	}
+}
+
+func TestQoSPushWait(t *testing.T) {
+	q := newQoSQueues()
+	for i := 0; i < qosQueueSizes[qosRealtime]; i++ {
+		q.push(qosRealtime, frameBuffer{data: []byte{1}})
+	}
+	if q.pushWait(qosRealtime, frameBuffer{data: []byte{2}}, func() bool { return false }) {
+		t.Error("push to the full queue of a closed tunnel should fail")
+	}
+	done := make(chan bool)
+	go func() {
+		done <- q.pushWait(qosRealtime, frameBuffer{data: []byte{2}}, func() bool { return true })
+	}()
+	q.pop()
+	if !<-done {
+		t.Error("push should wait for the room")
+	}
+	if q.Drops()[qosRealtime] != 0 {
+		t.Error("the waiting app frame isn't a drop")
+	}
+}
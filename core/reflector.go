@@ -0,0 +1,293 @@
+package openp2p
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	reuse "github.com/openp2p-cn/go-reuseport"
+	"golang.org/x/net/ipv4"
+)
+
+// The mDNS and SSDP packets are link-local, they don't cross the routers. The reflector joins their group
+// on the lan interfaces and the tun, then reflects the packets between them: the lan packets are sent to
+// the tun, which broadcasts them to the sdwan nodes, and the packets from the tun are sent to the lans.
+// A payload is reflected once in reflectDedupTime and the packets from this host are ignored, so the nodes
+// in the same lan, which receive the packet from both the lan and the tun, and the echoes don't loop.
+//   - the mDNS queries have the unicast-response bit cleared, the answers come back by multicast
+//   - the SSDP search responses are unicast, they're forwarded to the searchers on the other side
+//
+// The services found are reachable when their lans are the resources of the sdwan.
+
+const (
+	reflectDedupTime   = time.Second
+	reflectRefreshTime = time.Second * 30
+	reflectMaxSeen     = 1024
+	ssdpSearchTime     = time.Second * 5
+)
+
+type reflectService struct {
+	name  string
+	group net.IP
+	port  int
+	ttl   int
+}
+
+var reflectServices = []reflectService{
+	{name: "mdns", group: net.IPv4(224, 0, 0, 251), port: 5353, ttl: 255},
+	{name: "ssdp", group: net.IPv4(239, 255, 255, 250), port: 1900, ttl: 2},
+}
+
+// parseReflect parses the service names like mdns,ssdp
+func parseReflect(s string) []reflectService {
+	res := []reflectService{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, svc := range reflectServices {
+			if svc.name == name {
+				res = append(res, svc)
+			}
+		}
+	}
+	return res
+}
+
+type ssdpSearch struct {
+	addr    *net.UDPAddr
+	fromTun bool
+	expire  time.Time
+}
+
+type mcastReflector struct {
+	svc      reflectService
+	tunName  string
+	subnet   *net.IPNet
+	pc       *ipv4.PacketConn
+	mtx      sync.Mutex
+	tun      *net.Interface
+	lans     []*net.Interface
+	localIPs map[string]bool
+	joined   map[int]bool         // used by refresh only
+	seen     map[uint64]time.Time // payload hash: reflected time, used by the read loop only
+	searches []ssdpSearch
+	done     chan struct{}
+}
+
+func newMcastReflector(svc reflectService, tunName string, subnet *net.IPNet) (*mcastReflector, error) {
+	conn, err := reuse.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", svc.port)) // shared with the local responder
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(conn)
+	pc.SetMulticastLoopback(false)
+	pc.SetMulticastTTL(svc.ttl)
+	return &mcastReflector{
+		svc:      svc,
+		tunName:  tunName,
+		subnet:   subnet,
+		pc:       pc,
+		localIPs: make(map[string]bool),
+		joined:   make(map[int]bool),
+		seen:     make(map[uint64]time.Time),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// refresh joins the group on the new interfaces
+func (r *mcastReflector) refresh() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		gLog.Printf(LvERROR, "%s reflector interfaces error:%s", r.svc.name, err)
+		return
+	}
+	var tun *net.Interface
+	lans := []*net.Interface{}
+	localIPs := make(map[string]bool)
+	active := make(map[int]bool)
+	for i := range ifaces {
+		iface := &ifaces[i]
+		addrs, _ := iface.Addrs()
+		hasIPv4 := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				localIPs[ipnet.IP.String()] = true
+				hasIPv4 = true
+			}
+		}
+		isTun := iface.Name == r.tunName
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || !hasIPv4 ||
+			(!isTun && iface.Flags&net.FlagMulticast == 0) {
+			continue
+		}
+		if !r.joined[iface.Index] {
+			if err := r.pc.JoinGroup(iface, &net.UDPAddr{IP: r.svc.group}); err != nil {
+				gLog.Printf(LvDEBUG, "%s reflector join %s error:%s", r.svc.name, iface.Name, err)
+				continue
+			}
+			gLog.Printf(LvDEBUG, "%s reflector join %s", r.svc.name, iface.Name)
+		}
+		active[iface.Index] = true
+		if isTun {
+			tun = iface
+		} else {
+			lans = append(lans, iface)
+		}
+	}
+	r.joined = active // rejoin the interfaces after they're up again
+	r.mtx.Lock()
+	r.tun, r.lans, r.localIPs = tun, lans, localIPs
+	r.mtx.Unlock()
+}
+
+func (r *mcastReflector) run() {
+	gLog.Printf(LvINFO, "%s reflector start", r.svc.name)
+	defer gLog.Printf(LvINFO, "%s reflector end", r.svc.name)
+	go func() {
+		for {
+			r.refresh()
+			select {
+			case <-r.done:
+				return
+			case <-time.After(reflectRefreshTime):
+			}
+		}
+	}()
+	buf := make([]byte, maxTunMTU)
+	for {
+		n, _, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				gLog.Printf(LvERROR, "%s reflector read error:%s", r.svc.name, err)
+			}
+			return
+		}
+		from, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		r.mtx.Lock()
+		local := r.localIPs[from.IP.String()]
+		r.mtx.Unlock()
+		if local {
+			continue
+		}
+		r.handle(buf[:n], from, time.Now())
+	}
+}
+
+// stop closes the socket, which leaves the groups and ends run
+func (r *mcastReflector) stop() {
+	close(r.done)
+	r.pc.Close()
+}
+
+// handle reflects the packet from the lan to the tun, or from the tun to the lans
+func (r *mcastReflector) handle(b []byte, from *net.UDPAddr, now time.Time) {
+	fromTun := r.subnet.Contains(from.IP)
+	switch r.svc.name {
+	case "mdns":
+		if from.Port != r.svc.port { // the legacy unicast query expects the unicast answer
+			return
+		}
+		mdnsClearQU(b)
+	case "ssdp":
+		if bytes.HasPrefix(b, []byte("HTTP/")) {
+			r.forwardSSDPResponse(b, fromTun, now)
+			return
+		}
+	}
+	if r.duplicated(b, now) {
+		return
+	}
+	if r.svc.name == "ssdp" && bytes.HasPrefix(b, []byte("M-SEARCH")) {
+		r.searches = append(r.searches, ssdpSearch{addr: from, fromTun: fromTun, expire: now.Add(ssdpSearchTime)})
+	}
+	r.mtx.Lock()
+	dst := r.lans
+	if !fromTun {
+		dst = []*net.Interface{r.tun}
+	}
+	r.mtx.Unlock()
+	for _, iface := range dst {
+		if iface == nil {
+			continue
+		}
+		if err := r.pc.SetMulticastInterface(iface); err != nil {
+			gLog.Printf(LvDEBUG, "%s reflector set interface %s error:%s", r.svc.name, iface.Name, err)
+			continue
+		}
+		if _, err := r.pc.WriteTo(b, nil, &net.UDPAddr{IP: r.svc.group, Port: r.svc.port}); err != nil {
+			gLog.Printf(LvDEBUG, "%s reflector write %s error:%s", r.svc.name, iface.Name, err)
+			continue
+		}
+		gLog.Printf(LvDev, "%s reflect %s len=%d to %s", r.svc.name, from, len(b), iface.Name)
+	}
+}
+
+// forwardSSDPResponse sends the unicast response to the searchers on the other side
+func (r *mcastReflector) forwardSSDPResponse(b []byte, fromTun bool, now time.Time) {
+	searches := r.searches[:0]
+	for _, s := range r.searches {
+		if now.After(s.expire) {
+			continue
+		}
+		searches = append(searches, s)
+		if s.fromTun != fromTun {
+			r.pc.WriteTo(b, nil, s.addr)
+		}
+	}
+	r.searches = searches
+}
+
+// duplicated checks whether the payload is reflected recently
+func (r *mcastReflector) duplicated(b []byte, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write(b)
+	key := h.Sum64()
+	if t, ok := r.seen[key]; ok && now.Sub(t) < reflectDedupTime {
+		return true
+	}
+	if len(r.seen) >= reflectMaxSeen {
+		for k, t := range r.seen {
+			if now.Sub(t) >= reflectDedupTime {
+				delete(r.seen, k)
+			}
+		}
+	}
+	r.seen[key] = now
+	return false
+}
+
+// mdnsClearQU clears the unicast-response bit of the questions in the mDNS query
+func mdnsClearQU(b []byte) {
+	if len(b) < 12 || b[2]&0x80 != 0 { // not a query
+		return
+	}
+	qdcount := int(b[4])<<8 | int(b[5])
+	i := 12
+	for q := 0; q < qdcount; q++ {
+		for i < len(b) { // skip the name
+			l := int(b[i])
+			if l == 0 {
+				i++
+				break
+			}
+			if l&0xc0 == 0xc0 { // compression pointer
+				i += 2
+				break
+			}
+			i += 1 + l
+		}
+		if i+4 > len(b) {
+			return
+		}
+		b[i+2] &^= 0x80 // the top bit of qclass
+		i += 4
+	}
+}
@@ -0,0 +1,81 @@
+package openp2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseReflect(t *testing.T) {
+	svcs := parseReflect("mdns, SSDP,unknown")
+	if len(svcs) != 2 || svcs[0].port != 5353 || svcs[1].port != 1900 {
+		t.Errorf("parse reflect %v", svcs)
+	}
+	if len(parseReflect("")) != 0 {
+		t.Error("empty reflect")
+	}
+}
+
+func TestMDNSClearQU(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	for _, name := range []string{"_ipp._tcp.local.", "_googlecast._tcp.local."} {
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET | 0x8000})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdnsClearQU(msg)
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 2 {
+		t.Fatalf("questions %v error:%v", qs, err)
+	}
+	for _, q := range qs {
+		if q.Class != dnsmessage.ClassINET || q.Type != dnsmessage.TypePTR {
+			t.Errorf("%s class=%d type=%d", q.Name, q.Class, q.Type)
+		}
+	}
+	mdnsClearQU(msg[:20]) // truncated
+}
+
+func TestReflectDuplicated(t *testing.T) {
+	r := &mcastReflector{seen: make(map[uint64]time.Time)}
+	now := time.Now()
+	if r.duplicated([]byte("NOTIFY * HTTP/1.1"), now) {
+		t.Error("the first packet isn't duplicated")
+	}
+	if !r.duplicated([]byte("NOTIFY * HTTP/1.1"), now.Add(time.Millisecond*100)) {
+		t.Error("the echo should be duplicated")
+	}
+	if r.duplicated([]byte("NOTIFY * HTTP/1.1"), now.Add(reflectDedupTime*2)) {
+		t.Error("the repeated announcement should be reflected")
+	}
+	if r.duplicated([]byte("M-SEARCH * HTTP/1.1"), now) {
+		t.Error("different payload")
+	}
+}
+
+func TestReflectorStop(t *testing.T) {
+	r, err := newMcastReflector(reflectService{name: "test", group: net.IPv4(239, 255, 255, 251)}, "optun", nil)
+	if err != nil {
+		t.Skip("listen error:", err)
+	}
+	end := make(chan struct{})
+	go func() {
+		r.run()
+		close(end)
+	}()
+	r.stop()
+	select {
+	case <-end:
+	case <-time.After(time.Second * 3):
+		t.Error("reflector should end after stop")
+	}
+}
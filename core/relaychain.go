@@ -0,0 +1,367 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A relay chain connects two nodes through several relay nodes: A -> R1 -> ... -> Rn -> B.
+// A connects R1 with tunnel tA, B connects Rn with tunnel tB, Ri connects Ri+1 with tunnel ti.
+// The endpoints work like single relay: A uses rtid=tB, B uses rtid=tA.
+// Every relay node forwards MsgRelayData by the target tunnel id: tunnels on this node are
+// delivered directly, others are looked up in relayRoutes and forwarded to the next hop.
+// Between the relay nodes the frame is MsgRelayHopData with a ttl, a wrong route can't loop it forever.
+// Every hop checks the heartbeat of its tunnels, a broken hop is torn down and the source node rebuilds the chain.
+
+const (
+	MaxRelayHops        = 4
+	RelayRouteIdleTime  = TunnelHeartbeatTime * 3
+	relayRouteCheckTime = TunnelHeartbeatTime
+	RelayHopHeaderSize  = RelayHeaderSize + 1 // rtid + ttl
+)
+
+type relayRoute struct {
+	id         uint64 // target tunnel id
+	next       *P2PTunnel
+	from       string
+	activeTime atomic.Int64 // unix nano, written by the forwarding readers, read by relayRouteLoop
+}
+
+// relayChainHop is a relay node's part of a chain
+type relayChainHop struct {
+	req   RelayHopReq
+	prev  *P2PTunnel // to the previous hop, the source node's tunnel on the first hop
+	next  *P2PTunnel // to the next hop, the peer node's tunnel on the last hop
+	owned bool       // next is built for this chain, closed with it
+}
+
+// relayHeaderLen is the length of the relay header after the openP2PHeader
+func relayHeaderLen(frame []byte) int {
+	if len(frame) >= openP2PHeaderSize && binary.LittleEndian.Uint16(frame[6:8]) == MsgRelayHopData {
+		return RelayHopHeaderSize
+	}
+	return RelayHeaderSize
+}
+
+// parse the RelayNode list "R1,R2,R3"
+func (c *AppConfig) relayChain() ([]string, error) {
+	if c.RelayNode == "" {
+		return nil, nil
+	}
+	chain := []string{}
+	for _, node := range strings.Split(c.RelayNode, ",") {
+		node = strings.TrimSpace(node)
+		if node == "" {
+			continue
+		}
+		if node == gConf.Network.Node || node == c.PeerNode {
+			return nil, ErrRelayChainLoop
+		}
+		for _, n := range chain {
+			if n == node {
+				return nil, ErrRelayChainLoop
+			}
+		}
+		chain = append(chain, node)
+	}
+	if len(chain) > MaxRelayHops {
+		return nil, ErrRelayChainTooLong
+	}
+	return chain, nil
+}
+
+func (c *AppConfig) inRelayChain(node string) bool {
+	chain, _ := c.relayChain()
+	for _, n := range chain {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (pn *P2PNetwork) addRelayRoute(id uint64, next *P2PTunnel, from string) error {
+	if i, ok := pn.relayRoutes.Load(id); ok && i.(*relayRoute).next != next && i.(*relayRoute).next.isRuning() {
+		return ErrRelayChainLoop
+	}
+	gLog.Printf(LvDEBUG, "add relay route %d to %s:%d", id, next.config.LogPeerNode(), next.id)
+	route := &relayRoute{id: id, next: next, from: from}
+	route.activeTime.Store(time.Now().UnixNano())
+	pn.relayRoutes.Store(id, route)
+	return nil
+}
+
+// forward the relay data frame to the next relay node, the target tunnel id is kept.
+// The first hop wraps MsgRelayData into MsgRelayHopData, the others decrease its ttl
+func (pn *P2PNetwork) forwardRelay(from *P2PTunnel, to uint64, frame []byte) error {
+	i, ok := pn.relayRoutes.Load(to)
+	if !ok {
+		return ErrRelayTunnelNotFound
+	}
+	route := i.(*relayRoute)
+	if route.next == from { // never send it back
+		return ErrRelayChainLoop
+	}
+	inner := frame[openP2PHeaderSize+relayHeaderLen(frame):]
+	if err := pn.relayAcct.add(from.config.PeerNode, route.next.config.PeerNode, len(inner)); err != nil {
+		return err
+	}
+	route.activeTime.Store(time.Now().UnixNano())
+	var buf *[]byte
+	if relayHeaderLen(frame) == RelayHopHeaderSize {
+		ttl := &frame[openP2PHeaderSize+RelayHeaderSize]
+		if *ttl == 0 {
+			return ErrRelayHopTTL
+		}
+		*ttl--
+	} else {
+		buf = getBuffer()
+		defer putBuffer(buf)
+		frame = relayHopFrame(*buf, to, MaxRelayHops, inner)
+	}
+	if isNodeDataFrame(frame) {
+		return route.next.writeNodeFrame(frame)
+	}
+	return route.next.conn.WriteBuffer(frame)
+}
+
+// stampRelayNodeID overwrites the src node id of the relayed node data with the peer of the tunnel it's read from,
+// so a node can't send the packets in the name of others
+func stampRelayNodeID(inner []byte, from uint64) {
+	if len(inner) >= openP2PHeaderSize+8 && binary.LittleEndian.Uint16(inner[4:6]) == MsgP2P &&
+		binary.LittleEndian.Uint16(inner[6:8]) == MsgRelayNodeData {
+		binary.LittleEndian.PutUint64(inner[openP2PHeaderSize:], from)
+	}
+}
+
+// relayHopFrame builds the MsgRelayHopData frame in buf, it's allocated if buf is too small
+func relayHopFrame(buf []byte, to uint64, ttl uint8, inner []byte) []byte {
+	n := openP2PHeaderSize + RelayHopHeaderSize + len(inner)
+	if len(buf) < n {
+		buf = make([]byte, n)
+	}
+	putHeader(buf, MsgP2P, MsgRelayHopData, uint32(RelayHopHeaderSize+len(inner)))
+	binary.LittleEndian.PutUint64(buf[openP2PHeaderSize:], to)
+	buf[openP2PHeaderSize+RelayHeaderSize] = ttl
+	copy(buf[openP2PHeaderSize+RelayHopHeaderSize:], inner)
+	return buf[:n]
+}
+
+func (pn *P2PNetwork) relayRouteLoop() {
+	for pn.running {
+		time.Sleep(relayRouteCheckTime)
+		pn.checkRelayHops()
+		pn.relayRoutes.Range(func(id, i interface{}) bool {
+			route := i.(*relayRoute)
+			if !route.next.isActive() || time.Since(time.Unix(0, route.activeTime.Load())) > RelayRouteIdleTime {
+				gLog.Printf(LvDEBUG, "relay route %d to %s timeout, delete it", route.id, route.next.config.LogPeerNode())
+				pn.relayRoutes.Delete(id)
+			}
+			return true
+		})
+	}
+}
+
+// checkRelayHops tears down the hops whose tunnels lost the heartbeat, and tells the source node to rebuild
+func (pn *P2PNetwork) checkRelayHops() {
+	pn.relayHops.Range(func(_, i interface{}) bool {
+		hop := i.(*relayChainHop)
+		if hop.prev.isActive() && hop.next.isActive() {
+			return true
+		}
+		gLog.Printf(LvINFO, "relay chain %d hop %d from %s down", hop.req.SrcTunnelID, hop.req.Hop, hop.req.From)
+		pn.closeRelayHop(hop.req.SrcTunnelID)
+		pn.push(hop.req.From, MsgPushRelayHopClose, &RelayHopClose{From: gConf.Network.Node, SrcTunnelID: hop.req.SrcTunnelID})
+		return true
+	})
+}
+
+// closeRelayHop deletes the routes of the hop and closes the tunnel built for it
+func (pn *P2PNetwork) closeRelayHop(srcTunnelID uint64) {
+	i, ok := pn.relayHops.LoadAndDelete(srcTunnelID)
+	if !ok {
+		return
+	}
+	hop := i.(*relayChainHop)
+	gLog.Printf(LvDEBUG, "close relay chain %d hop %d", srcTunnelID, hop.req.Hop)
+	pn.relayRoutes.Delete(hop.req.SrcTunnelID)
+	pn.relayRoutes.Delete(hop.req.DstTunnelID)
+	if hop.owned {
+		hop.next.close()
+	}
+}
+
+// build the relay chain from the source node, return the tunnel to the first hop and the rtid
+func (pn *P2PNetwork) addRelayChain(config AppConfig, chain []string) (_ *P2PTunnel, _ uint64, err error) {
+	gLog.Printf(LvINFO, "addRelayChain to %s via %s start", config.LogPeerNode(), strings.Join(chain, "->"))
+	defer gLog.Printf(LvINFO, "addRelayChain to %s end", config.LogPeerNode())
+	t, err := pn.addDirectTunnel(AppConfig{PeerNode: chain[0], peerToken: config.peerToken, relayMode: "private"}, 0)
+	if err != nil {
+		gLog.Println(LvERROR, "direct connect error:", err)
+		return nil, 0, ErrConnectRelayNode
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// the hops built before the error
+		req := RelayHopClose{From: gConf.Network.Node, Token: config.peerToken, SrcTunnelID: t.id}
+		for _, node := range chain {
+			pn.push(node, MsgPushRelayHopClose, &req)
+		}
+		t.close()
+	}()
+	// peer connect the last hop
+	last := chain[len(chain)-1]
+	req := AddRelayTunnelReq{
+		From:          gConf.Network.Node,
+		RelayName:     last,
+		RelayToken:    config.peerToken,
+		RelayMode:     "private",
+		RelayTunnelID: t.id,
+	}
+	gLog.Printf(LvDEBUG, "push %s the last relay node(%s)", config.LogPeerNode(), last)
+	pn.push(config.PeerNode, MsgPushAddRelayTunnelReq, &req)
+	head, body := pn.read(config.PeerNode, MsgPush, MsgPushAddRelayTunnelRsp, PeerAddRelayTimeount)
+	if head == nil {
+		return nil, 0, errors.New("read MsgPushAddRelayTunnelRsp error")
+	}
+	rspID := TunnelMsg{}
+	if err = json.Unmarshal(body, &rspID); err != nil {
+		return nil, 0, ErrPeerConnectRelay
+	}
+	// connect hop by hop
+	var prevTunnelID uint64
+	for i, node := range chain {
+		hopReq := RelayHopReq{
+			From:         gConf.Network.Node,
+			Token:        config.peerToken,
+			Hop:          i,
+			PrevTunnelID: prevTunnelID,
+			SrcTunnelID:  t.id,
+			DstTunnelID:  rspID.ID,
+		}
+		if i < len(chain)-1 {
+			hopReq.NextNode = chain[i+1]
+			hopReq.NextToken = config.peerToken
+		}
+		if _, ok := pn.msgMap.Load(NodeNameToID(node)); !ok {
+			pn.msgMap.Store(NodeNameToID(node), make(chan msgCtx, 50))
+		}
+		pn.push(node, MsgPushRelayHopReq, &hopReq)
+		head, body = pn.read(node, MsgPush, MsgPushRelayHopRsp, PeerAddRelayTimeount)
+		if head == nil {
+			gLog.Printf(LvERROR, "read %s MsgPushRelayHopRsp error", node)
+			return nil, 0, ErrPeerConnectRelay
+		}
+		hopRsp := RelayHopRsp{}
+		if err = json.Unmarshal(body, &hopRsp); err != nil || hopRsp.Error != "" {
+			gLog.Printf(LvERROR, "relay hop %s error:%s", node, hopRsp.Error)
+			return nil, 0, ErrPeerConnectRelay
+		}
+		prevTunnelID = hopRsp.TunnelID
+	}
+	return t, rspID.ID, nil
+}
+
+func handleRelayHop(req RelayHopReq) {
+	gLog.Printf(LvDEBUG, "handleRelayHop %d from %s next %s", req.Hop, req.From, req.NextNode)
+	rsp := RelayHopRsp{}
+	err := relayHop(&req, &rsp)
+	if err != nil {
+		gLog.Printf(LvERROR, "relay hop %d from %s error:%s", req.Hop, req.From, err)
+		rsp.Error = err.Error()
+	}
+	GNetwork.push(req.From, MsgPushRelayHopRsp, &rsp)
+}
+
+func relayHop(req *RelayHopReq, rsp *RelayHopRsp) error {
+	// same as the connect request, only the nodes authorized by the server use this node as relay
+	if !verifyRelayToken(req.Token) {
+		return ErrRelayHopDenied
+	}
+	if req.Hop >= MaxRelayHops {
+		return ErrRelayChainTooLong
+	}
+	if req.NextNode == gConf.Network.Node || req.NextNode == req.From {
+		return ErrRelayChainLoop
+	}
+	hop := &relayChainHop{req: *req}
+	prevID := req.PrevTunnelID
+	if req.Hop == 0 {
+		prevID = req.SrcTunnelID
+	}
+	i, ok := GNetwork.allTunnels.Load(prevID)
+	if !ok {
+		return ErrRelayTunnelNotFound
+	}
+	hop.prev = i.(*P2PTunnel)
+	if req.PrevTunnelID != 0 {
+		if err := GNetwork.addRelayRoute(req.SrcTunnelID, hop.prev, req.From); err != nil {
+			return err
+		}
+	}
+	if req.NextNode == "" {
+		i, ok := GNetwork.allTunnels.Load(req.DstTunnelID)
+		if !ok {
+			GNetwork.relayRoutes.Delete(req.SrcTunnelID)
+			return ErrRelayTunnelNotFound
+		}
+		hop.next = i.(*P2PTunnel)
+		GNetwork.relayHops.Store(req.SrcTunnelID, hop)
+		return nil
+	}
+	t, err := GNetwork.addDirectTunnel(AppConfig{PeerNode: req.NextNode, peerToken: req.NextToken, relayMode: "private"}, 0)
+	if err != nil {
+		GNetwork.relayRoutes.Delete(req.SrcTunnelID)
+		return err
+	}
+	hop.next, hop.owned = t, true
+	GNetwork.relayHops.Store(req.SrcTunnelID, hop)
+	rsp.TunnelID = t.id
+	if err = GNetwork.addRelayRoute(req.DstTunnelID, t, req.From); err != nil {
+		GNetwork.closeRelayHop(req.SrcTunnelID)
+		return err
+	}
+	return nil
+}
+
+// handleRelayHopClose closes the hop on a relay node, or rebuilds the relay chain on the source node
+func handleRelayHopClose(req RelayHopClose) {
+	gLog.Printf(LvDEBUG, "handleRelayHopClose %d from %s", req.SrcTunnelID, req.From)
+	if i, ok := GNetwork.relayHops.Load(req.SrcTunnelID); ok {
+		if hop := i.(*relayChainHop); hop.req.From == req.From && verifyRelayToken(req.Token) {
+			GNetwork.closeRelayHop(req.SrcTunnelID)
+		}
+		return
+	}
+	GNetwork.apps.Range(func(_, i interface{}) bool {
+		app := i.(*p2pApp)
+		if t := app.RelayTunnel(); t == nil || t.id != req.SrcTunnelID || !app.config.inRelayChain(req.From) {
+			return true
+		}
+		gLog.Printf(LvINFO, "%s relay chain hop %s down, rebuild it", app.config.LogPeerNode(), req.From)
+		app.hbMtx.Lock()
+		app.hbTimeRelay = time.Time{} // checkRelayTunnel rebuilds it
+		app.hbMtx.Unlock()
+		return false
+	})
+}
+
+// closeRelayChain tears down the hops of the relay chain and the tunnel to the first hop
+func (app *p2pApp) closeRelayChain() {
+	t := app.RelayTunnel()
+	if len(app.relayChain) == 0 || t == nil {
+		return
+	}
+	req := RelayHopClose{From: gConf.Network.Node, Token: app.config.peerToken, SrcTunnelID: t.id}
+	for _, node := range app.relayChain {
+		GNetwork.push(node, MsgPushRelayHopClose, &req)
+	}
+	t.close()
+	app.relayChain = nil
+}
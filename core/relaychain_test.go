@@ -0,0 +1,125 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestRelayChain(t *testing.T) {
+	oldNode := gConf.Network.Node
+	gConf.Network.Node = "nodeA"
+	defer func() { gConf.Network.Node = oldNode }()
+	c := AppConfig{PeerNode: "nodeB", RelayNode: " R1, R2 ,R3"}
+	chain, err := c.relayChain()
+	if err != nil || len(chain) != 3 || chain[0] != "R1" || chain[2] != "R3" {
+		t.Errorf("relayChain error:%v %s", chain, err)
+	}
+	if !c.inRelayChain("R2") || c.inRelayChain("R4") {
+		t.Error("inRelayChain error")
+	}
+	for _, relayNode := range []string{"R1,R2,R1", "R1,nodeB", "nodeA,R1"} {
+		c.RelayNode = relayNode
+		if _, err = c.relayChain(); err != ErrRelayChainLoop {
+			t.Errorf("%s should be a loop", relayNode)
+		}
+	}
+	c.RelayNode = "R1,R2,R3,R4,R5"
+	if _, err = c.relayChain(); err != ErrRelayChainTooLong {
+		t.Error("relay chain should be too long")
+	}
+}
+
+func testRelayHopNetwork(t *testing.T) (prev, dst *P2PTunnel) {
+	oldNetwork, oldToken, oldNode := GNetwork, gConf.Network.Token, gConf.Network.Node
+	t.Cleanup(func() { GNetwork, gConf.Network.Token, gConf.Network.Node = oldNetwork, oldToken, oldNode })
+	GNetwork = &P2PNetwork{relayAcct: newRelayAccounting()}
+	gConf.Network.Token = 1234
+	gConf.Network.Node = "R2"
+	prev = &P2PTunnel{id: 10, running: true, conn: &benchUnderlay{}, config: AppConfig{PeerNode: "R1"}, hbTime: time.Now()}
+	dst = &P2PTunnel{id: 20, running: true, conn: &benchUnderlay{}, config: AppConfig{PeerNode: "nodeB"}, hbTime: time.Now()}
+	GNetwork.allTunnels.Store(prev.id, prev)
+	GNetwork.allTunnels.Store(dst.id, dst)
+	return prev, dst
+}
+
+func TestRelayHopSetup(t *testing.T) {
+	prev, dst := testRelayHopNetwork(t)
+	req := RelayHopReq{From: "nodeA", Token: 1, Hop: 1, PrevTunnelID: prev.id, SrcTunnelID: 5, DstTunnelID: dst.id}
+	if err := relayHop(&req, &RelayHopRsp{}); err != ErrRelayHopDenied {
+		t.Fatalf("wrong token error %v", err)
+	}
+	if _, ok := GNetwork.relayRoutes.Load(uint64(5)); ok {
+		t.Fatal("route added without auth")
+	}
+	req.Token = 1234
+	if err := relayHop(&req, &RelayHopRsp{}); err != nil {
+		t.Fatal(err)
+	}
+	// the last hop forwards the peer's frames to the previous hop with ttl
+	frame := testRelayOverlayFrame(5, 7, []byte("hello"))
+	if err := GNetwork.forwardRelay(dst, 5, frame); err != nil {
+		t.Fatal(err)
+	}
+	if n := prev.conn.(*benchUnderlay).written; n != len(frame)+1 {
+		t.Errorf("forwarded %d bytes, want %d", n, len(frame)+1)
+	}
+	hopFrame := relayHopFrame(nil, 5, 1, frame[openP2PHeaderSize+RelayHeaderSize:])
+	if err := GNetwork.forwardRelay(dst, 5, hopFrame); err != nil || hopFrame[openP2PHeaderSize+RelayHeaderSize] != 0 {
+		t.Errorf("ttl %d error %v", hopFrame[openP2PHeaderSize+RelayHeaderSize], err)
+	}
+	if err := GNetwork.forwardRelay(dst, 5, hopFrame); err != ErrRelayHopTTL {
+		t.Errorf("ttl 0 error %v", err)
+	}
+}
+
+func TestRelayHopTeardown(t *testing.T) {
+	prev, dst := testRelayHopNetwork(t)
+	req := RelayHopReq{From: "nodeA", Token: 1234, Hop: 1, PrevTunnelID: prev.id, SrcTunnelID: 5, DstTunnelID: dst.id}
+	if err := relayHop(&req, &RelayHopRsp{}); err != nil {
+		t.Fatal(err)
+	}
+	handleRelayHopClose(RelayHopClose{From: "nodeX", Token: 1234, SrcTunnelID: 5})
+	if _, ok := GNetwork.relayHops.Load(uint64(5)); !ok {
+		t.Fatal("closed by other node")
+	}
+	handleRelayHopClose(RelayHopClose{From: "nodeA", Token: 1234, SrcTunnelID: 5})
+	if _, ok := GNetwork.relayHops.Load(uint64(5)); ok {
+		t.Fatal("hop not closed")
+	}
+	if _, ok := GNetwork.relayRoutes.Load(uint64(5)); ok {
+		t.Fatal("route not deleted")
+	}
+	// the hop is down when a tunnel loses the heartbeat
+	if err := relayHop(&req, &RelayHopRsp{}); err != nil {
+		t.Fatal(err)
+	}
+	GNetwork.checkRelayHops()
+	if _, ok := GNetwork.relayHops.Load(uint64(5)); !ok {
+		t.Fatal("active hop closed")
+	}
+	prev.hbTime = time.Now().Add(-TunnelHeartbeatTime * 3)
+	GNetwork.checkRelayHops()
+	if _, ok := GNetwork.relayHops.Load(uint64(5)); ok {
+		t.Fatal("broken hop not closed")
+	}
+}
+
+func TestRelayStampNodeID(t *testing.T) {
+	prev, dst := testRelayHopNetwork(t)
+	prev.peerNodeID = NodeNameToID("nodeA")
+	claimed := make([]byte, 8)
+	binary.LittleEndian.PutUint64(claimed, NodeNameToID("nodeC"))
+	inner := testFrame(MsgRelayNodeData, append(claimed, []byte("ip packet")...))
+	frame := testFrame(MsgRelayData, append(make([]byte, RelayHeaderSize), inner...))
+	if err := GNetwork.relay(prev, dst.id, frame); err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.LittleEndian.Uint64(frame[openP2PHeaderSize+RelayHeaderSize+openP2PHeaderSize:]); id != prev.peerNodeID {
+		t.Errorf("node id %d should be stamped by the relay", id)
+	}
+	GNetwork.apps.Store(prev.peerNodeID, &p2pApp{relayTunnel: dst})
+	if !GNetwork.relayedBy(prev.peerNodeID, dst) || GNetwork.relayedBy(prev.peerNodeID, prev) || GNetwork.relayedBy(NodeNameToID("nodeC"), dst) {
+		t.Error("relayedBy error")
+	}
+}
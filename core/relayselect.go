@@ -0,0 +1,227 @@
+package openp2p
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	MaxRelayCandidates    = 5
+	RelayProbeTimeout     = time.Second * 3
+	RelayReselectInterval = time.Minute * 10
+	RelaySwitchRatio      = 0.7 // switch relay when the new one's rtt less than 70% of current
+)
+
+type relaySelection struct {
+	RelayCandidate
+	rtt    time.Duration            // rtt from local to relay plus relay to peer
+	scores map[string]time.Duration // all reachable candidates
+	time   time.Time
+}
+
+// candidates order: current relay, existing private tunnels, sdwan nodes, the relay node given by server
+func (pn *P2PNetwork) relayCandidates(config AppConfig, current *RelayCandidate) []RelayCandidate {
+	cands := []RelayCandidate{}
+	exist := map[string]bool{gConf.Network.Node: true, config.PeerNode: true}
+	add := func(c RelayCandidate) {
+		if exist[c.Node] || c.Node == "" {
+			return
+		}
+		exist[c.Node] = true
+		cands = append(cands, c)
+	}
+	if current != nil {
+		add(*current)
+	}
+	pn.allTunnels.Range(func(id, i interface{}) bool {
+		t := i.(*P2PTunnel)
+		if t.config.relayMode != "public" && t.isActive() {
+			add(RelayCandidate{Node: t.config.PeerNode, Token: config.peerToken, Mode: "private"})
+		}
+		return len(cands) < MaxRelayCandidates
+	})
+	for _, node := range gConf.getSDWAN().Nodes {
+		if len(cands) >= MaxRelayCandidates {
+			break
+		}
+		add(RelayCandidate{Node: node.Name, Token: config.peerToken, Mode: "private"})
+	}
+	pn.reqGatewayMtx.Lock()
+	pn.write(MsgRelay, MsgRelayNodeReq, &RelayNodeReq{config.PeerNode})
+	head, body := pn.read("", MsgRelay, MsgRelayNodeRsp, ClientAPITimeout)
+	pn.reqGatewayMtx.Unlock()
+	if head != nil {
+		rsp := RelayNodeRsp{}
+		if err := json.Unmarshal(body, &rsp); err == nil && rsp.RelayName != "" && rsp.RelayToken != 0 {
+			add(RelayCandidate{Node: rsp.RelayName, Token: rsp.RelayToken, Mode: rsp.Mode})
+		}
+	}
+	return cands
+}
+
+// activeTunnel returns a running tunnel to the node
+func (pn *P2PNetwork) activeTunnel(node string) *P2PTunnel {
+	var res *P2PTunnel
+	pn.allTunnels.Range(func(id, i interface{}) bool {
+		if t := i.(*P2PTunnel); t.config.PeerNode == node && t.isActive() {
+			res = t
+			return false
+		}
+		return true
+	})
+	return res
+}
+
+// measure the rtt to the candidates concurrently, unreachable candidates are not in the result.
+// The existing tunnels are reused, the tunnels built for probing are closed after it
+func probeRelays(cands []RelayCandidate) map[string]time.Duration {
+	res := make(map[string]time.Duration)
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range cands {
+		wg.Add(1)
+		go func(c RelayCandidate) {
+			defer wg.Done()
+			t := GNetwork.activeTunnel(c.Node)
+			if t == nil {
+				var err error
+				t, err = GNetwork.addDirectTunnel(AppConfig{PeerNode: c.Node, peerToken: c.Token, relayMode: c.Mode}, 0)
+				if err != nil {
+					gLog.Printf(LvDEBUG, "probe relay %s error:%s", c.Node, err)
+					return
+				}
+				defer t.close()
+			}
+			if rtt := t.measureRTT(RelayProbeTimeout); rtt > 0 {
+				mtx.Lock()
+				res[c.Node] = rtt
+				mtx.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return res
+}
+
+func bestRelay(cands []RelayCandidate, local, peer map[string]time.Duration) (*relaySelection, error) {
+	var best *relaySelection
+	scores := make(map[string]time.Duration)
+	for _, c := range cands {
+		l, ok1 := local[c.Node]
+		p, ok2 := peer[c.Node]
+		if !ok1 || !ok2 {
+			continue
+		}
+		scores[c.Node] = l + p
+		if best == nil || l+p < best.rtt {
+			best = &relaySelection{RelayCandidate: c, rtt: l + p, time: time.Now()}
+		}
+	}
+	if best == nil {
+		return nil, ErrNoRelayCandidate
+	}
+	best.scores = scores
+	return best, nil
+}
+
+// select the relay node with the lowest rtt for both sides, the result is cached RelayReselectInterval
+func (pn *P2PNetwork) selectRelay(config AppConfig, current *RelayCandidate) (*relaySelection, error) {
+	if i, ok := pn.relaySelections.Load(config.PeerNode); ok && current == nil {
+		if sel := i.(*relaySelection); time.Since(sel.time) < RelayReselectInterval {
+			return sel, nil
+		}
+	}
+	if compareVersion(config.peerVersion, SupportRelaySelectVersion) < 0 {
+		return nil, errors.New("peer not support relay selection")
+	}
+	cands := pn.relayCandidates(config, current)
+	if len(cands) == 0 {
+		return nil, ErrNoRelayCandidate
+	}
+	gLog.Printf(LvDEBUG, "probe %d relay candidates for %s", len(cands), config.LogPeerNode())
+	pn.push(config.PeerNode, MsgPushRelayProbeReq, &RelayProbeReq{From: gConf.Network.Node, Token: config.peerToken, Candidates: cands})
+	local := probeRelays(cands)
+	head, body := pn.read(config.PeerNode, MsgPush, MsgPushRelayProbeRsp, PeerAddRelayTimeount)
+	if head == nil {
+		return nil, errors.New("read MsgPushRelayProbeRsp error")
+	}
+	rsp := RelayProbeRsp{}
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return nil, err
+	}
+	peer := make(map[string]time.Duration)
+	for node, us := range rsp.RTT {
+		peer[node] = time.Duration(us) * time.Microsecond
+	}
+	best, err := bestRelay(cands, local, peer)
+	if err != nil {
+		return nil, err
+	}
+	gLog.Printf(LvINFO, "select relay %s for %s, rtt=%dms", best.Node, config.LogPeerNode(), best.rtt/time.Millisecond)
+	pn.relaySelections.Store(config.PeerNode, best)
+	return best, nil
+}
+
+func handleRelayProbe(req RelayProbeReq) {
+	gLog.Printf(LvDEBUG, "handleRelayProbe from %s, %d candidates", req.From, len(req.Candidates))
+	rsp := RelayProbeRsp{RTT: make(map[string]int64)}
+	defer GNetwork.push(req.From, MsgPushRelayProbeRsp, &rsp)
+	// same as the app connect, the candidates' tokens are only used for the nodes of this user
+	if req.Token != gConf.Network.Token {
+		gLog.Println(LvERROR, "relay probe Access Denied:", req.From)
+		return
+	}
+	if len(req.Candidates) > MaxRelayCandidates {
+		req.Candidates = req.Candidates[:MaxRelayCandidates]
+	}
+	for node, rtt := range probeRelays(req.Candidates) {
+		rsp.RTT[node] = int64(rtt / time.Microsecond)
+	}
+}
+
+// needRelaySwitch reports whether it's time to re-evaluate the relay node of the app.
+// The configured relay node and the app on the direct tunnel are kept
+func (app *p2pApp) needRelaySwitch() bool {
+	if app.config.RelayNode != "" || app.RelayTunnel() == nil || time.Since(app.relaySelectTime) < RelayReselectInterval {
+		return false
+	}
+	if t := app.DirectTunnel(); t != nil && t.isActive() {
+		return false
+	}
+	return true
+}
+
+// betterRelay reports whether the selected relay is much better than the current one
+func betterRelay(sel *relaySelection, current string) bool {
+	if sel.Node == current {
+		return false
+	}
+	if currentRTT, ok := sel.scores[current]; ok && float64(sel.rtt) > float64(currentRTT)*RelaySwitchRatio {
+		return false
+	}
+	return true
+}
+
+// periodically re-evaluate the relay node, switch it if a much better one appears
+func (app *p2pApp) checkRelaySwitch() {
+	if !app.needRelaySwitch() {
+		return
+	}
+	rt := app.RelayTunnel()
+	app.relaySelectTime = time.Now()
+	config := app.config
+	if err := GNetwork.requestPeerInfo(&config); err != nil {
+		return
+	}
+	current := RelayCandidate{Node: rt.config.PeerNode, Token: rt.config.peerToken, Mode: app.relayMode}
+	sel, err := GNetwork.selectRelay(config, &current)
+	if err != nil || !betterRelay(sel, current.Node) {
+		return
+	}
+	gLog.Printf(LvINFO, "%s switch relay %s to %s", app.config.LogPeerNode(), current.Node, sel.Node)
+	if err = app.buildRelayTunnel(); err != nil {
+		gLog.Printf(LvERROR, "%s switch relay error:%s", app.config.LogPeerNode(), err)
+	}
+}
@@ -0,0 +1,60 @@
+package openp2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBestRelay(t *testing.T) {
+	cands := []RelayCandidate{{Node: "R1"}, {Node: "R2"}, {Node: "R3"}}
+	local := map[string]time.Duration{"R1": time.Millisecond * 10, "R2": time.Millisecond * 30, "R3": time.Millisecond * 1}
+	peer := map[string]time.Duration{"R1": time.Millisecond * 50, "R2": time.Millisecond * 20}
+	best, err := bestRelay(cands, local, peer)
+	if err != nil || best.Node != "R2" || best.rtt != time.Millisecond*50 {
+		t.Errorf("bestRelay error:%+v %s", best, err)
+	}
+	if len(best.scores) != 2 || best.scores["R1"] != time.Millisecond*60 {
+		t.Errorf("scores error:%v", best.scores)
+	}
+	if _, err = bestRelay(cands, local, nil); err != ErrNoRelayCandidate {
+		t.Error("unreachable candidates should not be selected")
+	}
+}
+
+func TestRelaySwitch(t *testing.T) {
+	sel := &relaySelection{RelayCandidate: RelayCandidate{Node: "R2"}, rtt: time.Millisecond * 50,
+		scores: map[string]time.Duration{"R1": time.Millisecond * 100, "R2": time.Millisecond * 50}}
+	if !betterRelay(sel, "R1") {
+		t.Error("should switch to the much better relay")
+	}
+	if betterRelay(sel, "R2") {
+		t.Error("should not switch to the current relay")
+	}
+	sel.scores["R1"] = time.Millisecond * 60
+	if betterRelay(sel, "R1") {
+		t.Error("should not switch for a small improvement")
+	}
+	if !betterRelay(sel, "R3") {
+		t.Error("should switch from the unreachable relay")
+	}
+
+	relay := &P2PTunnel{running: true, conn: &benchUnderlay{}, hbTime: time.Now()}
+	app := &p2pApp{relayTunnel: relay}
+	if !app.needRelaySwitch() {
+		t.Error("relay app should be re-evaluated")
+	}
+	app.relaySelectTime = time.Now()
+	if app.needRelaySwitch() {
+		t.Error("re-evaluated too often")
+	}
+	app.relaySelectTime = time.Time{}
+	app.directTunnel = &P2PTunnel{running: true, conn: &benchUnderlay{}, hbTime: time.Now()}
+	if app.needRelaySwitch() {
+		t.Error("app on the direct tunnel should not switch relay")
+	}
+	app.directTunnel = nil
+	app.config.RelayNode = "R1"
+	if app.needRelaySwitch() {
+		t.Error("configured relay should not switch")
+	}
+}
@@ -0,0 +1,216 @@
+package openp2p
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	relayUsageFile         = "relayusage.json"
+	relayUsageSaveInterval = time.Minute
+)
+
+// RelayQuota limits the traffic relayed for a peer node when this node serves as a relay.
+// Node "*" matches all nodes without a specific rule.
+type RelayQuota struct {
+	Node      string `json:"node,omitempty"`
+	DailyMB   int64  `json:"dailyMB,omitempty"`   // 0 unlimited
+	MonthlyMB int64  `json:"monthlyMB,omitempty"` // 0 unlimited
+	Bandwidth int    `json:"bandwidth,omitempty"` // mbps, 0 unlimited
+}
+
+type relayUsage struct {
+	Node      string `json:"node"`
+	Tx        int64  `json:"tx"` // relayed bytes from this node
+	Rx        int64  `json:"rx"` // relayed bytes to this node
+	Daily     int64  `json:"daily"`
+	Monthly   int64  `json:"monthly"`
+	Day       string `json:"day"`
+	Month     string `json:"month"`
+	Dropped   int64  `json:"dropped"`
+	limiter   *SpeedLimiter
+	overQuota bool
+}
+
+type relayAccounting struct {
+	mtx   sync.Mutex
+	usage map[string]*relayUsage
+	file  string
+	now   func() time.Time // for testcase
+	date  int              // yyyymmdd of day and month, they are formatted only when the date changes
+	day   string
+	month string
+}
+
+func newRelayAccounting() *relayAccounting {
+	return &relayAccounting{usage: make(map[string]*relayUsage), file: relayUsagePath(), now: time.Now}
+}
+
+// relayUsagePath is next to config.json, in the working directory which is changed to the executable's at start
+func relayUsagePath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = filepath.Dir(os.Args[0])
+	}
+	return filepath.Join(dir, relayUsageFile)
+}
+
+func (ra *relayAccounting) quota(node string) *RelayQuota {
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
+	var def *RelayQuota
+	for _, q := range gConf.RelayQuotas {
+		if q.Node == node {
+			return q
+		}
+		if q.Node == "*" {
+			def = q
+		}
+	}
+	return def
+}
+
+// must hold ra.mtx
+func (ra *relayAccounting) get(node string) *relayUsage {
+	u, ok := ra.usage[node]
+	if !ok {
+		u = &relayUsage{Node: node}
+		ra.usage[node] = u
+	}
+	now := ra.now()
+	if y, m, d := now.Date(); y*10000+int(m)*100+d != ra.date {
+		ra.date = y*10000 + int(m)*100 + d
+		ra.day = now.Format("2006-01-02")
+		ra.month = now.Format("2006-01")
+	}
+	if u.Day != ra.day {
+		u.Day = ra.day
+		u.Daily = 0
+		u.overQuota = false
+	}
+	if u.Month != ra.month {
+		u.Month = ra.month
+		u.Monthly = 0
+		u.overQuota = false
+	}
+	return u
+}
+
+func (u *relayUsage) exceed(q *RelayQuota) bool {
+	if q == nil {
+		return false
+	}
+	return (q.DailyMB > 0 && u.Daily >= q.DailyMB*1024*1024) || (q.MonthlyMB > 0 && u.Monthly >= q.MonthlyMB*1024*1024)
+}
+
+// account the relay traffic from node to node, it will wait for the bandwidth limit of the source node
+func (ra *relayAccounting) add(from, to string, n int) error {
+	fromQuota := ra.quota(from)
+	toQuota := ra.quota(to)
+	ra.mtx.Lock()
+	src := ra.get(from)
+	dst := ra.get(to)
+	if src.exceed(fromQuota) || dst.exceed(toQuota) {
+		src.Dropped += int64(n)
+		if !src.overQuota {
+			src.overQuota = true
+			gLog.Printf(LvWARN, "relay quota exceeded %s->%s, drop it. daily=%d monthly=%d", from, to, src.Daily, src.Monthly)
+		}
+		ra.mtx.Unlock()
+		return ErrRelayQuotaExceeded
+	}
+	src.Tx += int64(n)
+	src.Daily += int64(n)
+	src.Monthly += int64(n)
+	dst.Rx += int64(n)
+	dst.Daily += int64(n)
+	dst.Monthly += int64(n)
+	var limiter *SpeedLimiter
+	if fromQuota != nil && fromQuota.Bandwidth > 0 {
+		if src.limiter == nil || src.limiter.speed != fromQuota.Bandwidth*1024*1024/8 {
+			src.limiter = newSpeedLimiter(fromQuota.Bandwidth*1024*1024/8, 1)
+		}
+		limiter = src.limiter
+	}
+	ra.mtx.Unlock()
+	if limiter != nil {
+		limiter.Add(n, true)
+	}
+	return nil
+}
+
+func (ra *relayAccounting) report() []RelayUsageInfo {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	res := []RelayUsageInfo{}
+	for node := range ra.usage {
+		u := ra.get(node)
+		info := RelayUsageInfo{
+			Node:    u.Node,
+			Tx:      u.Tx,
+			Rx:      u.Rx,
+			Daily:   u.Daily,
+			Monthly: u.Monthly,
+			Dropped: u.Dropped,
+		}
+		if q := ra.quota(node); q != nil {
+			info.DailyMB = q.DailyMB
+			info.MonthlyMB = q.MonthlyMB
+			info.Bandwidth = q.Bandwidth
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Tx+res[i].Rx > res[j].Tx+res[j].Rx })
+	return res
+}
+
+func (ra *relayAccounting) load() {
+	data, err := os.ReadFile(ra.file)
+	if err != nil {
+		return
+	}
+	usage := []*relayUsage{}
+	if err = json.Unmarshal(data, &usage); err != nil {
+		gLog.Println(LvERROR, "parse relayusage.json error:", err)
+		return
+	}
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	for _, u := range usage {
+		ra.usage[u.Node] = u
+	}
+}
+
+func (ra *relayAccounting) save() {
+	ra.mtx.Lock()
+	usage := make([]*relayUsage, 0, len(ra.usage))
+	for _, u := range ra.usage {
+		usage = append(usage, u)
+	}
+	data, _ := json.MarshalIndent(usage, "", "  ")
+	ra.mtx.Unlock()
+	if len(usage) == 0 {
+		return
+	}
+	if err := os.WriteFile(ra.file, data, 0644); err != nil {
+		gLog.Println(LvERROR, "save relayusage.json error:", err)
+	}
+}
+
+// run saves the usage periodically, it's loaded before the relay traffic is accounted
+func (ra *relayAccounting) run() {
+	for {
+		time.Sleep(relayUsageSaveInterval)
+		ra.save()
+	}
+}
+
+func handleReportRelayUsage() (err error) {
+	gLog.Println(LvDEBUG, "handleReportRelayUsage")
+	req := ReportRelayUsage{Usage: GNetwork.relayAcct.report()}
+	return GNetwork.write(MsgReport, MsgReportRelayUsage, &req)
+}
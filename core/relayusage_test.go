@@ -0,0 +1,63 @@
+package openp2p
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRelayQuota(t *testing.T) {
+	gConf.mtx.Lock()
+	old := gConf.RelayQuotas
+	gConf.RelayQuotas = []*RelayQuota{{Node: "*", MonthlyMB: 100}, {Node: "nodeA", DailyMB: 1}}
+	gConf.mtx.Unlock()
+	defer func() {
+		gConf.mtx.Lock()
+		gConf.RelayQuotas = old
+		gConf.mtx.Unlock()
+	}()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	ra := newRelayAccounting()
+	ra.now = func() time.Time { return now }
+	if err := ra.add("nodeA", "nodeB", 1024*1024); err != nil {
+		t.Error(err)
+	}
+	if err := ra.add("nodeA", "nodeB", 1024); err != ErrRelayQuotaExceeded {
+		t.Error("daily quota should be exceeded")
+	}
+	if err := ra.add("nodeB", "nodeA", 1024); err != ErrRelayQuotaExceeded {
+		t.Error("daily quota of destination should be exceeded")
+	}
+	if err := ra.add("nodeC", "nodeB", 1024); err != nil {
+		t.Error(err)
+	}
+	now = now.Add(time.Hour * 24)
+	if err := ra.add("nodeA", "nodeB", 1024); err != nil {
+		t.Error("daily quota should be reset", err)
+	}
+	res := make(map[string]RelayUsageInfo)
+	for _, u := range ra.report() {
+		res[u.Node] = u
+	}
+	a := res["nodeA"]
+	if len(res) != 3 || a.Tx != 1024*1024+1024 || a.Dropped != 1024 || a.Daily != 1024 || a.DailyMB != 1 {
+		t.Errorf("report error:%+v", a)
+	}
+	b := res["nodeB"]
+	if b.Rx != 1024*1024+1024*2 || b.Dropped != 1024 || b.MonthlyMB != 100 {
+		t.Errorf("report error:%+v", b)
+	}
+}
+
+func TestRelayUsageSaveLoad(t *testing.T) {
+	ra := newRelayAccounting()
+	ra.file = filepath.Join(t.TempDir(), relayUsageFile)
+	ra.add("nodeA", "nodeB", 1024)
+	ra.save()
+	loaded := newRelayAccounting()
+	loaded.file = ra.file
+	loaded.load()
+	if u := loaded.usage["nodeA"]; u == nil || u.Tx != 1024 || u.Daily != 1024 {
+		t.Errorf("loaded usage %+v", u)
+	}
+}
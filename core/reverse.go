@@ -0,0 +1,234 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The reverse app publishes a service of this node on the peer's port, like ssh -R. The app builds the tunnel
+// as usual, but instead of listening on SrcPort it asks the peer to listen. The peer sends every accepted
+// connection back by OverlayConnectReq, which this node dials to DstHost:DstPort like the peer side of a
+// normal app. The listen request is repeated as the heartbeat, the peer closes the listener when it stops.
+
+const (
+	reverseListenInterval = TunnelHeartbeatTime
+	reverseListenTimeout  = reverseListenInterval * 3
+)
+
+var reverseListeners sync.Map // appID: *reverseListener
+
+// reverseListener is the peer side of a reverse app
+type reverseListener struct {
+	appID    uint64
+	port     int
+	mtx      sync.Mutex
+	req      ReverseListenReq
+	tunnel   *P2PTunnel
+	lastReq  time.Time
+	listener net.Listener
+	iptree   *IPTree
+}
+
+// listenReverse asks the peer to listen for the app until the app is closed
+func (app *p2pApp) listenReverse() {
+	gLog.Printf(LvINFO, "REVERSE LISTEN ON %s PORT %d START", app.config.LogPeerNode(), app.config.SrcPort)
+	defer gLog.Printf(LvINFO, "REVERSE LISTEN ON %s PORT %d END", app.config.LogPeerNode(), app.config.SrcPort)
+	app.wg.Add(1)
+	defer app.wg.Done()
+	if app.config.Protocol == "udp" {
+		gLog.Printf(LvERROR, "%s reverse listen on port %d error:%s", app.config.LogPeerNode(), app.config.SrcPort, ErrReverseUDP)
+		app.errMsg = ErrReverseUDP.Error()
+		return
+	}
+	SaveKey(app.id, app.key) // the connections from the peer are encrypted by the key of this app
+	for app.running {
+		if t := app.Tunnel(); t != nil {
+			req := ReverseListenReq{AppID: app.id,
+				Token:     gConf.Network.Token,
+				SrcPort:   app.config.SrcPort,
+				Whitelist: app.config.Whitelist,
+				DstIP:     app.config.DstHost,
+				DstPort:   app.config.DstPort,
+			}
+			if !app.isDirect() {
+				req.RelayTunnelID = t.id
+			}
+			t.WriteMessage(app.RelayTunnelID(), MsgP2P, MsgReverseListenReq, &req)
+		}
+		for i := 0; i < int(reverseListenInterval/time.Second) && app.running; i++ {
+			time.Sleep(time.Second)
+		}
+	}
+	if t := app.Tunnel(); t != nil {
+		t.WriteMessage(app.RelayTunnelID(), MsgP2P, MsgReverseCloseReq, &ReverseCloseReq{AppID: app.id})
+	}
+}
+
+// handleReverseListenReq starts the listener of the reverse app, or refreshes it with the current tunnel.
+// The listener is reopened when the port or the listen address changes
+func (t *P2PTunnel) handleReverseListenReq(req *ReverseListenReq) {
+	rsp := ReverseListenRsp{AppID: req.AppID}
+	defer func() {
+		t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgReverseListenRsp, &rsp)
+	}()
+	// same as the app connect, avoid someone using the share relay node's token
+	if req.Token != gConf.Network.Token {
+		gLog.Println(LvERROR, "Access Denied:", req.Token)
+		rsp.Error = "access denied"
+		return
+	}
+	if i, ok := reverseListeners.Load(req.AppID); ok {
+		rl := i.(*reverseListener)
+		rl.mtx.Lock()
+		if req.SrcPort == rl.port && IsLocalhost(req.Whitelist) == IsLocalhost(rl.req.Whitelist) {
+			if req.Whitelist != rl.req.Whitelist {
+				rl.iptree = NewIPTree(req.Whitelist)
+			}
+			rl.req, rl.tunnel, rl.lastReq = *req, t, time.Now()
+			rl.mtx.Unlock()
+			return
+		}
+		rl.mtx.Unlock()
+		gLog.Printf(LvINFO, "reverse app %d listen on port %d changed, reopen it", rl.appID, rl.port)
+		rl.close()
+	}
+	listenAddr := ""
+	if IsLocalhost(req.Whitelist) { // not expose port
+		listenAddr = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenAddr, req.SrcPort))
+	if err != nil {
+		gLog.Printf(LvERROR, "%s:%d reverse app %d listen error:%s", t.config.LogPeerNode(), t.id, req.AppID, err)
+		rsp.Error = err.Error()
+		return
+	}
+	rl := &reverseListener{appID: req.AppID, port: req.SrcPort, req: *req, tunnel: t, lastReq: time.Now(), listener: l, iptree: NewIPTree(req.Whitelist)}
+	reverseListeners.Store(req.AppID, rl)
+	gLog.Printf(LvINFO, "%s reverse app %d listen on port %d to %s:%d", t.config.LogPeerNode(), req.AppID, req.SrcPort,
+		req.DstIP, req.DstPort)
+	go rl.accept()
+	go rl.checkExpired()
+}
+
+// handleReverseListenRsp shows the listen error of the peer in the app status
+func handleReverseListenRsp(rsp *ReverseListenRsp) {
+	GNetwork.apps.Range(func(_, i interface{}) bool {
+		app := i.(*p2pApp)
+		if app.id != rsp.AppID {
+			return true
+		}
+		if rsp.Error != "" && rsp.Error != app.errMsg {
+			gLog.Printf(LvERROR, "%s reverse listen on port %d error:%s", app.config.LogPeerNode(), app.config.SrcPort, rsp.Error)
+		}
+		app.errMsg = rsp.Error
+		return false
+	})
+}
+
+// handleReverseCloseReq closes the listener of the reverse app which sends its requests by t
+func (t *P2PTunnel) handleReverseCloseReq(req *ReverseCloseReq) {
+	i, ok := reverseListeners.Load(req.AppID)
+	if !ok {
+		return
+	}
+	rl := i.(*reverseListener)
+	rl.mtx.Lock()
+	own := rl.tunnel == t
+	rl.mtx.Unlock()
+	if own {
+		rl.close()
+	}
+}
+
+func (rl *reverseListener) close() {
+	if reverseListeners.CompareAndDelete(rl.appID, rl) {
+		rl.listener.Close()
+	}
+}
+
+// checkExpired closes the listener when the reverse app stops its requests
+func (rl *reverseListener) checkExpired() {
+	for {
+		time.Sleep(reverseListenInterval)
+		rl.mtx.Lock()
+		expired := time.Since(rl.lastReq) > reverseListenTimeout
+		rl.mtx.Unlock()
+		if i, ok := reverseListeners.Load(rl.appID); !ok || i != rl { // closed
+			return
+		}
+		if expired {
+			gLog.Printf(LvINFO, "reverse app %d on port %d expired", rl.appID, rl.port)
+			rl.close()
+			return
+		}
+	}
+}
+
+// accept sends the connections back to the node of the reverse app
+func (rl *reverseListener) accept() {
+	defer gLog.Printf(LvDEBUG, "reverse app %d accept on port %d end", rl.appID, rl.port)
+	for {
+		conn, err := rl.listener.Accept()
+		if err != nil {
+			rl.close()
+			return
+		}
+		rl.mtx.Lock()
+		t, req, iptree := rl.tunnel, rl.req, rl.iptree
+		rl.mtx.Unlock()
+		if req.Whitelist != "" {
+			remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			if !iptree.Contains(remoteIP) && !IsLocalhost(remoteIP) {
+				conn.Close()
+				gLog.Printf(LvERROR, "%s not in whitelist, access denied", remoteIP)
+				continue
+			}
+		}
+		if !t.isRuning() {
+			gLog.Printf(LvDEBUG, "reverse app %d tunnel %d closed, not ready", req.AppID, t.id)
+			conn.Close()
+			continue
+		}
+		oConn := overlayConn{
+			tunnel:   t,
+			connTCP:  conn,
+			id:       rand.Uint64(),
+			isClient: true,
+			rtid:     req.RelayTunnelID,
+			appID:    req.AppID,
+			appKey:   GetKey(req.AppID),
+			running:  true,
+		}
+		// pre-calc key bytes for encrypt
+		if oConn.appKey != 0 {
+			encryptKey := make([]byte, AESKeySize)
+			binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
+			binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
+			oConn.appKeyBytes = encryptKey
+			oConn.cbc, _ = newCBCCipher(encryptKey)
+		}
+		t.overlayConns.Store(oConn.id, &oConn)
+		gLog.Printf(LvDEBUG, "Accept reverse TCP overlayID:%d, %s", oConn.id, conn.RemoteAddr())
+		// tell the node of the app connect its service
+		connReq := OverlayConnectReq{ID: oConn.id,
+			Token:    gConf.Network.Token,
+			DstIP:    req.DstIP,
+			DstPort:  req.DstPort,
+			Protocol: "tcp",
+			AppID:    req.AppID,
+		}
+		if req.RelayTunnelID != 0 {
+			connReq.RelayTunnelID = t.id
+		}
+		t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgOverlayConnectReq, &connReq)
+		go func() {
+			// TODO: wait OverlayConnectRsp instead of sleep
+			time.Sleep(time.Second) // waiting remote node connection ok
+			oConn.run()
+		}()
+	}
+}
@@ -0,0 +1,138 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedUnderlay counts the written messages by subtype, it's written by several goroutines
+type lockedUnderlay struct {
+	benchUnderlay
+	mtx      sync.Mutex
+	wmtx     sync.Mutex
+	subTypes map[uint16]int
+}
+
+func (u *lockedUnderlay) Write(b []byte) (int, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.subTypes == nil {
+		u.subTypes = make(map[uint16]int)
+	}
+	if len(b) >= openP2PHeaderSize {
+		u.subTypes[binary.LittleEndian.Uint16(b[6:8])]++
+	}
+	return u.benchUnderlay.Write(b)
+}
+
+func (u *lockedUnderlay) written(subType uint16) int {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.subTypes[subType]
+}
+
+func (u *lockedUnderlay) WriteBytes(mainType uint16, subType uint16, data []byte) error {
+	return DefaultWriteBytes(u, mainType, subType, data)
+}
+
+func (u *lockedUnderlay) WriteBuffer(data []byte) error {
+	return DefaultWriteBuffer(u, data)
+}
+
+func (u *lockedUnderlay) WriteMessage(mainType uint16, subType uint16, packet interface{}) error {
+	return DefaultWriteMessage(u, mainType, subType, packet)
+}
+
+func (u *lockedUnderlay) WLock()   { u.wmtx.Lock() }
+func (u *lockedUnderlay) WUnlock() { u.wmtx.Unlock() }
+
+func freeTCPPort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestReverseListener(t *testing.T) {
+	oldToken := gConf.Network.Token
+	defer func() { gConf.Network.Token = oldToken }()
+	gConf.Network.Token = 12345
+	port := freeTCPPort(t)
+	ul := &lockedUnderlay{}
+	tunnel := &P2PTunnel{id: 1, conn: ul, running: true, config: AppConfig{PeerNode: "LAPTOP"}}
+	req := ReverseListenReq{AppID: 7, Token: 1, SrcPort: port, Whitelist: "127.0.0.1,10.2.0.0/16", DstIP: "127.0.0.1", DstPort: 3000}
+	tunnel.handleReverseListenReq(&req)
+	if _, ok := reverseListeners.Load(uint64(7)); ok {
+		t.Fatal("listen with wrong token")
+	}
+	req.Token = 12345
+	tunnel.handleReverseListenReq(&req)
+	defer tunnel.handleReverseCloseReq(&ReverseCloseReq{AppID: 7})
+	i, ok := reverseListeners.Load(uint64(7))
+	if !ok {
+		t.Fatal("not listening")
+	}
+	rl := i.(*reverseListener)
+	req.DstPort = 3001
+	req.Whitelist = "127.0.0.1,10.1.0.0/16"
+	tunnel.handleReverseListenReq(&req) // refresh
+	rl.mtx.Lock()
+	if rl.req.DstPort != 3001 || rl.tunnel != tunnel || !rl.iptree.Contains("10.1.2.3") {
+		t.Errorf("not refreshed %+v", rl.req)
+	}
+	rl.mtx.Unlock()
+	if i, _ := reverseListeners.Load(uint64(7)); i != rl {
+		t.Error("reopened by the refresh")
+	}
+	other := &P2PTunnel{id: 2, conn: ul, running: true, config: AppConfig{PeerNode: "OTHER"}}
+	other.handleReverseCloseReq(&ReverseCloseReq{AppID: 7})
+	if _, ok := reverseListeners.Load(uint64(7)); !ok {
+		t.Fatal("closed by the other tunnel")
+	}
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := false
+	for i := 0; i < 100 && !accepted; i++ {
+		tunnel.overlayConns.Range(func(_, o interface{}) bool {
+			oConn := o.(*overlayConn)
+			accepted = oConn.appID == 7 && oConn.rtid == 0
+			return false
+		})
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !accepted {
+		t.Error("no overlay connection")
+	}
+	conn.Close()
+	for i := 0; i < 300 && ul.written(MsgOverlayDisconnectReq) == 0; i++ { // the overlay starts after 1s
+		time.Sleep(time.Millisecond * 10)
+	}
+	if ul.written(MsgOverlayDisconnectReq) == 0 {
+		t.Error("the overlay connection isn't closed")
+	}
+	req.SrcPort = freeTCPPort(t)
+	tunnel.handleReverseListenReq(&req)
+	if i, ok := reverseListeners.Load(uint64(7)); !ok || i == rl || i.(*reverseListener).port != req.SrcPort {
+		t.Fatal("not reopened on the new port")
+	}
+	if c, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		c.Close()
+		t.Error("still listening on the old port")
+	}
+	tunnel.handleReverseCloseReq(&ReverseCloseReq{AppID: 7})
+	if _, ok := reverseListeners.Load(uint64(7)); ok {
+		t.Error("not closed")
+	}
+	if c, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", req.SrcPort)); err == nil {
+		c.Close()
+		t.Error("still listening")
+	}
+}
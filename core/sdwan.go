@@ -8,7 +8,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type PacketHeader struct {
@@ -26,6 +26,7 @@ func parseHeader(b []byte, h *PacketHeader) error {
 	}
 	h.version = int(b[0] >> 4)
 	h.protocol = byte(b[9])
+	h.dst = 0 // the ipv6 isn't routed by the ipv4 routes
 	if h.version == 4 {
 		h.dst = binary.BigEndian.Uint32(b[16:20])
 	} else if h.version != 6 {
@@ -50,14 +51,30 @@ type p2pSDWAN struct {
 	gateway       net.IP
 	virtualIP     *net.IPNet
 	internalRoute *IPTree
+	dns           *sdwanDNS
+	acl           *sdwanACL
+	exit          *exitRoute
+	mtu           atomic.Int32 // the current tun mtu
+	central       *centralHA
+	centralOnce   sync.Once
+	reflectMtx    sync.Mutex
+	reflectors    []*mcastReflector
+	macs          *macTable // the MACs behind the nodes in tap mode
 }
 
 func (s *p2pSDWAN) reset() {
 	gLog.Println(LvINFO, "reset sdwan when network disconnected")
 	// clear sysroute
-	delRoutesByGateway(s.gateway.String())
+	if !isNetstackMode() {
+		delRoutesByGateway(s.gateway.String())
+	}
 	// clear internel route
 	s.internalRoute = NewIPTree("")
+	if s.dns != nil {
+		s.dns.reset()
+	}
+	s.exit.clear()
+	s.stopReflector()
 	// clear p2papp
 	for _, node := range gConf.getAddNodes() {
 		gConf.delete(AppConfig{SrcPort: 0, PeerNode: node.Name})
@@ -72,6 +89,21 @@ func (s *p2pSDWAN) init(name string) error {
 	if s.internalRoute == nil {
 		s.internalRoute = NewIPTree("")
 	}
+	if s.dns == nil {
+		s.dns = newSDWANDNS()
+		resetSystemDNS() // the resolver left by the last crashed process
+	}
+	if s.acl == nil {
+		s.acl = newSDWANACL()
+	}
+	if s.exit == nil {
+		s.exit = newExitRoute()
+		s.exit.clearStale()
+	}
+	if s.central == nil {
+		s.central = newCentralHA()
+	}
+	s.centralOnce.Do(func() { go s.centralLoop() })
 
 	s.nodeName = name
 	if gw, sn, err := net.ParseCIDR(gConf.getSDWAN().Gateway); err == nil { // preserve old gateway
@@ -81,8 +113,10 @@ func (s *p2pSDWAN) init(name string) error {
 
 	for _, node := range gConf.getDelNodes() {
 		gLog.Println(LvDEBUG, "sdwan init: deal deleted node: ", node.Name)
-		gLog.Printf(LvDEBUG, "sdwan init: delRoute: %s, %s ", node.IP, s.gateway.String())
-		delRoute(node.IP, s.gateway.String())
+		if !isNetstackMode() {
+			gLog.Printf(LvDEBUG, "sdwan init: delRoute: %s, %s ", node.IP, s.gateway.String())
+			delRoute(node.IP, s.gateway.String())
+		}
 		s.internalRoute.Del(node.IP, node.IP)
 		ipNum, _ := inetAtoN(node.IP)
 		s.sysRoute.Delete(ipNum)
@@ -105,8 +139,10 @@ func (s *p2pSDWAN) init(name string) error {
 				maxIP[i] = minIP[i] | ^ipnet.Mask[i]
 			}
 			s.internalRoute.Del(minIP.String(), maxIP.String())
-			delRoute(ipnet.String(), s.gateway.String())
-			gLog.Printf(LvDEBUG, "sdwan init: resource delRoute: %s, %s ", ipnet.String(), s.gateway.String())
+			if !isNetstackMode() {
+				delRoute(ipnet.String(), s.gateway.String())
+				gLog.Printf(LvDEBUG, "sdwan init: resource delRoute: %s, %s ", ipnet.String(), s.gateway.String())
+			}
 		}
 	}
 	for _, node := range gConf.getAddNodes() {
@@ -124,12 +160,21 @@ func (s *p2pSDWAN) init(name string) error {
 				return err
 			}
 			gLog.Println(LvINFO, "sdwan init: start tun ok")
-			allowTunForward()
-			gLog.Printf(LvDEBUG, "sdwan init: addRoute %s %s %s", s.subnet.String(), s.gateway.String(), s.tun.tunName)
-			addRoute(s.subnet.String(), s.gateway.String(), s.tun.tunName)
+			if node.ExitNode != 0 {
+				gLog.Println(LvINFO, "sdwan init: this node is an exit node")
+				enableExitForward()
+			}
+			if isNetstackMode() { // no system route in userspace
+				continue
+			}
+			allowTunForward(s.tun.tunName)
+			if !isTapMode() { // the subnet is on the link of tap
+				gLog.Printf(LvDEBUG, "sdwan init: addRoute %s %s %s", s.subnet.String(), s.gateway.String(), s.tun.tunName)
+				addRoute(s.subnet.String(), s.gateway.String(), s.tun.tunName)
+			}
 			// addRoute("255.255.255.255/32", s.gateway.String(), s.tun.tunName) // for broadcast
 			// addRoute("224.0.0.0/4", s.gateway.String(), s.tun.tunName)        // for multicast
-			initSNATRule(s.subnet.String()) // for network resource
+			initSNATRule(s.tun.tunName, s.subnet.String()) // for network resource
 			continue
 		}
 		ip, err := inetAtoN(ipNet.String())
@@ -174,11 +219,26 @@ func (s *p2pSDWAN) init(name string) error {
 				}
 				s.internalRoute.Add(minIP.String(), maxIP.String(), &sdwanNode{name: node.Name, id: NodeNameToID(node.Name)})
 				// add sys route
-				gLog.Printf(LvDEBUG, "sdwan init: addRoute %s %s %s", ipnet.String(), s.gateway.String(), s.tun.tunName)
-				addRoute(ipnet.String(), s.gateway.String(), s.tun.tunName)
+				if isNetstackMode() {
+					continue
+				}
+				gw := s.gateway.String()
+				if isTapMode() { // the resource node forwards it
+					gw = node.IP
+				}
+				gLog.Printf(LvDEBUG, "sdwan init: addRoute %s %s %s", ipnet.String(), gw, s.tun.tunName)
+				addRoute(ipnet.String(), gw, s.tun.tunName)
 			}
 		}
 	}
+	sdwan := gConf.getSDWAN()
+	s.dns.update(&sdwan)
+	s.acl.update(&sdwan)
+	if s.tun != nil && s.virtualIP != nil {
+		s.setupExitNode(&sdwan)
+		s.startDNS()
+		s.startReflector()
+	}
 	gConf.retryAllMemApp()
 	gLog.Printf(LvINFO, "sdwan init ok")
 	return nil
@@ -192,29 +252,106 @@ func (s *p2pSDWAN) run() {
 	})
 }
 
+// flowHash keeps the packets of one flow in the same tun queue, so they are written in order
+func flowHash(b []byte) uint32 {
+	h := uint32(2166136261)
+	mix := func(p []byte) {
+		for _, c := range p {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+	}
+	var proto byte
+	var l4 []byte
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		ihl := int(b[0]&0x0f) * 4
+		proto = b[9]
+		mix(b[12:20]) // src and dst
+		// the ports are only in the first fragment, hash them when MF=0 and offset=0
+		if len(b) >= ihl+4 && binary.BigEndian.Uint16(b[6:8])&0x3fff == 0 {
+			l4 = b[ihl : ihl+4]
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		proto = b[6]
+		mix(b[8:40])
+		if len(b) >= 44 {
+			l4 = b[40:44]
+		}
+	default:
+		return 0
+	}
+	mix([]byte{proto})
+	if proto == 6 || proto == 17 { // TCP or UDP ports
+		mix(l4)
+	}
+	return h
+}
+
+// readNodeLoop dispatches the node data to the tun queues by flow
 func (s *p2pSDWAN) readNodeLoop() {
 	gLog.Printf(LvDEBUG, "sdwan readNodeLoop start")
 	defer gLog.Printf(LvDEBUG, "sdwan readNodeLoop end")
-	writeBuff := make([][]byte, 1)
-	for {
-		nd := GNetwork.ReadNode(time.Second * 10) // TODO: read multi packet
-		if nd == nil {
-			gLog.Printf(LvDev, "waiting for node data")
-			continue
+	num := s.tun.queueNum()
+	if num == 1 {
+		s.writeTunLoop(0, GNetwork.nodeData)
+		return
+	}
+	chs := make([]chan *NodeData, num)
+	for i := range chs {
+		chs[i] = make(chan *NodeData, WriteDataChanSize)
+		go s.writeTunLoop(i, chs[i])
+	}
+	for nd := range GNetwork.nodeData {
+		chs[flowHash(nd.Data)%uint32(num)] <- nd
+	}
+}
+
+// writeTunLoop writes the node data to tun queue q, packets are written in batch
+func (s *p2pSDWAN) writeTunLoop(q int, ch chan *NodeData) {
+	batch := s.tun.batchSize()
+	nds := make([]*NodeData, 0, batch)
+	writeBuff := make([][]byte, 0, batch)
+	headroom := s.tun.headroom()
+	head := PacketHeader{}
+	for nd := range ch {
+		nds = append(nds[:0], nd)
+	drain:
+		for len(nds) < batch {
+			select {
+			case nd = <-ch:
+				nds = append(nds, nd)
+			default:
+				break drain
+			}
 		}
-		head := PacketHeader{}
-		parseHeader(nd.Data, &head)
-		gLog.Printf(LvDev, "write tun dst ip=%s,len=%d", net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String(), len(nd.Data))
-		if PIHeaderSize == 0 {
-			writeBuff[0] = nd.Data
-		} else {
-			writeBuff[0] = make([]byte, PIHeaderSize+len(nd.Data))
-			copy(writeBuff[0][PIHeaderSize:], nd.Data)
+		writeBuff = writeBuff[:0]
+		for _, nd := range nds {
+			captureSDWAN(true, nd.NodeID, nd.Data, false)
+			if !s.acl.allow(nd.NodeID, nd.Data) {
+				gLog.Printf(LvDev, "sdwan acl deny packet from %d len=%d", nd.NodeID, len(nd.Data))
+				continue
+			}
+			if isTCPSYN(nd.Data) {
+				clampMSS(nd.Data, GNetwork.NodeMTU(nd.NodeID))
+			}
+			if gLog.enabled(LvDev) {
+				parseHeader(nd.Data, &head)
+				gLog.Printf(LvDev, "write tun %d dst ip=%s,len=%d", q, net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String(), len(nd.Data))
+			}
+			if b := nd.headroom(headroom); b != nil {
+				writeBuff = append(writeBuff, b)
+			} else {
+				b = make([]byte, headroom+len(nd.Data))
+				copy(b[headroom:], nd.Data)
+				writeBuff = append(writeBuff, b)
+			}
 		}
-
-		len, err := s.tun.Write(writeBuff, PIHeaderSize)
-		if err != nil {
-			gLog.Printf(LvDEBUG, "write tun dst ip=%s,len=%d,error:%s", net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String(), len, err)
+		if _, err := s.tun.writeQueue(q, writeBuff, headroom); err != nil {
+			gLog.Printf(LvDEBUG, "write tun %d %d packets error:%s", q, len(writeBuff), err)
+		}
+		for _, nd := range nds {
+			nd.Release()
 		}
 	}
 }
@@ -224,6 +361,8 @@ func isBroadcastOrMulticast(ipUint32 uint32, subnet *net.IPNet) bool {
 	return ipUint32 == 0xffffffff || (ipUint32>>28 == 0xe) // 225.255.255.255/32, 224.0.0.0/4
 }
 
+// routeTunPacket is called by the readTunLoop of every queue concurrently, the shared state it touches is
+// the routes in sync.Map, the atomic exit hop, the locked acl flows and the tunnel from app.nodeTunnel
 func (s *p2pSDWAN) routeTunPacket(p []byte, head *PacketHeader) {
 	var node *sdwanNode
 	// v, ok := s.routes.Load(ih.dst)
@@ -231,47 +370,193 @@ func (s *p2pSDWAN) routeTunPacket(p []byte, head *PacketHeader) {
 	if !ok || v == nil {
 		if isBroadcastOrMulticast(head.dst, s.subnet) {
 			gLog.Printf(LvDev, "multicast ip=%s", net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String())
+			captureSDWAN(false, captureFlood, p, false)
 			GNetwork.WriteBroadcast(p)
+			return
+		}
+		if head.version != 4 {
+			captureSDWAN(false, captureNoRoute, p, false)
+			return
+		}
+		if node = s.exit.nextHop(head.dst); node == nil {
+			captureSDWAN(false, captureNoRoute, p, false)
+			return
 		}
-		return
 	} else {
 		node = v.(*sdwanNode)
 	}
-
+	s.acl.track(p)
+	if len(p) > minTunMTU || isTCPSYN(p) {
+		mtu := GNetwork.NodeMTU(node.id)
+		if len(p) > mtu && head.version == 4 && p[6]&0x40 != 0 { // DF
+			gLog.Printf(LvDev, "packet to %s len=%d exceeds path mtu %d", node.name, len(p), mtu)
+			GNetwork.nodeData <- newNodeData(gConf.nodeID(), icmpFragNeeded(p, mtu))
+			return
+		}
+		if len(p) > mtu && head.version == 6 && len(p) >= 40 { // ipv6 is never fragmented by routers
+			gLog.Printf(LvDev, "ipv6 packet to %s len=%d exceeds path mtu %d", node.name, len(p), mtu)
+			GNetwork.nodeData <- newNodeData(gConf.nodeID(), icmpv6PacketTooBig(p, mtu))
+			return
+		}
+		clampMSS(p, mtu)
+	}
+	captureSDWAN(false, node.id, p, false)
 	err := GNetwork.WriteNode(node.id, p)
 	if err != nil {
 		gLog.Printf(LvDev, "write packet to %s fail: %s", node.name, err)
 	}
 }
 
-func (s *p2pSDWAN) readTunLoop() {
-	gLog.Printf(LvDEBUG, "sdwan readTunLoop start")
-	defer gLog.Printf(LvDEBUG, "sdwan readTunLoop end")
-	readBuff := make([][]byte, ReadTunBuffNum)
-	for i := 0; i < ReadTunBuffNum; i++ {
-		readBuff[i] = make([]byte, ReadTunBuffSize+PIHeaderSize)
-	}
-	readBuffSize := make([]int, ReadTunBuffNum)
+// readTunLoop reads tun queue q in batch, the kernel steers one flow to one queue
+func (s *p2pSDWAN) readTunLoop(q int) {
+	gLog.Printf(LvDEBUG, "sdwan readTunLoop %d start", q)
+	defer gLog.Printf(LvDEBUG, "sdwan readTunLoop %d end", q)
+	batch := s.tun.batchSize()
+	buffSize := readTunBuffSize()
+	headroom := s.tun.headroom()
+	readBuff := make([][]byte, batch)
+	for i := 0; i < batch; i++ {
+		readBuff[i] = make([]byte, buffSize+headroom)
+	}
+	readBuffSize := make([]int, batch)
 	ih := PacketHeader{}
 	for {
-		n, err := s.tun.Read(readBuff, readBuffSize, PIHeaderSize)
-		if err != nil {
-			gLog.Printf(LvERROR, "read tun fail: ", err)
+		n, err := s.tun.readQueue(q, readBuff, readBuffSize, headroom)
+		if err != nil && n == 0 { // the batch may be partially filled with error, like too many segments of GSO
+			gLog.Printf(LvERROR, "read tun %d fail: %s", q, err)
 			return
 		}
 		for i := 0; i < n; i++ {
-			if readBuffSize[i] > ReadTunBuffSize {
-				gLog.Printf(LvERROR, "read tun overflow: len=", readBuffSize[i])
+			if readBuffSize[i] > buffSize {
+				gLog.Printf(LvERROR, "read tun overflow: len=%d", readBuffSize[i])
 				continue
 			}
-			parseHeader(readBuff[i][PIHeaderSize:readBuffSize[i]+PIHeaderSize], &ih)
-			gLog.Printf(LvDev, "read tun dst ip=%s,len=%d", net.IP{byte(ih.dst >> 24), byte(ih.dst >> 16), byte(ih.dst >> 8), byte(ih.dst)}.String(), readBuffSize[0])
-			s.routeTunPacket(readBuff[i][PIHeaderSize:readBuffSize[i]+PIHeaderSize], &ih)
+			parseHeader(readBuff[i][headroom:readBuffSize[i]+headroom], &ih)
+			if gLog.enabled(LvDev) {
+				gLog.Printf(LvDev, "read tun %d dst ip=%s,len=%d", q, net.IP{byte(ih.dst >> 24), byte(ih.dst >> 16), byte(ih.dst >> 8), byte(ih.dst)}.String(), readBuffSize[i])
+			}
+			s.routeTunPacket(readBuff[i][headroom:readBuffSize[i]+headroom], &ih)
+		}
+	}
+}
+
+func isNetstackMode() bool {
+	return gConf.Network.SDWANMode == SDWANModeNetstack
+}
+
+// routable returns whether the ip is in the sdwan subnet or the resources of nodes
+func (s *p2pSDWAN) routable(ip net.IP) bool {
+	if s.subnet != nil && s.subnet.Contains(ip) {
+		return true
+	}
+	if ip.To4() == nil { // ipv6 is blocked by exit node
+		return s.exit.enabled()
+	}
+	ipNum, err := inetAtoN(ip.String())
+	if err != nil {
+		return false
+	}
+	_, ok := s.internalRoute.Load(ipNum)
+	return ok || s.exit.nextHop(ipNum) != nil
+}
+
+func (s *p2pSDWAN) setupExitNode(sdwan *SDWANInfo) {
+	if gConf.Network.ExitNode != "" && isTapMode() {
+		gLog.Println(LvWARN, "sdwan init: exit node is not supported in tap mode")
+	}
+	if gConf.Network.ExitNode == "" || gConf.Network.ExitNode == s.nodeName || isTapMode() {
+		s.exit.clear()
+		s.dns.setExitDNS("")
+		return
+	}
+	node, err := findExitNode(sdwan, gConf.Network.ExitNode)
+	if err == nil {
+		err = s.exit.setup(node, s.subnet, s.tun.tunName)
+	}
+	if err != nil {
+		gLog.Printf(LvERROR, "sdwan init: exit node error:%s", err)
+		s.exit.clear()
+		s.dns.setExitDNS("")
+		return
+	}
+	exitDNS := gConf.Network.ExitDNS
+	if exitDNS == "" {
+		exitDNS = defaultExitDNS
+	}
+	s.dns.setExitDNS(exitDNS)
+}
+
+func (s *p2pSDWAN) startNetstack() error {
+	if s.tun != nil {
+		return nil
+	}
+	ns, err := newNetstackTun(s.virtualIP.IP, s.routable)
+	if err != nil {
+		gLog.Println(LvERROR, "start netstack fail:", err)
+		return err
+	}
+	ns.lookup = s.dns.lookup
+	s.tun = &optun{tunName: SDWANModeNetstack, ns: ns}
+	go s.readTunLoop(0)
+	go s.readNodeLoop()
+	ns.serve()
+	return nil
+}
+
+// startDNS serves the node names on the virtual ip
+func (s *p2pSDWAN) startDNS() {
+	ip := s.virtualIP.IP.String()
+	if s.tun.ns != nil {
+		s.dns.start(ip, s.tun.ns.ListenPacket, s.tun.ns.DialContext)
+		return
+	}
+	var d net.Dialer
+	s.dns.start(ip, func(addr string) (net.PacketConn, error) {
+		return net.ListenPacket("udp4", addr)
+	}, d.DialContext)
+	if gConf.Network.DNSSystem != 0 || s.exit.enabled() { // the system resolver is required by dns leak protection
+		s.dns.setSystem(s.tun.tunName, ip)
+	}
+}
+
+// startReflector reflects the lan service discovery through the tun
+func (s *p2pSDWAN) startReflector() {
+	if s.tun.ns != nil || gConf.Network.Reflect == "" {
+		return
+	}
+	s.reflectMtx.Lock()
+	defer s.reflectMtx.Unlock()
+	if len(s.reflectors) > 0 {
+		return
+	}
+	for _, svc := range parseReflect(gConf.Network.Reflect) {
+		r, err := newMcastReflector(svc, s.tun.tunName, s.subnet)
+		if err != nil {
+			gLog.Printf(LvERROR, "%s reflector listen error:%s", svc.name, err)
+			continue
 		}
+		s.reflectors = append(s.reflectors, r)
+		go r.run()
 	}
 }
 
+// stopReflector stops the reflectors when the network is closed, they're started again by init
+func (s *p2pSDWAN) stopReflector() {
+	s.reflectMtx.Lock()
+	defer s.reflectMtx.Unlock()
+	for _, r := range s.reflectors {
+		r.stop()
+	}
+	s.reflectors = nil
+}
+
 func (s *p2pSDWAN) StartTun() error {
+	if isNetstackMode() {
+		return s.startNetstack()
+	}
+	if isTapMode() {
+		return s.startTap()
+	}
 	sdwan := gConf.getSDWAN()
 	if s.tun == nil {
 		tun := &optun{}
@@ -281,17 +566,51 @@ func (s *p2pSDWAN) StartTun() error {
 			return err
 		}
 		s.tun = tun
-		go s.readTunLoop()
-		go s.readNodeLoop() // multi-thread read will cause packets out of order, resulting in slower speeds
+		for q := 0; q < tun.queueNum(); q++ {
+			go s.readTunLoop(q)
+		}
+		go s.readNodeLoop() // packets of one flow are written by one goroutine, multi-thread writing will cause them out of order
 	}
 	err := setTunAddr(s.tun.tunName, s.virtualIP.String(), sdwan.Gateway, s.tun.dev)
 	if err != nil {
 		gLog.Printf(LvERROR, "setTunAddr error:%s,%s,%s,%s", err, s.tun.tunName, s.virtualIP.String(), sdwan.Gateway)
 		return err
 	}
+	s.mtu.Store(0)
+	s.updateTunMTU()
 	return nil
 }
 
+// updateTunMTU sets the tun mtu to the largest path mtu of the nodes, the smaller ones are served by
+// MSS clamping and ICMP fragmentation needed
+func (s *p2pSDWAN) updateTunMTU() {
+	tun := s.tun
+	if tun == nil || tun.ns != nil {
+		return
+	}
+	mtu := 0
+	s.sysRoute.Range(func(_, v interface{}) bool {
+		if m := GNetwork.NodeMTU(v.(*sdwanNode).id); m > mtu {
+			mtu = m
+		}
+		return true
+	})
+	if mtu == 0 {
+		mtu = tunMTU()
+	}
+	if tun.tap != nil { // the frame carries the ethernet header
+		mtu -= ethHeaderSize
+	}
+	if int(s.mtu.Swap(int32(mtu))) == mtu {
+		return
+	}
+	if err := setTunMTU(tun.tunName, mtu, tun.dev); err != nil {
+		gLog.Printf(LvWARN, "set tun mtu %d error:%s", mtu, err)
+		return
+	}
+	gLog.Printf(LvINFO, "tun mtu %d", mtu)
+}
+
 func handleSDWAN(subType uint16, msg []byte) error {
 	gLog.Printf(LvDEBUG, "handle sdwan msg type:%d", subType)
 	var err error
@@ -311,6 +630,9 @@ func handleSDWAN(subType uint16, msg []byte) error {
 		if err != nil {
 			gLog.Println(LvERROR, "sdwan init fail: ", err)
 			if GNetwork.sdwan.tun != nil {
+				GNetwork.sdwan.exit.clear()
+				GNetwork.sdwan.dns.stop()
+				GNetwork.sdwan.stopReflector()
 				GNetwork.sdwan.tun.Stop()
 				GNetwork.sdwan.tun = nil
 				return err
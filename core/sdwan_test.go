@@ -0,0 +1,44 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func testIPv4Packet(src, dst uint32, proto byte, sport, dport uint16) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	b[9] = proto
+	binary.BigEndian.PutUint32(b[12:16], src)
+	binary.BigEndian.PutUint32(b[16:20], dst)
+	binary.BigEndian.PutUint16(b[20:22], sport)
+	binary.BigEndian.PutUint16(b[22:24], dport)
+	return b
+}
+
+func TestFlowHash(t *testing.T) {
+	p1 := testIPv4Packet(0x0a020301, 0x0a020302, 6, 40000, 22)
+	p2 := testIPv4Packet(0x0a020301, 0x0a020302, 6, 40000, 22)
+	p2[30] = 1 // payload differs
+	if flowHash(p1) != flowHash(p2) {
+		t.Error("the same flow should have the same hash")
+	}
+	if flowHash(p1) == flowHash(testIPv4Packet(0x0a020301, 0x0a020302, 6, 40001, 22)) {
+		t.Error("different ports should have different hash")
+	}
+	// icmp ignores the bytes after ip header
+	i1 := testIPv4Packet(0x0a020301, 0x0a020302, 1, 1, 2)
+	i2 := testIPv4Packet(0x0a020301, 0x0a020302, 1, 3, 4)
+	if flowHash(i1) != flowHash(i2) {
+		t.Error("icmp of the same hosts should have the same hash")
+	}
+	// fragments use the hosts only
+	f := testIPv4Packet(0x0a020301, 0x0a020302, 17, 5, 6)
+	binary.BigEndian.PutUint16(f[6:8], 10)
+	if flowHash(f) == flowHash(testIPv4Packet(0x0a020301, 0x0a020302, 17, 5, 6)) {
+		t.Error("fragment should not hash the ports")
+	}
+	if flowHash([]byte{1, 2, 3}) != 0 {
+		t.Error("short packet should be 0")
+	}
+}
@@ -0,0 +1,521 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// "openp2p speedtest NODE" measures the throughput over the tunnel the traffic to the node uses, like iperf
+// without an app. The sender writes the test frames for the duration then tells the receiver how many it
+// sent, the receiver replies the bytes, the jitter and the loss it counted. The tcp mode writes the frames
+// to the reliable stream as fast as it goes, the udp mode sends datagrams at the bandwidth over a direct
+// quic tunnel. The peer serves the test only with -allowspeedtest 1.
+
+const (
+	SpeedTestTCP  = "tcp"
+	SpeedTestUDP  = "udp"
+	SpeedTestUp   = "up"
+	SpeedTestDown = "down"
+	SpeedTestBoth = "both"
+)
+
+const (
+	speedTestDefaultDuration  = time.Second * 10
+	speedTestMaxDuration      = time.Minute
+	speedTestMaxStreams       = 16
+	speedTestDefaultBandwidth = 100       // Mbps
+	speedTestDatagramSize     = 1100      // the frame size if the path mtu is unknown, fits the smallest quic packet
+	speedTestHeaderSize       = 8 + 4 + 8 // id, stream, send time
+	speedTestRspTimeout       = time.Second * 5
+	speedTestEndTimeout       = time.Second * 10 // the frames in flight and the result after the duration
+)
+
+var speedTests sync.Map // id: *speedTestSession
+
+// speedTestRecv counts the frames received, the jitter is the RFC 3550 interarrival jitter of every stream
+type speedTestRecv struct {
+	mtx     sync.Mutex
+	bytes   uint64
+	frames  uint64
+	first   time.Time
+	last    time.Time
+	transit map[uint32]int64 // the last transit time of the streams
+	jitter  float64          // nanoseconds
+}
+
+func (r *speedTestRecv) add(stream uint32, sendTime int64, n int, now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.frames == 0 {
+		r.first = now
+	}
+	r.last = now
+	r.bytes += uint64(n)
+	r.frames++
+	if r.transit == nil {
+		r.transit = make(map[uint32]int64)
+	}
+	transit := now.UnixNano() - sendTime // the clock offset of the nodes cancels in the difference
+	if prev, ok := r.transit[stream]; ok {
+		d := float64(transit - prev)
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (d - r.jitter) / 16
+	}
+	r.transit[stream] = transit
+}
+
+func (r *speedTestRecv) result(id uint64) SpeedTestResult {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return SpeedTestResult{ID: id, Bytes: r.bytes, Frames: r.frames, Duration: r.last.Sub(r.first).Milliseconds(),
+		Jitter: int64(r.jitter) / 1000}
+}
+
+type speedTestSession struct {
+	req        SpeedTestReq
+	tunnel     *P2PTunnel
+	rtid       uint64           // the peer's tunnel on the relay node, 0 if direct
+	datagram   datagramUnderlay // udp mode
+	client     bool
+	recv       speedTestRecv
+	sentBytes  atomic.Uint64
+	sentFrames atomic.Uint64
+	rspCh      chan SpeedTestRsp
+	resultCh   chan SpeedTestResult // the peer received
+	endCh      chan SpeedTestEnd    // the peer finished sending
+	done       chan struct{}
+	doneOnce   sync.Once
+}
+
+func newSpeedTestSession(req *SpeedTestReq, t *P2PTunnel, rtid uint64, client bool) (*speedTestSession, error) {
+	switch {
+	case req.Mode != SpeedTestTCP && req.Mode != SpeedTestUDP,
+		req.Direction != SpeedTestUp && req.Direction != SpeedTestDown && req.Direction != SpeedTestBoth,
+		req.Streams < 1 || req.Streams > speedTestMaxStreams,
+		req.Duration <= 0 || req.Duration > speedTestMaxDuration.Milliseconds(),
+		req.Mode == SpeedTestUDP && req.Bandwidth <= 0:
+		return nil, ErrSpeedTestParam
+	}
+	s := &speedTestSession{req: *req, tunnel: t, rtid: rtid, client: client,
+		rspCh: make(chan SpeedTestRsp, 1), resultCh: make(chan SpeedTestResult, 1), endCh: make(chan SpeedTestEnd, 1),
+		done: make(chan struct{})}
+	if req.Mode == SpeedTestUDP {
+		du, ok := t.conn.(datagramUnderlay)
+		if !ok || !du.SupportsDatagrams() || rtid != 0 {
+			return nil, ErrSpeedTestDatagram
+		}
+		s.datagram = du
+	}
+	return s, nil
+}
+
+func (s *speedTestSession) duration() time.Duration {
+	return time.Duration(s.req.Duration) * time.Millisecond
+}
+
+func (s *speedTestSession) stop() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+func (s *speedTestSession) writeMessage(subType uint16, req interface{}) error {
+	return s.tunnel.WriteMessage(s.rtid, MsgP2P, subType, req)
+}
+
+// sends reports whether this side sends the data frames
+func (s *speedTestSession) sends() bool {
+	if s.req.Direction == SpeedTestBoth {
+		return true
+	}
+	return (s.req.Direction == SpeedTestUp) == s.client
+}
+
+// receives reports whether this side receives the data frames
+func (s *speedTestSession) receives() bool {
+	if s.req.Direction == SpeedTestBoth {
+		return true
+	}
+	return (s.req.Direction == SpeedTestDown) == s.client
+}
+
+// send writes the frames of the streams for the duration, then tells the peer the frames sent
+func (s *speedTestSession) send() {
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(s.duration())
+	for i := 0; i < s.req.Streams; i++ {
+		wg.Add(1)
+		go func(stream uint32) {
+			defer wg.Done()
+			s.sendStream(stream, deadline)
+		}(uint32(i))
+	}
+	wg.Wait()
+	if err := s.writeMessage(MsgSpeedTestEnd, &SpeedTestEnd{ID: s.req.ID, Frames: s.sentFrames.Load()}); err != nil {
+		gLog.Printf(LvERROR, "speedtest %d write end error:%s", s.req.ID, err)
+	}
+}
+
+func (s *speedTestSession) sendStream(stream uint32, deadline time.Time) {
+	bodyLen := ReadBuffLen
+	var rate float64 // bytes per second of this stream, 0 is unlimited
+	if s.datagram != nil {
+		frameSize := speedTestDatagramSize
+		if pmtu := int(s.tunnel.pmtu.Load()); pmtu > 0 {
+			frameSize = pmtu
+		}
+		bodyLen = frameSize - openP2PHeaderSize
+		rate = float64(s.req.Bandwidth) * 1000 * 1000 / 8 / float64(s.req.Streams)
+	}
+	frame, body := speedTestFrame(s.rtid, bodyLen)
+	binary.LittleEndian.PutUint64(body[0:8], s.req.ID)
+	binary.LittleEndian.PutUint32(body[8:12], stream)
+	start := time.Now()
+	sent := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		now := time.Now()
+		if now.After(deadline) {
+			return
+		}
+		binary.LittleEndian.PutUint64(body[12:20], uint64(now.UnixNano()))
+		var err error
+		if s.datagram != nil {
+			err = s.datagram.WriteDatagram(frame)
+		} else {
+			err = s.tunnel.conn.WriteBuffer(frame)
+		}
+		if err != nil {
+			gLog.Printf(LvERROR, "speedtest %d stream %d write error:%s", s.req.ID, stream, err)
+			return
+		}
+		s.tunnel.txBytes.Add(uint64(len(frame)))
+		s.sentFrames.Add(1)
+		s.sentBytes.Add(uint64(len(body)))
+		sent += len(body)
+		if rate > 0 {
+			if ahead := time.Duration(float64(sent)/rate*float64(time.Second)) - time.Since(start); ahead > time.Millisecond {
+				time.Sleep(ahead)
+			}
+		}
+	}
+}
+
+// speedTestFrame builds the data frame, wrapped to the relay node if rtid isn't 0
+func speedTestFrame(rtid uint64, bodyLen int) (frame, body []byte) {
+	if rtid == 0 {
+		frame = make([]byte, openP2PHeaderSize+bodyLen)
+		putHeader(frame, MsgP2P, MsgSpeedTestData, uint32(bodyLen))
+		return frame, frame[openP2PHeaderSize:]
+	}
+	inner := openP2PHeaderSize + bodyLen
+	frame = make([]byte, openP2PHeaderSize+RelayHeaderSize+inner)
+	putHeader(frame, MsgP2P, MsgRelayData, uint32(RelayHeaderSize+inner))
+	binary.LittleEndian.PutUint64(frame[openP2PHeaderSize:], rtid)
+	putHeader(frame[openP2PHeaderSize+RelayHeaderSize:], MsgP2P, MsgSpeedTestData, uint32(bodyLen))
+	return frame, frame[openP2PHeaderSize+RelayHeaderSize+openP2PHeaderSize:]
+}
+
+func isSpeedTestFrame(frame []byte) bool {
+	return len(frame) >= openP2PHeaderSize+speedTestHeaderSize && binary.LittleEndian.Uint16(frame[4:6]) == MsgP2P &&
+		binary.LittleEndian.Uint16(frame[6:8]) == MsgSpeedTestData
+}
+
+// handleSpeedTestData is called by the read loops, the frames of the unknown tests are dropped
+func handleSpeedTestData(body []byte) {
+	if len(body) < speedTestHeaderSize {
+		return
+	}
+	i, ok := speedTests.Load(binary.LittleEndian.Uint64(body[0:8]))
+	if !ok {
+		return
+	}
+	i.(*speedTestSession).recv.add(binary.LittleEndian.Uint32(body[8:12]), int64(binary.LittleEndian.Uint64(body[12:20])),
+		len(body), time.Now())
+}
+
+// handleSpeedTestReq serves the test of the peer if it's allowed
+func (t *P2PTunnel) handleSpeedTestReq(req *SpeedTestReq) {
+	rsp := SpeedTestRsp{ID: req.ID}
+	s, err := newSpeedTestSession(req, t, req.RelayTunnelID, false)
+	if gConf.Network.SpeedTest == 0 {
+		rsp.Error = "speedtest is not allowed, run the peer with -allowspeedtest 1"
+	} else if err != nil {
+		rsp.Error = err.Error()
+	}
+	if rsp.Error != "" {
+		gLog.Printf(LvWARN, "%s:%d speedtest %d refused:%s", t.config.LogPeerNode(), t.id, req.ID, rsp.Error)
+		t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgSpeedTestRsp, &rsp)
+		return
+	}
+	speedTests.Store(req.ID, s)
+	time.AfterFunc(s.duration()+speedTestEndTimeout, func() {
+		s.stop()
+		speedTests.Delete(req.ID)
+	})
+	gLog.Printf(LvINFO, "%s:%d speedtest %d start, %s %s %d streams %s", t.config.LogPeerNode(), t.id, req.ID,
+		req.Mode, req.Direction, req.Streams, s.duration())
+	s.writeMessage(MsgSpeedTestRsp, &rsp)
+	if s.sends() {
+		go s.send()
+	}
+}
+
+// handleSpeedTestMsg handles the control messages of the test, the data frames go to handleSpeedTestData
+func handleSpeedTestMsg(subType uint16, body []byte) {
+	switch subType {
+	case MsgSpeedTestRsp:
+		rsp := SpeedTestRsp{}
+		if err := json.Unmarshal(body, &rsp); err != nil {
+			gLog.Printf(LvERROR, "wrong SpeedTestRsp:%s", err)
+			return
+		}
+		if i, ok := speedTests.Load(rsp.ID); ok {
+			select {
+			case i.(*speedTestSession).rspCh <- rsp:
+			default:
+			}
+		}
+	case MsgSpeedTestEnd:
+		end := SpeedTestEnd{}
+		if err := json.Unmarshal(body, &end); err != nil {
+			gLog.Printf(LvERROR, "wrong SpeedTestEnd:%s", err)
+			return
+		}
+		i, ok := speedTests.Load(end.ID)
+		if !ok {
+			return
+		}
+		s := i.(*speedTestSession)
+		if s.client {
+			select {
+			case s.endCh <- end:
+			default:
+			}
+			return
+		}
+		res := s.recv.result(end.ID)
+		gLog.Printf(LvINFO, "speedtest %d received %d/%d frames %s", end.ID, res.Frames, end.Frames, formatBytes(res.Bytes))
+		s.writeMessage(MsgSpeedTestResult, &res)
+	case MsgSpeedTestResult:
+		res := SpeedTestResult{}
+		if err := json.Unmarshal(body, &res); err != nil {
+			gLog.Printf(LvERROR, "wrong SpeedTestResult:%s", err)
+			return
+		}
+		if i, ok := speedTests.Load(res.ID); ok {
+			select {
+			case i.(*speedTestSession).resultCh <- res:
+			default:
+			}
+		}
+	}
+}
+
+// formatBitrate is the throughput of n bytes in d
+func formatBitrate(n uint64, d time.Duration) string {
+	if d <= 0 {
+		return "- Mbps"
+	}
+	return fmt.Sprintf("%.2f Mbps", float64(n)*8/d.Seconds()/1000/1000)
+}
+
+// speedTestSummary reports the frames received by one side, the duration is the test duration if too few frames
+func speedTestSummary(dir string, res SpeedTestResult, sent uint64, d time.Duration) string {
+	if res.Duration > 0 {
+		d = time.Duration(res.Duration) * time.Millisecond
+	}
+	lost := uint64(0)
+	if sent > res.Frames {
+		lost = sent - res.Frames
+	}
+	loss := 0.0
+	if sent > 0 {
+		loss = float64(lost) * 100 / float64(sent)
+	}
+	return fmt.Sprintf("%-5s %s  %s in %.1fs  jitter %.2fms  loss %d/%d (%.2f%%)", dir, formatBitrate(res.Bytes, d),
+		formatBytes(res.Bytes), d.Seconds(), float64(res.Jitter)/1000, lost, sent, loss)
+}
+
+// handleSpeedTest runs the test to the node, it streams the progress every second and the summary in text
+func handleSpeedTest(w http.ResponseWriter, r *http.Request) {
+	if GNetwork == nil {
+		http.Error(w, "openp2p is not running", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	node := q.Get("node")
+	req := SpeedTestReq{ID: rand.Uint64(), Mode: q.Get("mode"), Direction: q.Get("direction")}
+	req.Streams, _ = strconv.Atoi(q.Get("streams"))
+	req.Bandwidth, _ = strconv.Atoi(q.Get("bandwidth"))
+	duration, _ := time.ParseDuration(q.Get("duration"))
+	req.Duration = duration.Milliseconds()
+	app, t := peerTunnel(node)
+	if t == nil {
+		http.Error(w, "no tunnel to "+node, http.StatusNotFound)
+		return
+	}
+	rtid, path := uint64(0), "direct"
+	if app != nil && !app.isDirect() {
+		rtid, path = app.RelayTunnelID(), "relay via "+app.relayNode
+		req.RelayTunnelID = t.id
+	}
+	s, err := newSpeedTestSession(&req, t, rtid, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	speedTests.Store(req.ID, s)
+	defer speedTests.Delete(req.ID)
+	defer s.stop()
+	if err = s.writeMessage(MsgSpeedTestReq, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	select {
+	case rsp := <-s.rspCh:
+		if rsp.Error != "" {
+			http.Error(w, node+": "+rsp.Error, http.StatusForbidden)
+			return
+		}
+	case <-time.After(speedTestRspTimeout):
+		http.Error(w, "no response from "+node, http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	gLog.Printf(LvINFO, "speedtest %d to %s start, %s %s %d streams %s", req.ID, node, req.Mode, req.Direction,
+		req.Streams, s.duration())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	printf := func(format string, a ...interface{}) {
+		fmt.Fprintf(w, format, a...)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	printf("speedtest to %s, %s tunnel %d over %s, %s\n", node, tunnelLinkMode(t), t.id, t.conn.Protocol(), path)
+	printf("%s %s, %d streams, %s\n", req.Mode, req.Direction, req.Streams, s.duration())
+	if s.sends() {
+		go s.send()
+	}
+	end := time.Now().Add(s.duration())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastSent, lastRecv uint64
+	for sec := 1; time.Duration(sec)*time.Second <= s.duration(); sec++ {
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+		line := fmt.Sprintf("%3ds", sec)
+		if s.sends() {
+			sent := s.sentBytes.Load()
+			line += "  up " + formatBitrate(sent-lastSent, time.Second)
+			lastSent = sent
+		}
+		if s.receives() {
+			s.recv.mtx.Lock()
+			recv := s.recv.bytes
+			s.recv.mtx.Unlock()
+			line += "  down " + formatBitrate(recv-lastRecv, time.Second)
+			lastRecv = recv
+		}
+		printf("%s\n", line)
+	}
+	select {
+	case <-time.After(time.Until(end)):
+	case <-r.Context().Done():
+		return
+	}
+	wait := time.After(speedTestEndTimeout)
+	printf("---\n")
+	if s.sends() {
+		select {
+		case res := <-s.resultCh:
+			printf("%s\n", speedTestSummary("up", res, s.sentFrames.Load(), s.duration()))
+		case <-wait:
+			printf("up    no result from %s\n", node)
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if s.receives() {
+		select {
+		case end := <-s.endCh:
+			printf("%s\n", speedTestSummary("down", s.recv.result(req.ID), end.Frames, s.duration()))
+		case <-wait:
+			printf("down  no end from %s\n", node)
+		case <-r.Context().Done():
+			return
+		}
+	}
+	gLog.Printf(LvINFO, "speedtest %d to %s end", req.ID, node)
+}
+
+func init() {
+	ctlHandle("/speedtest", handleSpeedTest)
+}
+
+// speedtestCmd runs the throughput test of the running node to the peer node
+func speedtestCmd(args []string) {
+	fset := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	udp := fset.Bool("u", false, "udp mode, send datagrams at the bandwidth, requires a direct quic tunnel")
+	direction := fset.String("d", SpeedTestUp, "up, down or both")
+	streams := fset.Int("P", 1, "the parallel streams")
+	duration := fset.Duration("t", speedTestDefaultDuration, "the test duration, max 1m")
+	bandwidth := fset.Int("b", speedTestDefaultBandwidth, "udp mode sending rate in Mbps")
+	fset.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: openp2p speedtest [-u] [-d up|down|both] [-P 1] [-t 10s] [-b 100] NODE")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	node := fset.Arg(0)
+	fset.Parse(fset.Args()[1:]) // the flags after the node
+	gConf.load()
+	mode := SpeedTestTCP
+	if *udp {
+		mode = SpeedTestUDP
+	}
+	query := url.Values{}
+	query.Set("node", node)
+	query.Set("mode", mode)
+	query.Set("direction", *direction)
+	query.Set("streams", strconv.Itoa(*streams))
+	query.Set("duration", duration.String())
+	query.Set("bandwidth", strconv.Itoa(*bandwidth))
+	rsp, err := ctlRequest("/speedtest", query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "speedtest error:", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		rsp.Body.Close() // stop the test
+	}()
+	io.Copy(os.Stdout, rsp.Body)
+}
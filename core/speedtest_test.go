@@ -0,0 +1,92 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpeedTestFrame(t *testing.T) {
+	s := &speedTestSession{req: SpeedTestReq{ID: 7}}
+	speedTests.Store(uint64(7), s)
+	defer speedTests.Delete(uint64(7))
+	now := time.Now()
+	for _, rtid := range []uint64{0, 99} {
+		frame, body := speedTestFrame(rtid, 100)
+		binary.LittleEndian.PutUint64(body[0:8], 7)
+		binary.LittleEndian.PutUint64(body[12:20], uint64(now.UnixNano()))
+		if rtid != 0 {
+			head := openP2PHeader{}
+			parseP2PHeader(frame, &head)
+			if head.SubType != MsgRelayData || binary.LittleEndian.Uint64(frame[openP2PHeaderSize:]) != rtid {
+				t.Fatalf("wrong relay frame %+v", head)
+			}
+			frame = frame[openP2PHeaderSize+RelayHeaderSize:] // forwarded by the relay node
+		}
+		if !isSpeedTestFrame(frame) || len(frame) != openP2PHeaderSize+100 {
+			t.Fatalf("rtid %d wrong frame len %d", rtid, len(frame))
+		}
+		handleSpeedTestData(frame[openP2PHeaderSize:])
+	}
+	if res := s.recv.result(7); res.Frames != 2 || res.Bytes != 200 {
+		t.Errorf("received %+v", res)
+	}
+	handleSpeedTestData(make([]byte, speedTestHeaderSize)) // unknown test
+}
+
+func TestSpeedTestRecv(t *testing.T) {
+	r := speedTestRecv{}
+	start := time.Unix(1000, 0)
+	// stream 0 arrives every 10ms without jitter, stream 1 alternates 0 and 2ms late
+	for i := 0; i < 100; i++ {
+		sendTime := start.Add(time.Duration(i) * 10 * time.Millisecond)
+		r.add(0, sendTime.UnixNano(), 1000, sendTime.Add(time.Millisecond*5))
+		late := time.Duration(i%2) * 2 * time.Millisecond
+		r.add(1, sendTime.UnixNano(), 1000, sendTime.Add(time.Millisecond*5+late))
+	}
+	res := r.result(1)
+	if res.Frames != 200 || res.Bytes != 200000 || res.Duration != 992 {
+		t.Errorf("result %+v", res)
+	}
+	if res.Jitter <= 0 || res.Jitter > 2000 {
+		t.Errorf("jitter %dus", res.Jitter)
+	}
+	summary := speedTestSummary("down", res, 250, time.Second)
+	for _, want := range []string{"1.61 Mbps", "loss 50/250 (20.00%)"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("%q doesn't contain %q", summary, want)
+		}
+	}
+}
+
+func TestSpeedTestDirection(t *testing.T) {
+	cases := []struct {
+		direction              string
+		client, sends, receive bool
+	}{
+		{SpeedTestUp, true, true, false},
+		{SpeedTestUp, false, false, true},
+		{SpeedTestDown, true, false, true},
+		{SpeedTestDown, false, true, false},
+		{SpeedTestBoth, true, true, true},
+		{SpeedTestBoth, false, true, true},
+	}
+	for _, c := range cases {
+		s := &speedTestSession{req: SpeedTestReq{Direction: c.direction}, client: c.client}
+		if s.sends() != c.sends || s.receives() != c.receive {
+			t.Errorf("%s client %v sends %v receives %v", c.direction, c.client, s.sends(), s.receives())
+		}
+	}
+	for _, req := range []SpeedTestReq{
+		{Mode: "x", Direction: SpeedTestUp, Streams: 1, Duration: 1000},
+		{Mode: SpeedTestTCP, Direction: "x", Streams: 1, Duration: 1000},
+		{Mode: SpeedTestTCP, Direction: SpeedTestUp, Streams: 0, Duration: 1000},
+		{Mode: SpeedTestTCP, Direction: SpeedTestUp, Streams: 1, Duration: 3600000},
+		{Mode: SpeedTestUDP, Direction: SpeedTestUp, Streams: 1, Duration: 1000},
+	} {
+		if _, err := newSpeedTestSession(&req, nil, 0, true); err != ErrSpeedTestParam {
+			t.Errorf("%+v error %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package openp2p
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The static sdwan is defined by staticSDWAN in config.json, it works without the server, like in an
+// air-gapped site. Every node listens on TCPPort, the peers are connected by the static endpoint of the
+// node or the address found by lan discovery. The nodes are authenticated by the shared token:
+//   - the dialer sends its nonce in MsgStaticHandshake
+//   - the listener answers its nonce and the mac of both nonces in MsgStaticHandshakeAck
+//   - the dialer answers the mac of both nonces in MsgStaticHandshake
+//
+// The macs are bound to the tunnel id and the direction, so a recorded handshake can't be replayed or
+// reflected. The lan beacon is bound to the ip it's sent from and expires after staticAuthWindow.
+// The bigger node id dials first, the smaller one dials after staticDialDelay when it's still disconnected.
+
+const (
+	staticCheckInterval = time.Second * 5
+	staticDialDelay     = time.Second * 10
+	staticAuthWindow    = time.Minute * 5
+	staticDiscoveryPort = 27180
+)
+
+type staticPeers struct {
+	mtx        sync.Mutex
+	discovered map[string]string    // node: ip:port found in lan
+	downTime   map[string]time.Time // node: disconnected since
+	dialing    map[string]bool
+}
+
+var gStatic *staticPeers
+
+func isStaticSDWAN() bool {
+	return gConf.StaticSDWAN != nil
+}
+
+func staticAuth(format string, a ...interface{}) string {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, gConf.Network.Token)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, format, a...)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// staticHandshakeAuth is the mac of the handshake from the dialer client to the listener server, role is
+// the side which sends it
+func staticHandshakeAuth(role string, tid uint64, client, server, clientNonce, serverNonce string) string {
+	return staticAuth("handshake/%s/%s/%d/%s/%s/%s/%s", role, gConf.StaticSDWAN.Name, tid, client, server, clientNonce, serverNonce)
+}
+
+func staticNonce() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// staticMember checks the node is another node of the static sdwan
+func staticMember(network, node string) error {
+	sdwan := gConf.StaticSDWAN
+	if sdwan == nil || network != sdwan.Name || node == gConf.Network.Node {
+		return ErrStaticAuth
+	}
+	for _, n := range sdwan.Nodes {
+		if n.Name == node {
+			return nil
+		}
+	}
+	return ErrStaticAuth
+}
+
+// newStaticBeacon is the lan discovery beacon sent from ip
+func newStaticBeacon(ip net.IP) *StaticHello {
+	h := &StaticHello{
+		Network: gConf.StaticSDWAN.Name,
+		Node:    gConf.Network.Node,
+		IP:      ip.String(),
+		Port:    gConf.Network.TCPPort,
+		Ts:      time.Now().Unix(),
+	}
+	h.Auth = staticAuth("beacon/%s/%s/%s/%d/%d", h.Network, h.Node, h.IP, h.Port, h.Ts)
+	return h
+}
+
+// verifyStaticBeacon checks the beacon is sent recently by another node of the static sdwan from ip
+func verifyStaticBeacon(h *StaticHello, from net.IP, now time.Time) error {
+	if err := staticMember(h.Network, h.Node); err != nil {
+		return err
+	}
+	if h.Port == 0 || !from.Equal(net.ParseIP(h.IP)) {
+		return ErrStaticAuth
+	}
+	if d := now.Unix() - h.Ts; d > int64(staticAuthWindow/time.Second) || d < -int64(staticAuthWindow/time.Second) {
+		return ErrStaticAuth
+	}
+	if !hmac.Equal([]byte(h.Auth), []byte(staticAuth("beacon/%s/%s/%s/%d/%d", h.Network, h.Node, h.IP, h.Port, h.Ts))) {
+		return ErrStaticAuth
+	}
+	return nil
+}
+
+// initStatic starts the static sdwan instead of login
+func (pn *P2PNetwork) initStatic() error {
+	sdwan := *gConf.StaticSDWAN
+	if gConf.Network.Token == 0 {
+		return ErrStaticToken
+	}
+	if _, _, err := net.ParseCIDR(sdwan.Gateway); err != nil {
+		return fmt.Errorf("static sdwan gateway %s error:%s", sdwan.Gateway, err)
+	}
+	onceV4Listener.Do(func() {
+		v4l = &v4Listener{port: gConf.Network.TCPPort}
+		go v4l.start()
+	})
+	gConf.setSDWAN(sdwan)
+	if err := pn.sdwan.init(gConf.Network.Node); err != nil {
+		return err
+	}
+	gStatic = &staticPeers{discovered: make(map[string]string), downTime: make(map[string]time.Time), dialing: make(map[string]bool)}
+	go gStatic.discoveryLoop()
+	go gStatic.connectLoop()
+	gLog.Printf(LvINFO, "static sdwan %s started, %d nodes", sdwan.Name, len(sdwan.Nodes))
+	return nil
+}
+
+func (sp *staticPeers) endpoint(node *SDWANNode) string {
+	if node.Endpoint != "" {
+		return node.Endpoint
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	return sp.discovered[node.Name]
+}
+
+func staticConnected(node string) bool {
+	i, ok := GNetwork.apps.Load(NodeNameToID(node))
+	if !ok {
+		return false
+	}
+	t := i.(*p2pApp).DirectTunnel()
+	return t != nil && t.isActive()
+}
+
+func (sp *staticPeers) connectLoop() {
+	for {
+		for _, node := range gConf.StaticSDWAN.Nodes {
+			if node.Name == gConf.Network.Node {
+				continue
+			}
+			if ep := sp.endpoint(node); ep != "" && sp.shouldDial(node.Name, time.Now()) {
+				go func(name, ep string) {
+					if err := dialStatic(name, ep); err != nil {
+						gLog.Printf(LvDEBUG, "static sdwan connect %s %s error:%s", name, ep, err)
+					}
+					sp.mtx.Lock()
+					delete(sp.dialing, name)
+					sp.mtx.Unlock()
+				}(node.Name, ep)
+			}
+		}
+		time.Sleep(staticCheckInterval)
+	}
+}
+
+// shouldDial marks the node dialing when it's disconnected and not being dialed
+func (sp *staticPeers) shouldDial(node string, now time.Time) bool {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if staticConnected(node) {
+		delete(sp.downTime, node)
+		return false
+	}
+	down, ok := sp.downTime[node]
+	if !ok {
+		down = now
+		sp.downTime[node] = now
+	}
+	if sp.dialing[node] || (gConf.nodeID() < NodeNameToID(node) && now.Sub(down) < staticDialDelay) {
+		return false
+	}
+	sp.dialing[node] = true
+	return true
+}
+
+func dialStatic(node, endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	ul, err := dialTCP(host, p, 0, LinkModeTCP4)
+	if err != nil {
+		return err
+	}
+	tid := rand.Uint64()
+	hello := StaticHello{Network: gConf.StaticSDWAN.Name, Node: gConf.Network.Node, TunnelID: tid, Nonce: staticNonce()}
+	if err = ul.WriteMessage(MsgP2P, MsgStaticHandshake, &hello); err != nil {
+		ul.Close()
+		return err
+	}
+	ul.SetReadDeadline(time.Now().Add(UnderlayTCPConnectTimeout))
+	head, buff, err := ul.ReadBuffer()
+	if err != nil {
+		ul.Close()
+		return err
+	}
+	ack := StaticHello{}
+	if head.SubType != MsgStaticHandshakeAck || json.Unmarshal(buff, &ack) != nil || ack.Node != node ||
+		ack.TunnelID != tid || ack.Nonce == "" || staticMember(ack.Network, ack.Node) != nil ||
+		!hmac.Equal([]byte(ack.Auth), []byte(staticHandshakeAuth("server", tid, hello.Node, node, hello.Nonce, ack.Nonce))) {
+		ul.Close()
+		return ErrStaticAuth
+	}
+	fin := StaticHello{Network: hello.Network, Node: hello.Node, TunnelID: tid,
+		Auth: staticHandshakeAuth("client", tid, hello.Node, node, hello.Nonce, ack.Nonce)}
+	if err = ul.WriteMessage(MsgP2P, MsgStaticHandshake, &fin); err != nil {
+		ul.Close()
+		return err
+	}
+	ul.SetReadDeadline(time.Time{})
+	addStaticTunnel(ul, node, tid, true)
+	return nil
+}
+
+// handleStaticConn accepts the static sdwan node connected to v4Listener
+func handleStaticConn(ul *underlayTCP, buff []byte) {
+	hello := StaticHello{}
+	if err := json.Unmarshal(buff, &hello); err != nil || hello.Nonce == "" || staticMember(hello.Network, hello.Node) != nil {
+		gLog.Printf(LvWARN, "static sdwan handshake from %s error:%s", ul.RemoteAddr(), ErrStaticAuth)
+		ul.Close()
+		return
+	}
+	if i, ok := GNetwork.apps.Load(NodeNameToID(hello.Node)); ok {
+		t := i.(*p2pApp).DirectTunnel()
+		if t != nil && t.isActive() && !t.tunnelServer && gConf.nodeID() > NodeNameToID(hello.Node) { // keep the one dialed by the bigger node
+			gLog.Printf(LvDEBUG, "static sdwan %s already connected", hello.Node)
+			ul.Close()
+			return
+		}
+	}
+	ack := StaticHello{Network: hello.Network, Node: gConf.Network.Node, TunnelID: hello.TunnelID, Nonce: staticNonce()}
+	ack.Auth = staticHandshakeAuth("server", hello.TunnelID, hello.Node, ack.Node, hello.Nonce, ack.Nonce)
+	if err := ul.WriteMessage(MsgP2P, MsgStaticHandshakeAck, &ack); err != nil {
+		ul.Close()
+		return
+	}
+	head, buff, err := ul.ReadBuffer()
+	fin := StaticHello{}
+	if err != nil || head.SubType != MsgStaticHandshake || json.Unmarshal(buff, &fin) != nil || fin.TunnelID != hello.TunnelID ||
+		!hmac.Equal([]byte(fin.Auth), []byte(staticHandshakeAuth("client", hello.TunnelID, hello.Node, ack.Node, hello.Nonce, ack.Nonce))) {
+		gLog.Printf(LvWARN, "static sdwan handshake from %s %s error:%s", hello.Node, ul.RemoteAddr(), ErrStaticAuth)
+		ul.Close()
+		return
+	}
+	ul.SetReadDeadline(time.Time{})
+	addStaticTunnel(ul, hello.Node, hello.TunnelID, false)
+}
+
+// addStaticTunnel serves the sdwan packets of node by the tunnel like a memapp
+func addStaticTunnel(ul underlay, node string, tid uint64, isClient bool) {
+	config := AppConfig{PeerNode: node, AppName: fmt.Sprintf("%d", NodeNameToID(node)), peerToken: gConf.Network.Token}
+	t := &P2PTunnel{
+		conn:         ul,
+		config:       config,
+		id:           tid,
+		running:      true,
+		tunnelServer: !isClient,
+		linkModeWeb:  LinkModeIntranet,
+		writeQueue:   newQoSQueues(),
+	}
+	GNetwork.allTunnels.Store(tid, t)
+	i, _ := GNetwork.apps.LoadOrStore(config.ID(), &p2pApp{
+		id:          rand.Uint64(),
+		config:      config,
+		running:     true,
+		hbTimeRelay: time.Now(),
+	})
+	app := i.(*p2pApp)
+	old := app.DirectTunnel()
+	app.setDirectTunnel(t)
+	if old != nil {
+		old.close()
+	}
+	go t.readLoop()
+	go t.writeLoop()
+	gLog.Printf(LvINFO, "static sdwan %s connected, tunnel %d", node, tid)
+}
+
+// lanBroadcastAddrs returns the ipv4 lan addresses and their broadcast addresses
+func lanBroadcastAddrs() (ips []net.IP, res []net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			ip := make(net.IP, net.IPv4len)
+			for i := range ip {
+				ip[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+			}
+			ips = append(ips, ipnet.IP.To4())
+			res = append(res, ip)
+		}
+	}
+	return
+}
+
+// discoveryLoop broadcasts the beacon in lan and records the nodes found
+func (sp *staticPeers) discoveryLoop() {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: staticDiscoveryPort})
+	if err != nil {
+		gLog.Printf(LvERROR, "static sdwan discovery listen %d error:%s", staticDiscoveryPort, err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			ips, broadcasts := lanBroadcastAddrs()
+			for i, ip := range broadcasts {
+				data, _ := json.Marshal(newStaticBeacon(ips[i]))
+				conn.WriteToUDP(data, &net.UDPAddr{IP: ip, Port: staticDiscoveryPort})
+			}
+			time.Sleep(staticCheckInterval)
+		}
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			gLog.Printf(LvERROR, "static sdwan discovery read error:%s", err)
+			return
+		}
+		hello := StaticHello{}
+		if json.Unmarshal(buf[:n], &hello) != nil || verifyStaticBeacon(&hello, from.IP, time.Now()) != nil {
+			continue
+		}
+		ep := net.JoinHostPort(from.IP.String(), strconv.Itoa(hello.Port))
+		sp.mtx.Lock()
+		if sp.discovered[hello.Node] != ep {
+			gLog.Printf(LvINFO, "static sdwan found %s at %s", hello.Node, ep)
+			sp.discovered[hello.Node] = ep
+		}
+		sp.mtx.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package openp2p
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifyStaticBeacon(t *testing.T) {
+	oldStatic, oldNode, oldToken, oldPort := gConf.StaticSDWAN, gConf.Network.Node, gConf.Network.Token, gConf.Network.TCPPort
+	defer func() {
+		gConf.StaticSDWAN, gConf.Network.Node, gConf.Network.Token, gConf.Network.TCPPort = oldStatic, oldNode, oldToken, oldPort
+	}()
+	gConf.StaticSDWAN = &SDWANInfo{Name: "factory", Gateway: "10.2.3.254/24",
+		Nodes: []*SDWANNode{{Name: "n1", IP: "10.2.3.1"}, {Name: "n2", IP: "10.2.3.2"}}}
+	gConf.Network.Token = 123456
+	gConf.Network.TCPPort = 50448
+	gConf.Network.Node = "n1"
+	from := net.ParseIP("192.168.1.10")
+	h := newStaticBeacon(from)
+	gConf.Network.Node = "n2"
+	now := time.Now()
+	if err := verifyStaticBeacon(h, from, now); err != nil {
+		t.Errorf("verify error:%s", err)
+	}
+	if verifyStaticBeacon(h, net.ParseIP("192.168.1.66"), now) == nil {
+		t.Error("beacon replayed from other ip should fail")
+	}
+	if verifyStaticBeacon(h, from, now.Add(staticAuthWindow+time.Minute)) == nil {
+		t.Error("expired beacon should fail")
+	}
+	other := *h
+	other.Network = "office"
+	if verifyStaticBeacon(&other, from, now) == nil {
+		t.Error("beacon of other network should fail")
+	}
+	other = *h
+	other.Port = 1234
+	if verifyStaticBeacon(&other, from, now) == nil {
+		t.Error("beacon with changed port should fail")
+	}
+	gConf.Network.Token = 654321
+	if verifyStaticBeacon(h, from, now) == nil {
+		t.Error("beacon with wrong token should fail")
+	}
+	gConf.Network.Node = "n1"
+	gConf.Network.Token = 123456
+	if verifyStaticBeacon(h, from, now) == nil {
+		t.Error("beacon from itself should fail")
+	}
+}
+
+func TestStaticHandshakeAuth(t *testing.T) {
+	oldStatic, oldToken := gConf.StaticSDWAN, gConf.Network.Token
+	defer func() {
+		gConf.StaticSDWAN, gConf.Network.Token = oldStatic, oldToken
+	}()
+	gConf.StaticSDWAN = &SDWANInfo{Name: "factory"}
+	gConf.Network.Token = 123456
+	auth := staticHandshakeAuth("server", 1, "n1", "n2", "c", "s")
+	if auth != staticHandshakeAuth("server", 1, "n1", "n2", "c", "s") {
+		t.Error("mac should be stable")
+	}
+	// a reflected or replayed mac doesn't match
+	if auth == staticHandshakeAuth("client", 1, "n1", "n2", "c", "s") {
+		t.Error("mac should be bound to the direction")
+	}
+	if auth == staticHandshakeAuth("server", 2, "n1", "n2", "c", "s") {
+		t.Error("mac should be bound to the tunnel id")
+	}
+	if auth == staticHandshakeAuth("server", 1, "n1", "n2", "c2", "s") {
+		t.Error("mac should be bound to the nonce")
+	}
+	if a, b := staticNonce(), staticNonce(); a == b || len(a) != 32 {
+		t.Errorf("wrong nonce %s %s", a, b)
+	}
+}
+
+func TestInitStaticToken(t *testing.T) {
+	oldStatic, oldToken := gConf.StaticSDWAN, gConf.Network.Token
+	defer func() {
+		gConf.StaticSDWAN, gConf.Network.Token = oldStatic, oldToken
+	}()
+	gConf.StaticSDWAN = &SDWANInfo{Name: "factory", Gateway: "10.2.3.254/24"}
+	gConf.Network.Token = 0
+	if err := (&P2PNetwork{}).initStatic(); err != ErrStaticToken {
+		t.Errorf("initStatic error:%v, want %s", err, ErrStaticToken)
+	}
+}
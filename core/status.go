@@ -0,0 +1,320 @@
+package openp2p
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// "openp2p status" and "openp2p ping" inspect the running node through the control api.
+
+const pingTimeout = time.Second * 3
+
+func init() {
+	ctlHandle("/status", handleStatus)
+	ctlHandle("/ping", handlePing)
+}
+
+func natTypeName(natType int) string {
+	switch natType {
+	case NATCone:
+		return "cone"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDrops prints the drops by class like bulk:12,default:3
+func formatDrops(drops map[string]uint64) string {
+	if len(drops) == 0 {
+		return "-"
+	}
+	res := []string{}
+	for _, name := range qosClassNames {
+		if n := drops[name]; n > 0 {
+			res = append(res, fmt.Sprintf("%s:%d", name, n))
+		}
+	}
+	return strings.Join(res, ",")
+}
+
+func tunnelLinkMode(t *P2PTunnel) string {
+	if t.config.linkMode != "" {
+		return t.config.linkMode
+	}
+	return t.linkModeWeb
+}
+
+// appStatus reports the app with the tunnel it's using
+func appStatus(app *p2pApp) AppStatus {
+	st := AppStatus{
+		AppName:  app.config.AppName,
+		Protocol: app.config.Protocol,
+		SrcPort:  app.config.SrcPort,
+		Reverse:  app.config.Reverse,
+		PeerNode: app.config.PeerNode,
+		DstHost:  app.config.DstHost,
+		DstPort:  app.config.DstPort,
+		Error:    app.errMsg,
+		RTT:      app.RTT().Microseconds(),
+	}
+	if st.SrcPort == 0 && st.AppName == "" { // memapp
+		st.AppName = "sdwan"
+	}
+	if app.isActive() {
+		st.IsActive = 1
+	}
+	t := app.Tunnel()
+	if t == nil {
+		return st
+	}
+	if !app.isDirect() {
+		st.RelayNode = app.relayNode
+	}
+	st.LinkMode = tunnelLinkMode(t)
+	st.TunnelID = t.id
+	st.TxBytes = t.txBytes.Load()
+	st.RxBytes = t.rxBytes.Load()
+	for class, n := range t.writeQueue.Drops() {
+		if n == 0 {
+			continue
+		}
+		if st.QoSDrops == nil {
+			st.QoSDrops = make(map[string]uint64)
+		}
+		st.QoSDrops[qosClassNames[class]] = n
+	}
+	return st
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := NodeStatus{
+		Node:            gConf.Network.Node,
+		Version:         OpenP2PVersion,
+		PublicIP:        gConf.Network.publicIP,
+		IPv6:            gConf.IPv6(),
+		LanIP:           gConf.Network.localIP,
+		NatType:         gConf.Network.natType,
+		HasIPv4:         gConf.Network.hasIPv4,
+		HasUPNPorNATPMP: gConf.Network.hasUPNPorNATPMP,
+	}
+	if GNetwork != nil {
+		if GNetwork.online {
+			st.Online = 1
+		}
+		if GNetwork.sdwan != nil && GNetwork.sdwan.virtualIP != nil {
+			st.SDWANIP = GNetwork.sdwan.virtualIP.String()
+		}
+		GNetwork.apps.Range(func(_, i interface{}) bool {
+			st.Apps = append(st.Apps, appStatus(i.(*p2pApp)))
+			return true
+		})
+	}
+	json.NewEncoder(w).Encode(&st)
+}
+
+// peerTunnel finds the tunnel the traffic to the node uses, the app is nil if the tunnel isn't used by any app
+func peerTunnel(node string) (*p2pApp, *P2PTunnel) {
+	var app *p2pApp
+	if i, ok := GNetwork.apps.Load(NodeNameToID(node)); ok { // the sdwan memapp
+		app = i.(*p2pApp)
+	}
+	GNetwork.apps.Range(func(_, i interface{}) bool {
+		if a := i.(*p2pApp); app == nil && a.config.PeerNode == node && a.Tunnel() != nil {
+			app = a
+		}
+		return app == nil
+	})
+	if app != nil && app.Tunnel() != nil {
+		return app, app.Tunnel()
+	}
+	var tunnel *P2PTunnel
+	GNetwork.allTunnels.Range(func(_, i interface{}) bool {
+		if t := i.(*P2PTunnel); t.config.PeerNode == node {
+			tunnel = t
+		}
+		return tunnel == nil
+	})
+	return nil, tunnel
+}
+
+// handlePing measures the rtt over the tunnel the traffic to the node uses
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	node := r.URL.Query().Get("node")
+	if GNetwork == nil {
+		http.Error(w, "openp2p is not running", http.StatusServiceUnavailable)
+		return
+	}
+	app, t := peerTunnel(node)
+	if t == nil {
+		http.Error(w, "no tunnel to "+node, http.StatusNotFound)
+		return
+	}
+	rsp := PingRsp{PeerNode: node, LinkMode: tunnelLinkMode(t), TunnelID: t.id}
+	if app == nil {
+		rsp.RTT = t.measureRTT(pingTimeout).Microseconds()
+	} else {
+		if !app.isDirect() {
+			rsp.RelayNode = app.relayNode
+		}
+		rsp.RTT = app.ping(pingTimeout).Microseconds()
+	}
+	json.NewEncoder(w).Encode(&rsp)
+}
+
+func statusCmd(args []string) {
+	fset := flag.NewFlagSet("status", flag.ExitOnError)
+	jsonOut := fset.Bool("json", false, "print the status in json")
+	fset.Parse(args)
+	gConf.load()
+	rsp, err := ctlRequest("/status", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "status error:", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	st := NodeStatus{}
+	if err = json.NewDecoder(rsp.Body).Decode(&st); err != nil {
+		fmt.Fprintln(os.Stderr, "status error:", err)
+		os.Exit(1)
+	}
+	if *jsonOut {
+		b, _ := json.MarshalIndent(&st, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	online := "offline"
+	if st.Online == 1 {
+		online = "online"
+	}
+	fmt.Printf("node:    %s %s, version %s\n", st.Node, online, st.Version)
+	fmt.Printf("network: public ip %s, %s nat, hasIPv4 %d, upnp %d, lan ip %s\n", st.PublicIP, natTypeName(st.NatType), st.HasIPv4, st.HasUPNPorNATPMP, st.LanIP)
+	if st.IPv6 != "" {
+		fmt.Printf("ipv6:    %s\n", st.IPv6)
+	}
+	if st.SDWANIP != "" {
+		fmt.Printf("sdwan:   %s\n", st.SDWANIP)
+	}
+	if len(st.Apps) == 0 {
+		return
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "APP\tLOCAL\tPEER\tDST\tSTATUS\tLINK\tRTT\tTX\tRX\tDROPS")
+	for _, app := range st.Apps {
+		local, dst := "-", "-"
+		if app.SrcPort != 0 {
+			local = fmt.Sprintf("%s:%d", app.Protocol, app.SrcPort)
+			dst = fmt.Sprintf("%s:%d", app.DstHost, app.DstPort)
+		}
+		if app.Reverse == 1 { // the peer listens, the connections come to dst of this node
+			local = fmt.Sprintf("%s:%d on peer", app.Protocol, app.SrcPort)
+		}
+		status := "active"
+		if app.IsActive == 0 {
+			status = "inactive"
+			if app.Error != "" {
+				status = app.Error
+			}
+		}
+		link := app.LinkMode
+		if app.RelayNode != "" {
+			link = fmt.Sprintf("%s via %s", app.LinkMode, app.RelayNode)
+		}
+		if link == "" {
+			link = "-"
+		}
+		rtt := "-"
+		if app.RTT > 0 {
+			rtt = fmt.Sprintf("%.1fms", float64(app.RTT)/1000)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", app.AppName, local, app.PeerNode, dst, status, link, rtt, formatBytes(app.TxBytes), formatBytes(app.RxBytes), formatDrops(app.QoSDrops))
+	}
+	tw.Flush()
+}
+
+func pingCmd(args []string) {
+	fset := flag.NewFlagSet("ping", flag.ExitOnError)
+	count := fset.Int("c", 4, "stop after N pings, 0:until Ctrl+C")
+	interval := fset.Duration("i", time.Second, "the interval between pings")
+	fset.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: openp2p ping [-c 4] [-i 1s] NODE")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	node := fset.Arg(0)
+	fset.Parse(fset.Args()[1:]) // the flags after the node
+	gConf.load()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	sent, received := 0, 0
+	var min, max, sum time.Duration
+	for seq := 1; ; seq++ {
+		sent++
+		rsp, err := ctlRequest("/ping", url.Values{"node": {node}})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ping error:", err)
+			os.Exit(1)
+		}
+		pr := PingRsp{}
+		err = json.NewDecoder(rsp.Body).Decode(&pr)
+		rsp.Body.Close()
+		if err == nil && pr.RTT > 0 {
+			rtt := time.Duration(pr.RTT) * time.Microsecond
+			path := "direct"
+			if pr.RelayNode != "" {
+				path = "relay via " + pr.RelayNode
+			}
+			fmt.Printf("reply from %s: seq=%d rtt=%.1fms %s %s tunnel %d\n", node, seq, float64(pr.RTT)/1000, path, pr.LinkMode, pr.TunnelID)
+			received++
+			sum += rtt
+			if min == 0 || rtt < min {
+				min = rtt
+			}
+			if rtt > max {
+				max = rtt
+			}
+		} else {
+			fmt.Printf("seq=%d timeout\n", seq)
+		}
+		if *count != 0 && seq >= *count {
+			break
+		}
+		select {
+		case <-ch:
+		case <-time.After(*interval):
+			continue
+		}
+		break
+	}
+	fmt.Printf("--- %s ping statistics ---\n%d sent, %d received, %.0f%% loss", node, sent, received, float64(sent-received)*100/float64(sent))
+	if received > 0 {
+		fmt.Printf(", rtt min/avg/max %.1f/%.1f/%.1fms", float64(min.Microseconds())/1000, float64((sum/time.Duration(received)).Microseconds())/1000, float64(max.Microseconds())/1000)
+	}
+	fmt.Println()
+}
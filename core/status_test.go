@@ -0,0 +1,35 @@
+package openp2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[uint64]string{0: "0B", 1023: "1023B", 1536: "1.5KB", 10 * 1024 * 1024: "10.0MB", 3 << 40: "3.0TB"} {
+		if s := formatBytes(n); s != want {
+			t.Errorf("formatBytes(%d)=%s, want %s", n, s, want)
+		}
+	}
+}
+
+func TestFormatDrops(t *testing.T) {
+	if s := formatDrops(nil); s != "-" {
+		t.Errorf("formatDrops(nil)=%s", s)
+	}
+	if s := formatDrops(map[string]uint64{"bulk": 12, "realtime": 1}); s != "realtime:1,bulk:12" {
+		t.Errorf("formatDrops=%s, want realtime:1,bulk:12", s)
+	}
+}
+
+func TestRelayHeartbeatRTT(t *testing.T) {
+	app := &p2pApp{}
+	if app.RTT() != 0 {
+		t.Error("rtt should be 0 before the heartbeat")
+	}
+	app.relayHbSend = time.Now().Add(-time.Millisecond * 20)
+	app.ackRelayHeartbeat()
+	if rtt := app.RTT(); rtt < time.Millisecond*20 || rtt > time.Second {
+		t.Errorf("rtt %s", rtt)
+	}
+}
@@ -0,0 +1,207 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// The tap mode runs the sdwan as a layer 2 network on linux, the ethernet frames are sent as the node data,
+// so ARP, DHCP and the non-IP protocols work across the nodes. Every node learns the source MACs of the
+// frames from the peers, the unicast frames are sent to the learned node, the broadcast, multicast and
+// unknown unicast ones are flooded to all nodes. The frames from the peers are only written to the tap and
+// never forwarded again, so the full mesh doesn't loop. All the nodes of the sdwan should run the tap mode.
+// The tap can be added to a local bridge, then the lan behind it joins the layer 2 network.
+// The acl checks the IPv4 frames, VLAN tagged or not. When there are rules, only ARP is allowed besides
+// them, the other ethertypes like IPv6 would bypass the rules.
+
+const (
+	SDWANModeTAP  = "tap"
+	tapIfaceName  = "optap"
+	ethHeaderSize = 14
+	ethTypeIPv4   = 0x0800
+	ethTypeARP    = 0x0806
+	ethTypeVLAN   = 0x8100
+	ethTypeQinQ   = 0x88a8
+	macAgingTime  = time.Minute * 5
+)
+
+func isTapMode() bool {
+	return gConf.Network.SDWANMode == SDWANModeTAP
+}
+
+// ethPayload returns the ethertype and the payload of the frame after the VLAN tags
+func ethPayload(f []byte) (uint16, []byte) {
+	etherType := binary.BigEndian.Uint16(f[12:14])
+	p := f[ethHeaderSize:]
+	for (etherType == ethTypeVLAN || etherType == ethTypeQinQ) && len(p) >= 4 {
+		etherType = binary.BigEndian.Uint16(p[2:4])
+		p = p[4:]
+	}
+	return etherType, p
+}
+
+// tapAllow checks the frame from srcID by the acl
+func tapAllow(acl *sdwanACL, srcID uint64, f []byte) bool {
+	switch etherType, p := ethPayload(f); etherType {
+	case ethTypeIPv4:
+		return acl.allow(srcID, p)
+	case ethTypeARP:
+		return true
+	default:
+		return !acl.enabled.Load()
+	}
+}
+
+type macEntry struct {
+	nodeID uint64
+	seen   time.Time
+}
+
+// macTable maps the MACs behind the peers to the nodes
+type macTable struct {
+	mtx       sync.RWMutex
+	entries   map[[6]byte]macEntry
+	lastSweep time.Time
+}
+
+func newMACTable() *macTable {
+	return &macTable{entries: make(map[[6]byte]macEntry)}
+}
+
+// learn records the source MAC of the frame from node
+func (m *macTable) learn(mac []byte, nodeID uint64, now time.Time) {
+	if mac[0]&1 != 0 { // multicast isn't a source
+		return
+	}
+	var key [6]byte
+	copy(key[:], mac)
+	m.mtx.RLock()
+	e, ok := m.entries[key]
+	m.mtx.RUnlock()
+	if ok && e.nodeID == nodeID && now.Sub(e.seen) < time.Second { // skip the lock for the most frames
+		return
+	}
+	m.mtx.Lock()
+	if !ok || e.nodeID != nodeID {
+		gLog.Printf(LvDEBUG, "tap learn %x from node %d", mac, nodeID)
+	}
+	m.entries[key] = macEntry{nodeID: nodeID, seen: now}
+	if now.Sub(m.lastSweep) > macAgingTime {
+		m.lastSweep = now
+		for k, e := range m.entries {
+			if now.Sub(e.seen) > macAgingTime {
+				delete(m.entries, k)
+			}
+		}
+	}
+	m.mtx.Unlock()
+}
+
+// lookup returns the node of the unicast MAC
+func (m *macTable) lookup(mac []byte, now time.Time) (uint64, bool) {
+	var key [6]byte
+	copy(key[:], mac)
+	m.mtx.RLock()
+	e, ok := m.entries[key]
+	m.mtx.RUnlock()
+	if !ok || now.Sub(e.seen) > macAgingTime {
+		return 0, false
+	}
+	return e.nodeID, true
+}
+
+// forget removes the MACs of node, like the node is offline
+func (m *macTable) forget(nodeID uint64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for k, e := range m.entries {
+		if e.nodeID == nodeID {
+			delete(m.entries, k)
+		}
+	}
+}
+
+func (s *p2pSDWAN) startTap() error {
+	if s.tun == nil {
+		tap, err := createTAP(tapIfaceName)
+		if err != nil {
+			gLog.Println(LvERROR, "open tap fail:", err)
+			return err
+		}
+		s.tun = &optun{tunName: tap.name, tap: tap}
+		s.macs = newMACTable()
+		go s.readTapLoop()
+		go s.writeTapLoop()
+	}
+	if err := setTapAddr(s.tun.tunName, s.virtualIP.String(), gConf.Network.TapBridge); err != nil {
+		gLog.Printf(LvERROR, "setTapAddr error:%s,%s,%s,%s", err, s.tun.tunName, s.virtualIP.String(), gConf.Network.TapBridge)
+		return err
+	}
+	s.mtu.Store(0)
+	s.updateTunMTU()
+	return nil
+}
+
+func (s *p2pSDWAN) readTapLoop() {
+	gLog.Printf(LvDEBUG, "sdwan readTapLoop start")
+	defer gLog.Printf(LvDEBUG, "sdwan readTapLoop end")
+	buf := make([]byte, readTunBuffSize()+ethHeaderSize)
+	for {
+		n, err := s.tun.tap.Read(buf)
+		if err != nil {
+			gLog.Printf(LvERROR, "read tap fail: %s", err)
+			return
+		}
+		if n < ethHeaderSize {
+			continue
+		}
+		s.routeTapFrame(buf[:n])
+	}
+}
+
+// routeTapFrame sends the frame to the node of its destination MAC, or floods it
+func (s *p2pSDWAN) routeTapFrame(f []byte) {
+	if etherType, p := ethPayload(f); etherType == ethTypeIPv4 {
+		s.acl.track(p)
+	}
+	if f[0]&1 == 0 {
+		if nodeID, ok := s.macs.lookup(f[:6], time.Now()); ok {
+			captureSDWAN(false, nodeID, f, true)
+			if err := GNetwork.WriteNode(nodeID, f); err == nil {
+				return
+			}
+			s.macs.forget(nodeID)
+		}
+	}
+	gLog.Printf(LvDev, "tap flood %x len=%d", f[:6], len(f))
+	captureSDWAN(false, captureFlood, f, true)
+	s.sysRoute.Range(func(_, v interface{}) bool {
+		GNetwork.WriteNode(v.(*sdwanNode).id, f)
+		return true
+	})
+}
+
+// writeTapLoop writes the frames from the peers to the tap
+func (s *p2pSDWAN) writeTapLoop() {
+	gLog.Printf(LvDEBUG, "sdwan writeTapLoop start")
+	defer gLog.Printf(LvDEBUG, "sdwan writeTapLoop end")
+	for nd := range GNetwork.nodeData {
+		f := nd.Data
+		if len(f) < ethHeaderSize {
+			nd.Release()
+			continue
+		}
+		captureSDWAN(true, nd.NodeID, f, true)
+		if !tapAllow(s.acl, nd.NodeID, f) {
+			gLog.Printf(LvDev, "sdwan acl deny frame from %d len=%d", nd.NodeID, len(f))
+			nd.Release()
+			continue
+		}
+		s.macs.learn(f[6:12], nd.NodeID, time.Now())
+		if _, err := s.tun.tap.Write(f); err != nil {
+			gLog.Printf(LvDEBUG, "write tap error:%s", err)
+		}
+		nd.Release()
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !android
+
+package openp2p
+
+import (
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type tapDevice struct {
+	name string
+	file *os.File
+}
+
+// createTAP opens the layer 2 tap, every read or write is an ethernet frame
+func createTAP(name string) (*tapDevice, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &tapDevice{name: ifr.Name(), file: os.NewFile(uintptr(fd), "/dev/net/tun")}, nil
+}
+
+func (t *tapDevice) Read(b []byte) (int, error) {
+	return t.file.Read(b)
+}
+
+func (t *tapDevice) Write(b []byte) (int, error) {
+	return t.file.Write(b)
+}
+
+func (t *tapDevice) Close() error {
+	return t.file.Close()
+}
+
+// setTapAddr brings up the tap, the virtual ip with the sdwan subnet is set on the tap, or the bridge
+// when the tap is its port
+func setTapAddr(ifname, localAddr, bridge string) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	addrLink := link
+	if bridge != "" {
+		br, err := netlink.LinkByName(bridge)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetMaster(link, br); err != nil {
+			return err
+		}
+		addrLink = br
+	}
+	netlink.LinkSetTxQLen(link, 1000)
+	if err = netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(localAddr)
+	if err != nil {
+		return err
+	}
+	if previousIP != "" && previousIP != localAddr {
+		if old, err := netlink.ParseAddr(previousIP); err == nil {
+			netlink.AddrDel(addrLink, old)
+		}
+	}
+	previousIP = localAddr
+	return netlink.AddrReplace(addrLink, addr)
+}
@@ -0,0 +1,27 @@
+//go:build !linux || android
+
+package openp2p
+
+type tapDevice struct {
+	name string
+}
+
+func createTAP(name string) (*tapDevice, error) {
+	return nil, ErrTapUnsupported
+}
+
+func (t *tapDevice) Read(b []byte) (int, error) {
+	return 0, ErrTapUnsupported
+}
+
+func (t *tapDevice) Write(b []byte) (int, error) {
+	return 0, ErrTapUnsupported
+}
+
+func (t *tapDevice) Close() error {
+	return nil
+}
+
+func setTapAddr(ifname, localAddr, bridge string) error {
+	return ErrTapUnsupported
+}
@@ -0,0 +1,70 @@
+package openp2p
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestMACTable(t *testing.T) {
+	m := newMACTable()
+	now := time.Now()
+	mac1 := []byte{0x02, 0, 0, 0, 0, 1}
+	mac2 := []byte{0x02, 0, 0, 0, 0, 2}
+	m.learn(mac1, 100, now)
+	m.learn(mac2, 200, now)
+	m.learn([]byte{0x01, 0, 0x5e, 0, 0, 0xfb}, 300, now) // multicast source is ignored
+	if id, ok := m.lookup(mac1, now); !ok || id != 100 {
+		t.Errorf("lookup mac1 %d %t", id, ok)
+	}
+	if _, ok := m.lookup([]byte{0x01, 0, 0x5e, 0, 0, 0xfb}, now); ok {
+		t.Error("multicast should not be learned")
+	}
+	// moved to another node
+	m.learn(mac1, 200, now.Add(time.Second))
+	if id, _ := m.lookup(mac1, now.Add(time.Second)); id != 200 {
+		t.Errorf("mac1 moved to %d, want 200", id)
+	}
+	if _, ok := m.lookup(mac2, now.Add(macAgingTime+time.Second)); ok {
+		t.Error("mac2 should be aged")
+	}
+	m.forget(200)
+	if _, ok := m.lookup(mac1, now.Add(time.Second)); ok {
+		t.Error("mac1 should be forgotten with its node")
+	}
+}
+
+func testEthFrame(etherType uint16, tags int, payload []byte) []byte {
+	f := make([]byte, 12, ethHeaderSize+tags*4+len(payload))
+	for i := 0; i < tags; i++ {
+		f = binary.BigEndian.AppendUint16(f, ethTypeVLAN)
+		f = binary.BigEndian.AppendUint16(f, uint16(10+i)) // vid
+	}
+	f = binary.BigEndian.AppendUint16(f, etherType)
+	return append(f, payload...)
+}
+
+func TestTapAllow(t *testing.T) {
+	acl := newSDWANACL()
+	node := NodeNameToID("laptop1")
+	ssh := testIPv4Packet(0x0a020306, 0x0a020301, IPProtoTCP, 40000, 22)
+	web := testIPv4Packet(0x0a020306, 0x0a020301, IPProtoTCP, 40000, 80)
+	if !tapAllow(acl, node, testEthFrame(0x86dd, 0, web)) {
+		t.Error("no rules should allow all")
+	}
+	acl.update(&SDWANInfo{Rules: []*SDWANRule{{Src: "*", Proto: "tcp", Ports: "22", Action: "allow"}}})
+	for tags := 0; tags <= 2; tags++ {
+		if !tapAllow(acl, node, testEthFrame(ethTypeIPv4, tags, ssh)) {
+			t.Errorf("ssh with %d vlan tags should be allowed", tags)
+		}
+		if tapAllow(acl, node, testEthFrame(ethTypeIPv4, tags, web)) {
+			t.Errorf("web with %d vlan tags should be denied", tags)
+		}
+	}
+	if !tapAllow(acl, node, testEthFrame(ethTypeARP, 1, make([]byte, 28))) {
+		t.Error("arp should be allowed")
+	}
+	if tapAllow(acl, node, testEthFrame(0x86dd, 0, web)) {
+		t.Error("ipv6 should be denied with rules")
+	}
+}
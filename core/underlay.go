@@ -1,6 +1,7 @@
 package openp2p
 
 import (
+	"encoding/binary"
 	"io"
 	"time"
 )
@@ -9,6 +10,7 @@ type underlay interface {
 	Read([]byte) (int, error)
 	Write([]byte) (int, error)
 	ReadBuffer() (*openP2PHeader, []byte, error)
+	ReadFrame(*[]byte, *openP2PHeader) ([]byte, error)
 	WriteBytes(uint16, uint16, []byte) error
 	WriteBuffer([]byte) error
 	WriteMessage(uint16, uint16, interface{}) error
@@ -20,15 +22,65 @@ type underlay interface {
 	Protocol() string
 }
 
+// datagramUnderlay sends the sdwan packets unreliably to avoid TCP-over-TCP meltdown,
+// the control messages and port-forward streams are always reliable
+type datagramUnderlay interface {
+	SupportsDatagrams() bool
+	WriteDatagram([]byte) error
+	ReadDatagram() ([]byte, error)
+}
+
+const (
+	streamFlowSlots   = 256
+	streamFlowTimeout = time.Second * 5 // the stream frames in flight are delivered long before
+)
+
+// isNodeDataFrame reports whether the frame carries sdwan packets directly or through relay
+func isNodeDataFrame(frame []byte) bool {
+	if len(frame) < openP2PHeaderSize || binary.LittleEndian.Uint16(frame[4:6]) != MsgP2P {
+		return false
+	}
+	switch binary.LittleEndian.Uint16(frame[6:8]) {
+	case MsgNodeData, MsgRelayNodeData:
+		return true
+	case MsgRelayData, MsgRelayHopData:
+		if n := relayHeaderLen(frame); len(frame) >= openP2PHeaderSize+n {
+			return isNodeDataFrame(frame[openP2PHeaderSize+n:])
+		}
+	}
+	return false
+}
+
+// nodeFramePacket returns the ip packet in the node data frame, nil if it isn't one
+func nodeFramePacket(frame []byte) []byte {
+	if len(frame) < openP2PHeaderSize || binary.LittleEndian.Uint16(frame[4:6]) != MsgP2P {
+		return nil
+	}
+	switch binary.LittleEndian.Uint16(frame[6:8]) {
+	case MsgNodeData:
+		return frame[openP2PHeaderSize:]
+	case MsgRelayNodeData:
+		if len(frame) >= openP2PHeaderSize+8 {
+			return frame[openP2PHeaderSize+8:] // the src node id
+		}
+	case MsgRelayData, MsgRelayHopData:
+		if n := relayHeaderLen(frame); len(frame) >= openP2PHeaderSize+n {
+			return nodeFramePacket(frame[openP2PHeaderSize+n:])
+		}
+	}
+	return nil
+}
+
 func DefaultReadBuffer(ul underlay) (*openP2PHeader, []byte, error) {
 	headBuf := make([]byte, openP2PHeaderSize)
 	_, err := io.ReadFull(ul, headBuf)
 	if err != nil {
 		return nil, nil, err
 	}
-	head, err := decodeHeader(headBuf)
-	if err != nil || head.MainType > 16 {
-		return nil, nil, err
+	head := &openP2PHeader{}
+	parseP2PHeader(headBuf, head)
+	if head.MainType > 16 {
+		return nil, nil, ErrMsgFormat
 	}
 	dataBuf := make([]byte, head.DataLen)
 	_, err = io.ReadFull(ul, dataBuf)
@@ -36,7 +88,16 @@ func DefaultReadBuffer(ul underlay) (*openP2PHeader, []byte, error) {
 }
 
 func DefaultWriteBytes(ul underlay, mainType, subType uint16, data []byte) error {
-	writeBytes := append(encodeHeader(mainType, subType, uint32(len(data))), data...)
+	var writeBytes []byte
+	if len(data)+openP2PHeaderSize <= PoolBufferSize {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		writeBytes = (*buf)[:openP2PHeaderSize+len(data)]
+	} else {
+		writeBytes = make([]byte, openP2PHeaderSize+len(data))
+	}
+	putHeader(writeBytes, mainType, subType, uint32(len(data)))
+	copy(writeBytes[openP2PHeaderSize:], data)
 	ul.SetWriteDeadline(time.Now().Add(TunnelHeartbeatTime / 2))
 	ul.WLock()
 	_, err := ul.Write(writeBytes)
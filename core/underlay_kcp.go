@@ -23,6 +23,10 @@ func (conn *underlayKCP) ReadBuffer() (*openP2PHeader, []byte, error) {
 	return DefaultReadBuffer(conn)
 }
 
+func (conn *underlayKCP) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(conn, buf, head)
+}
+
 func (conn *underlayKCP) WriteBytes(mainType uint16, subType uint16, data []byte) error {
 	return DefaultWriteBytes(conn, mainType, subType, data)
 }
@@ -24,6 +24,7 @@ type underlayQUIC struct {
 	writeMtx *sync.Mutex
 	quic.Stream
 	quic.Connection
+	datagram bool // both sides enable QUIC DATAGRAM
 }
 
 func (conn *underlayQUIC) Protocol() string {
@@ -34,6 +35,10 @@ func (conn *underlayQUIC) ReadBuffer() (*openP2PHeader, []byte, error) {
 	return DefaultReadBuffer(conn)
 }
 
+func (conn *underlayQUIC) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(conn, buf, head)
+}
+
 func (conn *underlayQUIC) WriteBytes(mainType uint16, subType uint16, data []byte) error {
 	return DefaultWriteBytes(conn, mainType, subType, data)
 }
@@ -46,6 +51,18 @@ func (conn *underlayQUIC) WriteMessage(mainType uint16, subType uint16, packet i
 	return DefaultWriteMessage(conn, mainType, subType, packet)
 }
 
+func (conn *underlayQUIC) SupportsDatagrams() bool {
+	return conn.datagram
+}
+
+func (conn *underlayQUIC) WriteDatagram(frame []byte) error {
+	return conn.Connection.SendMessage(frame)
+}
+
+func (conn *underlayQUIC) ReadDatagram() ([]byte, error) {
+	return conn.Connection.ReceiveMessage()
+}
+
 func (conn *underlayQUIC) Close() error {
 	conn.Stream.CancelRead(1)
 	conn.Connection.CloseWithError(0, "")
@@ -77,13 +94,14 @@ func (conn *underlayQUIC) Accept() error {
 	}
 	conn.Stream = stream
 	conn.Connection = sess
+	conn.datagram = sess.ConnectionState().SupportsDatagrams
 	return nil
 }
 
 func listenQuic(addr string, idleTimeout time.Duration) (*underlayQUIC, error) {
 	gLog.Println(LvDEBUG, "quic listen on ", addr)
 	listener, err := quic.ListenAddr(addr, generateTLSConfig(),
-		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true})
+		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true, EnableDatagrams: true})
 	if err != nil {
 		return nil, fmt.Errorf("quic.ListenAddr error:%s", err)
 	}
@@ -102,7 +120,7 @@ func dialQuic(conn *net.UDPConn, remoteAddr *net.UDPAddr, idleTimeout time.Durat
 		NextProtos:         []string{"openp2pv1"},
 	}
 	Connection, err := quic.DialContext(context.Background(), conn, remoteAddr, conn.LocalAddr().String(), tlsConf,
-		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true})
+		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true, EnableDatagrams: true})
 	if err != nil {
 		return nil, fmt.Errorf("quic.DialContext error:%s", err)
 	}
@@ -110,7 +128,8 @@ func dialQuic(conn *net.UDPConn, remoteAddr *net.UDPAddr, idleTimeout time.Durat
 	if err != nil {
 		return nil, fmt.Errorf("OpenStreamSync error:%s", err)
 	}
-	qConn := &underlayQUIC{nil, &sync.Mutex{}, stream, Connection}
+	qConn := &underlayQUIC{writeMtx: &sync.Mutex{}, Stream: stream, Connection: Connection,
+		datagram: Connection.ConnectionState().SupportsDatagrams}
 	return qConn, nil
 }
 
@@ -24,6 +24,10 @@ func (conn *underlayTCP) ReadBuffer() (*openP2PHeader, []byte, error) {
 	return DefaultReadBuffer(conn)
 }
 
+func (conn *underlayTCP) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(conn, buf, head)
+}
+
 func (conn *underlayTCP) WriteBytes(mainType uint16, subType uint16, data []byte) error {
 	return DefaultWriteBytes(conn, mainType, subType, data)
 }
@@ -20,6 +20,10 @@ func (conn *underlayTCP6) ReadBuffer() (*openP2PHeader, []byte, error) {
 	return DefaultReadBuffer(conn)
 }
 
+func (conn *underlayTCP6) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(conn, buf, head)
+}
+
 func (conn *underlayTCP6) WriteBytes(mainType uint16, subType uint16, data []byte) error {
 	return DefaultWriteBytes(conn, mainType, subType, data)
 }
@@ -0,0 +1,253 @@
+package openp2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsUnderlayPath = "/openp2p/underlay"
+	wsServerName   = "openp2p-wss" // the self-signed cert is issued to this name instead of the changing public ip
+)
+
+// underlayWS transfers the openP2PHeader framed stream over websocket binary messages,
+// it works through HTTP CONNECT proxy in restrictive networks.
+type underlayWS struct {
+	ws          *websocket.Conn
+	writeMtx    *sync.Mutex
+	reader      io.Reader
+	connectTime time.Time
+}
+
+func (conn *underlayWS) Protocol() string {
+	return "wss"
+}
+
+func (conn *underlayWS) Read(b []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			_, r, err := conn.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			conn.reader = r
+		}
+		n, err := conn.reader.Read(b)
+		if err == io.EOF {
+			conn.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (conn *underlayWS) Write(b []byte) (int, error) {
+	if err := conn.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *underlayWS) ReadBuffer() (*openP2PHeader, []byte, error) {
+	return DefaultReadBuffer(conn)
+}
+
+func (conn *underlayWS) ReadFrame(buf *[]byte, head *openP2PHeader) ([]byte, error) {
+	return DefaultReadFrame(conn, buf, head)
+}
+
+func (conn *underlayWS) WriteBytes(mainType uint16, subType uint16, data []byte) error {
+	return DefaultWriteBytes(conn, mainType, subType, data)
+}
+
+func (conn *underlayWS) WriteBuffer(data []byte) error {
+	return DefaultWriteBuffer(conn, data)
+}
+
+func (conn *underlayWS) WriteMessage(mainType uint16, subType uint16, packet interface{}) error {
+	return DefaultWriteMessage(conn, mainType, subType, packet)
+}
+
+func (conn *underlayWS) Close() error {
+	return conn.ws.Close()
+}
+
+func (conn *underlayWS) WLock() {
+	conn.writeMtx.Lock()
+}
+
+func (conn *underlayWS) WUnlock() {
+	conn.writeMtx.Unlock()
+}
+
+func (conn *underlayWS) SetReadDeadline(t time.Time) error {
+	return conn.ws.SetReadDeadline(t)
+}
+
+func (conn *underlayWS) SetWriteDeadline(t time.Time) error {
+	return conn.ws.SetWriteDeadline(t)
+}
+
+// use the configured http proxy, otherwise HTTPS_PROXY in environment
+func httpProxy() func(*http.Request) (*url.URL, error) {
+	if gConf.Network.HTTPProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	u, err := url.Parse(gConf.Network.HTTPProxy)
+	if err != nil {
+		gLog.Println(LvERROR, "parse http proxy error:", err)
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(u)
+}
+
+// wsClientTLSConfig only trusts the peer's self-signed cert, which is sent by the server in PushConnectRsp
+func wsClientTLSConfig(certDER []byte) (*tls.Config, error) {
+	if len(certDER) == 0 {
+		return nil, ErrWSSCert
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWSSCert, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{RootCAs: roots, ServerName: wsServerName}, nil
+}
+
+// generateWSTLSConfig returns the listener's tls config and its cert
+func generateWSTLSConfig() (*tls.Config, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{wsServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCert := tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{tlsCert}, NextProtos: []string{"http/1.1"}}, certDER, nil
+}
+
+func dialWS(host string, port int, certDER []byte, timeout time.Duration) (*underlayWS, error) {
+	tlsConfig, err := wsClientTLSConfig(certDER)
+	if err != nil {
+		return nil, err
+	}
+	dialer := websocket.Dialer{
+		Proxy:            httpProxy(),
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	u := url.URL{Scheme: "wss", Host: fmt.Sprintf("%s:%d", host, port), Path: wsUnderlayPath}
+	c, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &underlayWS{ws: c, writeMtx: &sync.Mutex{}, connectTime: time.Now()}, nil
+}
+
+type wsListener struct {
+	conns     sync.Map
+	port      int
+	acceptCh  chan bool
+	tlsConfig *tls.Config
+	cert      []byte // sent to the peers in PushConnectRsp
+	listener  net.Listener
+}
+
+// newWSListener binds the port, the port is advertised to the peers only if it succeeds
+func newWSListener(port int) (*wsListener, error) {
+	tlsConfig, cert, err := generateWSTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return &wsListener{port: port, acceptCh: make(chan bool, 500), tlsConfig: tlsConfig, cert: cert, listener: ln}, nil
+}
+
+func (wl *wsListener) start() {
+	mux := http.NewServeMux()
+	mux.Handle(wsUnderlayPath, wl)
+	gLog.Printf(LvINFO, "wsListener listen %d start", wl.port)
+	srv := &http.Server{Handler: mux, TLSConfig: wl.tlsConfig}
+	err := srv.ServeTLS(wl.listener, "", "")
+	gLog.Printf(LvERROR, "wsListener listen %d error:%s", wl.port, err)
+}
+
+func (wl *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		gLog.Println(LvERROR, "wsListener upgrade error:", err)
+		return
+	}
+	gLog.Println(LvDEBUG, "wsListener accept connection: ", c.RemoteAddr().String())
+	uws := &underlayWS{ws: c, writeMtx: &sync.Mutex{}, connectTime: time.Now()}
+	uws.SetReadDeadline(time.Now().Add(UnderlayTCPConnectTimeout))
+	_, buff, err := uws.ReadBuffer()
+	if err != nil || len(buff) < 8 {
+		gLog.Println(LvERROR, "uws.ReadBuffer error:", err)
+		uws.Close()
+		return
+	}
+	uws.SetReadDeadline(time.Time{})
+	uws.WriteBytes(MsgP2P, MsgTunnelHandshakeAck, buff)
+	tid := binary.LittleEndian.Uint64(buff[:8])
+	gLog.Println(LvDEBUG, "hello ", tid)
+	// clear timeout connection
+	wl.conns.Range(func(idx, i interface{}) bool {
+		if i.(*underlayWS).connectTime.Before(time.Now().Add(-UnderlayTCPConnectTimeout)) {
+			i.(*underlayWS).Close()
+			wl.conns.Delete(idx)
+		}
+		return true
+	})
+	wl.conns.Store(tid, uws)
+	if len(wl.acceptCh) == 0 {
+		wl.acceptCh <- true
+	}
+}
+
+func (wl *wsListener) getUnderlayWS(tid uint64) *underlayWS {
+	for start := time.Now(); time.Since(start) < UnderlayConnectTimeout; {
+		select {
+		case <-time.After(time.Millisecond * 50):
+		case <-wl.acceptCh:
+		}
+		if u, ok := wl.conns.LoadAndDelete(tid); ok {
+			return u.(*underlayWS)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package openp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestUnderlayWS(t *testing.T) {
+	wl, err := newWSListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wl.start()
+	defer wl.listener.Close()
+	host, portNum := "127.0.0.1", wl.listener.Addr().(*net.TCPAddr).Port
+	if _, err = newWSListener(portNum); err == nil {
+		t.Fatal("listened on the port in use")
+	}
+	other, _, _ := generateWSTLSConfig()
+	if _, err = dialWS(host, portNum, other.Certificates[0].Certificate[0], UnderlayConnectTimeout); err == nil {
+		t.Fatal("connected with the wrong cert")
+	}
+	if _, err = dialWS(host, portNum, nil, UnderlayConnectTimeout); !errors.Is(err, ErrWSSCert) {
+		t.Fatalf("connected without cert: %v", err)
+	}
+	client, err := dialWS(host, portNum, wl.cert, UnderlayConnectTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tid := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tid, 12345)
+	client.WriteBytes(MsgP2P, MsgTunnelHandshake, tid)
+	if _, buff, err := client.ReadBuffer(); err != nil || !bytes.Equal(buff, tid) {
+		t.Fatalf("handshake error:%v %s", buff, err)
+	}
+	server := wl.getUnderlayWS(12345)
+	if server == nil {
+		t.Fatal("getUnderlayWS error")
+	}
+	defer server.Close()
+	// two frames in one message and one frame in two messages
+	all := append(encodeHeader(MsgP2P, MsgOverlayData, 3), []byte("abc")...)
+	all = append(all, encodeHeader(MsgP2P, MsgOverlayData, 2)...)
+	client.WriteBuffer(append(all, []byte("de")...))
+	client.WriteBuffer(encodeHeader(MsgP2P, MsgRelayData, 4))
+	client.WriteBuffer([]byte("fghi"))
+	for _, expect := range []string{"abc", "de", "fghi"} {
+		_, buff, err := server.ReadBuffer()
+		if err != nil || string(buff) != expect {
+			t.Errorf("read %s error:%s %s", expect, buff, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package openp2p
 
 import (
+	"os/exec"
 	"strings"
 	"syscall"
 )
@@ -30,3 +31,19 @@ func setRLimit() error {
 
 func setFirewall() {
 }
+
+// firewallStatus inspects the application firewall which may block the incoming tunnels
+func firewallStatus() []firewallCheck {
+	out, err := exec.Command("/usr/libexec/ApplicationFirewall/socketfilterfw", "--getglobalstate").Output()
+	if err != nil {
+		return []firewallCheck{{"the application firewall state is unknown: " + err.Error(), false}}
+	}
+	if strings.Contains(string(out), "enabled") {
+		return []firewallCheck{{"the application firewall is enabled, allow the incoming connections of openp2p", true}}
+	}
+	return []firewallCheck{{"the application firewall is disabled", false}}
+}
+
+func setDontFragment(c syscall.RawConn) error {
+	return ErrMTUProbeUnsupported
+}
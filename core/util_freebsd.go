@@ -67,3 +67,11 @@ func setRLimit() error {
 
 func setFirewall() {
 }
+
+func firewallStatus() []firewallCheck {
+	return []firewallCheck{{"not inspected on freebsd", false}}
+}
+
+func setDontFragment(c syscall.RawConn) error {
+	return ErrMTUProbeUnsupported
+}
@@ -3,8 +3,10 @@ package openp2p
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"runtime"
 	"strings"
 	"syscall"
@@ -74,3 +76,31 @@ func setRLimit() error {
 
 func setFirewall() {
 }
+
+// firewallStatus inspects the firewalls which may block the incoming tunnels
+func firewallStatus() []firewallCheck {
+	res := []firewallCheck{}
+	if out, err := exec.Command("systemctl", "is-active", "firewalld").Output(); err == nil && strings.TrimSpace(string(out)) == "active" {
+		res = append(res, firewallCheck{fmt.Sprintf("firewalld is active, allow tcp %d and udp for the direct tunnels", gConf.Network.TCPPort), true})
+	}
+	if out, err := exec.Command("ufw", "status").Output(); err == nil && strings.Contains(string(out), "Status: active") {
+		res = append(res, firewallCheck{fmt.Sprintf("ufw is active, allow tcp %d and udp for the direct tunnels", gConf.Network.TCPPort), true})
+	}
+	if out, err := exec.Command("iptables", "-S", "INPUT").Output(); err == nil && strings.Contains(string(out), "-P INPUT DROP") {
+		res = append(res, firewallCheck{"iptables INPUT policy is DROP, allow the direct tunnels", true})
+	}
+	if len(res) == 0 {
+		res = append(res, firewallCheck{"no firewalld, ufw or iptables INPUT DROP", false})
+	}
+	return res
+}
+
+func setDontFragment(c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
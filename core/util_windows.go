@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"golang.org/x/sys/windows/registry"
 )
@@ -63,3 +64,16 @@ func setFirewall() {
 		exec.Command("cmd.exe", `/c`, fmt.Sprintf(`netsh advfirewall firewall add rule name="%s" dir=in action=allow program="%s" enable=yes`, ProductName, fullPath)).Run()
 	}
 }
+
+// firewallStatus checks the rule added by setFirewall
+func firewallStatus() []firewallCheck {
+	err := exec.Command("cmd.exe", `/c`, fmt.Sprintf(`netsh advfirewall firewall show rule name="%s"`, ProductName)).Run()
+	if err != nil {
+		return []firewallCheck{{fmt.Sprintf(`no firewall rule "%s", run openp2p as administrator to add it`, ProductName), true}}
+	}
+	return []firewallCheck{{fmt.Sprintf(`firewall rule "%s" allows openp2p`, ProductName), false}}
+}
+
+func setDontFragment(c syscall.RawConn) error {
+	return ErrMTUProbeUnsupported
+}
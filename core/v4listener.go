@@ -45,10 +45,14 @@ func (vl *v4Listener) handleConnection(c net.Conn) {
 	gLog.Println(LvDEBUG, "v4Listener accept connection: ", c.RemoteAddr().String())
 	utcp := &underlayTCP{writeMtx: &sync.Mutex{}, Conn: c, connectTime: time.Now()}
 	utcp.SetReadDeadline(time.Now().Add(UnderlayTCPConnectTimeout))
-	_, buff, err := utcp.ReadBuffer()
+	head, buff, err := utcp.ReadBuffer()
 	if err != nil {
 		gLog.Println(LvERROR, "utcp.ReadBuffer error:", err)
 	}
+	if head != nil && head.SubType == MsgStaticHandshake {
+		handleStaticConn(utcp, buff)
+		return
+	}
 	utcp.WriteBytes(MsgP2P, MsgTunnelHandshakeAck, buff)
 	var tid uint64
 	if string(buff) == "OpenP2P,hello" { // old client